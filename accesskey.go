@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// Links with one of the album's AccessKeys, like /baku/?key=…, get past its login without a password, for emails
+// and the like. Nothing is kept in a cookie, the key is added to the links of the pages it opens instead, so it
+// follows the visitor around the album. Taking a key out of AccessKeys takes back every link with it.
+const ACCESS_KEY_PARAM = "key"
+const ACCESS_KEY_MIN_LENGTH = 16
+
+// the key goes in URLs as it is, so it's kept to characters that need no escaping
+var accessKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Albums implement this so links with an access key get past basic auth, see checkAndRequireAuth
+type AccessKeyChecker interface {
+	CheckAccessKey(r *http.Request) bool
+}
+
+func (a *Album) validateAccessKeys() error {
+	if len(a.AccessKeys) > 0 && !a.HasAuth() {
+		return errors.New("AccessKeys get past the album's login, and the album (and the site) has none")
+	}
+	for _, v := range a.AccessKeys {
+		if len(v) < ACCESS_KEY_MIN_LENGTH || !accessKeyRegexp.MatchString(v) {
+			return errors.New("AccessKeys must be at least 16 letters, digits, dashes or underscores long")
+		}
+	}
+	return nil
+}
+
+func (a *Album) CheckAccessKey(r *http.Request) bool {
+	key := r.URL.Query().Get(ACCESS_KEY_PARAM)
+	if key == "" {
+		return false
+	}
+
+	ok := false
+	for _, v := range a.AccessKeys {
+		if subtle.ConstantTimeCompare([]byte(v), []byte(key)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// what the links of a page opened with an access key get, so the pages they open are let in as well. Empty for
+// requests without a valid key.
+func (a *Album) getAccessQuery(r *http.Request) string {
+	if !a.CheckAccessKey(r) {
+		return ""
+	}
+	return "?" + ACCESS_KEY_PARAM + "=" + url.QueryEscape(r.URL.Query().Get(ACCESS_KEY_PARAM))
+}
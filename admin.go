@@ -0,0 +1,760 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// every site with AdminUser and AdminPass set gets its admin pages under this path
+const ADMIN_PATH = "/admin/"
+
+// the culling mode shows photos full-screen, so it asks for bigger ones than the album pages
+const ADMIN_CULL_PHOTO_WIDTH = 1600
+
+type AdminIndexPageContext struct {
+	*BasePageContext
+
+	Albums  []*Album
+	Message string
+
+	StagedPublishing bool
+	Published        *PublishedSite //nil until it's been read from the bucket
+}
+
+type AdminOrderingPageContext struct {
+	*BasePageContext
+
+	Album       *Album
+	Photos      []AdminPhoto
+	CurrentHash string
+
+	Message string
+}
+
+type AdminCaptionsPageContext struct {
+	*BasePageContext
+
+	Album       *Album
+	Photos      []AdminPhoto
+	CurrentHash string
+
+	Message string
+}
+
+type AdminCullPageContext struct {
+	*BasePageContext
+
+	Album       *Album
+	Photos      []AdminCullPhoto
+	CurrentHash string
+}
+
+// handed to the culling mode's script as JSON, so the fields keep the names the script uses
+type AdminCullPhoto struct {
+	Key         string `json:"key"`
+	Url         string `json:"url"`
+	IsCover     bool   `json:"cover"`
+	IsThumbnail bool   `json:"thumbnail"`
+
+	// consecutive near-duplicate frames share a group, and are compared side by side
+	Group int `json:"group"`
+}
+
+type AdminOrderingPreviewPageContext struct {
+	*BasePageContext
+
+	Album       *Album
+	Diff        OrderingDiff
+	YAML        string
+	CurrentHash string
+}
+
+// a photo as shown in the admin, Key is relative to the album prefix like in ordering.yaml
+type AdminPhoto struct {
+	Key         string
+	Photo       Renderable
+	Details     OrderingEntry
+	IsCover     bool
+	IsThumbnail bool
+}
+
+// what changes for visitors when a new ordering is written, shown before the write is confirmed
+type OrderingDiff struct {
+	CoverBefore string
+	CoverAfter  string
+
+	ThumbnailsBefore  []string
+	ThumbnailsAfter   []string
+	ThumbnailsAdded   []string
+	ThumbnailsRemoved []string
+
+	Moves []OrderingMove
+}
+
+// a photo that changed position in the album, positions start at 1
+type OrderingMove struct {
+	Key  string
+	From int
+	To   int
+}
+
+func (d OrderingDiff) HasCoverChange() bool {
+	return d.CoverBefore != d.CoverAfter
+}
+
+func (d OrderingDiff) HasThumbnailChanges() bool {
+	return strings.Join(d.ThumbnailsBefore, "\n") != strings.Join(d.ThumbnailsAfter, "\n")
+}
+
+func (d OrderingDiff) IsEmpty() bool {
+	return !d.HasCoverChange() && !d.HasThumbnailChanges() && len(d.Moves) == 0
+}
+
+// Compares what visitors see now with what they'd see after the change. Rather than listing every photo
+// that shifted by a position, only the photos that were actually moved are listed: everything on the
+// longest run of photos that kept their relative order stays put.
+func (a *Album) DiffOrderingKeys(before AlbumOrderingKeys, after AlbumOrderingKeys) OrderingDiff {
+	var diff OrderingDiff
+	diff.CoverBefore = a.RelativeOrderingKey(before.Cover)
+	diff.CoverAfter = a.RelativeOrderingKey(after.Cover)
+
+	for _, v := range before.Thumbnails {
+		diff.ThumbnailsBefore = append(diff.ThumbnailsBefore, a.RelativeOrderingKey(v))
+	}
+	for _, v := range after.Thumbnails {
+		diff.ThumbnailsAfter = append(diff.ThumbnailsAfter, a.RelativeOrderingKey(v))
+	}
+	diff.ThumbnailsAdded = addedKeys(diff.ThumbnailsBefore, diff.ThumbnailsAfter)
+	diff.ThumbnailsRemoved = addedKeys(diff.ThumbnailsAfter, diff.ThumbnailsBefore)
+
+	positionBefore := make(map[string]int)
+	for i, v := range before.Ordering {
+		positionBefore[v] = i
+	}
+
+	var keysToCheck []string
+	var positionsToCheck []int
+	for _, v := range after.Ordering {
+		if i, ok := positionBefore[v]; ok {
+			keysToCheck = append(keysToCheck, v)
+			positionsToCheck = append(positionsToCheck, i)
+		}
+	}
+
+	stayed := longestIncreasingRun(positionsToCheck)
+	positionAfter := make(map[string]int)
+	for i, v := range after.Ordering {
+		positionAfter[v] = i
+	}
+
+	for i, v := range keysToCheck {
+		if !stayed[i] {
+			diff.Moves = append(diff.Moves, OrderingMove{
+				Key:  a.RelativeOrderingKey(v),
+				From: positionBefore[v] + 1,
+				To:   positionAfter[v] + 1,
+			})
+		}
+	}
+	return diff
+}
+
+// marks the members of one of the longest increasing subsequences of values (patience sorting, n log n)
+func longestIncreasingRun(values []int) map[int]bool {
+	var tails []int // index in values of the last element of the best run of each length
+	previous := make([]int, len(values))
+	for i, v := range values {
+		length := sort.Search(len(tails), func(j int) bool { return values[tails[j]] >= v })
+		if length > 0 {
+			previous[i] = tails[length-1]
+		} else {
+			previous[i] = -1
+		}
+
+		if length == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[length] = i
+		}
+	}
+
+	members := make(map[int]bool)
+	if len(tails) == 0 {
+		return members
+	}
+	for i := tails[len(tails)-1]; i >= 0; i = previous[i] {
+		members[i] = true
+	}
+	return members
+}
+
+func isSameOriginRequest(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+
+	u, err := url.Parse(origin)
+	return origin != "" && err == nil && u.Host == r.Host
+}
+
+func getAdminBasePageContext(site *Site, path string, title string) *BasePageContext {
+	u := site.GetUrlForPath(path)
+
+	return &BasePageContext{
+		site.GetCanonicalUrl().String(),
+		u.String(),
+		fmt.Sprintf("%s | %s", title, site.SiteTitle),
+		site.SiteTitle,
+		nil,
+		nil,
+		"",
+	}
+}
+
+func handleAdmin(site *Site, w http.ResponseWriter, r *http.Request) {
+	page := strings.TrimPrefix(r.URL.Path, ADMIN_PATH)
+
+	// the album is always in the query, the body isn't read until the request is let in and its size is limited
+	scopeAlbum := r.URL.Query().Get("album")
+	if isAdminSitePage(page) {
+		scopeAlbum = ""
+	}
+	if !requireAdminAccess(site, w, r, getAdminPageScope(page), scopeAlbum) {
+		return
+	}
+
+	if page == "" {
+		handleAdminIndex(site, w, r)
+		return
+	}
+	if isAdminSitePage(page) {
+		handleAdminSitePage(site, page, w, r)
+		return
+	}
+
+	album, err := site.GetAlbumForPath(r.URL.Query().Get("album"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if album.Locked && isAdminWritePage(page) {
+		writeAdminError(w, http.StatusForbidden, album.checkNotLocked())
+		return
+	}
+
+	switch {
+	case page == "ordering" && r.Method == http.MethodGet:
+		handleAdminOrdering(album, w, r)
+	case page == "ordering/preview" && r.Method == http.MethodPost:
+		handleAdminOrderingPreview(album, w, r)
+	case page == "ordering/save" && r.Method == http.MethodPost:
+		handleAdminOrderingSave(album, w, r)
+	case page == "ordering/rollback" && r.Method == http.MethodPost:
+		handleAdminOrderingRollback(album, w, r)
+	case page == "captions" && r.Method == http.MethodGet:
+		handleAdminCaptions(album, w, r)
+	case page == "captions/save" && r.Method == http.MethodPost:
+		handleAdminCaptionsSave(album, w, r)
+	case page == "cull" && r.Method == http.MethodGet:
+		handleAdminCull(album, w, r)
+	case page == "cull/save" && r.Method == http.MethodPost:
+		handleAdminCullSave(album, w, r)
+	case page == "upload" && r.Method == http.MethodGet:
+		handleAdminUpload(album, w, r)
+	case page == "upload/save" && r.Method == http.MethodPost:
+		handleAdminUploadSave(album, w, r)
+	case page == "upload/start" && r.Method == http.MethodPost:
+		handleAdminUploadStart(album, w, r)
+	case page == "upload/part" && r.Method == http.MethodPost:
+		handleAdminUploadPart(album, w, r)
+	case page == "upload/parts" && r.Method == http.MethodGet:
+		handleAdminUploadParts(album, w, r)
+	case page == "upload/complete" && r.Method == http.MethodPost:
+		handleAdminUploadComplete(album, w, r)
+	case page == "upload/abort" && r.Method == http.MethodPost:
+		handleAdminUploadAbort(album, w, r)
+	case page == "upload/compare" && r.Method == http.MethodPost:
+		handleAdminUploadCompare(album, w, r)
+	case page == "refresh" && r.Method == http.MethodPost:
+		handleAdminRefresh(album, w, r)
+	case page == "retention" && r.Method == http.MethodGet:
+		handleAdminRetention(album, w, r)
+	case page == "takedown" && r.Method == http.MethodGet:
+		handleAdminTakedown(album, w, r)
+	case page == "takedown/save" && r.Method == http.MethodPost:
+		handleAdminTakedownSave(album, w, r)
+	case page == "share" && r.Method == http.MethodGet:
+		handleAdminShare(album, w, r)
+	case page == "share/create" && r.Method == http.MethodPost:
+		handleAdminShareCreate(album, w, r)
+	case page == "share/upload" && r.Method == http.MethodPost:
+		handleAdminShareUpload(album, w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found\n"))
+	}
+}
+
+// Lets in the admin, and the logins and bearer tokens with scope (in scopeAlbum, unless it's empty). Answers the
+// request when they aren't let in. The admin's pages and the API both go through this.
+func requireAdminAccess(site *Site, w http.ResponseWriter, r *http.Request, scope string, scopeAlbum string) bool {
+	// scripts can use a bearer token instead of the admin's password. Browsers never send those by
+	// themselves, so they need no protection from other sites' forms.
+	if getBearerToken(r) != "" && site.HasBearerTokens() {
+		allowed := site.requireBearerScope(w, r, scope, scopeAlbum)
+		if allowed {
+			auditLogin(site.GetAdminCredentials(), r, "bearer", getBearerSubject(site, r), AUTH_AUDIT_SUCCESS)
+		} else {
+			auditLogin(site.GetAdminCredentials(), r, "bearer", getBearerSubject(site, r), AUTH_AUDIT_FAILURE)
+		}
+		return allowed
+	}
+
+	if !checkAndRequireAuth(w, r, site.GetAdminCredentialsForScope(scope)) {
+		return false
+	}
+
+	// the admin is protected by basic auth, which browsers send along with any request, including ones
+	// made by forms on other sites.
+	if r.Method == http.MethodPost && !isSameOriginRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Cross-origin requests are not allowed\n"))
+		return false
+	}
+	return true
+}
+
+// the pages that change what's in the album's prefix, which locked albums refuse
+func isAdminWritePage(page string) bool {
+	switch page {
+	case "ordering/save", "ordering/rollback", "captions/save", "cull/save", "upload/save", "upload/start", "upload/part", "upload/complete",
+		"takedown/save":
+		return true
+	default:
+		return false
+	}
+}
+
+// what a bearer token needs to be allowed to use an admin page
+func getAdminPageScope(page string) string {
+	switch {
+	case page == "upload" || strings.HasPrefix(page, "upload/"):
+		return JWT_SCOPE_UPLOAD
+	case page == "refresh":
+		return JWT_SCOPE_REFRESH
+	case page == "" || page == "ordering" || strings.HasPrefix(page, "ordering/") || page == "captions" ||
+		strings.HasPrefix(page, "captions/") || page == "cull" || strings.HasPrefix(page, "cull/"):
+		return JWT_SCOPE_EDIT
+	default:
+		return JWT_SCOPE_ADMIN
+	}
+}
+
+func handleAdminIndex(site *Site, w http.ResponseWriter, r *http.Request) {
+	var message string
+	if album := r.FormValue("refreshed"); album != "" {
+		message = fmt.Sprintf("The photos and ordering of %s have been reloaded from the bucket.", album)
+	}
+	if r.FormValue("published") != "" {
+		message = "Every album has been published, visitors see what's in the bucket now."
+	}
+
+	ctx := &AdminIndexPageContext{
+		getAdminBasePageContext(site, ADMIN_PATH, "Admin"),
+		site.Albums,
+		message,
+		site.StagedPublishing,
+		nil,
+	}
+	if site.StagedPublishing {
+		ctx.Published = site.getPublishedState()
+	}
+	site.executeTemplate(w, "admin_index.html", ctx)
+}
+
+// Reloads the album's photos and ordering from the bucket right away, rather than at the next hourly refresh,
+// for changes made to the bucket behind 50mm's back
+func handleAdminRefresh(album *Album, w http.ResponseWriter, r *http.Request) {
+	album.RefreshKeyCache()
+	album.RefreshOrderingCache()
+
+	if getBearerToken(r) != "" {
+		keys, _ := album.KeyCache.Load().([]string)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"album": album.Path, "objects": len(keys)})
+		return
+	}
+	http.Redirect(w, r, album.site.GetUrlPath(ADMIN_PATH+"?refreshed="+url.QueryEscape(album.Path)), http.StatusSeeOther)
+}
+
+// Reads the ordering straight from the bucket rather than from the cache. Returns the raw contents (nil
+// when there's no ordering.yaml yet) as well, their hash guards against concurrent edits.
+func getCurrentOrderingConfig(album *Album) (AlbumOrderingConfig, []byte, error) {
+	current, err := album.GetObjectFromBucket(ORDERING_YAML_NAME)
+	if err != nil {
+		if isNotFoundError(err) {
+			return AlbumOrderingConfig{}, nil, nil
+		}
+		return AlbumOrderingConfig{}, nil, err
+	}
+
+	// a malformed file is treated like a missing one (it's ignored for visitors too), so it can be fixed
+	// by saving a new ordering over it.
+	config, err := album.ParseAlbumOrderingConfig(current)
+	if err != nil {
+		return AlbumOrderingConfig{}, current, nil
+	}
+	return config, current, nil
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	w.Write([]byte(err.Error()))
+}
+
+// every photo of the album in the order visitors see them, along with the hash of the current ordering.yaml
+func getAdminPhotos(album *Album) ([]AdminPhoto, string, error) {
+	config, current, err := getCurrentOrderingConfig(album)
+	if err != nil {
+		return nil, "", err
+	}
+
+	orderingKeys, err := album.GetOrderedKeys(config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	thumbnails := make(map[string]bool)
+	for _, v := range orderingKeys.Thumbnails {
+		thumbnails[v] = true
+	}
+
+	var photos []AdminPhoto
+	for _, v := range orderingKeys.Ordering {
+		photos = append(photos, AdminPhoto{
+			Key:         album.RelativeOrderingKey(v),
+			Photo:       album.getPhotoForKey(v, orderingKeys.photoDetails),
+			Details:     config.Entries[v],
+			IsCover:     v == orderingKeys.Cover && !album.HasRandomCover(config),
+			IsThumbnail: thumbnails[v],
+		})
+	}
+	return photos, HashOrderingYAML(current), nil
+}
+
+func handleAdminOrdering(album *Album, w http.ResponseWriter, r *http.Request) {
+	photos, currentHash, err := getAdminPhotos(album)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var message string
+	switch r.FormValue("done") {
+	case "save":
+		message = "The new ordering has been saved."
+	case "rollback":
+		message = "The previous ordering has been restored."
+	case "cull":
+		message = "The culled photos have been excluded."
+	}
+
+	ctx := &AdminOrderingPageContext{
+		getAdminBasePageContext(album.site, ADMIN_PATH+"ordering", "Ordering of "+album.AlbumTitle),
+		album,
+		photos,
+		currentHash,
+		message,
+	}
+	album.site.executeTemplate(w, "admin_ordering.html", ctx)
+}
+
+func handleAdminOrderingPreview(album *Album, w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	config, _, err := getCurrentOrderingConfig(album)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the editor posts keys relative to the prefix, like they're written in ordering.yaml
+	prefix := strings.TrimLeft(album.BucketPrefix, "/")
+	proposed := AlbumOrderingConfig{Entries: config.Entries, RandomCover: config.RandomCover}
+	if cover := r.PostFormValue("cover"); cover != "" {
+		proposed.Cover = prefix + cover
+	}
+	for _, v := range r.PostForm["thumbnails"] {
+		proposed.Thumbnails = append(proposed.Thumbnails, prefix+v)
+	}
+	for _, v := range r.PostForm["ordering"] {
+		proposed.Ordering = append(proposed.Ordering, prefix+v)
+	}
+
+	renderOrderingPreview(album, config, proposed, r.PostFormValue("current"), w)
+}
+
+// shows what changes with the proposed ordering, and the yaml that would be written if it's confirmed
+func renderOrderingPreview(album *Album, config AlbumOrderingConfig, proposed AlbumOrderingConfig, currentHash string, w http.ResponseWriter) {
+	data, err := album.MarshalAlbumOrderingConfig(proposed)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// diff against what will actually be written, not against what was posted
+	proposed, err = album.ParseAlbumOrderingConfig(data)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	before, err := album.GetOrderedKeys(config)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	after, err := album.GetOrderedKeys(proposed)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx := &AdminOrderingPreviewPageContext{
+		getAdminBasePageContext(album.site, ADMIN_PATH+"ordering/preview", "Preview of "+album.AlbumTitle),
+		album,
+		album.DiffOrderingKeys(before, after),
+		string(data),
+		currentHash,
+	}
+	album.site.executeTemplate(w, "admin_ordering_preview.html", ctx)
+}
+
+func handleAdminOrderingSave(album *Album, w http.ResponseWriter, r *http.Request) {
+	if err := album.WriteOrderingYAML([]byte(r.PostFormValue("yaml")), r.PostFormValue("current")); err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+
+	http.Redirect(w, r, album.site.GetUrlPath(ADMIN_PATH+"ordering?done=save&album="+url.QueryEscape(album.Path)), http.StatusSeeOther)
+}
+
+func handleAdminOrderingRollback(album *Album, w http.ResponseWriter, r *http.Request) {
+	if err := album.RollbackOrderingYAML(); err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+
+	http.Redirect(w, r, album.site.GetUrlPath(ADMIN_PATH+"ordering?done=rollback&album="+url.QueryEscape(album.Path)), http.StatusSeeOther)
+}
+
+func handleAdminCaptions(album *Album, w http.ResponseWriter, r *http.Request) {
+	photos, currentHash, err := getAdminPhotos(album)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var message string
+	if r.FormValue("done") == "save" {
+		message = "The captions have been saved."
+	}
+
+	ctx := &AdminCaptionsPageContext{
+		getAdminBasePageContext(album.site, ADMIN_PATH+"captions", "Captions of "+album.AlbumTitle),
+		album,
+		photos,
+		currentHash,
+		message,
+	}
+	album.site.executeTemplate(w, "admin_captions.html", ctx)
+}
+
+// all captions are saved in a single write of ordering.yaml, the cover, thumbnails and ordering are left as they are.
+func handleAdminCaptionsSave(album *Album, w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	keys := r.PostForm["key"]
+	titles := r.PostForm["title"]
+	captions := r.PostForm["caption"]
+	alts := r.PostForm["alt"]
+	if len(titles) != len(keys) || len(captions) != len(keys) || len(alts) != len(keys) {
+		writeAdminError(w, http.StatusBadRequest, errors.New("Every photo needs a title, caption and alt field."))
+		return
+	}
+
+	config, _, err := getCurrentOrderingConfig(album)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	prefix := strings.TrimLeft(album.BucketPrefix, "/")
+	entries := make(map[string]OrderingEntry)
+	for k, v := range config.Entries {
+		entries[k] = v
+	}
+	for i, v := range keys {
+		// the people and tags aren't edited here, they stay as they were
+		entry := entries[prefix+v]
+		entry.Key = prefix + v
+		entry.Title = strings.TrimSpace(titles[i])
+		entry.Caption = strings.TrimSpace(captions[i])
+		entry.Alt = strings.TrimSpace(alts[i])
+		if entry.HasDetails() {
+			entries[entry.Key] = entry
+		} else {
+			delete(entries, entry.Key)
+		}
+	}
+	config.Entries = entries
+
+	data, err := album.MarshalAlbumOrderingConfig(config)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := album.WriteOrderingYAML(data, r.PostFormValue("current")); err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+
+	http.Redirect(w, r, album.site.GetUrlPath(ADMIN_PATH+"captions?done=save&album="+url.QueryEscape(album.Path)), http.StatusSeeOther)
+}
+
+func handleAdminCull(album *Album, w http.ResponseWriter, r *http.Request) {
+	photos, currentHash, err := getAdminPhotos(album)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// hashes are cached by their full keys
+	prefix := strings.TrimLeft(album.BucketPrefix, "/")
+	renderables := make(map[string]Renderable)
+	for _, v := range photos {
+		renderables[prefix+v.Key] = v.Photo
+	}
+	hashes := album.GetPerceptualHashes(renderables)
+
+	var cullPhotos []AdminCullPhoto
+	group := 0
+	for i, v := range photos {
+		if i > 0 && !isNearDuplicate(hashes, prefix+photos[i-1].Key, prefix+v.Key) {
+			group++
+		}
+
+		cullPhotos = append(cullPhotos, AdminCullPhoto{
+			Key:         v.Key,
+			Url:         v.Photo.GetPhotoForWidth(ADMIN_CULL_PHOTO_WIDTH),
+			IsCover:     v.IsCover,
+			IsThumbnail: v.IsThumbnail,
+			Group:       group,
+		})
+	}
+
+	ctx := &AdminCullPageContext{
+		getAdminBasePageContext(album.site, ADMIN_PATH+"cull", "Culling "+album.AlbumTitle),
+		album,
+		cullPhotos,
+		currentHash,
+	}
+	album.site.executeTemplate(w, "admin_cull.html", ctx)
+}
+
+// Writes the result of a culling session: the cover and thumbnails are replaced, and culled photos are
+// added to the exclude list (and dropped from everywhere else) so they stay in the bucket untouched.
+func handleAdminCullSave(album *Album, w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	config, _, err := getCurrentOrderingConfig(album)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	prefix := strings.TrimLeft(album.BucketPrefix, "/")
+	excluded := make(map[string]bool)
+	for _, v := range r.PostForm["exclude"] {
+		excluded[prefix+v] = true
+		config.Exclude = append(config.Exclude, escapeExcludePattern(v))
+	}
+
+	config.Cover = ""
+	if cover := r.PostFormValue("cover"); cover != "" && !excluded[prefix+cover] {
+		config.Cover = prefix + cover
+	}
+
+	config.Thumbnails = nil
+	for _, v := range r.PostForm["thumbnails"] {
+		if !excluded[prefix+v] {
+			config.Thumbnails = append(config.Thumbnails, prefix+v)
+		}
+	}
+
+	var ordering []string
+	for _, v := range config.Ordering {
+		if !excluded[v] {
+			ordering = append(ordering, v)
+		}
+	}
+	config.Ordering = ordering
+
+	entries := make(map[string]OrderingEntry)
+	for k, v := range config.Entries {
+		if !excluded[k] {
+			entries[k] = v
+		}
+	}
+	config.Entries = entries
+
+	data, err := album.MarshalAlbumOrderingConfig(config)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := album.WriteOrderingYAML(data, r.PostFormValue("current")); err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+
+	http.Redirect(w, r, album.site.GetUrlPath(ADMIN_PATH+"ordering?done=cull&album="+url.QueryEscape(album.Path)), http.StatusSeeOther)
+}
+
+// photos we couldn't hash are never near-duplicates of anything
+func isNearDuplicate(hashes map[string]uint64, a string, b string) bool {
+	hashA, okA := hashes[a]
+	hashB, okB := hashes[b]
+	return okA && okB && HammingDistance(hashA, hashB) < NEAR_DUPLICATE_DISTANCE
+}
+
+// an exclude pattern matching just the given key, even if it has glob characters in it
+func escapeExcludePattern(key string) string {
+	var b strings.Builder
+	for _, c := range key {
+		if strings.ContainsRune(`*?[\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"image"
+	"net"
 	"net/url"
+	"path"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -11,6 +19,8 @@ import (
 
 	"io/ioutil"
 	"math"
+	"math/rand"
+	"net/http"
 
 	"bitbucket.org/zombiezen/cardcpx/natsort"
 	"github.com/aws/aws-sdk-go/aws"
@@ -22,6 +32,26 @@ import (
 
 const CACHE_INTERVAL = 1 * time.Hour
 const ORDERING_YAML_NAME = "ordering.yaml"
+const ORDERING_YAML_PREVIOUS_NAME = "ordering.yaml.previous"
+const ORDERING_YAML_CONTENT_TYPE = "application/x-yaml"
+
+// these have to match the sizes the templates ask for, otherwise we'd be warming the wrong derivatives
+const PREWARM_PHOTO_WIDTH = 800
+const PREWARM_THUMBNAIL_WIDTH = 150
+const PREWARM_THUMBNAIL_HEIGHT = 100
+const PREWARM_TIMEOUT = 30 * time.Second
+
+const DEFAULT_WATERMARK_OPACITY = 50
+
+//as CoverMode, or as the cover in ordering.yaml, picks a different cover every time the key cache refreshes
+const COVER_MODE_RANDOM = "random"
+
+//how many thumbnails the index shows next to an album's cover, unless the site or album says otherwise
+const DEFAULT_INDEX_THUMBNAILS = 5
+
+// how many photos are downloaded at once to analyse them (see AnalyseImage)
+const IMAGE_ANALYSIS_CONCURRENCY = 8
+const IMAGE_ANALYSIS_TIMEOUT = 30 * time.Second
 
 type Album struct {
 	site *Site
@@ -29,21 +59,136 @@ type Album struct {
 	Path         string
 	BucketPrefix string
 
-	AuthUser string
-	AuthPass string
+	AuthUser     string
+	AuthPass     string
+	AuthPassHash string   //bcrypt:<hash>, instead of AuthPass
+	AuthUsers    []string //user:pass pairs, on top of AuthUser and AuthPass
+	AuthFile     string
+	authFile     *HtpasswdFile //loaded on config read from AuthFile
+
+	AuthTOTPSecrets []string          //user:secret pairs, for logins that need a code as well
+	authTOTPSecrets map[string][]byte //parsed on config read from AuthTOTPSecrets
+
+	AccessKeys []string //for ?key= links that get past the album's login, see accesskey.go
+
+	OIDCEmailDomains []string
+	OIDCGroups       []string
 
-	MetaTitle  string
-	AlbumTitle string
+	AllowedCIDRs []string
+	allowedNets  []*net.IPNet //parsed on config read from AllowedCIDRs
+
+	ImageUrlLifetime time.Duration //how long the photo URLs handed out work, 0 for the site's ImageUrlLifetime
+
+	MetaTitle       string
+	MetaDescription string //for link previews, see opengraph.go
+	ShareTitle      string //what the album says where it's shared, see sharetext.go
+	ShareText       string
+	AlbumTitle      string
+	Tags            []string //shown on the site's tag pages along with the photos' own, see tags.go
 
 	InIndex bool
+	NoIndex bool //keep search engines away, see robots.go
+	Locked  bool //delivered or archived, nothing can be changed through 50mm
+
+	RenderableExtensions []string
+	Exclude              []string
+
+	CoverMode       string
+	CoverRotation   int
+	IndexThumbnails int
+	IndexMinPhotos  int //kept out of the index until it has this many photos, overrides the site's
+	PageSize        int //photos per album page, overrides the site's, see pagination.go
+
+	ShowMap        bool
+	ShowExif       bool //the camera and its settings on photo pages, see permalink.go
+	CollapseBursts bool
+	LiveUpdates    bool //tell open album pages about new photos, see live.go
+
+	Kiosk         bool //a slideshow for screens at events, see kiosk.go
+	KioskInterval time.Duration
+
+	Embed bool //a gallery for other sites to show in an iframe, see embed.go
+
+	Language string //of the album's pages, overrides the site's, see i18n.go
+	Theme    string //of the album's pages, overrides the site's, see theme.go
+
+	AllowOriginalDownload bool
+	StripExif             bool //serve the photos without their metadata, see privacy.go
+
+	AllowZipDownload    bool
+	AllowWebZipDownload bool
+	ZipDownloadMaxMB    int
+	OriginalZipUsers    []string //logins allowed to download the originals, empty for anybody who can see the album
+	PrebuildZips        bool
+
+	WatermarkText    string
+	WatermarkImage   string
+	WatermarkOpacity int
 
 	KeyCache                           atomic.Value
+	KeyDatesCache                      atomic.Value //map[string]time.Time, when every key was last modified
+	KeySizesCache                      atomic.Value //map[string]int64, the size of every key in bytes
 	OrderingCache                      atomic.Value
+	TakedownsCache                     atomic.Value //[]Takedown, the photos whose URLs answer 410 Gone
 	LastKeyCacheUpdate                 time.Time
 	LastAlbumOrderingConfigCacheUpdate time.Time
 
 	KeyCacheUpdateMutex                 sync.Mutex
 	AlbumAlbumOrderingConfigUpdateMutex sync.Mutex
+
+	views uint64 // page views since the server started, accessed atomically
+
+	// EXIF data by key, photos don't change once uploaded so entries are only dropped with their keys
+	exifCache         map[string]*ExifData
+	exifCacheMutex    sync.RWMutex
+	exifCacheUpdating int32 // set while updateExifCache runs, accessed atomically
+
+	// by key, computed when the admin compares photos or, with PlaceholderColors on, in the background
+	imageAnalysisCache         map[string]ImageAnalysis
+	imageAnalysisCacheMutex    sync.Mutex
+	imageAnalysisCacheUpdating int32 // set while updateImageAnalysisCache runs, accessed atomically
+
+	// what photos weigh on the album page by key, only measured when the site has a PageBudgetKB
+	photoSizeCache         map[string]int64
+	photoSizeCacheMutex    sync.Mutex
+	photoSizeCacheUpdating int32 // set while updatePhotoSizeCache runs, accessed atomically
+	pageBudgetWarned       int32 // set once we've said the budget can't be met, accessed atomically
+
+	// whether GIFs, PNGs and WebPs are animated by key, only read when the site has AnimatedImages set
+	animationCache         map[string]bool
+	animationCacheMutex    sync.RWMutex
+	animationCacheUpdating int32 // set while updateAnimationCache runs, accessed atomically
+
+	// the fingerprints of the zips in the bucket that are up to date by key, only built with PrebuildZips on
+	prebuiltZips         map[string]string
+	prebuiltZipsMutex    sync.Mutex
+	prebuiltZipsUpdating int32 // set while updatePrebuiltZips runs, accessed atomically
+
+	// only used when the site has a StaticMirrorBucket
+	staticMirrorUpdating int32 // set while updateStaticMirror runs, accessed atomically
+	staticMirrorPending  int32 // set when the pages need writing (again), accessed atomically
+
+	// only used when the site has PersistCaches on, see cache.go
+	persistedCacheLoaded      int32 // set once it's been read, accessed atomically
+	persistedCacheUpdating    int32 // set while updatePersistedCache runs, accessed atomically
+	persistedCachePending     int32 // set when it needs writing (again), accessed atomically
+	persistedCacheFingerprint atomic.Value
+
+	// the album pages waiting to hear about changes, only used with LiveUpdates on
+	liveClients      map[chan struct{}]bool
+	liveClientsMutex sync.Mutex
+	liveFingerprint  string // what the album looked like the last time they were told
+
+	// only used with CheckCovers on, by key, see covercheck.go
+	coverChecks      map[string]*CoverCheck
+	coverChecksMutex sync.Mutex
+
+	//only used with the site's Search or TagPages on, an *albumSearchIndex, see search.go
+	searchIndex atomic.Value
+
+	// the photos the webhooks were last told visitors see, nil until they've been worked out, see webhook.go
+	webhookPhotos      []string
+	webhookPhotosMutex sync.Mutex
 }
 
 //this struct will store the _configuration_ as read from a yaml file
@@ -51,9 +196,91 @@ type AlbumOrderingConfig struct {
 	Cover             string
 	Thumbnails        []string
 	Ordering          []string
+	Entries           map[string]OrderingEntry //details of the photos that were written as maps, by key
+	Exclude           []string                 //patterns relative to the album prefix, like the album's Exclude
+	People            map[string]PersonConsent //by name, whether the people tagged in photos may be shown publicly
+	RandomCover       bool                     //set by `cover: random`, Cover is empty then
 	negativeCacheThis bool
 }
 
+//a photo as listed in ordering.yaml, either just its key (`- img_1234.jpg`) or a map with the key and
+//details about the photo (`- key: img_1234.jpg` with `caption: Sunset at the pier`).
+type OrderingEntry struct {
+	Key     string   `yaml:"key"`
+	Title   string   `yaml:"title,omitempty"`
+	Caption string   `yaml:"caption,omitempty"`
+	Alt     string   `yaml:"alt,omitempty"`
+	People  []string `yaml:"people,omitempty"` //names of the people in the photo, see PersonConsent
+	Tags    []string `yaml:"tags,omitempty"`   //see tags.go
+}
+
+func (e *OrderingEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&e.Key); err == nil {
+		return nil
+	}
+
+	//an alias without the UnmarshalYAML method, so we don't end up back in here
+	type plainOrderingEntry OrderingEntry
+	return unmarshal((*plainOrderingEntry)(e))
+}
+
+//entries without details are written back as plain keys
+func (e OrderingEntry) MarshalYAML() (interface{}, error) {
+	if !e.HasDetails() {
+		return e.Key, nil
+	}
+
+	type plainOrderingEntry OrderingEntry
+	return plainOrderingEntry(e), nil
+}
+
+func (e OrderingEntry) HasDetails() bool {
+	return e.Title != "" || e.Caption != "" || e.Alt != "" || len(e.People) > 0 || len(e.Tags) > 0
+}
+
+//the key lists stay plain lists of keys for everything downstream, details of entries written as maps
+//are collected in Entries.
+func (c *AlbumOrderingConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw struct {
+		Cover      OrderingEntry
+		Thumbnails []OrderingEntry
+		Ordering   []OrderingEntry
+		Photos     []OrderingEntry
+		Exclude    []string
+		People     map[string]PersonConsent
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	c.Exclude = raw.Exclude
+	c.People = raw.People
+
+	c.Entries = make(map[string]OrderingEntry)
+	addEntry := func(entry OrderingEntry) string {
+		if entry.HasDetails() {
+			c.Entries[entry.Key] = entry
+		}
+		return entry.Key
+	}
+
+	if raw.Cover.Key == COVER_MODE_RANDOM {
+		c.RandomCover = true
+	} else {
+		c.Cover = addEntry(raw.Cover)
+	}
+	for _, v := range raw.Thumbnails {
+		c.Thumbnails = append(c.Thumbnails, addEntry(v))
+	}
+	for _, v := range raw.Ordering {
+		c.Ordering = append(c.Ordering, addEntry(v))
+	}
+	//photos only listed for their details, they don't change the ordering
+	for _, v := range raw.Photos {
+		addEntry(v)
+	}
+	return nil
+}
+
 //this struct will store our actual renderable orderings, as processed
 //by reading the config, the actual file index, and doing some merging
 type AlbumOrdering struct {
@@ -62,6 +289,15 @@ type AlbumOrdering struct {
 	Ordering   []Renderable
 }
 
+//the keys behind an AlbumOrdering, before they're turned in to Renderables
+type AlbumOrderingKeys struct {
+	Cover      string
+	Thumbnails []string
+	Ordering   []string
+
+	photoDetails map[string]*PhotoDetails
+}
+
 type GetFromKeyCacheResult struct {
 	keys []string
 	err  error
@@ -73,7 +309,7 @@ type GetFromOrderingConfigCacheResult struct {
 }
 
 func NewAlbumFromConfig(section *ini.Section, s *Site) (*Album, error) {
-	album := &Album{site: s, InIndex: true}
+	album := &Album{site: s, InIndex: true, WatermarkOpacity: DEFAULT_WATERMARK_OPACITY}
 	if err := section.MapTo(album); err != nil {
 		return nil, err
 	}
@@ -82,6 +318,17 @@ func NewAlbumFromConfig(section *ini.Section, s *Site) (*Album, error) {
 		return nil, err
 	}
 
+	if album.AuthFile != "" {
+		var err error
+		if album.authFile, err = LoadHtpasswdFile(album.AuthFile); err != nil {
+			return nil, err
+		}
+	}
+
+	//checked in IsValid
+	album.allowedNets, _ = parseCIDRs(album.AllowedCIDRs)
+	album.authTOTPSecrets, _ = parseTOTPSecrets(album.AuthTOTPSecrets)
+
 	album.Canonicalize()
 	return album, nil
 }
@@ -96,6 +343,8 @@ func NewAlbum(s *Site, path string, bucketPrefix string, authUser string, authPa
 		MetaTitle:    metaTitle,
 		AlbumTitle:   albumTitle,
 		InIndex:      true,
+
+		WatermarkOpacity: DEFAULT_WATERMARK_OPACITY,
 	}
 
 	if err := album.IsValid(); err != nil {
@@ -114,17 +363,143 @@ func (a *Album) IsValid() error {
 	if a.InIndex && a.HasOwnAuth() {
 		return errors.New("An album that requires authentication can't be shown in the index. If you need authentication please add it to the site.")
 	}
+
+	if a.InIndex && len(a.AllowedCIDRs) > 0 {
+		return errors.New("An album with AllowedCIDRs can't be shown in the index. If the whole site is for one network please add them to the site.")
+	}
+
+	if _, err := parseCIDRs(a.AllowedCIDRs); err != nil {
+		return fmt.Errorf("AllowedCIDRs: %s", err.Error())
+	}
+
+	if err := validateAuthUsers(a.AuthUsers); err != nil {
+		return err
+	}
+
+	if err := validateTOTPSecrets(a.AuthTOTPSecrets, a.site.AuthSessionLifetime); err != nil {
+		return err
+	}
+	if len(a.AuthTOTPSecrets) > 0 && !a.HasOwnAuth() {
+		return errors.New("AuthTOTPSecrets are for the album's own logins, add them to the site for the site's logins")
+	}
+
+	if err := validatePassHash(a.AuthUser, a.AuthPass, a.AuthPassHash); err != nil {
+		return err
+	}
+
+	if err := a.validateAccessKeys(); err != nil {
+		return err
+	}
+
+	if err := a.validateShareTemplates(); err != nil {
+		return err
+	}
+
+	if err := a.validateKiosk(); err != nil {
+		return err
+	}
+
+	if err := a.validateEmbed(); err != nil {
+		return err
+	}
+
+	if err := validateLanguage(a.Language); err != nil {
+		return err
+	}
+
+	if err := validateTheme(a.Theme); err != nil {
+		return err
+	}
+
+	if err := a.validateStripExif(); err != nil {
+		return err
+	}
+
+	if a.CoverMode != "" && a.CoverMode != COVER_MODE_RANDOM {
+		return fmt.Errorf("CoverMode must be %s, or skipped to use the first photo", COVER_MODE_RANDOM)
+	}
+
+	if a.CoverRotation < 0 {
+		return errors.New("CoverRotation can't be negative, use 0 to turn cover rotation off")
+	}
+
+	if a.IndexThumbnails < 0 {
+		return errors.New("IndexThumbnails can't be negative, use 0 to show the site's number of thumbnails")
+	}
+
+	if a.IndexMinPhotos < 0 {
+		return errors.New("IndexMinPhotos can't be negative, use 0 to go by the site's IndexMinPhotos")
+	}
+
+	if a.PageSize < 0 {
+		return errors.New("PageSize can't be negative, use 0 to go by the site's PageSize")
+	}
+
+	if a.ZipDownloadMaxMB < 0 {
+		return errors.New("ZipDownloadMaxMB can't be negative, use 0 for no limit")
+	}
+
+	if a.PrebuildZips && !a.AllowZipDownload && !a.AllowWebZipDownload {
+		return errors.New("PrebuildZips needs AllowZipDownload or AllowWebZipDownload on")
+	}
+
+	if err := validateImageUrlLifetime(a.ImageUrlLifetime); err != nil {
+		return err
+	}
+
+	if a.WatermarkOpacity < 0 || a.WatermarkOpacity > 100 {
+		return errors.New("WatermarkOpacity must be between 0 and 100")
+	}
+
+	if err := validateExcludePatterns(a.Exclude); err != nil {
+		return err
+	}
 	return nil
 }
 
+//the album's ImageUrlLifetime, or the site's, 0 when neither has one
+func (a *Album) getImageUrlLifetime() time.Duration {
+	if a.ImageUrlLifetime > 0 {
+		return a.ImageUrlLifetime
+	}
+	return a.site.ImageUrlLifetime
+}
+
+//how long the album's photo URLs work, see SIGNED_URL_PATH
+func (a *Album) GetImageUrlExpiry() time.Duration {
+	if lifetime := a.getImageUrlLifetime(); lifetime > 0 {
+		return lifetime
+	}
+	return a.site.GetSignedUrlExpiry()
+}
+
+func (a *Album) HasWatermark() bool {
+	return a.WatermarkText != "" || a.WatermarkImage != ""
+}
+
+func (a *Album) GetWatermark() *Watermark {
+	if !a.HasWatermark() {
+		return nil
+	}
+
+	return &Watermark{
+		Text:     a.WatermarkText,
+		ImageKey: a.WatermarkImage,
+		Opacity:  a.WatermarkOpacity,
+	}
+}
+
 func (a *Album) Canonicalize() {
 	if a.Path[len(a.Path)-1] != '/' {
 		a.Path = a.Path + "/"
 	}
+	a.RenderableExtensions = canonicalizeExtensions(a.RenderableExtensions)
+	a.OIDCEmailDomains = canonicalizeEmailDomains(a.OIDCEmailDomains)
 }
 
 func (a *Album) HasOwnAuth() bool {
-	return a.AuthUser != "" && a.AuthPass != ""
+	return (a.AuthUser != "" && (a.AuthPass != "" || a.AuthPassHash != "")) || len(a.AuthUsers) > 0 || a.AuthFile != "" ||
+		len(a.OIDCEmailDomains) > 0 || len(a.OIDCGroups) > 0
 }
 
 // An album inherits it's sites auth settings if the album config doesn't override them. If both the site and album have
@@ -133,26 +508,113 @@ func (a *Album) HasAuth() bool {
 	return a.site.HasAuth() || a.HasOwnAuth()
 }
 
-func (a *Album) GetAuthUser() string {
-	if a.AuthUser != "" {
-		return a.AuthUser
+func (a *Album) CheckCredentials(user string, pass string) bool {
+	if a.HasOwnAuth() {
+		pass, codeOk := checkTOTPCode(a.getTOTPSecret(user), pass, time.Now())
+		passOk := checkCredentials(user, pass, a.AuthUser, a.AuthPass) || checkHashedCredentials(user, pass, a.AuthUser, a.AuthPassHash) ||
+			checkCredentialsList(user, pass, a.AuthUsers) ||
+			(a.authFile != nil && a.authFile.CheckCredentials(user, pass))
+		return codeOk && passOk
 	} else {
-		return a.site.AuthUser
+		return a.site.CheckCredentials(user, pass)
+	}
+}
+
+//whether the cover is picked at random, an explicit cover in ordering.yaml wins over the album's CoverMode
+func (a *Album) HasRandomCover(albumOrderingConfig AlbumOrderingConfig) bool {
+	if albumOrderingConfig.Cover != "" {
+		return false
 	}
+	return albumOrderingConfig.RandomCover || a.CoverMode == COVER_MODE_RANDOM
 }
 
-func (a *Album) GetAuthPass() string {
-	if a.AuthPass != "" {
-		return a.AuthPass
+//how many thumbnails the album gets in the index
+func (a *Album) GetNumIndexThumbnails() int {
+	if a.IndexThumbnails > 0 {
+		return a.IndexThumbnails
 	} else {
-		return a.site.AuthPass
+		return a.site.IndexThumbnails
 	}
 }
 
+func (a *Album) GetIndexMinPhotos() int {
+	if a.IndexMinPhotos > 0 {
+		return a.IndexMinPhotos
+	}
+	return a.site.IndexMinPhotos
+}
+
+//whether the album has the photos it needs to be listed in the index. An album whose photos can't be listed
+//right now keeps its place, like it kept its cover.
+func (a *Album) HasIndexMinPhotos() bool {
+	min := a.GetIndexMinPhotos()
+	if min == 0 {
+		return true
+	}
+	orderingKeys, err := a.getVisibleOrderedKeys()
+	return err != nil || len(orderingKeys.Ordering) >= min
+}
+
+// albums can narrow down or widen the site's list of renderable extensions, otherwise the site list is used
+func (a *Album) GetRenderableExtensions() []string {
+	if len(a.RenderableExtensions) > 0 {
+		return a.RenderableExtensions
+	} else {
+		return a.site.RenderableExtensions
+	}
+}
+
+func (a *Album) IsRenderableKey(key string) bool {
+	//browsers can't show HEIC, it's only renderable when the resizing service turns it in to JPEG for us
+	if isHeicKey(key) {
+		return a.site.TranscodesHeic()
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(key), "."))
+	for _, v := range a.GetRenderableExtensions() {
+		if v == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func validateExcludePatterns(patterns []string) error {
+	for _, v := range patterns {
+		if _, err := path.Match(v, ""); err != nil {
+			return fmt.Errorf("Exclude pattern '%s' is not a valid glob", v)
+		}
+	}
+	return nil
+}
+
+// Keys are matched relative to the album prefix. Patterns ending in a slash exclude everything under that
+// sub-prefix (`private/`), patterns without any slash are matched against the file name as well, so
+// `*.xmp` catches sidecars in sub-prefixes too.
+func (a *Album) IsExcludedKey(key string, patterns []string) bool {
+	relativeKey := a.RelativeOrderingKey(key)
+	for _, v := range patterns {
+		if strings.HasSuffix(v, "/") {
+			if strings.HasPrefix(relativeKey, v) {
+				return true
+			}
+			continue
+		}
+
+		if ok, _ := path.Match(v, relativeKey); ok {
+			return true
+		}
+		if !strings.Contains(v, "/") {
+			if ok, _ := path.Match(v, path.Base(relativeKey)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (a *Album) GetCanonicalUrl() *url.URL {
-	u := a.site.GetCanonicalUrl()
-	u.Path = a.Path
-	return u
+	return a.site.GetUrlForPath(a.Path)
 }
 
 func mergeList(bucketKeys []string, configKeys []string, album_name string) []string {
@@ -200,6 +662,33 @@ func (a *Album) GetCoverPhotoForTemplate() Renderable {
 	return cover
 }
 
+// The cover shown on the site index. With CoverRotation set this is one of the album's first CoverRotation
+// photos, changing once a day. Every album starts at a different offset so they don't all change in step.
+func (a *Album) GetIndexCoverPhotoForTemplate() Renderable {
+	albumOrdering, _ := a.GetOrderedPhotos()
+	if a.CoverRotation <= 1 || len(albumOrdering.Ordering) == 0 {
+		return albumOrdering.Cover
+	}
+
+	var candidates []Renderable
+	for _, v := range albumOrdering.Ordering {
+		if !v.Details().hasPrivatePeople && !a.isBrokenCover(a.BucketPrefix+v.Slug()) {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return albumOrdering.Cover
+	}
+	if len(candidates) > a.CoverRotation {
+		candidates = candidates[:a.CoverRotation]
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(a.Path))
+	day := time.Now().UTC().Unix() / int64(24*time.Hour/time.Second)
+	return candidates[(uint64(day)+uint64(hash.Sum32()))%uint64(len(candidates))]
+}
+
 func (a *Album) GetThumbnailPhotosForTemplate() []Renderable {
 	albumOrdering, _ := a.GetOrderedPhotos()
 	return albumOrdering.Thumbnails
@@ -207,43 +696,61 @@ func (a *Album) GetThumbnailPhotosForTemplate() []Renderable {
 
 //lowest level, gets the list of objects in the bucket and prefix that
 //corresponds to the album it is acting on, it's an object with multiple
-//fields.
+//fields. S3 lists 1000 objects at a time, so bigger albums take more than one page.
 func (a *Album) GetAllObjects() ([]*s3.Object, error) {
 	svc, err := a.site.GetS3Service()
 	if err != nil {
 		return nil, err
 	}
 
-	objects, err := svc.ListObjects(&s3.ListObjectsInput{
+	var objects []*s3.Object
+	err = svc.ListObjectsPages(&s3.ListObjectsInput{
 		Bucket:    aws.String(a.site.BucketName),
 		Prefix:    aws.String(a.BucketPrefix),
 		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
 	})
 	if err != nil {
 		return nil, err
 	}
-	return objects.Contents, nil
+	return objects, nil
 }
 
 //wrapper around the lowest level method to extract out the fields of relevance, namely
 //the key of an object, also drops prefixes (i.e: the folder path) from that output.
 func (a *Album) GetAllObjectKeysFromBucket() ([]string, error) {
+	keys, _, _, err := a.getAllObjectKeysAndMetadataFromBucket()
+	return keys, err
+}
+
+//same as GetAllObjectKeysFromBucket, along with when each key was last modified and its size
+func (a *Album) getAllObjectKeysAndMetadataFromBucket() ([]string, map[string]time.Time, map[string]int64, error) {
 	objects, err := a.GetAllObjects()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	var imageKeys []string
+	dates := make(map[string]time.Time)
+	sizes := make(map[string]int64)
 	for _, obj := range objects {
 		key := *obj.Key
 		if key[len(key)-1] != '/' {
 			//check for 'folder' name vs actual object - objects end without trailing /
 			imageKeys = append(imageKeys, key)
+			if obj.LastModified != nil {
+				dates[key] = *obj.LastModified
+			}
+			if obj.Size != nil {
+				sizes[key] = *obj.Size
+			}
 		}
 	}
 
 	natsort.Strings(imageKeys)
-	return imageKeys, nil
+	return imageKeys, dates, sizes, nil
 }
 
 //highest level, acts on an album to return processed renderable imageurls, here we must also
@@ -253,34 +760,141 @@ func (a *Album) GetOrderedPhotos() (AlbumOrdering, error) {
 	//TODO cache this, probably in config.
 	var albumOrdering AlbumOrdering
 
-	//pick up our configuration, note that this may be all empties if there's an err in retrieval/parsing.
-	albumOrderingConfig, err := a.GetAlbumOrderingConfig()
-
+	orderingKeys, err := a.getVisibleOrderedKeys()
 	if err != nil {
-		if aerr, ok := err.(awserr.RequestFailure); ok {
-			if aerr.StatusCode() != 404 {
-				//regular 404's add too much noise, we shouldn't say anything. Other errors should be displayed.
-				fmt.Printf("\nUnable to pick up album ordering for album %s from S3, Error: %s", a.Path, err.Error())
-			}
-		}
+		//note albumOrdering would be empty, error checking matters!
+		return albumOrdering, err
 	}
 
+	albumOrdering.Cover = a.getPhotoForKey(orderingKeys.Cover, orderingKeys.photoDetails)
+	for _, v := range orderingKeys.Thumbnails {
+		albumOrdering.Thumbnails = append(albumOrdering.Thumbnails, a.getPhotoForKey(v, orderingKeys.photoDetails))
+	}
+	for _, v := range orderingKeys.Ordering {
+		albumOrdering.Ordering = append(albumOrdering.Ordering, a.getPhotoForKey(v, orderingKeys.photoDetails))
+	}
+
+	return albumOrdering, nil
+}
+
+//merges an ordering configuration with the keys actually in the bucket, giving the keys of the cover,
+//thumbnails and ordering. This is separate from GetOrderedPhotos so that configurations that haven't
+//been written yet (like the admin's proposed orderings) can be merged the same way.
+func (a *Album) GetOrderedKeys(albumOrderingConfig AlbumOrderingConfig) (AlbumOrderingKeys, error) {
+	var orderingKeys AlbumOrderingKeys
+
 	// pick up the raw keys, ready for comparison to our configuration
-	imageKeys, err := a.GetAllObjectKeys()
+	allKeys, err := a.GetAllObjectKeys()
 
 	if err != nil {
 		fmt.Printf("\nUnable to get object keys from S3 for album %s. Error: %s", a.Path, err.Error())
-		//note albumOrdering would be empty, error checking matters!
-		return albumOrdering, err
+		return orderingKeys, err
+	}
+
+	return a.mergeOrderedKeys(albumOrderingConfig, allKeys)
+}
+
+//GetOrderedKeys for keys that aren't (or are no longer) the ones in the bucket, like what was published
+func (a *Album) mergeOrderedKeys(albumOrderingConfig AlbumOrderingConfig, allKeys []string) (AlbumOrderingKeys, error) {
+	var orderingKeys AlbumOrderingKeys
+
+	//excluded keys are gone before anything else looks at them, they're never even offered as siblings
+	excludePatterns := append(append([]string{}, a.Exclude...), albumOrderingConfig.Exclude...)
+	var imageKeys []string
+	for _, v := range allKeys {
+		if !a.IsExcludedKey(v, excludePatterns) {
+			imageKeys = append(imageKeys, v)
+		}
+	}
+
+	//alternative encodings of a photo (photo.webp next to photo.jpg) are offered through the photo itself,
+	//they don't get an entry of their own in the album.
+	photoDetails, siblingKeys := a.findFormatSiblings(imageKeys)
+
+	//details from ordering.yaml, like titles and captions, travel with the photos
+	for k, v := range albumOrderingConfig.Entries {
+		details, ok := photoDetails[k]
+		if !ok {
+			details = &PhotoDetails{}
+			photoDetails[k] = details
+		}
+		details.Title = v.Title
+		details.Caption = v.Caption
+		details.Alt = v.Alt
+		details.People = v.People
+		details.Tags = normalizeTags(v.Tags)
+	}
+
+	if a.ReadsExif() {
+		for _, v := range imageKeys {
+			cached := a.GetCachedExif(v)
+			if cached == nil {
+				continue
+			}
+
+			//photos read for the map alone are left the way they've always been shown
+			exif := *cached
+			if !a.site.FixOrientation {
+				exif.Orientation = 0
+			}
+			if !a.site.DetectPanoramas {
+				exif.Projection = ""
+				exif.Width = 0
+				exif.Height = 0
+			}
+
+			details, ok := photoDetails[strings.TrimLeft(v, "/")]
+			if !ok {
+				details = &PhotoDetails{}
+				photoDetails[strings.TrimLeft(v, "/")] = details
+			}
+			details.Exif = &exif
+		}
+	}
+
+	if a.site.PlaceholderColors {
+		for _, v := range imageKeys {
+			key := strings.TrimLeft(v, "/")
+			analysis, ok := a.GetCachedImageAnalysis(key)
+			if !ok {
+				continue
+			}
+
+			details, ok := photoDetails[key]
+			if !ok {
+				details = &PhotoDetails{}
+				photoDetails[key] = details
+			}
+			details.DominantColor = analysis.DominantColor
+		}
+	}
+
+	//animations can't be watermarked (or have their metadata stripped), so those albums keep them flattened by the
+	//resizing service
+	if a.site.AnimatedImages != "" && a.GetWatermark() == nil && !a.StripExif {
+		for _, v := range imageKeys {
+			if !a.IsCachedAnimation(v) {
+				continue
+			}
+
+			key := strings.TrimLeft(v, "/")
+			details, ok := photoDetails[key]
+			if !ok {
+				details = &PhotoDetails{}
+				photoDetails[key] = details
+			}
+			details.IsAnimated = true
+			if a.site.AnimatedImages == ANIMATED_IMAGES_POSTER {
+				details.AnimationUrl = a.site.GetS3Photo(v, &PhotoDetails{UrlLifetime: a.getImageUrlLifetime()}).GetPhotoForWidth(0)
+			}
+		}
 	}
 
 	var cleanImageKeys []string
-	//clean out the keys, we don't want the yaml interfering with the yaml :P
+	//clean out the keys, only things we can render make it in to the album. This also keeps
+	//the yaml (and any stray .txt, .DS_Store or RAW files) from interfering with the album.
 	for _, v := range imageKeys {
-		if strings.HasSuffix(v, ORDERING_YAML_NAME) {
-			//for now, just do nothing, we simply want to avoid appending,
-			//when we agree on a list of valid formats, we can ditch this check.
-		} else {
+		if a.IsRenderableKey(v) && !siblingKeys[v] {
 			cleanImageKeys = append(cleanImageKeys, v)
 		}
 	}
@@ -296,6 +910,7 @@ func (a *Album) GetOrderedPhotos() (AlbumOrdering, error) {
 
 	//let's start with the cover photo, there's only one, this should be easy.
 
+	var coverKey string
 	if albumOrderingConfig.Cover != "" {
 
 		// not the most efficient way of checking for existence, but it's one-off so not worth
@@ -309,49 +924,163 @@ func (a *Album) GetOrderedPhotos() (AlbumOrdering, error) {
 		}
 
 		if coverKeyInBucket {
-			albumOrdering.Cover = a.site.GetPhotoForKey(albumOrderingConfig.Cover)
+			coverKey = albumOrderingConfig.Cover
 		} else {
 			fmt.Printf("\ncover photo specified in ordering file not found in bucket, check %s exists. "+
 				"Falling back to first photo", albumOrderingConfig.Cover)
 			if len(cleanImageKeys) > 0 {
-				albumOrdering.Cover = a.site.GetPhotoForKey(cleanImageKeys[0])
-			} else {
-				albumOrdering.Cover = a.site.GetPhotoForKey("")
+				coverKey = cleanImageKeys[0]
 			}
 		}
+	} else if a.HasRandomCover(albumOrderingConfig) {
+		if len(cleanImageKeys) > 0 {
+			//seeded by the last refresh, so the cover stays put between refreshes rather than every page view
+			random := rand.New(rand.NewSource(a.LastKeyCacheUpdate.UnixNano()))
+			coverKey = cleanImageKeys[random.Intn(len(cleanImageKeys))]
+		}
 	} else {
 		if len(cleanImageKeys) > 0 {
-			albumOrdering.Cover = a.site.GetPhotoForKey(cleanImageKeys[0])
-		} else {
-			albumOrdering.Cover = a.site.GetPhotoForKey("")
+			coverKey = cleanImageKeys[0]
 		}
 	}
+	orderingKeys.Cover = coverKey
 
 	//thumbnails - there is a bit of duplicate code here, but it was clearer to do it
 	//this way rather than to reduce code and be opaque
 	var thumbKeys []string
 	if len(albumOrderingConfig.Thumbnails) > 0 {
 		thumbKeys = mergeList(cleanImageKeys, albumOrderingConfig.Thumbnails, a.Path)
-		numUsableThumbKeys := int(math.Min(5, float64(len(thumbKeys))))
+		numUsableThumbKeys := int(math.Min(float64(a.GetNumIndexThumbnails()), float64(len(thumbKeys))))
 		thumbKeys = thumbKeys[0:numUsableThumbKeys]
 	} else {
-		//take care of the offset here (i.e: cover is index 0 if we're not using the config)
-		numUsableThumbKeys := int(math.Min(5, float64(len(cleanImageKeys))))
-		thumbKeys = make([]string, numUsableThumbKeys)
-		copy(thumbKeys, cleanImageKeys[1:numUsableThumbKeys])
+		//nothing's been curated, so pick thumbnails spread evenly through the album (beginning, middle
+		//and end) for a more representative preview. The cover is left out so it doesn't show up twice.
+		var candidateKeys []string
+		for _, v := range cleanImageKeys {
+			if strings.TrimLeft(v, "/") != strings.TrimLeft(coverKey, "/") {
+				candidateKeys = append(candidateKeys, v)
+			}
+		}
+		thumbKeys = spreadSample(candidateKeys, a.GetNumIndexThumbnails())
 	}
 
-	for _, v := range thumbKeys {
-		albumOrdering.Thumbnails = append(albumOrdering.Thumbnails, a.site.GetPhotoForKey(v))
-	}
+	orderingKeys.Thumbnails = thumbKeys
 
 	//the actual album ordering
-	mergedOrdering := mergeList(cleanImageKeys, albumOrderingConfig.Ordering, a.Path)
-	for _, v := range mergedOrdering {
-		albumOrdering.Ordering = append(albumOrdering.Ordering, a.site.GetPhotoForKey(v))
+	orderingKeys.Ordering = mergeList(cleanImageKeys, albumOrderingConfig.Ordering, a.Path)
+	if a.site.PageBudgetKB > 0 {
+		a.applyPageBudget(orderingKeys.Ordering, photoDetails)
+	}
+	if a.CollapseBursts {
+		a.applyBursts(orderingKeys.Ordering, photoDetails)
 	}
+	orderingKeys.photoDetails = photoDetails
 
-	return albumOrdering, nil
+	return orderingKeys, nil
+}
+
+//picks n keys spread evenly from the first to the last one, keeping their order.
+func spreadSample(keys []string, n int) []string {
+	if len(keys) <= n {
+		return keys
+	}
+	if n == 1 {
+		return []string{keys[len(keys)/2]}
+	}
+
+	sampled := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		sampled = append(sampled, keys[i*(len(keys)-1)/(n-1)])
+	}
+	return sampled
+}
+
+//photos share the details gathered for their key, keys we know nothing about just get empty ones.
+func (a *Album) getPhotoForKey(key string, photoDetails map[string]*PhotoDetails) Renderable {
+	details, ok := photoDetails[strings.TrimLeft(key, "/")]
+	if !ok {
+		details = &PhotoDetails{}
+	}
+	details.Watermark = a.GetWatermark()
+	details.StripExif = a.StripExif
+	details.UrlLifetime = a.getImageUrlLifetime()
+	if details.IsAnimated && a.site.AnimatedImages == ANIMATED_IMAGES_PASSTHROUGH {
+		//straight from the bucket, so the resizing service never gets to flatten it
+		return a.proxyPhoto(a.site.GetS3Photo(key, details))
+	}
+	return a.proxyPhoto(a.site.GetPhotoForKeyWithDetails(key, details))
+}
+
+//use this rather than Site.GetPhotoForKey for anything that belongs to the album, so album wide settings
+//(like the watermark) are applied.
+func (a *Album) GetPhotoForKey(key string) Renderable {
+	return a.getPhotoForKey(key, nil)
+}
+
+//looks for .webp/.avif uploads that share their name with a renderable photo (photo.webp + photo.jpg).
+//returns the details (with siblings filled in) for every photo that has siblings, and the set of
+//sibling keys so they can be left out of the album. A HEIC photo uploaded along with a JPEG of itself is
+//left out as well, the JPEG doesn't need transcoding. The video half of a Live Photo (IMG_1234.mov next
+//to IMG_1234.jpg) becomes the photo's motion.
+func (a *Album) findFormatSiblings(keys []string) (map[string]*PhotoDetails, map[string]bool) {
+	keysByName := make(map[string][]string)
+	for _, v := range keys {
+		name := strings.TrimSuffix(v, path.Ext(v))
+		keysByName[name] = append(keysByName[name], v)
+	}
+
+	photoDetails := make(map[string]*PhotoDetails)
+	siblingKeys := make(map[string]bool)
+	for _, group := range keysByName {
+		if len(group) < 2 {
+			continue
+		}
+
+		var primaryKey string
+		var motionKey string
+		var heicKeys []string
+		siblings := make(map[string]string)
+		for _, v := range group {
+			ext := strings.ToLower(strings.TrimPrefix(path.Ext(v), "."))
+			if stringInSlice(ext, MODERN_FORMATS) {
+				siblings[ext] = v
+			} else if isMotionKey(v) {
+				motionKey = v
+			} else if isHeicKey(v) {
+				heicKeys = append(heicKeys, v)
+			} else if primaryKey == "" && a.IsRenderableKey(v) {
+				primaryKey = v
+			}
+		}
+
+		if primaryKey == "" && len(heicKeys) > 0 && a.IsRenderableKey(heicKeys[0]) {
+			primaryKey = heicKeys[0]
+		}
+		for _, v := range heicKeys {
+			if v != primaryKey && primaryKey != "" {
+				siblingKeys[v] = true
+			}
+		}
+
+		if primaryKey == "" || (len(siblings) == 0 && motionKey == "") {
+			continue
+		}
+
+		details := &PhotoDetails{}
+		if len(siblings) > 0 {
+			details.Siblings = siblings
+		}
+		//the video can't be watermarked or stripped of its location, those albums only show the still
+		if motionKey != "" && a.GetWatermark() == nil && !a.StripExif {
+			details.MotionUrl = a.site.GetS3Photo(motionKey, &PhotoDetails{UrlLifetime: a.getImageUrlLifetime()}).GetPhotoForWidth(0)
+			siblingKeys[motionKey] = true
+		}
+		photoDetails[strings.TrimLeft(primaryKey, "/")] = details
+		for _, v := range siblings {
+			siblingKeys[v] = true
+		}
+	}
+	return photoDetails, siblingKeys
 }
 
 //wrapper around GetAllObjectKeysFromBucket to add in a caching layer, nothing below
@@ -368,22 +1097,14 @@ func (a *Album) GetAllObjectKeys() ([]string, error) {
 
 			a.KeyCacheUpdateMutex.Lock()
 			if a.NeedsKeyCacheUpdate() {
-				keys, err = a.GetAllObjectKeysFromBucket()
-				if err == nil {
-					a.KeyCache.Store(keys)
-					a.LastKeyCacheUpdate = time.Now()
-				}
+				a.updateKeyCache()
 			}
 
 			a.KeyCacheUpdateMutex.Unlock()
 		} else {
 			a.KeyCacheUpdateMutex.Lock()
 
-			keys, err = a.GetAllObjectKeysFromBucket()
-			if err == nil {
-				a.KeyCache.Store(keys)
-				a.LastKeyCacheUpdate = time.Now()
-			}
+			keys, err = a.updateKeyCache()
 			c <- &GetFromKeyCacheResult{keys, err}
 
 			a.KeyCacheUpdateMutex.Unlock()
@@ -407,17 +1128,8 @@ func (a *Album) GetAllObjectKeys() ([]string, error) {
 // cost of hiding a bit of reality)
 func (a *Album) GetAlbumOrderingConfigFromS3AndPreprocess() (AlbumOrderingConfig, error) {
 	var albumOrdering AlbumOrderingConfig
-	svc, err := a.site.GetS3Service()
-	if err != nil {
-		return albumOrdering, err
-	}
-
-	orderingYAMLKey := strings.Join([]string{a.BucketPrefix, ORDERING_YAML_NAME}, "")
-	yaml_object, err := svc.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(a.site.BucketName),
-		Key:    aws.String(orderingYAMLKey),
-	})
 
+	data_bytes, err := a.GetObjectFromBucket(ORDERING_YAML_NAME)
 	if err != nil {
 		if aerr, ok := err.(awserr.RequestFailure); ok {
 			if aerr.StatusCode() == 404 {
@@ -429,10 +1141,13 @@ func (a *Album) GetAlbumOrderingConfigFromS3AndPreprocess() (AlbumOrderingConfig
 		return albumOrdering, err
 	}
 
-	//extract the contents from what we read so we can then parse the yaml
-	data_bytes, err := ioutil.ReadAll(yaml_object.Body)
-	//data_string := string(data_bytes)
-	err = yaml.Unmarshal(data_bytes, &albumOrdering)
+	return a.ParseAlbumOrderingConfig(data_bytes)
+}
+
+//parses and preprocesses (see GetAlbumOrderingConfigFromS3AndPreprocess) the contents of an ordering.yaml
+func (a *Album) ParseAlbumOrderingConfig(data_bytes []byte) (AlbumOrderingConfig, error) {
+	var albumOrdering AlbumOrderingConfig
+	err := yaml.Unmarshal(data_bytes, &albumOrdering)
 
 	if err != nil {
 		//we were unable to read what the yaml was, it's likely malformed, and that may not change
@@ -443,6 +1158,12 @@ func (a *Album) GetAlbumOrderingConfigFromS3AndPreprocess() (AlbumOrderingConfig
 		return albumOrdering, err
 	}
 
+	if err := validateExcludePatterns(albumOrdering.Exclude); err != nil {
+		fmt.Printf("\nCould not parse yaml for album %s. error: %s", a.Path, err)
+		albumOrdering.negativeCacheThis = true
+		return albumOrdering, err
+	}
+
 	//we want to prepend the album path to every supported key, this is simply for later consistency.
 	if albumOrdering.Cover != "" {
 		parsedAlbumPrefix, _ := url.Parse(a.BucketPrefix)
@@ -474,9 +1195,211 @@ func (a *Album) GetAlbumOrderingConfigFromS3AndPreprocess() (AlbumOrderingConfig
 		}
 	}
 
+	//the details need to be found by the same keys as everything else
+	entries := make(map[string]OrderingEntry)
+	for k, v := range albumOrdering.Entries {
+		parsedAlbumPrefix, _ := url.Parse(a.BucketPrefix)
+		parsedKey, _ := url.Parse(k)
+
+		v.Key = strings.TrimLeft(parsedAlbumPrefix.ResolveReference(parsedKey).String(), "/")
+		entries[v.Key] = v
+	}
+	albumOrdering.Entries = entries
+
 	return albumOrdering, nil
 }
 
+//reads an object relative to the album's prefix
+func (a *Album) GetObjectFromBucket(name string) ([]byte, error) {
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(a.site.BucketName),
+		Key:    aws.String(a.BucketPrefix + name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	return ioutil.ReadAll(object.Body)
+}
+
+//errors for locked albums, for anything that would write to the album's prefix
+func (a *Album) checkNotLocked() error {
+	if a.Locked {
+		return fmt.Errorf("Album %s is locked, it can't be changed through 50mm", a.Path)
+	}
+	return nil
+}
+
+//writes an object relative to the album's prefix
+func (a *Album) PutObjectInBucket(name string, data []byte, contentType string) error {
+	if err := a.checkNotLocked(); err != nil {
+		return err
+	}
+
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return err
+	}
+	if err := a.checkNotHeld(svc, name); err != nil {
+		return err
+	}
+
+	checksums := checksumBytes(data)
+	output, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(a.site.BucketName),
+		Key:         aws.String(a.BucketPrefix + name),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+		ContentMD5:  aws.String(checksums.Md5Base64()),
+		Metadata: map[string]*string{
+			UPLOAD_CHECKSUM_METADATA: aws.String(checksums.Sha256),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	//S3 has checked the data against ContentMD5 already, this catches S3 compatible stores that don't
+	etag := strings.Trim(aws.StringValue(output.ETag), `"`)
+	if aws.StringValue(output.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms && etag != checksums.Etag {
+		return fmt.Errorf("%s was stored with ETag %s rather than %s", name, etag, checksums.Etag)
+	}
+	return nil
+}
+
+//ordering.yaml refers to photos relative to the album's prefix, this undoes the preprocessing.
+func (a *Album) RelativeOrderingKey(key string) string {
+	return strings.TrimPrefix(strings.TrimLeft(key, "/"), strings.TrimLeft(a.BucketPrefix, "/"))
+}
+
+//turns a (preprocessed) ordering configuration back in to the yaml we'd expect to find in the bucket.
+func (a *Album) MarshalAlbumOrderingConfig(albumOrdering AlbumOrderingConfig) ([]byte, error) {
+	var raw struct {
+		Cover      *OrderingEntry           `yaml:"cover,omitempty"`
+		Thumbnails []OrderingEntry          `yaml:"thumbnails,omitempty"`
+		Ordering   []OrderingEntry          `yaml:"ordering,omitempty"`
+		Photos     []OrderingEntry          `yaml:"photos,omitempty"`
+		Exclude    []string                 `yaml:"exclude,omitempty"`
+		People     map[string]PersonConsent `yaml:"people,omitempty"`
+	}
+	raw.Exclude = albumOrdering.Exclude
+	raw.People = albumOrdering.People
+
+	written := make(map[string]bool)
+	entryForKey := func(key string) OrderingEntry {
+		entry, ok := albumOrdering.Entries[key]
+		if !ok {
+			entry = OrderingEntry{}
+		}
+		entry.Key = a.RelativeOrderingKey(key)
+		written[key] = true
+		return entry
+	}
+
+	if albumOrdering.Cover != "" {
+		cover := entryForKey(albumOrdering.Cover)
+		raw.Cover = &cover
+	} else if albumOrdering.RandomCover {
+		raw.Cover = &OrderingEntry{Key: COVER_MODE_RANDOM}
+	}
+	for _, v := range albumOrdering.Thumbnails {
+		raw.Thumbnails = append(raw.Thumbnails, entryForKey(v))
+	}
+	for _, v := range albumOrdering.Ordering {
+		raw.Ordering = append(raw.Ordering, entryForKey(v))
+	}
+
+	//details of photos that aren't mentioned anywhere else go in to their own section, sorted so the
+	//file doesn't change from one write to the next.
+	var remaining []string
+	for k, v := range albumOrdering.Entries {
+		if !written[k] && v.HasDetails() {
+			remaining = append(remaining, k)
+		}
+	}
+	sort.Strings(remaining)
+	for _, v := range remaining {
+		raw.Photos = append(raw.Photos, entryForKey(v))
+	}
+
+	return yaml.Marshal(&raw)
+}
+
+//Replaces ordering.yaml, keeping what was there before as ordering.yaml.previous for rollbacks. To avoid
+//overwriting changes somebody else made in the meantime, expectedHash has to match the hash (see
+//HashOrderingYAML) of what's currently in the bucket. The ordering cache is refreshed afterwards.
+func (a *Album) WriteOrderingYAML(data []byte, expectedHash string) error {
+	if _, err := a.ParseAlbumOrderingConfig(data); err != nil {
+		return err
+	}
+
+	current, err := a.GetObjectFromBucket(ORDERING_YAML_NAME)
+	if err != nil && !isNotFoundError(err) {
+		return err
+	}
+
+	if HashOrderingYAML(current) != expectedHash {
+		return errors.New("The ordering was changed by somebody else in the meantime, please start over.")
+	}
+
+	if current != nil {
+		if err := a.PutObjectInBucket(ORDERING_YAML_PREVIOUS_NAME, current, ORDERING_YAML_CONTENT_TYPE); err != nil {
+			return err
+		}
+	}
+
+	if err := a.PutObjectInBucket(ORDERING_YAML_NAME, data, ORDERING_YAML_CONTENT_TYPE); err != nil {
+		return err
+	}
+
+	a.RefreshOrderingCache()
+	return nil
+}
+
+//swaps ordering.yaml and ordering.yaml.previous, so a rollback can be rolled back as well.
+func (a *Album) RollbackOrderingYAML() error {
+	previous, err := a.GetObjectFromBucket(ORDERING_YAML_PREVIOUS_NAME)
+	if err != nil {
+		if isNotFoundError(err) {
+			return errors.New("There is no previous ordering to roll back to.")
+		}
+		return err
+	}
+
+	current, err := a.GetObjectFromBucket(ORDERING_YAML_NAME)
+	if err != nil && !isNotFoundError(err) {
+		return err
+	}
+
+	return a.WriteOrderingYAML(previous, HashOrderingYAML(current))
+}
+
+func HashOrderingYAML(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func isNotFoundError(err error) bool {
+	aerr, ok := err.(awserr.RequestFailure)
+	return ok && aerr.StatusCode() == 404
+}
+
+func (a *Album) RefreshOrderingCache() {
+	a.AlbumAlbumOrderingConfigUpdateMutex.Lock()
+	_, err := a.updateOrderingCache()
+	a.AlbumAlbumOrderingConfigUpdateMutex.Unlock()
+
+	if err == nil && a.HasLiveUpdates() {
+		a.notifyLiveUpdate()
+	}
+}
+
 //note that this also caches negative values, i.e: adding a ordering file may take an hour
 //to be rechecked.
 func (a *Album) GetAlbumOrderingConfig() (AlbumOrderingConfig, error) {
@@ -487,28 +1410,12 @@ func (a *Album) GetAlbumOrderingConfig() (AlbumOrderingConfig, error) {
 
 			a.AlbumAlbumOrderingConfigUpdateMutex.Lock()
 			if a.NeedsOrderingCacheUpdate() {
-
-				albumOrdering, err := a.GetAlbumOrderingConfigFromS3AndPreprocess()
-				if err == nil || albumOrdering.negativeCacheThis {
-					// whether the item is valid or we should be negatively
-					// caching this result (probs err!=nil, but the value
-					// should be there and a valid boolean.
-					a.OrderingCache.Store(albumOrdering)
-					a.LastAlbumOrderingConfigCacheUpdate = time.Now()
-				}
-
+				a.updateOrderingCache()
 			}
 			a.AlbumAlbumOrderingConfigUpdateMutex.Unlock()
 		} else {
 			a.AlbumAlbumOrderingConfigUpdateMutex.Lock()
-			albumOrdering, err := a.GetAlbumOrderingConfigFromS3AndPreprocess()
-			if err == nil || albumOrdering.negativeCacheThis {
-				// whether the item is valid or we should be negatively
-				// caching this result (probs err!=nil, but the value
-				// should be there and a valid boolean.
-				a.OrderingCache.Store(albumOrdering)
-				a.LastAlbumOrderingConfigCacheUpdate = time.Now()
-			}
+			albumOrdering, err := a.updateOrderingCache()
 
 			c <- &GetFromOrderingConfigCacheResult{albumOrdering, err}
 
@@ -526,17 +1433,290 @@ func (a *Album) GetAlbumOrderingConfig() (AlbumOrderingConfig, error) {
 	}
 }
 
+//fetches the keys from the bucket and stores them in the cache, callers must hold KeyCacheUpdateMutex.
+func (a *Album) updateKeyCache() ([]string, error) {
+	previousKeys, _ := a.KeyCache.Load().([]string)
+
+	keys, dates, sizes, err := a.getAllObjectKeysAndMetadataFromBucket()
+	if err == nil {
+		a.KeyDatesCache.Store(dates)
+		a.KeySizesCache.Store(sizes)
+		a.KeyCache.Store(keys)
+		a.LastKeyCacheUpdate = time.Now()
+
+		a.loadPersistedCacheOnce()
+
+		if len(addedKeys(previousKeys, keys)) > 0 && a.site.PrewarmImages > 0 {
+			go a.PrewarmCDN()
+		}
+		if a.ReadsExif() {
+			go a.updateExifCache(keys)
+		}
+		if a.site.PlaceholderColors {
+			go a.updateImageAnalysisCache(keys)
+		}
+		if a.site.PageBudgetKB > 0 {
+			go a.updatePhotoSizeCache(keys)
+		}
+		if a.site.AnimatedImages != "" {
+			go a.updateAnimationCache(keys)
+		}
+		if a.PrebuildZips {
+			go a.updatePrebuiltZips()
+		}
+		if len(a.site.Webhooks) > 0 {
+			go a.notifyWebhooks()
+		}
+		go a.updateTakedownsCache()
+	}
+	return keys, err
+}
+
+//a pre-signed link to the original upload of a photo, which browsers download rather than show (or its URL on
+//the site, with ProxyPhotos). Empty unless the album has AllowOriginalDownload on.
+func (a *Album) GetOriginalDownloadUrl(slug string) string {
+	if !a.AllowOriginalDownload {
+		return ""
+	}
+	if a.site.ProxyPhotos {
+		return a.getPhotoProxyUrl(slug) + "?" + url.Values{PHOTO_PROXY_VARIANT_PARAM: {PHOTO_PROXY_VARIANT_DOWNLOAD}}.Encode()
+	}
+	return a.getSignedOriginalDownloadUrl(slug)
+}
+
+func (a *Album) getSignedOriginalDownloadUrl(slug string) string {
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return ""
+	}
+
+	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket:                     aws.String(a.site.BucketName),
+		Key:                        aws.String(a.BucketPrefix + slug),
+		ResponseContentDisposition: aws.String(fmt.Sprintf("attachment; filename=%q", slug)),
+	})
+
+	signedUrl, err := req.Presign(a.GetImageUrlExpiry())
+	if err != nil {
+		fmt.Printf("\nUnable to sign download URL for %s in album %s. Error: %s", slug, a.Path, err.Error())
+		return ""
+	}
+	return signedUrl
+}
+
+func (a *Album) ReadsExif() bool {
+	return a.site.FixOrientation || a.site.DetectPanoramas || a.ShowMap || a.ShowExif || a.CollapseBursts
+}
+
+func (a *Album) GetCachedExif(key string) *ExifData {
+	a.exifCacheMutex.RLock()
+	defer a.exifCacheMutex.RUnlock()
+	return a.exifCache[key]
+}
+
+//Reads the EXIF data of photos we haven't seen yet, and forgets photos that were removed. Only the start
+//of every photo is downloaded, and only once, so this is cheap after the first run. Until a photo's EXIF
+//data is read, it's shown as if it had none.
+func (a *Album) updateExifCache(keys []string) {
+	if !atomic.CompareAndSwapInt32(&a.exifCacheUpdating, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&a.exifCacheUpdating, 0)
+
+	current := make(map[string]bool)
+	var missing []string
+	for _, v := range keys {
+		current[v] = true
+
+		ext := strings.ToLower(path.Ext(v))
+		if (ext == ".jpg" || ext == ".jpeg") && a.GetCachedExif(v) == nil {
+			missing = append(missing, v)
+		}
+	}
+
+	a.exifCacheMutex.Lock()
+	if a.exifCache == nil {
+		a.exifCache = make(map[string]*ExifData)
+	}
+	for k := range a.exifCache {
+		if !current[k] {
+			delete(a.exifCache, k)
+		}
+	}
+	a.exifCacheMutex.Unlock()
+
+	for _, v := range missing {
+		data, err := a.getObjectStart(v, EXIF_READ_BYTES)
+		if err != nil {
+			fmt.Printf("\nUnable to read EXIF data of %s in album %s. Error: %s", v, a.Path, err.Error())
+			continue
+		}
+
+		exif, err := ParseExif(data)
+		if err != nil {
+			//still cached, so we don't download a broken file over and over
+			fmt.Printf("\nUnable to parse EXIF data of %s in album %s. Error: %s", v, a.Path, err.Error())
+			exif = &ExifData{}
+		}
+
+		a.exifCacheMutex.Lock()
+		a.exifCache[v] = exif
+		a.exifCacheMutex.Unlock()
+	}
+	a.updatePersistedCache()
+}
+
+//reads the first n bytes of an object, key is the full key in the bucket
+func (a *Album) getObjectStart(key string, n int) ([]byte, error) {
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(a.site.BucketName),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", n-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	return ioutil.ReadAll(object.Body)
+}
+
+//keys that are in current but weren't in previous.
+func addedKeys(previous []string, current []string) []string {
+	previousMembership := make(map[string]bool)
+	for _, v := range previous {
+		previousMembership[v] = true
+	}
+
+	var added []string
+	for _, v := range current {
+		if !previousMembership[v] {
+			added = append(added, v)
+		}
+	}
+	return added
+}
+
+//requests the first byte of the cover, the thumbnails and the first PrewarmImages photos of the album through
+//the resizing service/CDN, so the first real visitor after photos are published hits warm edge caches.
+func (a *Album) PrewarmCDN() {
+	albumOrdering, err := a.GetOrderedPhotos()
+	if err != nil {
+		return
+	}
+
+	var urls []string
+	if albumOrdering.Cover != nil {
+		urls = append(urls, getUpstreamPhoto(albumOrdering.Cover).GetPhotoForWidth(PREWARM_PHOTO_WIDTH))
+	}
+	for _, v := range albumOrdering.Thumbnails {
+		urls = append(urls, getUpstreamPhoto(v).GetThumbnailForWidthAndHeight(PREWARM_THUMBNAIL_WIDTH, PREWARM_THUMBNAIL_HEIGHT))
+	}
+	for i, v := range albumOrdering.Ordering {
+		if i >= a.site.PrewarmImages {
+			break
+		}
+		urls = append(urls, getUpstreamPhoto(v).GetPhotoForWidth(PREWARM_PHOTO_WIDTH))
+	}
+
+	client := &http.Client{Timeout: PREWARM_TIMEOUT}
+	for _, u := range urls {
+		if u == "" {
+			continue
+		}
+
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Range", "bytes=0-0")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Printf("\nUnable to prewarm %s for album %s. Error: %s", u, a.Path, err.Error())
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+//fetches the ordering config from the bucket and stores it in the cache, callers must hold
+//AlbumAlbumOrderingConfigUpdateMutex.
+func (a *Album) updateOrderingCache() (AlbumOrderingConfig, error) {
+	albumOrdering, err := a.GetAlbumOrderingConfigFromS3AndPreprocess()
+	if err == nil || albumOrdering.negativeCacheThis {
+		// whether the item is valid or we should be negatively
+		// caching this result (probs err!=nil, but the value
+		// should be there and a valid boolean.
+		a.OrderingCache.Store(albumOrdering)
+		a.LastAlbumOrderingConfigCacheUpdate = time.Now()
+	}
+	return albumOrdering, err
+}
+
+//used by the background refresher to fill empty caches and update stale ones before a visitor has to.
+func (a *Album) RefreshCachesIfNeeded() {
+	refreshed := false
+	a.KeyCacheUpdateMutex.Lock()
+	if a.KeyCache.Load() == nil || a.NeedsKeyCacheUpdate() {
+		if _, err := a.updateKeyCache(); err != nil {
+			fmt.Printf("\nUnable to refresh object keys for album %s. Error: %s", a.Path, err.Error())
+		} else {
+			refreshed = true
+		}
+	}
+	a.KeyCacheUpdateMutex.Unlock()
+
+	a.AlbumAlbumOrderingConfigUpdateMutex.Lock()
+	if a.OrderingCache.Load() == nil || a.NeedsOrderingCacheUpdate() {
+		if _, err := a.updateOrderingCache(); err == nil {
+			refreshed = true
+		}
+	}
+	a.AlbumAlbumOrderingConfigUpdateMutex.Unlock()
+
+	//the mirror is written once both caches are, so its pages have the ordering that goes with the photos
+	if refreshed && a.site.HasStaticMirror() {
+		go a.updateStaticMirror()
+	}
+	if refreshed && a.HasLiveUpdates() {
+		a.notifyLiveUpdate()
+	}
+}
+
+func (a *Album) RecordView() {
+	atomic.AddUint64(&a.views, 1)
+}
+
+func (a *Album) GetViews() uint64 {
+	return atomic.LoadUint64(&a.views)
+}
+
 func (a *Album) ImageExists(slug string) bool {
+	_, ok := a.GetPhotoForSlug(slug)
+	return ok
+}
+
+func (a *Album) GetPhotoForSlug(slug string) (Renderable, bool) {
 	albumOrdering, err := a.GetOrderedPhotos()
 	if err == nil {
 		// we don't really care if there was an error, we'll return false below.
 		for _, v := range albumOrdering.Ordering {
 			if strings.TrimLeft(v.Slug(), "/") == strings.TrimLeft(slug, "/") {
-				return true
+				return v, true
 			}
 		}
 	}
-	return false
+	return nil, false
+}
+
+func (a *Album) HasCachedKeys() bool {
+	return a.KeyCache.Load() != nil
 }
 
 func (a *Album) NeedsKeyCacheUpdate() bool {
@@ -546,3 +1726,114 @@ func (a *Album) NeedsKeyCacheUpdate() bool {
 func (a *Album) NeedsOrderingCacheUpdate() bool {
 	return time.Now().Sub(a.LastAlbumOrderingConfigCacheUpdate) > CACHE_INTERVAL
 }
+
+//Perceptual hashes (see DifferenceHash) of the given photos by key. Photos that can't be downloaded or
+//decoded are left out.
+func (a *Album) GetPerceptualHashes(photos map[string]Renderable) map[string]uint64 {
+	hashes := make(map[string]uint64)
+	for k, v := range a.GetImageAnalyses(photos) {
+		hashes[k] = v.PerceptualHash
+	}
+	return hashes
+}
+
+//Analyses the given photos by key, downloading a small derivative of every photo that isn't cached yet.
+//Photos that can't be downloaded or decoded are left out.
+func (a *Album) GetImageAnalyses(photos map[string]Renderable) map[string]ImageAnalysis {
+	analyses := make(map[string]ImageAnalysis)
+	var missing []string
+
+	a.imageAnalysisCacheMutex.Lock()
+	if a.imageAnalysisCache == nil {
+		a.imageAnalysisCache = make(map[string]ImageAnalysis)
+	}
+	for k := range photos {
+		if analysis, ok := a.imageAnalysisCache[k]; ok {
+			analyses[k] = analysis
+		} else {
+			missing = append(missing, k)
+		}
+	}
+	a.imageAnalysisCacheMutex.Unlock()
+
+	client := &http.Client{Timeout: IMAGE_ANALYSIS_TIMEOUT}
+	work := make(chan string)
+	var wg sync.WaitGroup
+	var analysesMutex sync.Mutex
+	for i := 0; i < IMAGE_ANALYSIS_CONCURRENCY; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				u := getUpstreamPhoto(photos[key]).GetThumbnailForWidthAndHeight(IMAGE_ANALYSIS_SOURCE_SIZE, IMAGE_ANALYSIS_SOURCE_SIZE)
+				analysis, err := downloadImageAnalysis(client, u)
+				if err != nil {
+					fmt.Printf("\nUnable to analyse %s in album %s. Error: %s", key, a.Path, err.Error())
+					continue
+				}
+
+				analysesMutex.Lock()
+				analyses[key] = analysis
+				analysesMutex.Unlock()
+
+				a.imageAnalysisCacheMutex.Lock()
+				a.imageAnalysisCache[key] = analysis
+				a.imageAnalysisCacheMutex.Unlock()
+			}
+		}()
+	}
+	for _, v := range missing {
+		work <- v
+	}
+	close(work)
+	wg.Wait()
+
+	return analyses
+}
+
+func (a *Album) GetCachedImageAnalysis(key string) (ImageAnalysis, bool) {
+	a.imageAnalysisCacheMutex.Lock()
+	defer a.imageAnalysisCacheMutex.Unlock()
+	analysis, ok := a.imageAnalysisCache[key]
+	return analysis, ok
+}
+
+//analyses the photos we haven't seen yet in the background, so their placeholder colours are known
+//by the time most visitors show up.
+func (a *Album) updateImageAnalysisCache(keys []string) {
+	if !atomic.CompareAndSwapInt32(&a.imageAnalysisCacheUpdating, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&a.imageAnalysisCacheUpdating, 0)
+
+	photos := make(map[string]Renderable)
+	for _, v := range keys {
+		if a.IsRenderableKey(v) {
+			photos[strings.TrimLeft(v, "/")] = a.GetPhotoForKey(v)
+		}
+	}
+	a.GetImageAnalyses(photos)
+	a.updatePersistedCache()
+}
+
+func downloadImageAnalysis(client *http.Client, u string) (ImageAnalysis, error) {
+	if u == "" {
+		return ImageAnalysis{}, errors.New("No URL for the photo")
+	}
+
+	resp, err := client.Get(u)
+	if err != nil {
+		return ImageAnalysis{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ImageAnalysis{}, fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+
+	img, _, err := image.Decode(resp.Body)
+	if err != nil {
+		return ImageAnalysis{}, err
+	}
+	return AnalyseImage(img), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math/bits"
+)
+
+// frames closer than this many differing bits are considered near-duplicates
+const NEAR_DUPLICATE_DISTANCE = 10
+
+// size of the derivative downloaded for analysis, anything bigger is wasted bandwidth
+const IMAGE_ANALYSIS_SOURCE_SIZE = 64
+
+// what we learn from a small version of a photo, cached per photo by its album
+type ImageAnalysis struct {
+	PerceptualHash uint64
+	DominantColor  string // as a CSS hex colour, like #a0b0c0
+}
+
+func AnalyseImage(img image.Image) ImageAnalysis {
+	return ImageAnalysis{
+		PerceptualHash: DifferenceHash(img),
+		DominantColor:  DominantColor(img),
+	}
+}
+
+// Computes a 64 bit difference hash of img: the image is shrunk to 9x8 grayscale pixels and every bit tells
+// whether a pixel is brighter than its right neighbour. Unlike a checksum, similar images get similar
+// hashes, so the number of differing bits tells how alike two photos look.
+func DifferenceHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	var gray [h][w]float64
+
+	bounds := img.Bounds()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// average the block of source pixels that shrinks down to this pixel
+			x0 := bounds.Min.X + x*bounds.Dx()/w
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/w
+			y0 := bounds.Min.Y + y*bounds.Dy()/h
+			y1 := bounds.Min.Y + (y+1)*bounds.Dy()/h
+			if x1 == x0 {
+				x1++
+			}
+			if y1 == y0 {
+				y1++
+			}
+
+			var sum float64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					r, g, b, _ := img.At(sx, sy).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+				}
+			}
+			gray[y][x] = sum / float64((x1-x0)*(y1-y0))
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// The most common colour of img: pixels are sorted in to buckets of similar colours (16 shades per channel),
+// and the average of the fullest bucket wins. Unlike the plain average, this doesn't turn a blue sky over
+// a red roof in to purple.
+func DominantColor(img image.Image) string {
+	var counts [4096]int
+	var sums [4096][3]uint64
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			r, g, b = r>>8, g>>8, b>>8
+			bucket := (r>>4)<<8 | (g>>4)<<4 | b>>4
+			counts[bucket]++
+			sums[bucket][0] += uint64(r)
+			sums[bucket][1] += uint64(g)
+			sums[bucket][2] += uint64(b)
+		}
+	}
+
+	best := 0
+	for i := range counts {
+		if counts[i] > counts[best] {
+			best = i
+		}
+	}
+	if counts[best] == 0 {
+		return ""
+	}
+
+	n := uint64(counts[best])
+	return fmt.Sprintf("#%02x%02x%02x", sums[best][0]/n, sums[best][1]/n, sums[best][2]/n)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// the values AnimatedImages can take, "" leaves animations to the resizing service (which usually flattens them)
+const ANIMATED_IMAGES_PASSTHROUGH = "passthrough"
+const ANIMATED_IMAGES_POSTER = "poster"
+
+// formats that can hold animations. GIFs are the only ones we can't tell apart from the first few bytes alone,
+// but animated GIFs announce that they loop (NETSCAPE2.0) before their first frame.
+var ANIMATED_EXTENSIONS = []string{".gif", ".png", ".apng", ".webp"}
+
+const ANIMATION_READ_BYTES = 64 * 1024
+
+func isAnimatableKey(key string) bool {
+	return stringInSlice(strings.ToLower(path.Ext(key)), ANIMATED_EXTENSIONS)
+}
+
+// Tells whether an image (GIF, APNG or WebP) is animated from (at least) its first ANIMATION_READ_BYTES bytes.
+// Anything that isn't one of those formats, or is cut off before we could tell, is taken to be a still image.
+func IsAnimatedImage(data []byte) bool {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return isAnimatedGif(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return isAnimatedPng(data)
+	case len(data) >= 21 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:16], []byte("WEBPVP8X")):
+		// the extended header has a flag for animations
+		return data[20]&0x02 != 0
+	default:
+		return false
+	}
+}
+
+// an APNG has an acTL chunk before its image data, plain PNGs don't
+func isAnimatedPng(data []byte) bool {
+	for i := 8; i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		chunkType := string(data[i+4 : i+8])
+		if chunkType == "acTL" {
+			return true
+		}
+		if chunkType == "IDAT" || length < 0 {
+			return false
+		}
+		i = i + 12 + length
+	}
+	return false
+}
+
+// walks the blocks of a GIF until it finds a second frame or the NETSCAPE2.0 looping extension
+func isAnimatedGif(data []byte) bool {
+	if len(data) < 13 {
+		return false
+	}
+
+	i := 13
+	if data[10]&0x80 != 0 {
+		// global colour table
+		i += 3 << (uint(data[10]&0x07) + 1)
+	}
+
+	frames := 0
+	for i < len(data) {
+		switch data[i] {
+		case 0x21:
+			// extension: label, then data sub-blocks
+			if i+2 >= len(data) {
+				return false
+			}
+			if data[i+1] == 0xFF && i+14 <= len(data) && string(data[i+3:i+14]) == "NETSCAPE2.0" {
+				return true
+			}
+			i = skipGifSubBlocks(data, i+2)
+		case 0x2C:
+			frames++
+			if frames > 1 {
+				return true
+			}
+			if i+10 > len(data) {
+				return false
+			}
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				// local colour table
+				i += 3 << (uint(flags&0x07) + 1)
+			}
+			// LZW minimum code size, then the image data sub-blocks
+			i = skipGifSubBlocks(data, i+1)
+		default:
+			// the trailer, or something we don't understand
+			return false
+		}
+	}
+	return false
+}
+
+// gives the index just past the terminating empty sub-block starting from i
+func skipGifSubBlocks(data []byte, i int) int {
+	for i < len(data) {
+		size := int(data[i])
+		i++
+		if size == 0 {
+			return i
+		}
+		i += size
+	}
+	return i
+}
+
+func (a *Album) IsCachedAnimation(key string) bool {
+	a.animationCacheMutex.RLock()
+	defer a.animationCacheMutex.RUnlock()
+	return a.animationCache[key]
+}
+
+// Reads the start of GIFs, PNGs and WebPs we haven't seen yet to find out which ones are animated, and forgets
+// keys that were removed. Until a photo has been read it's treated as a still image.
+func (a *Album) updateAnimationCache(keys []string) {
+	if !atomic.CompareAndSwapInt32(&a.animationCacheUpdating, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&a.animationCacheUpdating, 0)
+
+	current := make(map[string]bool)
+	var missing []string
+	a.animationCacheMutex.Lock()
+	if a.animationCache == nil {
+		a.animationCache = make(map[string]bool)
+	}
+	for _, v := range keys {
+		current[v] = true
+		if _, ok := a.animationCache[v]; !ok && isAnimatableKey(v) {
+			missing = append(missing, v)
+		}
+	}
+	for k := range a.animationCache {
+		if !current[k] {
+			delete(a.animationCache, k)
+		}
+	}
+	a.animationCacheMutex.Unlock()
+
+	for _, v := range missing {
+		data, err := a.getObjectStart(v, ANIMATION_READ_BYTES)
+		if err != nil {
+			fmt.Printf("\nUnable to read %s in album %s to check for animations. Error: %s", v, a.Path, err.Error())
+			continue
+		}
+
+		a.animationCacheMutex.Lock()
+		a.animationCache[v] = IsAnimatedImage(data)
+		a.animationCacheMutex.Unlock()
+	}
+	a.updatePersistedCache()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Scripts and apps (photo managers, phones) use albums through here, with a bearer token or the admin's login,
+// rather than through the bucket. An album's endpoints are under its path, like /api/v1/albums/baku/photos.
+const API_PATH = "/api/v1/"
+const API_ALBUMS_PATH = API_PATH + "albums/"
+
+// ordering.yaml files with captions for thousands of photos run to a few MB
+const API_ORDERING_MAX_BYTES = 16 * 1024 * 1024
+
+type ApiUploadResponse struct {
+	Album    string            `json:"album"`
+	Uploaded []string          `json:"uploaded"`
+	Rejected []UploadRejection `json:"rejected"`
+}
+
+func (s *Site) validateApi() error {
+	if !s.HasAdmin() {
+		return nil
+	}
+	for _, a := range s.Albums {
+		if strings.HasPrefix(a.Path, API_PATH) {
+			return fmt.Errorf("Album %s can't be served under %s, that's where the API is", a.Path, API_PATH)
+		}
+	}
+	return nil
+}
+
+func writeApiError(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	writeAdminJSON(w, map[string]string{"error": err.Error()})
+}
+
+// the album of an /api/v1/albums/ path and the endpoint after it, like /baku/ and photos
+func getApiAlbumPath(urlPath string) (string, string) {
+	rest := "/" + strings.TrimPrefix(urlPath, API_ALBUMS_PATH)
+	i := strings.LastIndex(rest, "/") + 1
+	return rest[:i], rest[i:]
+}
+
+func handleApi(site *Site, w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, API_ALBUMS_PATH) {
+		writeApiError(w, http.StatusNotFound, errors.New("Not found"))
+		return
+	}
+	albumPath, endpoint := getApiAlbumPath(r.URL.Path)
+
+	var handler func(album *Album, w http.ResponseWriter, r *http.Request)
+	var scope string
+	writes := r.Method != http.MethodGet
+	switch {
+	case endpoint == "photos" && r.Method == http.MethodPost:
+		handler, scope = handleApiUpload, JWT_SCOPE_UPLOAD
+	case endpoint == "ordering" && r.Method == http.MethodGet:
+		handler, scope = handleApiOrdering, JWT_SCOPE_EDIT
+	case endpoint == "ordering" && r.Method == http.MethodPut:
+		handler, scope = handleApiOrderingSave, JWT_SCOPE_EDIT
+	case endpoint == "photos" || endpoint == "ordering":
+		writeApiError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s doesn't take %s requests", endpoint, r.Method))
+		return
+	default:
+		writeApiError(w, http.StatusNotFound, errors.New("Not found"))
+		return
+	}
+	if !requireAdminAccess(site, w, r, scope, albumPath) {
+		return
+	}
+
+	// like the admin, the API sees albums that haven't been published yet
+	album, err := site.GetAlbumForPath(albumPath)
+	if err != nil {
+		writeApiError(w, http.StatusNotFound, err)
+		return
+	}
+	if album.Locked && writes {
+		writeApiError(w, http.StatusForbidden, album.checkNotLocked())
+		return
+	}
+
+	handler(album, w, r)
+}
+
+// Reads the files of the multipart body one at a time as they come in, each is spooled to disk only for as long
+// as it takes to check and store it. Files are stored like guests' uploads (see uploadExternalFile), so a name
+// that's already in the album gets a number rather than replacing its photo.
+func handleApiUpload(album *Album, w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > ADMIN_UPLOAD_MAX_BYTES {
+		writeApiError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("Uploads can be at most %dMB at once", ADMIN_UPLOAD_MAX_BYTES/1024/1024))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, ADMIN_UPLOAD_MAX_BYTES)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, errors.New("The photos have to be sent as multipart/form-data"))
+		return
+	}
+
+	response := ApiUploadResponse{Album: album.Path, Uploaded: []string{}, Rejected: []UploadRejection{}}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			err = errors.New("Unable to read the upload, it may be too big")
+			if len(response.Uploaded) > 0 {
+				album.RefreshKeyCache()
+				err = fmt.Errorf("%s. %s made it in to the album", err.Error(), strings.Join(response.Uploaded, ", "))
+			}
+			writeApiError(w, http.StatusBadRequest, err)
+			return
+		}
+		if part.FileName() == "" {
+			continue
+		}
+
+		name := path.Base(strings.Replace(part.FileName(), "\\", "/", -1))
+		stored, reason, err := uploadExternalFile(album, name, part, response.Uploaded)
+		if err != nil {
+			reason = err.Error()
+		}
+		if reason != "" {
+			response.Rejected = append(response.Rejected, UploadRejection{name, reason})
+		} else {
+			response.Uploaded = append(response.Uploaded, stored)
+		}
+	}
+
+	if len(response.Uploaded)+len(response.Rejected) == 0 {
+		writeApiError(w, http.StatusBadRequest, errors.New("The upload has no files"))
+		return
+	}
+	if len(response.Uploaded) > 0 {
+		fmt.Printf("\nUploaded %d photos to album %s through the API", len(response.Uploaded), album.Path)
+		album.RefreshKeyCache()
+	}
+	writeAdminJSON(w, response)
+}
+
+// the ordering's ETag, what a PUT has to send as If-Match to replace it
+func getOrderingETag(current []byte) string {
+	return `"` + HashOrderingYAML(current) + `"`
+}
+
+// Gives ordering.yaml as it is in the bucket, keys relative to the album's prefix, along with its ETag. Malformed
+// files are given as they are, so they can be fixed.
+func handleApiOrdering(album *Album, w http.ResponseWriter, r *http.Request) {
+	_, current, err := getCurrentOrderingConfig(album)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if current == nil {
+		writeApiError(w, http.StatusNotFound, fmt.Errorf("Album %s has no %s yet", album.Path, ORDERING_YAML_NAME))
+		return
+	}
+	w.Header().Set("Content-Type", ORDERING_YAML_CONTENT_TYPE)
+	w.Header().Set("ETag", getOrderingETag(current))
+	w.Write(current)
+}
+
+// every photo the ordering names has to be in the album, a cover that isn't would leave the album without one
+func (a *Album) validateOrderingKeys(config AlbumOrderingConfig) error {
+	keys, err := a.GetAllObjectKeys()
+	if err != nil {
+		return err
+	}
+	inAlbum := make(map[string]bool)
+	for _, v := range keys {
+		inAlbum[strings.TrimLeft(v, "/")] = true
+	}
+
+	var missing []string
+	named := append(append([]string{config.Cover}, config.Thumbnails...), config.Ordering...)
+	for _, v := range named {
+		key := strings.TrimLeft(v, "/")
+		if v != "" && !inAlbum[key] {
+			missing = append(missing, strings.TrimPrefix(key, strings.TrimLeft(a.BucketPrefix, "/")))
+			inAlbum[key] = true //named once in the error
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("The ordering names photos that aren't in the album: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Replaces ordering.yaml with the body, after checking it the way it'll be read. Like the editor, it only
+// replaces the ordering the client saw: If-Match has to be its ETag, or If-None-Match * when there's none yet.
+func handleApiOrderingSave(album *Album, w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, API_ORDERING_MAX_BYTES))
+	if err != nil {
+		writeApiError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("%s can be at most %dMB", ORDERING_YAML_NAME, API_ORDERING_MAX_BYTES/1024/1024))
+		return
+	}
+
+	_, current, err := getCurrentOrderingConfig(album)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	switch {
+	case r.Header.Get("If-Match") == "" && r.Header.Get("If-None-Match") == "":
+		writeApiError(w, http.StatusPreconditionRequired, errors.New("Send the ETag of the ordering being replaced as If-Match, or If-None-Match: * for a new one"))
+		return
+	case r.Header.Get("If-None-Match") == "*" && current != nil,
+		r.Header.Get("If-Match") != "" && (current == nil || r.Header.Get("If-Match") != getOrderingETag(current)):
+		writeApiError(w, http.StatusPreconditionFailed, errors.New("The ordering was changed by somebody else in the meantime"))
+		return
+	}
+
+	config, err := album.ParseAlbumOrderingConfig(data)
+	if err != nil {
+		writeApiError(w, http.StatusUnprocessableEntity, fmt.Errorf("%s isn't valid: %s", ORDERING_YAML_NAME, err.Error()))
+		return
+	}
+	if err := album.validateOrderingKeys(config); err != nil {
+		writeApiError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	if err := album.WriteOrderingYAML(data, HashOrderingYAML(current)); err != nil {
+		writeApiError(w, http.StatusConflict, err)
+		return
+	}
+	fmt.Printf("\nSaved the ordering of album %s through the API", album.Path)
+	w.Header().Set("ETag", getOrderingETag(data))
+	w.WriteHeader(http.StatusNoContent)
+}
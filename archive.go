@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// prebuilt zips are kept in a folder of their own under the album's prefix, which the (non-recursive) bucket
+// listing never sees
+const PREBUILT_ZIP_FOLDER = ".50mm/"
+
+// what went in to a prebuilt zip, kept as x-amz-meta-fingerprint on the zip itself
+const PREBUILT_ZIP_FINGERPRINT_METADATA = "Fingerprint"
+
+func (a *Album) getPrebuiltZipKey(web bool) string {
+	return a.BucketPrefix + PREBUILT_ZIP_FOLDER + a.GetZipDownloadFilename(web)
+}
+
+// changes whenever a photo is added, removed, replaced or moved, which is when the zip has to be built again
+func (a *Album) getZipFingerprint(keys []string, web bool) string {
+	dates, _ := a.KeyDatesCache.Load().(map[string]time.Time)
+	sizes, _ := a.KeySizesCache.Load().(map[string]int64)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "web=%t\n", web)
+	// zips built before their photos were named by the key relative to the album (see getZipEntryName)
+	fmt.Fprintln(hash, "names=relative")
+	// zips built before StripExif was turned on still have the metadata
+	if a.StripExif {
+		fmt.Fprintln(hash, "strip-exif")
+	}
+	for _, v := range keys {
+		fmt.Fprintf(hash, "%s %d %d\n", v, dates[v].Unix(), sizes[v])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// A pre-signed link to the prebuilt zip when it's up to date with keys, empty otherwise. S3 serves the zip
+// with Range support, so slow or interrupted downloads can pick up where they left off.
+func (a *Album) GetPrebuiltZipUrl(web bool, keys []string) string {
+	key := a.getPrebuiltZipKey(web)
+	a.prebuiltZipsMutex.Lock()
+	built := a.prebuiltZips[key]
+	a.prebuiltZipsMutex.Unlock()
+
+	if built == "" || built != a.getZipFingerprint(keys, web) {
+		return ""
+	}
+
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return ""
+	}
+
+	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket:                     aws.String(a.site.BucketName),
+		Key:                        aws.String(key),
+		ResponseContentDisposition: aws.String(fmt.Sprintf("attachment; filename=%q", a.GetZipDownloadFilename(web))),
+	})
+
+	signedUrl, err := req.Presign(S3_URL_EXPIRY)
+	if err != nil {
+		fmt.Printf("\nUnable to sign the zip URL of album %s. Error: %s", a.Path, err.Error())
+		return ""
+	}
+	return signedUrl
+}
+
+// Brings the album's prebuilt zips up to date, building the ones that are missing or out of date. Zips built
+// by an earlier run (or another instance) are picked up through their fingerprint, so they aren't built twice.
+func (a *Album) updatePrebuiltZips() {
+	if !atomic.CompareAndSwapInt32(&a.prebuiltZipsUpdating, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&a.prebuiltZipsUpdating, 0)
+
+	keys, photoDetails, _, err := a.getZipDownloadKeys()
+	if err != nil {
+		return
+	}
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return
+	}
+
+	a.prebuiltZipsMutex.Lock()
+	if a.prebuiltZips == nil {
+		a.prebuiltZips = make(map[string]string)
+	}
+	a.prebuiltZipsMutex.Unlock()
+
+	var kinds []bool
+	if a.AllowZipDownload {
+		kinds = append(kinds, false)
+	}
+	if a.AllowWebZipDownload {
+		kinds = append(kinds, true)
+	}
+
+	for _, web := range kinds {
+		key := a.getPrebuiltZipKey(web)
+		fingerprint := a.getZipFingerprint(keys, web)
+
+		a.prebuiltZipsMutex.Lock()
+		built := a.prebuiltZips[key]
+		a.prebuiltZipsMutex.Unlock()
+		if built == fingerprint {
+			continue
+		}
+
+		head, err := svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(a.site.BucketName),
+			Key:    aws.String(key),
+		})
+		if err != nil || aws.StringValue(head.Metadata[PREBUILT_ZIP_FINGERPRINT_METADATA]) != fingerprint {
+			fmt.Printf("\nBuilding %s for album %s", key, a.Path)
+			if err := a.uploadZip(svc, key, fingerprint, keys, photoDetails, web); err != nil {
+				fmt.Printf("\nUnable to build %s for album %s. Error: %s", key, a.Path, err.Error())
+				continue
+			}
+		}
+
+		a.prebuiltZipsMutex.Lock()
+		a.prebuiltZips[key] = fingerprint
+		a.prebuiltZipsMutex.Unlock()
+	}
+}
+
+// the zip is uploaded while it's written, in parts, so building it takes no more memory than streaming it
+func (a *Album) uploadZip(svc *s3.S3, key string, fingerprint string, keys []string, photoDetails map[string]*PhotoDetails, web bool) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(a.writeZip(svc, keys, photoDetails, web, writer))
+	}()
+
+	checksums := newChecksumWriter()
+	_, err := newUploader(svc).Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(a.site.BucketName),
+		Key:         aws.String(key),
+		Body:        io.TeeReader(reader, checksums),
+		ContentType: aws.String("application/zip"),
+		Metadata: map[string]*string{
+			PREBUILT_ZIP_FINGERPRINT_METADATA: aws.String(fingerprint),
+		},
+	})
+	// stops the writer if the upload gave up first
+	reader.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+	return verifyUploadedObject(svc, a.site.BucketName, key, checksums.Checksums())
+}
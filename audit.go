@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuthAuditLog = stdout logs to the standard output, anything else is a file that's appended to
+const AUTH_AUDIT_STDOUT = "stdout"
+
+const (
+	AUTH_AUDIT_SUCCESS    = "success"
+	AUTH_AUDIT_FAILURE    = "failure"
+	AUTH_AUDIT_LOCKED_OUT = "locked_out"
+)
+
+// One line of JSON per login, for the owners of private albums to see who got in to what and when. Logins kept
+// in a session cookie are logged once, when they're made, share links the first time they're used from a
+// browser and bearer tokens (which have no session) on every request.
+type AuthAuditEntry struct {
+	Time      time.Time `json:"time"`
+	Site      string    `json:"site"`
+	Album     string    `json:"album,omitempty"` //the album's path, the admin's for the admin and empty for the site
+	Path      string    `json:"path"`
+	Method    string    `json:"method"` //basic, share, key, bearer or oidc
+	User      string    `json:"user,omitempty"`
+	Result    string    `json:"result"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+}
+
+type AuthAuditLogger struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// sites logging to the same file share the logger, so their lines don't end up in the middle of each other
+var authAuditLoggers = make(map[string]*AuthAuditLogger)
+var authAuditLoggersMutex sync.Mutex
+
+func GetAuthAuditLogger(path string) (*AuthAuditLogger, error) {
+	authAuditLoggersMutex.Lock()
+	defer authAuditLoggersMutex.Unlock()
+
+	if logger, ok := authAuditLoggers[path]; ok {
+		return logger, nil
+	}
+
+	var w io.Writer = os.Stdout
+	if path != AUTH_AUDIT_STDOUT {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open AuthAuditLog %s: %s", path, err.Error())
+		}
+		w = file
+	}
+
+	logger := &AuthAuditLogger{w: w}
+	authAuditLoggers[path] = logger
+	return logger, nil
+}
+
+// Closes the loggers of files no site that's served logs to, like the one of a deployed config that loaded but
+// was rejected.
+func closeUnusedAuthAuditLoggers() {
+	used := make(map[string]bool)
+	for _, s := range app.Sites() {
+		used[s.AuthAuditLog] = true
+	}
+
+	authAuditLoggersMutex.Lock()
+	defer authAuditLoggersMutex.Unlock()
+	for path, logger := range authAuditLoggers {
+		if used[path] {
+			continue
+		}
+		if file, ok := logger.w.(*os.File); ok && path != AUTH_AUDIT_STDOUT {
+			logger.mutex.Lock()
+			file.Close()
+			logger.mutex.Unlock()
+		}
+		delete(authAuditLoggers, path)
+	}
+}
+
+// nil loggers, for sites without AuthAuditLog, log nothing
+func (l *AuthAuditLogger) Log(entry AuthAuditEntry) {
+	if l == nil {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		fmt.Printf("\nUnable to write to the auth audit log. Error: %s", err.Error())
+	}
+}
+
+func (s *Site) auditLogin(r *http.Request, path string, album string, method string, user string, result string) {
+	if s.authAuditLogger == nil {
+		return
+	}
+
+	entry := AuthAuditEntry{
+		Time:      time.Now().UTC(),
+		Site:      s.Domain,
+		Album:     album,
+		Path:      path,
+		Method:    method,
+		User:      user,
+		Result:    result,
+		UserAgent: r.UserAgent(),
+	}
+	if ip := s.GetClientIP(r); ip != nil {
+		entry.IP = ip.String()
+	} else {
+		entry.IP = r.RemoteAddr
+	}
+	s.authAuditLogger.Log(entry)
+}
+
+// the site and album logins to provider are logged under
+func getAuditScope(provider AuthCredentialsProvider) (*Site, string) {
+	switch v := provider.(type) {
+	case *Site:
+		return v, ""
+	case *Album:
+		return v.site, v.Path
+	case *AdminCredentials:
+		return v.site, ADMIN_PATH
+	default:
+		return nil, ""
+	}
+}
+
+// the subject of the request's bearer token, empty when it isn't valid
+func getBearerSubject(provider AuthCredentialsProvider, r *http.Request) string {
+	site, _ := getAuditScope(provider)
+	if site == nil {
+		return ""
+	}
+	if token, err := site.VerifyBearerToken(getBearerToken(r), time.Now()); err == nil {
+		return token.Subject
+	}
+	return ""
+}
+
+func auditLogin(provider AuthCredentialsProvider, r *http.Request, method string, user string, result string) {
+	if site, album := getAuditScope(provider); site != nil {
+		site.auditLogin(r, r.URL.Path, album, method, user, result)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Sites with a BasePath are served under it, like /photos for a site mounted behind the reverse proxy of
+// another one at example.com/photos/. The proxy passes requests on with the path as it is, and 50mm takes
+// BasePath off before working out the page, so albums, the admin and /static/ are all under it. Every link,
+// canonical URL, redirect and cookie of the site has it put back.
+const STATIC_PATH = "/static/"
+
+var staticHandler = withDevCaching(http.StripPrefix(STATIC_PATH, http.FileServer(http.Dir("static/"))))
+
+var basePathRegexp = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+$`)
+
+func (s *Site) validateBasePath() error {
+	s.BasePath = strings.TrimRight(s.BasePath, "/")
+	if s.BasePath == "" {
+		return nil
+	}
+	if !basePathRegexp.MatchString(s.BasePath) {
+		return errors.New("BasePath should be a path like /photos, of letters, digits and . _ ~ -")
+	}
+	return nil
+}
+
+// the path of the site's page at path, with the BasePath in front, for links and redirects
+func (s *Site) GetUrlPath(path string) string {
+	return s.BasePath + path
+}
+
+// the canonical URL of the site's page at path
+func (s *Site) GetUrlForPath(path string) *url.URL {
+	u := s.GetCanonicalUrl()
+	u.Path = s.GetUrlPath(path)
+	return u
+}
+
+// Takes the site's BasePath off the request's path, like http.StripPrefix. ok is false for paths outside of
+// it, and for the BasePath without its slash, which is redirected to the site's index.
+func (s *Site) stripBasePath(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if s.BasePath == "" {
+		return r, true
+	}
+	if r.URL.Path == s.BasePath {
+		http.Redirect(w, r, s.GetUrlPath("/"), http.StatusMovedPermanently)
+		return nil, false
+	}
+	if !strings.HasPrefix(r.URL.Path, s.BasePath+"/") {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	stripped := new(http.Request)
+	*stripped = *r
+	stripped.URL = new(url.URL)
+	*stripped.URL = *r.URL
+	stripped.URL.Path = strings.TrimPrefix(r.URL.Path, s.BasePath)
+	stripped.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, s.BasePath)
+	return stripped, true
+}
+
+// the site's BasePath, for links in templates: {{.BasePath}}/static/base.css
+func (c *BasePageContext) BasePath() string {
+	u, err := url.Parse(c.SiteUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(u.Path, "/")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// the width the album page shows its photos at, which is what the page weight is measured at
+const PAGE_BUDGET_PHOTO_WIDTH = 800
+
+// used for photos that haven't been measured yet
+const PAGE_BUDGET_DEFAULT_PHOTO_BYTES = 150 * 1024
+
+// A step down from the resizing service's defaults, tried in order until the album page fits the budget.
+// Quality 0 leaves the quality to the resizing service. Factor is roughly how much of the bytes of the
+// default are left, going by how JPEG sizes fall with quality and with the number of pixels.
+type PageBudgetStep struct {
+	Quality int
+	Width   int
+	Factor  float64
+}
+
+var PAGE_BUDGET_STEPS = []PageBudgetStep{
+	{0, PAGE_BUDGET_PHOTO_WIDTH, 1},
+	{60, PAGE_BUDGET_PHOTO_WIDTH, .75},
+	{45, PAGE_BUDGET_PHOTO_WIDTH, .6},
+	{30, PAGE_BUDGET_PHOTO_WIDTH, .45},
+	{30, 640, .45 * .64},
+	{30, 480, .45 * .36},
+}
+
+// Picks the first step that keeps the estimated weight of all photos under budget bytes, sizes are what
+// the photos weigh at the resizing service's defaults. When no step is good enough the last one is used
+// and ok is false.
+func PickPageBudgetStep(sizes []int64, budget int64) (step PageBudgetStep, estimate int64, ok bool) {
+	var total int64
+	for _, v := range sizes {
+		total += v
+	}
+
+	for _, step = range PAGE_BUDGET_STEPS {
+		estimate = int64(float64(total) * step.Factor)
+		if estimate <= budget {
+			return step, estimate, true
+		}
+	}
+	return step, estimate, false
+}
+
+// steps the photos of the album down until the album page fits in the site's PageBudgetKB
+func (a *Album) applyPageBudget(keys []string, photoDetails map[string]*PhotoDetails) {
+	var sizes []int64
+	for _, v := range keys {
+		size, ok := a.GetCachedPhotoSize(v)
+		if !ok {
+			size = PAGE_BUDGET_DEFAULT_PHOTO_BYTES
+		}
+		sizes = append(sizes, size)
+	}
+
+	budget := int64(a.site.PageBudgetKB) * 1024
+	step, estimate, ok := PickPageBudgetStep(sizes, budget)
+	if !ok {
+		// said once, not on every page view
+		if atomic.CompareAndSwapInt32(&a.pageBudgetWarned, 0, 1) {
+			fmt.Printf("\nAlbum %s weighs about %dKB even at the lowest quality, over the budget of %dKB",
+				a.Path, estimate/1024, a.site.PageBudgetKB)
+		}
+	} else {
+		atomic.StoreInt32(&a.pageBudgetWarned, 0)
+	}
+
+	if step.Quality == 0 && step.Width == PAGE_BUDGET_PHOTO_WIDTH {
+		return
+	}
+	for _, v := range keys {
+		key := strings.TrimLeft(v, "/")
+		details, ok := photoDetails[key]
+		if !ok {
+			details = &PhotoDetails{}
+			photoDetails[key] = details
+		}
+		details.Quality = step.Quality
+		details.MaxWidth = step.Width
+	}
+}
+
+func (a *Album) GetCachedPhotoSize(key string) (int64, bool) {
+	a.photoSizeCacheMutex.Lock()
+	defer a.photoSizeCacheMutex.Unlock()
+	size, ok := a.photoSizeCache[strings.TrimLeft(key, "/")]
+	return size, ok
+}
+
+// measures what the photos we haven't seen yet weigh on the album page, in the background
+func (a *Album) updatePhotoSizeCache(keys []string) {
+	if !atomic.CompareAndSwapInt32(&a.photoSizeCacheUpdating, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&a.photoSizeCacheUpdating, 0)
+
+	a.photoSizeCacheMutex.Lock()
+	if a.photoSizeCache == nil {
+		a.photoSizeCache = make(map[string]int64)
+	}
+	a.photoSizeCacheMutex.Unlock()
+
+	client := &http.Client{Timeout: IMAGE_ANALYSIS_TIMEOUT}
+	for _, v := range keys {
+		if !a.IsRenderableKey(v) {
+			continue
+		}
+		if _, ok := a.GetCachedPhotoSize(v); ok {
+			continue
+		}
+
+		// measured without any budget steps applied, those are worked out from here
+		size, err := measurePhotoSize(client, getUpstreamPhoto(a.GetPhotoForKey(v)).GetPhotoForWidth(PAGE_BUDGET_PHOTO_WIDTH))
+		if err != nil {
+			fmt.Printf("\nUnable to measure %s in album %s. Error: %s", v, a.Path, err.Error())
+			continue
+		}
+
+		a.photoSizeCacheMutex.Lock()
+		a.photoSizeCache[strings.TrimLeft(v, "/")] = size
+		a.photoSizeCacheMutex.Unlock()
+	}
+}
+
+// asks for the size with a HEAD request, and downloads the photo if the resizing service won't tell
+func measurePhotoSize(client *http.Client, u string) (int64, error) {
+	resp, err := client.Head(u)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && resp.ContentLength > 0 {
+			return resp.ContentLength, nil
+		}
+	}
+
+	resp, err = client.Get(u)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+	return io.Copy(ioutil.Discard, resp.Body)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cameras shoot bursts at several frames a second, anything further apart was shot on purpose
+const BURST_MAX_GAP = 2 * time.Second
+
+// two photos in a row are just two photos
+const BURST_MIN_PHOTOS = 3
+
+// splits the name of a photo in to the camera's prefix and its sequence number, IMG_1234.jpg gives IMG_ and
+// 1234. ok is false for names that don't end in a number.
+func splitSequenceNumber(key string) (prefix string, number int, ok bool) {
+	name := path.Base(key)
+	name = strings.TrimSuffix(name, path.Ext(name))
+
+	i := len(name)
+	for i > 0 && name[i-1] >= '0' && name[i-1] <= '9' {
+		i--
+	}
+	if i == len(name) {
+		return "", 0, false
+	}
+
+	number, err := strconv.Atoi(name[i:])
+	if err != nil {
+		return "", 0, false
+	}
+	return name[:i], number, true
+}
+
+// Finds the runs of keys that look like bursts: consecutive sequence numbers from the same camera, taken no more
+// than BURST_MAX_GAP apart. Keys are looked at in the order given, so photos moved apart in ordering.yaml stay
+// apart. Photos we don't know the time of are never part of a burst.
+func FindBursts(keys []string, times map[string]time.Time) [][]string {
+	var bursts [][]string
+	var run []string
+
+	flush := func() {
+		if len(run) >= BURST_MIN_PHOTOS {
+			bursts = append(bursts, run)
+		}
+		run = nil
+	}
+
+	for _, v := range keys {
+		if len(run) > 0 && !continuesBurst(run[len(run)-1], v, times) {
+			flush()
+		}
+		if _, ok := times[v]; ok {
+			run = append(run, v)
+		}
+	}
+	flush()
+	return bursts
+}
+
+func continuesBurst(previous string, key string, times map[string]time.Time) bool {
+	previousPrefix, previousNumber, ok := splitSequenceNumber(previous)
+	if !ok {
+		return false
+	}
+	prefix, number, ok := splitSequenceNumber(key)
+	if !ok || prefix != previousPrefix || number != previousNumber+1 {
+		return false
+	}
+
+	previousTime, ok := times[previous]
+	if !ok {
+		return false
+	}
+	keyTime, ok := times[key]
+	if !ok {
+		return false
+	}
+	gap := keyTime.Sub(previousTime)
+	return gap >= 0 && gap <= BURST_MAX_GAP
+}
+
+// marks the bursts among the album's photos, so the album page can show each as a single photo
+func (a *Album) applyBursts(keys []string, photoDetails map[string]*PhotoDetails) {
+	times := make(map[string]time.Time)
+	for _, v := range keys {
+		if exif := a.GetCachedExif(v); exif != nil && !exif.DateTime.IsZero() {
+			times[v] = exif.DateTime
+		}
+	}
+
+	for _, burst := range FindBursts(keys, times) {
+		for i, v := range burst {
+			key := strings.TrimLeft(v, "/")
+			details, ok := photoDetails[key]
+			if !ok {
+				details = &PhotoDetails{}
+				photoDetails[key] = details
+			}
+
+			if i == 0 {
+				details.BurstSize = len(burst)
+			} else {
+				details.BurstLeader = path.Base(burst[0])
+			}
+		}
+	}
+}
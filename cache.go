@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// With PersistCaches on, what 50mm works out about every photo by downloading (some of) it is kept in the
+// album's prefix as well, so the next instance to start, or another one serving the same bucket, reads one object
+// instead of every photo. Any instance writes it, whenever it's worked out something new. An entry only counts
+// for the photo it was worked out from: one that has been replaced since (going by its last modified date) is
+// worked out again.
+const PERSISTED_CACHE_NAME = PREBUILT_ZIP_FOLDER + "cache.json"
+
+// entries written by other versions of 50mm may mean something else, so they're ignored
+const PERSISTED_CACHE_VERSION = 2
+
+type PersistedCache struct {
+	Version int                             `json:"version"`
+	Photos  map[string]PersistedCachedPhoto `json:"photos"` //by key
+}
+
+type PersistedCachedPhoto struct {
+	Modified time.Time      `json:"modified"`
+	Exif     *ExifData      `json:"exif,omitempty"`
+	Analysis *ImageAnalysis `json:"analysis,omitempty"`
+	Animated *bool          `json:"animated,omitempty"`
+}
+
+// reads the persisted cache in to the album's caches, for keys that haven't changed since it was written
+func (a *Album) loadPersistedCache() error {
+	data, err := a.GetObjectFromBucket(PERSISTED_CACHE_NAME)
+	if isNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var cache PersistedCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return fmt.Errorf("Unable to read %s: %s", PERSISTED_CACHE_NAME, err.Error())
+	}
+	if cache.Version != PERSISTED_CACHE_VERSION {
+		return nil
+	}
+
+	dates, _ := a.KeyDatesCache.Load().(map[string]time.Time)
+	a.exifCacheMutex.Lock()
+	a.imageAnalysisCacheMutex.Lock()
+	a.animationCacheMutex.Lock()
+	defer a.exifCacheMutex.Unlock()
+	defer a.imageAnalysisCacheMutex.Unlock()
+	defer a.animationCacheMutex.Unlock()
+	if a.exifCache == nil {
+		a.exifCache = make(map[string]*ExifData)
+	}
+	if a.imageAnalysisCache == nil {
+		a.imageAnalysisCache = make(map[string]ImageAnalysis)
+	}
+	if a.animationCache == nil {
+		a.animationCache = make(map[string]bool)
+	}
+	for k, v := range cache.Photos {
+		modified, ok := dates[k]
+		if !ok || !modified.Equal(v.Modified) {
+			continue
+		}
+		if v.Exif != nil {
+			a.exifCache[k] = v.Exif
+		}
+		if v.Analysis != nil {
+			a.imageAnalysisCache[k] = *v.Analysis
+		}
+		if v.Animated != nil {
+			a.animationCache[k] = *v.Animated
+		}
+	}
+	return nil
+}
+
+// once, on the album's first load, before anything is worked out that's in there already
+func (a *Album) loadPersistedCacheOnce() {
+	if !a.site.PersistCaches || !atomic.CompareAndSwapInt32(&a.persistedCacheLoaded, 0, 1) {
+		return
+	}
+	if err := a.loadPersistedCache(); err != nil {
+		fmt.Printf("\nUnable to read %s of album %s. Error: %s", PERSISTED_CACHE_NAME, a.Path, err.Error())
+		return
+	}
+	// only what's changed since is written back
+	if _, fingerprint, err := a.marshalPersistedCache(); err == nil {
+		a.persistedCacheFingerprint.Store(fingerprint)
+	}
+}
+
+// what the album's caches know about the keys that are in it now
+func (a *Album) getPersistedCache() PersistedCache {
+	cache := PersistedCache{PERSISTED_CACHE_VERSION, make(map[string]PersistedCachedPhoto)}
+	dates, _ := a.KeyDatesCache.Load().(map[string]time.Time)
+
+	a.exifCacheMutex.RLock()
+	a.imageAnalysisCacheMutex.Lock()
+	a.animationCacheMutex.RLock()
+	defer a.exifCacheMutex.RUnlock()
+	defer a.imageAnalysisCacheMutex.Unlock()
+	defer a.animationCacheMutex.RUnlock()
+	for k, modified := range dates {
+		photo := PersistedCachedPhoto{Modified: modified, Exif: a.exifCache[k]}
+		if analysis, ok := a.imageAnalysisCache[k]; ok {
+			photo.Analysis = &analysis
+		}
+		if animated, ok := a.animationCache[k]; ok {
+			photo.Animated = &animated
+		}
+		if photo.Exif != nil || photo.Analysis != nil || photo.Animated != nil {
+			cache.Photos[k] = photo
+		}
+	}
+	return cache
+}
+
+func (a *Album) marshalPersistedCache() ([]byte, string, error) {
+	data, err := json.Marshal(a.getPersistedCache())
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.Sum256(data)
+	return data, hex.EncodeToString(hash[:]), nil
+}
+
+// writes the persisted cache when it has changed since this instance last read or wrote it
+func (a *Album) writePersistedCache() error {
+	data, fingerprint, err := a.marshalPersistedCache()
+	if err != nil {
+		return err
+	}
+	if previous, _ := a.persistedCacheFingerprint.Load().(string); previous == fingerprint {
+		return nil
+	}
+
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(a.site.BucketName),
+		Key:         aws.String(a.BucketPrefix + PERSISTED_CACHE_NAME),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err == nil {
+		a.persistedCacheFingerprint.Store(fingerprint)
+	}
+	return err
+}
+
+// Called when the album's caches have learned something, in the background. Like updateStaticMirror, calls
+// while it's writing have it write once more when it's done.
+func (a *Album) updatePersistedCache() {
+	if !a.site.PersistCaches {
+		return
+	}
+	atomic.StoreInt32(&a.persistedCachePending, 1)
+	for atomic.CompareAndSwapInt32(&a.persistedCacheUpdating, 0, 1) {
+		for atomic.CompareAndSwapInt32(&a.persistedCachePending, 1, 0) {
+			if err := a.writePersistedCache(); err != nil {
+				fmt.Printf("\nUnable to write %s of album %s. Error: %s", PERSISTED_CACHE_NAME, a.Path, err.Error())
+			}
+		}
+		atomic.StoreInt32(&a.persistedCacheUpdating, 0)
+
+		// a call between the last write and the line above left it pending, and found it still updating
+		if atomic.LoadInt32(&a.persistedCachePending) == 0 {
+			return
+		}
+	}
+}
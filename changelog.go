@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// sites with HasChangelog set list what's new on their albums at this path
+const CHANGELOG_PATH = "/changelog/"
+
+// older news isn't news anymore
+const CHANGELOG_MAX_ENTRIES = 50
+
+type ChangelogPageContext struct {
+	*BasePageContext
+
+	Entries []ChangelogEntry
+}
+
+// photos that showed up in an album on a given day. The first day photos showed up in an album is the day
+// the album itself was added.
+type ChangelogEntry struct {
+	Date       time.Time
+	Album      *Album
+	NumPhotos  int
+	IsNewAlbum bool
+}
+
+// The album's history, newest first, going by when the photos currently in the album were uploaded to the
+// bucket (as far as the last refresh of the key cache knows). Photos that were removed or excluded since
+// don't show up.
+func (a *Album) GetChangelogEntries() []ChangelogEntry {
+	orderingKeys, err := a.getVisibleOrderedKeys()
+	if err != nil {
+		return nil
+	}
+
+	dates, _ := a.KeyDatesCache.Load().(map[string]time.Time)
+	photosByDay := make(map[time.Time]int)
+	for _, v := range orderingKeys.Ordering {
+		date, ok := dates[v]
+		if !ok {
+			continue
+		}
+
+		day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+		photosByDay[day]++
+	}
+
+	var entries []ChangelogEntry
+	for day, count := range photosByDay {
+		entries = append(entries, ChangelogEntry{Date: day, Album: a, NumPhotos: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Date.After(entries[j].Date)
+	})
+
+	if len(entries) > 0 {
+		entries[len(entries)-1].IsNewAlbum = true
+	}
+	return entries
+}
+
+// the changelog of every album in the index, newest first. Albums left out of the index stay out of
+// the changelog too, and so do albums with NoIndex, which aren't news for search engines to pick up.
+func (s *Site) GetChangelog() []ChangelogEntry {
+	var entries []ChangelogEntry
+	for _, a := range s.GetAlbumsForIndex() {
+		if a.NoIndex {
+			continue
+		}
+		entries = append(entries, a.GetChangelogEntries()...)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Date.After(entries[j].Date)
+	})
+	if len(entries) > CHANGELOG_MAX_ENTRIES {
+		entries = entries[:CHANGELOG_MAX_ENTRIES]
+	}
+	return entries
+}
+
+func handleChangelog(site *Site, w http.ResponseWriter, r *http.Request) {
+	if site.HasAuth() && !checkAndRequireAuth(w, r, site) {
+		return
+	}
+
+	u := site.GetUrlForPath(CHANGELOG_PATH)
+
+	locale := site.GetLocale(w, r)
+	ctx := &ChangelogPageContext{
+		&BasePageContext{
+			site.GetCanonicalUrl().String(),
+			u.String(),
+			locale.T("whats_new") + " | " + site.MetaTitle,
+			site.SiteTitle,
+			locale,
+			site.GetTheme(),
+			site.GetColorScheme(),
+		},
+		site.GetChangelog(),
+	}
+	site.executeTemplate(w, "changelog.html", ctx)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// uploads carry their SHA-256 as x-amz-meta-sha256, as the ETag is only the MD5 of objects uploaded in one part
+const UPLOAD_CHECKSUM_METADATA = "Sha256"
+
+// every upload goes up in parts this big, so we know what the ETag of an object uploaded in parts will be
+const UPLOAD_PART_SIZE = 16 * 1024 * 1024
+
+type UploadChecksums struct {
+	Size   int64
+	Md5    string
+	Sha256 string
+
+	// what S3 should answer with: the MD5 for uploads that fit in a part, an MD5 of the parts' MD5s followed by
+	// the number of parts for the others
+	Etag string
+}
+
+// the Content-MD5 header of uploads that go up in one part, S3 refuses the upload if what it got doesn't match
+func (c UploadChecksums) Md5Base64() string {
+	sum, _ := hex.DecodeString(c.Md5)
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+func (c UploadChecksums) IsMultipart() bool {
+	return c.Size > UPLOAD_PART_SIZE
+}
+
+// works out the checksums of whatever's written to it, in one pass
+type checksumWriter struct {
+	size     int64
+	md5      hash.Hash
+	sha256   hash.Hash
+	part     hash.Hash
+	partSize int64
+	parts    []byte
+}
+
+func newChecksumWriter() *checksumWriter {
+	return &checksumWriter{md5: md5.New(), sha256: sha256.New(), part: md5.New()}
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	c.md5.Write(p)
+	c.sha256.Write(p)
+	c.size += int64(len(p))
+
+	for len(p) > 0 {
+		n := int64(len(p))
+		if n > UPLOAD_PART_SIZE-c.partSize {
+			n = UPLOAD_PART_SIZE - c.partSize
+		}
+		c.part.Write(p[:n])
+		c.partSize += n
+		p = p[n:]
+		if c.partSize == UPLOAD_PART_SIZE {
+			c.parts = c.part.Sum(c.parts)
+			c.part.Reset()
+			c.partSize = 0
+		}
+	}
+	return written, nil
+}
+
+func (c *checksumWriter) Checksums() UploadChecksums {
+	checksums := UploadChecksums{
+		Size:   c.size,
+		Md5:    hex.EncodeToString(c.md5.Sum(nil)),
+		Sha256: hex.EncodeToString(c.sha256.Sum(nil)),
+	}
+	checksums.Etag = checksums.Md5
+
+	if checksums.IsMultipart() {
+		parts := c.parts
+		count := len(parts) / md5.Size
+		if c.partSize > 0 {
+			parts = c.part.Sum(parts)
+			count++
+		}
+		sum := md5.Sum(parts)
+		checksums.Etag = fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), count)
+	}
+	return checksums
+}
+
+// reads the whole upload, and rewinds it for whatever reads it next
+func checksumUpload(body io.ReadSeeker) (UploadChecksums, error) {
+	writer := newChecksumWriter()
+	if _, err := io.Copy(writer, body); err != nil {
+		return UploadChecksums{}, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return UploadChecksums{}, err
+	}
+	return writer.Checksums(), nil
+}
+
+func checksumBytes(data []byte) UploadChecksums {
+	checksums, _ := checksumUpload(bytes.NewReader(data))
+	return checksums
+}
+
+func newUploader(svc *s3.S3) *s3manager.Uploader {
+	return s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+		u.PartSize = UPLOAD_PART_SIZE
+	})
+}
+
+// Checks that what S3 stored is what we sent: the size, and the ETag unless the bucket encrypts with KMS (which
+// makes for ETags that aren't MD5s). Objects that don't match are deleted again, so a truncated or garbled
+// upload never shows up in an album.
+func verifyUploadedObject(svc *s3.S3, bucket string, key string, checksums UploadChecksums) error {
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to check the upload of %s: %s", key, err.Error())
+	}
+
+	etag := strings.Trim(aws.StringValue(head.ETag), `"`)
+	matches := aws.Int64Value(head.ContentLength) == checksums.Size
+	if aws.StringValue(head.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms {
+		matches = matches && etag == checksums.Etag
+	}
+	if matches {
+		return nil
+	}
+
+	svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return fmt.Errorf("The upload of %s was stored with ETag %s and %d bytes rather than %s and %d bytes, "+
+		"it has been removed again", key, etag, aws.Int64Value(head.ContentLength), checksums.Etag, checksums.Size)
+}
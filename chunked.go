@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Big files (TIFFs, videos) go up a part at a time, straight in to an S3 multipart upload next to the album
+// where it doesn't list them. A part that fails is sent again on its own, and an upload cut short can carry on
+// from the parts S3 already has. Once all parts are in, the upload goes through the same checks as any other
+// before it's copied in to the album.
+const CHUNKED_UPLOAD_FOLDER = PREBUILT_ZIP_FOLDER + "uploads/"
+
+// S3 wants parts of at least 5MB (but for the last), and no more than 10000 of them
+const CHUNKED_UPLOAD_PART_SIZE = UPLOAD_PART_SIZE
+const CHUNKED_UPLOAD_MAX_PARTS = 10000
+
+// CopyObject copies up to 5GB, bigger objects are copied a part at a time
+const S3_MAX_COPY_SIZE = 5 * 1024 * 1024 * 1024
+const S3_COPY_PART_SIZE = 512 * 1024 * 1024
+
+type ChunkedUpload struct {
+	Key      string `json:"key"`
+	UploadId string `json:"uploadId"`
+	PartSize int64  `json:"partSize"`
+}
+
+type ChunkedUploadPart struct {
+	Part int64 `json:"part"`
+	Size int64 `json:"size"`
+}
+
+// the staging key of the upload, after checking it's one of this album's
+func (a *Album) getChunkedUploadKey(r *http.Request) (string, error) {
+	key := r.FormValue("key")
+	rest := strings.TrimPrefix(key, a.BucketPrefix+CHUNKED_UPLOAD_FOLDER)
+	if rest == key || strings.Count(rest, "/") != 1 || !a.IsUploadableName(path.Base(rest)) || r.FormValue("uploadId") == "" {
+		return "", errors.New("Not an upload to this album")
+	}
+	return key, nil
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func handleAdminUploadStart(album *Album, w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if !album.IsUploadableName(name) {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("%s isn't a photo this album can show", name))
+		return
+	}
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size <= 0 || size > CHUNKED_UPLOAD_PART_SIZE*CHUNKED_UPLOAD_MAX_PARTS {
+		writeAdminError(w, http.StatusBadRequest, errors.New("The size of the upload is missing, or too big"))
+		return
+	}
+
+	svc, err := album.site.GetS3Service()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	key := album.BucketPrefix + CHUNKED_UPLOAD_FOLDER + id + "/" + name
+	created, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(album.site.BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminJSON(w, &ChunkedUpload{key, aws.StringValue(created.UploadId), CHUNKED_UPLOAD_PART_SIZE})
+}
+
+// the part is the body of the request, sent with its MD5 so a part garbled on the way is refused by S3
+func handleAdminUploadPart(album *Album, w http.ResponseWriter, r *http.Request) {
+	key, err := album.getChunkedUploadKey(r)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	part, err := strconv.ParseInt(r.FormValue("part"), 10, 64)
+	if err != nil || part < 1 || part > CHUNKED_UPLOAD_MAX_PARTS {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("part must be between 1 and %d", CHUNKED_UPLOAD_MAX_PARTS))
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, CHUNKED_UPLOAD_PART_SIZE))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Unable to read the part, parts can't be bigger than %d bytes", CHUNKED_UPLOAD_PART_SIZE))
+		return
+	}
+
+	svc, err := album.site.GetS3Service()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sum := md5.Sum(data)
+	if _, err := svc.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String(album.site.BucketName),
+		Key:        aws.String(key),
+		UploadId:   aws.String(r.FormValue("uploadId")),
+		PartNumber: aws.Int64(part),
+		Body:       bytes.NewReader(data),
+		ContentMD5: aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+	}); err != nil {
+		writeAdminError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeAdminJSON(w, &ChunkedUploadPart{part, int64(len(data))})
+}
+
+func listChunkedUploadParts(svc *s3.S3, bucket string, key string, uploadId string) ([]*s3.Part, error) {
+	var parts []*s3.Part
+	err := svc.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		parts = append(parts, page.Parts...)
+		return true
+	})
+	return parts, err
+}
+
+// the parts S3 already has, so an upload that was cut short only sends the rest
+func handleAdminUploadParts(album *Album, w http.ResponseWriter, r *http.Request) {
+	key, err := album.getChunkedUploadKey(r)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	svc, err := album.site.GetS3Service()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	parts, err := listChunkedUploadParts(svc, album.site.BucketName, key, r.FormValue("uploadId"))
+	if err != nil {
+		// most likely the upload was finished or aborted, the browser starts over
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	done := []ChunkedUploadPart{}
+	for _, v := range parts {
+		done = append(done, ChunkedUploadPart{aws.Int64Value(v.PartNumber), aws.Int64Value(v.Size)})
+	}
+	writeAdminJSON(w, map[string]interface{}{"parts": done})
+}
+
+func handleAdminUploadComplete(album *Album, w http.ResponseWriter, r *http.Request) {
+	key, err := album.getChunkedUploadKey(r)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, errors.New("The size of the upload is missing"))
+		return
+	}
+	svc, err := album.site.GetS3Service()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	uploadId := r.FormValue("uploadId")
+	parts, err := listChunkedUploadParts(svc, album.site.BucketName, key, uploadId)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	var completed []*s3.CompletedPart
+	for i, v := range parts {
+		// a missing part would make for a file with a hole in it
+		if aws.Int64Value(v.PartNumber) != int64(i+1) {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Part %d of the upload is missing", i+1))
+			return
+		}
+		completed = append(completed, &s3.CompletedPart{ETag: v.ETag, PartNumber: v.PartNumber})
+	}
+	if _, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(album.site.BucketName),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	}); err != nil {
+		writeAdminError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	name := path.Base(key)
+	skipped, err := album.PublishStagedUpload(name, key, size)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if skipped == "" {
+		album.RefreshKeyCache()
+	}
+	writeAdminJSON(w, map[string]string{"name": name, "skipped": skipped})
+}
+
+func handleAdminUploadAbort(album *Album, w http.ResponseWriter, r *http.Request) {
+	key, err := album.getChunkedUploadKey(r)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	svc, err := album.site.GetS3Service()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(album.site.BucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(r.FormValue("uploadId")),
+	}); err != nil {
+		writeAdminError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeAdminJSON(w, map[string]bool{"aborted": true})
+}
+
+// Reads the finished upload back from its staging key, for the scanner and the checksums, and copies it in to
+// the album unless it's a duplicate or the scanner objects to it. The staging copy is removed either way. Gives
+// why the upload was skipped, empty when it made it in to the album.
+func (a *Album) PublishStagedUpload(name string, stagingKey string, size int64) (string, error) {
+	if err := a.checkNotLocked(); err != nil {
+		return "", err
+	}
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return "", err
+	}
+	defer svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(a.site.BucketName),
+		Key:    aws.String(stagingKey),
+	})
+
+	object, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(a.site.BucketName),
+		Key:    aws.String(stagingKey),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer object.Body.Close()
+
+	checksum := newChecksumWriter()
+	body := io.TeeReader(object.Body, checksum)
+	var found string
+	if scanner := a.site.GetUploadScanner(); scanner != nil {
+		if found, err = scanner.Scan(name, body); err != nil {
+			return "", fmt.Errorf("Unable to scan %s: %s", name, err.Error())
+		}
+	}
+	// the scanner may stop reading early, the checksums need all of it
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return "", err
+	}
+	if found != "" {
+		fmt.Printf("\nRefused upload %s to album %s, the scanner found %s", name, a.Path, found)
+		return "The scanner found " + found, nil
+	}
+
+	checksums := checksum.Checksums()
+	if checksums.Size != size {
+		return "", fmt.Errorf("The upload of %s has %d bytes rather than %d, please try again", name, checksums.Size, size)
+	}
+	duplicate, err := a.FindDuplicateObject(checksums)
+	if err != nil {
+		return "", fmt.Errorf("Unable to look for duplicates of %s: %s", name, err.Error())
+	}
+	if duplicate != "" {
+		return "Already in the album as " + path.Base(duplicate), nil
+	}
+
+	if err := a.checkNotHeld(svc, name); err != nil {
+		return "", err
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	metadata := map[string]*string{UPLOAD_CHECKSUM_METADATA: aws.String(checksums.Sha256)}
+	if err := copyObject(svc, a.site.BucketName, stagingKey, a.BucketPrefix+name, size, contentType, metadata); err != nil {
+		return "", err
+	}
+
+	// copies get ETags of their own, so only the size can be checked against what was read back
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(a.site.BucketName),
+		Key:    aws.String(a.BucketPrefix + name),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to check the upload of %s: %s", name, err.Error())
+	}
+	if aws.Int64Value(head.ContentLength) != size {
+		svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(a.site.BucketName),
+			Key:    aws.String(a.BucketPrefix + name),
+		})
+		return "", fmt.Errorf("The upload of %s was stored with %d bytes rather than %d, it has been removed again",
+			name, aws.Int64Value(head.ContentLength), size)
+	}
+	return "", nil
+}
+
+func copyObject(svc *s3.S3, bucket string, src string, dst string, size int64, contentType string, metadata map[string]*string) error {
+	source := (&url.URL{Path: bucket + "/" + src}).EscapedPath()
+	if size <= S3_MAX_COPY_SIZE {
+		_, err := svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:            aws.String(bucket),
+			Key:               aws.String(dst),
+			CopySource:        aws.String(source),
+			ContentType:       aws.String(contentType),
+			Metadata:          metadata,
+			MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		})
+		return err
+	}
+
+	created, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(dst),
+		ContentType: aws.String(contentType),
+		Metadata:    metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	var completed []*s3.CompletedPart
+	for start, part := int64(0), int64(1); start < size; start, part = start+S3_COPY_PART_SIZE, part+1 {
+		end := start + S3_COPY_PART_SIZE - 1
+		if end >= size {
+			end = size - 1
+		}
+		copied, err := svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(dst),
+			UploadId:        created.UploadId,
+			PartNumber:      aws.Int64(part),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucket),
+				Key:      aws.String(dst),
+				UploadId: created.UploadId,
+			})
+			return err
+		}
+		completed = append(completed, &s3.CompletedPart{ETag: copied.CopyPartResult.ETag, PartNumber: aws.Int64(part)})
+	}
+
+	_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(dst),
+		UploadId:        created.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+// With ResizingService = cloudfront and CloudfrontSignedCookies, album pages hand out CloudFront's signed cookies
+// once the visitor is let in, rather than signing every photo URL. The cookies are scoped to the album's
+// BucketPrefix on the distribution, so the CDN lets through exactly the photos of the albums the browser has
+// been let in to. Browsers only send them along when the distribution is on a domain the site shares, which is
+// CloudfrontCookieDomain (example.com for photos.example.com and cdn.example.com).
+const CLOUDFRONT_COOKIE_EXPIRY = 12 * time.Hour
+
+func (s *Site) UsesCloudfrontCookies() bool {
+	return s.ResizingService == "cloudfront" && s.CloudfrontSignedCookies
+}
+
+func isHostInDomain(host string, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func (s *Site) validateCloudfrontCookies() error {
+	if !s.CloudfrontSignedCookies {
+		if s.CloudfrontCookieDomain != "" {
+			return errors.New("CloudfrontCookieDomain needs CloudfrontSignedCookies")
+		}
+		return nil
+	}
+
+	// thumbor's URLs put the options before the key, so there's no path to scope an album's cookies to
+	if s.ResizingService != "cloudfront" {
+		return errors.New("CloudfrontSignedCookies needs ResizingService = cloudfront")
+	}
+	if s.CloudfrontCookieDomain == "" {
+		return errors.New("CloudfrontSignedCookies needs the CloudfrontCookieDomain the site and the distribution share")
+	}
+	cookieDomain := strings.TrimPrefix(s.CloudfrontCookieDomain, ".")
+
+	baseUrl, err := url.Parse(s.BaseUrl)
+	if err != nil || baseUrl.Host == "" {
+		return errors.New("CloudfrontSignedCookies needs the distribution's URL as BaseUrl, like https://cdn.example.com/")
+	}
+	if !isHostInDomain(baseUrl.Hostname(), cookieDomain) {
+		return fmt.Errorf("BaseUrl %s isn't in CloudfrontCookieDomain %s, browsers wouldn't send it the cookies", s.BaseUrl, cookieDomain)
+	}
+	if !isHostInDomain(strings.Split(s.Domain, ":")[0], cookieDomain) {
+		return fmt.Errorf("Domain %s isn't in CloudfrontCookieDomain %s, it can't set cookies for it", s.Domain, cookieDomain)
+	}
+
+	// the mirror has nothing to hand out the cookies, its photos wouldn't load
+	if s.HasStaticMirror() {
+		return errors.New("StaticMirrorBucket can't be used with CloudfrontSignedCookies")
+	}
+	return nil
+}
+
+func (a *Album) getCloudfrontCookieLifetime() time.Duration {
+	if lifetime := a.getImageUrlLifetime(); lifetime > 0 {
+		return lifetime
+	}
+	return CLOUDFRONT_COOKIE_EXPIRY
+}
+
+// the album's photos on the distribution, as a prefix of their URLs
+func (a *Album) getCloudfrontPhotosUrl() (*url.URL, error) {
+	baseUrl, err := url.Parse(a.site.BaseUrl)
+	if err != nil {
+		return nil, err
+	}
+	return baseUrl.ResolveReference(&url.URL{Path: a.BucketPrefix}), nil
+}
+
+func (a *Album) getCloudfrontCookieOptions(photosUrl *url.URL) func(*sign.CookieOptions) {
+	return func(o *sign.CookieOptions) {
+		o.Path = photosUrl.EscapedPath()
+		o.Domain = strings.TrimPrefix(a.site.CloudfrontCookieDomain, ".")
+		o.Secure = photosUrl.Scheme == "https"
+	}
+}
+
+// Hands out the cookies that let the browser load the album's photos from the distribution, for as long as its
+// photo URLs would work otherwise. Called once the visitor has been let in to the album.
+func (a *Album) setCloudfrontCookies(w http.ResponseWriter) {
+	if !a.site.UsesCloudfrontCookies() {
+		return
+	}
+
+	photosUrl, err := a.getCloudfrontPhotosUrl()
+	if err != nil {
+		fmt.Printf("\nUnable to sign CloudFront cookies for album %s. Error: %s", a.Path, err.Error())
+		return
+	}
+
+	expires := time.Now().Add(a.getCloudfrontCookieLifetime())
+	policy := &sign.Policy{
+		Statements: []sign.Statement{{
+			Resource:  photosUrl.String() + "*",
+			Condition: sign.Condition{DateLessThan: sign.NewAWSEpochTime(expires)},
+		}},
+	}
+	signer := sign.NewCookieSigner(a.site.AWS_CLOUDFRONT_PRIVATE_KEY_PAIR_ID, a.site.CloudfrontPrivateKey,
+		a.getCloudfrontCookieOptions(photosUrl))
+	cookies, err := signer.SignWithPolicy(policy)
+	if err != nil {
+		fmt.Printf("\nUnable to sign CloudFront cookies for album %s. Error: %s", a.Path, err.Error())
+		return
+	}
+	for _, c := range cookies {
+		c.Expires = expires
+		c.SameSite = http.SameSiteLaxMode
+		http.SetCookie(w, c)
+	}
+}
+
+// Browsers don't send the cookies to the site, so they're cleared whether or not the browser has them
+func (a *Album) clearCloudfrontCookies(w http.ResponseWriter) {
+	if !a.site.UsesCloudfrontCookies() {
+		return
+	}
+
+	photosUrl, err := a.getCloudfrontPhotosUrl()
+	if err != nil {
+		return
+	}
+	options := sign.CookieOptions{}
+	a.getCloudfrontCookieOptions(photosUrl)(&options)
+	for _, name := range []string{sign.CookiePolicyName, sign.CookieSignatureName, sign.CookieKeyIDName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     options.Path,
+			Domain:   options.Domain,
+			Expires:  time.Unix(0, 0),
+			Secure:   options.Secure,
+			HttpOnly: true,
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Pages follow the visitor's light or dark setting (prefers-color-scheme) unless the site's ColorScheme keeps them
+// light or dark. Templates get it as .ColorScheme and put it on <html data-color-scheme="...">, which the
+// stylesheets go by, so a template or theme can style the schemes differently, or leave dark out.
+const COLOR_SCHEME_AUTO = "auto"
+const COLOR_SCHEME_LIGHT = "light"
+const COLOR_SCHEME_DARK = "dark"
+
+func validateColorScheme(scheme string) error {
+	if scheme == "" || scheme == COLOR_SCHEME_AUTO || scheme == COLOR_SCHEME_LIGHT || scheme == COLOR_SCHEME_DARK {
+		return nil
+	}
+	return fmt.Errorf("ColorScheme should be one of %s, %s or %s", COLOR_SCHEME_AUTO, COLOR_SCHEME_LIGHT, COLOR_SCHEME_DARK)
+}
+
+func (s *Site) GetColorScheme() string {
+	if s.ColorScheme == "" {
+		return COLOR_SCHEME_AUTO
+	}
+	return s.ColorScheme
+}
+
+// the schemes the page can be shown in, for <meta name="color-scheme">, so browsers don't flash white before
+// the stylesheets are in. Pages without a scheme (the admin's) are light.
+func (c *BasePageContext) SupportedColorSchemes() string {
+	switch c.ColorScheme {
+	case COLOR_SCHEME_AUTO:
+		return "light dark"
+	case COLOR_SCHEME_DARK:
+		return COLOR_SCHEME_DARK
+	default:
+		return COLOR_SCHEME_LIGHT
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Sync tools send what they have of an album, and get back what the album is missing, what's different in it and
+// what it has that they don't, so they only upload what changed without listing the bucket themselves. Files
+// are compared like duplicate uploads are found: by size, then by ETag with the file's MD5, and by the SHA-256
+// stored on upload (see UPLOAD_CHECKSUM_METADATA) for objects uploaded in parts.
+const COMPARE_MAX_BYTES = 16 * 1024 * 1024
+
+type CompareManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Md5    string `json:"md5"`
+	Sha256 string `json:"sha256"`
+}
+
+type CompareManifest struct {
+	Files []CompareManifestFile `json:"files"`
+}
+
+type CompareResult struct {
+	Missing   []string `json:"missing"`
+	Changed   []string `json:"changed"`
+	Extra     []string `json:"extra"`
+	Unchanged int      `json:"unchanged"`
+}
+
+func (m *CompareManifest) IsValid(album *Album) error {
+	names := make(map[string]bool)
+	for _, v := range m.Files {
+		if !album.IsUploadableName(v.Name) {
+			return fmt.Errorf("%s isn't a photo this album can show", v.Name)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("%s is in the manifest more than once", v.Name)
+		}
+		if v.Md5 == "" && v.Sha256 == "" {
+			return fmt.Errorf("%s needs its md5 or sha256", v.Name)
+		}
+		names[v.Name] = true
+	}
+	return nil
+}
+
+// the objects right under the album's prefix by name, all of them, however many pages that takes
+func (a *Album) getCompareObjects(svc *s3.S3) (map[string]*s3.Object, error) {
+	objects := make(map[string]*s3.Object)
+	err := svc.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket:    aws.String(a.site.BucketName),
+		Prefix:    aws.String(a.BucketPrefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			objects[strings.TrimPrefix(aws.StringValue(obj.Key), a.BucketPrefix)] = obj
+		}
+		return true
+	})
+	return objects, err
+}
+
+func (a *Album) isSameObject(svc *s3.S3, obj *s3.Object, file CompareManifestFile) (bool, error) {
+	if aws.Int64Value(obj.Size) != file.Size {
+		return false, nil
+	}
+	if file.Md5 != "" && strings.Trim(aws.StringValue(obj.ETag), `"`) == strings.ToLower(file.Md5) {
+		return true, nil
+	}
+	if file.Sha256 == "" {
+		return false, nil
+	}
+
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(a.site.BucketName),
+		Key:    obj.Key,
+	})
+	if err != nil {
+		return false, err
+	}
+	return aws.StringValue(head.Metadata[UPLOAD_CHECKSUM_METADATA]) == strings.ToLower(file.Sha256), nil
+}
+
+// Objects uploaded some other way have no SHA-256 stored, so a file that's only sent with its SHA-256 shows up as
+// changed if it was uploaded in parts. Uploading it again through 50mm stores it.
+func (a *Album) CompareManifest(manifest *CompareManifest) (*CompareResult, error) {
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := a.getCompareObjects(svc)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CompareResult{Missing: []string{}, Changed: []string{}, Extra: []string{}}
+	inManifest := make(map[string]bool)
+	for _, v := range manifest.Files {
+		inManifest[v.Name] = true
+		obj, ok := objects[v.Name]
+		if !ok {
+			result.Missing = append(result.Missing, v.Name)
+			continue
+		}
+		same, err := a.isSameObject(svc, obj, v)
+		if err != nil {
+			return nil, err
+		}
+		if same {
+			result.Unchanged++
+		} else {
+			result.Changed = append(result.Changed, v.Name)
+		}
+	}
+
+	// only what could have been synced in the first place, not the ordering or what's under .50mm/
+	for name := range objects {
+		if !inManifest[name] && a.IsUploadableName(name) {
+			result.Extra = append(result.Extra, name)
+		}
+	}
+	sort.Strings(result.Extra)
+	return result, nil
+}
+
+func handleAdminUploadCompare(album *Album, w http.ResponseWriter, r *http.Request) {
+	var manifest CompareManifest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, COMPARE_MAX_BYTES)).Decode(&manifest); err != nil {
+		writeAdminError(w, http.StatusBadRequest, errors.New("The manifest must be JSON like {\"files\": [{\"name\": ..., \"size\": ..., \"sha256\": ...}]}"))
+		return
+	}
+	if err := manifest.IsValid(album); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := album.CompareManifest(&manifest)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminJSON(w, result)
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 )
 
 const CONFIG_DIR_ENV_VAR = "FIFTYMM_CONFIG_DIR"
@@ -15,8 +17,9 @@ const DEFAULT_PORT = "8080"
 type App struct {
 	port string
 
-	configDir string
-	sites     map[string]*Site
+	configDir  string
+	sites      map[string]*Site
+	sitesMutex sync.RWMutex //sites are swapped when the admin deploys a new config
 }
 
 func NewApp() *App {
@@ -25,10 +28,7 @@ func NewApp() *App {
 		port = DEFAULT_PORT
 	}
 
-	configDir := os.Getenv(CONFIG_DIR_ENV_VAR)
-	if configDir == "" {
-		configDir = DEFAULT_CONFIG_DIR
-	}
+	configDir := getConfigDir()
 
 	configFilesMap := make(map[string]*Site)
 	filepath.Walk(configDir, func(path string, info os.FileInfo, err error) error {
@@ -58,10 +58,41 @@ func NewApp() *App {
 	}
 }
 
+func getConfigDir() string {
+	if configDir := os.Getenv(CONFIG_DIR_ENV_VAR); configDir != "" {
+		return configDir
+	}
+	return DEFAULT_CONFIG_DIR
+}
+
 func (a *App) SiteForDomain(domain string) (*Site, error) {
+	a.sitesMutex.RLock()
+	defer a.sitesMutex.RUnlock()
 	if cs, ok := a.sites[domain]; !ok {
 		return nil, fmt.Errorf("No site configured for domain %s", domain)
 	} else {
 		return cs, nil
 	}
 }
+
+func (a *App) Sites() []*Site {
+	a.sitesMutex.RLock()
+	sites := make([]*Site, 0, len(a.sites))
+	for _, s := range a.sites {
+		sites = append(sites, s)
+	}
+	a.sitesMutex.RUnlock()
+
+	sort.Slice(sites, func(i, j int) bool {
+		return sites[i].Domain < sites[j].Domain
+	})
+	return sites
+}
+
+// Serves site instead of the site of the same domain from now on. Requests the old site is already serving
+// finish with it, its caches aren't carried over.
+func (a *App) ReplaceSite(site *Site) {
+	a.sitesMutex.Lock()
+	a.sites[site.Domain] = site
+	a.sitesMutex.Unlock()
+}
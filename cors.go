@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Sites with CORSOrigins let pages on those origins (or on any, with *) use the API and the photos of ProxyPhotos
+// from the browser, with fetch() or a <canvas>. Preflight requests are answered before any login is checked,
+// browsers send them without one. With CORSCredentials the origins' requests can come with the visitor's
+// cookies or login as well, which only works for origins that are listed.
+const CORS_ANY_ORIGIN = "*"
+
+var DEFAULT_CORS_METHODS = []string{"GET", "HEAD", "POST", "PUT"}
+var DEFAULT_CORS_HEADERS = []string{"Authorization", "Content-Type", "Range"}
+
+// what the routes send that scripts on other origins get to read, for Range requests and revalidation
+var CORS_EXPOSED_HEADERS = []string{"Content-Length", "Content-Range", "Accept-Ranges", "ETag"}
+
+// how long browsers keep a preflight's answer
+const CORS_MAX_AGE = 600
+
+// origins are written scheme://host[:port], like https://example.com, and compared in lower case
+func canonicalizeOrigins(origins []string) []string {
+	var canonical []string
+	for _, v := range origins {
+		origin := strings.ToLower(strings.TrimRight(strings.TrimSpace(v), "/"))
+		if origin != "" {
+			canonical = append(canonical, origin)
+		}
+	}
+	return canonical
+}
+
+func (s *Site) validateCORS() error {
+	s.CORSOrigins = canonicalizeOrigins(s.CORSOrigins)
+	if len(s.CORSOrigins) == 0 {
+		if s.CORSCredentials {
+			return errors.New("CORSCredentials needs the CORSOrigins it lets in")
+		}
+		return nil
+	}
+
+	for _, v := range s.CORSOrigins {
+		if v == CORS_ANY_ORIGIN {
+			if s.CORSCredentials {
+				return errors.New("CORSCredentials can't be used with any origin (*), browsers don't send logins to it")
+			}
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" ||
+			u.RawQuery != "" || u.User != nil {
+			return fmt.Errorf("CORSOrigins %s should be an origin like https://example.com, or *", v)
+		}
+	}
+	var methods []string
+	for _, v := range s.CORSMethods {
+		methods = append(methods, strings.ToUpper(v))
+	}
+	s.CORSMethods = methods
+	return nil
+}
+
+// the Access-Control-Allow-Origin of requests from origin, empty for origins that aren't allowed
+func (s *Site) getCORSAllowedOrigin(origin string) string {
+	origin = strings.ToLower(origin)
+	for _, v := range s.CORSOrigins {
+		if v == CORS_ANY_ORIGIN {
+			return CORS_ANY_ORIGIN
+		}
+		if v == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// Sets the CORS headers of requests from the site's CORSOrigins. Preflight requests are answered here, and
+// handleCORS is true for them, the route has nothing more to do.
+func (s *Site) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	if len(s.CORSOrigins) == 0 {
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	allowed := s.getCORSAllowedOrigin(origin)
+	if allowed != CORS_ANY_ORIGIN {
+		w.Header().Add("Vary", "Origin")
+	}
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if origin == "" || allowed == "" {
+		// without the headers the browser keeps the response from the page
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return preflight
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	if s.CORSCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(CORS_EXPOSED_HEADERS, ", "))
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(s.CORSMethods, ", "))
+	if len(s.CORSHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(s.CORSHeaders, ", "))
+	}
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(CORS_MAX_AGE))
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
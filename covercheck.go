@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// With CheckCovers on, the covers and thumbnails visitors are shown are checked in the background, the first
+// time they're picked and then every CACHE_INTERVAL: the photo has to be in the bucket, and the resizing service
+// has to be able to render it. Until a photo that failed comes through a check again, the next photo of the
+// album that isn't known to fail takes its place, so index tiles and link previews don't show up broken. The
+// failures are listed on the admin's front page.
+type CoverCheck struct {
+	Key     string
+	Error   string // empty when the photo could be shown
+	Checked time.Time
+
+	checking bool
+}
+
+func (a *Album) getCoverCheck(key string) (CoverCheck, bool) {
+	a.coverChecksMutex.Lock()
+	defer a.coverChecksMutex.Unlock()
+	check, ok := a.coverChecks[strings.TrimLeft(key, "/")]
+	if !ok {
+		return CoverCheck{}, false
+	}
+	return *check, true
+}
+
+// photos that haven't been checked yet are given the benefit of the doubt
+func (a *Album) isBrokenCover(key string) bool {
+	check, ok := a.getCoverCheck(key)
+	return ok && check.Error != ""
+}
+
+// checks the photo in the background, unless it's being checked or was checked recently
+func (a *Album) scheduleCoverCheck(key string) {
+	a.coverChecksMutex.Lock()
+	defer a.coverChecksMutex.Unlock()
+	if a.coverChecks == nil {
+		a.coverChecks = make(map[string]*CoverCheck)
+	}
+	check, ok := a.coverChecks[strings.TrimLeft(key, "/")]
+	if ok && (check.checking || time.Since(check.Checked) < CACHE_INTERVAL) {
+		return
+	}
+	if !ok {
+		check = &CoverCheck{Key: strings.TrimLeft(key, "/")}
+		a.coverChecks[check.Key] = check
+	}
+	check.checking = true
+	go a.checkCover(key)
+}
+
+func (a *Album) checkCover(key string) {
+	err := a.getCoverError(key)
+
+	a.coverChecksMutex.Lock()
+	check := a.coverChecks[strings.TrimLeft(key, "/")]
+	check.checking = false
+	check.Checked = time.Now()
+	previous := check.Error
+	check.Error = ""
+	if err != nil {
+		check.Error = err.Error()
+	}
+	a.coverChecksMutex.Unlock()
+
+	if err != nil && previous == "" {
+		fmt.Printf("\nCover or thumbnail %s of album %s can't be shown, using the next photo instead. Error: %s", key, a.Path, err.Error())
+	}
+}
+
+func (a *Album) getCoverError(key string) error {
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return err
+	}
+	if _, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(a.site.BucketName),
+		Key:    aws.String(key),
+	}); err != nil {
+		if isNotFoundError(err) {
+			return fmt.Errorf("%s isn't in the bucket", key)
+		}
+		// the bucket being unreachable says nothing about the photo
+		return nil
+	}
+
+	// only the first byte, like PrewarmCDN
+	u := getUpstreamPhoto(a.GetPhotoForKey(key)).GetPhotoForWidth(PREWARM_PHOTO_WIDTH)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := (&http.Client{Timeout: PREWARM_TIMEOUT}).Do(req)
+	if err != nil {
+		return nil
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable ||
+		resp.StatusCode == http.StatusGatewayTimeout:
+		// the resizing service itself is down, every photo would fail
+		return nil
+	case resp.StatusCode >= 400:
+		return fmt.Errorf("The resizing service answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Swaps covers and thumbnails that are known to fail for the album's next photos, and has the ones that are
+// picked checked. Runs after applyPeopleConsent, the photos taking their place have to be public as well.
+func (a *Album) applyCoverFallback(orderingKeys *AlbumOrderingKeys) {
+	if !a.site.CheckCovers {
+		return
+	}
+
+	used := make(map[string]bool)
+	usable := func(key string) bool {
+		details, ok := orderingKeys.photoDetails[strings.TrimLeft(key, "/")]
+		return !used[key] && !a.isBrokenCover(key) && !(ok && details.hasPrivatePeople)
+	}
+	next := func() string {
+		for _, v := range orderingKeys.Ordering {
+			if usable(v) {
+				return v
+			}
+		}
+		return ""
+	}
+
+	// the ones that were picked are checked even when they're known to fail, so they're back once they're fixed
+	picked := append([]string{orderingKeys.Cover}, orderingKeys.Thumbnails...)
+	for _, v := range picked {
+		used[v] = true
+	}
+
+	if orderingKeys.Cover != "" && a.isBrokenCover(orderingKeys.Cover) {
+		orderingKeys.Cover = next()
+		used[orderingKeys.Cover] = true
+	}
+	var thumbnails []string
+	for _, v := range orderingKeys.Thumbnails {
+		if a.isBrokenCover(v) {
+			if v = next(); v == "" {
+				continue
+			}
+			used[v] = true
+		}
+		thumbnails = append(thumbnails, v)
+	}
+	orderingKeys.Thumbnails = thumbnails
+
+	for _, v := range append(append(picked, orderingKeys.Cover), thumbnails...) {
+		if v != "" {
+			a.scheduleCoverCheck(v)
+		}
+	}
+}
+
+// the covers and thumbnails of the album that failed their last check, for the admin
+func (a *Album) GetCoverFailures() []CoverCheck {
+	a.coverChecksMutex.Lock()
+	defer a.coverChecksMutex.Unlock()
+	var failures []CoverCheck
+	for _, v := range a.coverChecks {
+		if v.Error != "" {
+			failures = append(failures, *v)
+		}
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Key < failures[j].Key
+	})
+	return failures
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Finds an object of the album with the same bytes as an upload, so the same export uploaded twice under
+// another name isn't stored twice. Only objects of the same size are looked at: their ETag is compared first,
+// objects uploaded in parts (or encrypted with KMS) need a HEAD to compare the checksum we stored on upload.
+// Gives the key of the duplicate, empty when there's none.
+func (a *Album) FindDuplicateObject(checksums UploadChecksums) (string, error) {
+	objects, err := a.GetAllObjects()
+	if err != nil {
+		return "", err
+	}
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return "", err
+	}
+
+	for _, obj := range objects {
+		if aws.Int64Value(obj.Size) != checksums.Size || strings.HasSuffix(aws.StringValue(obj.Key), "/") {
+			continue
+		}
+		if strings.Trim(aws.StringValue(obj.ETag), `"`) == checksums.Md5 {
+			return aws.StringValue(obj.Key), nil
+		}
+
+		head, err := svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(a.site.BucketName),
+			Key:    obj.Key,
+		})
+		if err != nil {
+			return "", err
+		}
+		if aws.StringValue(head.Metadata[UPLOAD_CHECKSUM_METADATA]) == checksums.Sha256 {
+			return aws.StringValue(obj.Key), nil
+		}
+	}
+	return "", nil
+}
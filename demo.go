@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// `50mm seed-demo <bucket>` uploads a demo album to the bucket and writes a config for it, so there's a working
+// gallery on localhost to look around in. The photos are drawn by 50mm itself, so there's no license to
+// worry about and nothing to download. Keys are read from the usual AWS environment variables.
+const SEED_DEMO_COMMAND = "seed-demo"
+
+const DEMO_BUCKET_PREFIX = "50mm-demo/"
+const DEMO_PHOTO_WIDTH = 1600
+const DEMO_PHOTO_HEIGHT = 1067
+
+type demoPhoto struct {
+	Name    string
+	Title   string
+	Caption string
+
+	SkyTop    color.RGBA
+	SkyBottom color.RGBA
+	Sun       color.RGBA
+	SunX      float64 //as a fraction of the width and height
+	SunY      float64
+	Hills     []color.RGBA //back to front
+}
+
+var demoPhotos = []demoPhoto{
+	{"dawn.jpg", "Dawn", "The first light over the hills.",
+		color.RGBA{52, 62, 120, 255}, color.RGBA{250, 170, 130, 255}, color.RGBA{255, 230, 180, 255}, 0.3, 0.7,
+		[]color.RGBA{{110, 90, 130, 255}, {70, 60, 100, 255}, {40, 36, 64, 255}}},
+	{"noon.jpg", "Noon", "Not a cloud in the sky.",
+		color.RGBA{40, 110, 200, 255}, color.RGBA{160, 210, 240, 255}, color.RGBA{255, 255, 230, 255}, 0.7, 0.18,
+		[]color.RGBA{{120, 170, 110, 255}, {80, 140, 70, 255}, {50, 100, 45, 255}}},
+	{"dusk.jpg", "Dusk", "The sun going down behind the ridge.",
+		color.RGBA{90, 40, 110, 255}, color.RGBA{250, 120, 60, 255}, color.RGBA{255, 200, 90, 255}, 0.55, 0.62,
+		[]color.RGBA{{150, 70, 80, 255}, {90, 40, 60, 255}, {45, 20, 35, 255}}},
+	{"fog.jpg", "Fog", "Morning fog in the valley.",
+		color.RGBA{170, 180, 190, 255}, color.RGBA{220, 224, 228, 255}, color.RGBA{240, 240, 235, 255}, 0.8, 0.3,
+		[]color.RGBA{{190, 196, 200, 255}, {150, 160, 168, 255}, {110, 120, 130, 255}}},
+	{"night.jpg", "Night", "A full moon and the last of the light.",
+		color.RGBA{8, 12, 36, 255}, color.RGBA{30, 44, 90, 255}, color.RGBA{235, 235, 220, 255}, 0.2, 0.22,
+		[]color.RGBA{{24, 30, 60, 255}, {16, 20, 44, 255}, {6, 8, 20, 255}}},
+}
+
+func mixColor(a color.RGBA, b color.RGBA, t float64) color.RGBA {
+	mix := func(x uint8, y uint8) uint8 {
+		return uint8(float64(x) + (float64(y)-float64(x))*t)
+	}
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 255}
+}
+
+// a sky, a sun and rows of hills
+func (p demoPhoto) draw() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, DEMO_PHOTO_WIDTH, DEMO_PHOTO_HEIGHT))
+	w, h := float64(DEMO_PHOTO_WIDTH), float64(DEMO_PHOTO_HEIGHT)
+	sunX, sunY, sunR := p.SunX*w, p.SunY*h, h/12
+
+	for y := 0; y < DEMO_PHOTO_HEIGHT; y++ {
+		sky := mixColor(p.SkyTop, p.SkyBottom, float64(y)/h)
+		for x := 0; x < DEMO_PHOTO_WIDTH; x++ {
+			c := sky
+			if math.Hypot(float64(x)-sunX, float64(y)-sunY) < sunR {
+				c = p.Sun
+			}
+			for i, hill := range p.Hills {
+				f := float64(i + 1)
+				ridge := h*(0.5+0.12*f) + h/12*math.Sin(float64(x)/w*math.Pi*(1.5+f)+f*2)
+				if float64(y) > ridge {
+					c = hill
+				}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func (p demoPhoto) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, p.draw(), &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func getDemoOrdering() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "cover: %s\nordering:\n", demoPhotos[2].Name)
+	for _, v := range demoPhotos {
+		fmt.Fprintf(&b, "  - key: %s\n    title: %s\n    caption: %s\n", v.Name, v.Title, v.Caption)
+	}
+	return b.Bytes()
+}
+
+// the keys are the ones the AWS CLI and SDKs use, so they're usually set already
+func getDemoAnswers(bucket string) (*setupAnswers, error) {
+	a := &setupAnswers{
+		BucketName:   bucket,
+		BucketRegion: os.Getenv("AWS_REGION"),
+		S3Host:       os.Getenv("AWS_ENDPOINT_URL_S3"),
+		AWSKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		AWSKey:       os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SiteTitle:    "50mm demo",
+		AlbumTitle:   "Demo",
+		AlbumPath:    "/demo/",
+		BucketPrefix: DEMO_BUCKET_PREFIX,
+	}
+	if a.AWSKeyId == "" || a.AWSKey == "" {
+		return nil, errors.New("Set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to keys that can write to the bucket")
+	}
+	if a.BucketRegion == "" {
+		a.BucketRegion = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if a.BucketRegion == "" {
+		a.BucketRegion = DEFAULT_SETUP_REGION
+	}
+	if a.S3Host == "" {
+		a.S3Host = os.Getenv("AWS_ENDPOINT_URL")
+	}
+
+	port := os.Getenv(PORT_ENV_VAR)
+	if port == "" {
+		port = DEFAULT_PORT
+	}
+	a.Domain = "localhost:" + port
+	return a, nil
+}
+
+func uploadDemoAlbum(album *Album, out io.Writer) error {
+	for _, v := range demoPhotos {
+		data, err := v.encode()
+		if err != nil {
+			return err
+		}
+		if err := album.PutObjectInBucket(v.Name, data, "image/jpeg"); err != nil {
+			return fmt.Errorf("Unable to upload %s%s: %s", album.BucketPrefix, v.Name, err.Error())
+		}
+		fmt.Fprintf(out, "Uploaded %s%s\n", album.BucketPrefix, v.Name)
+	}
+
+	if err := album.PutObjectInBucket(ORDERING_YAML_NAME, getDemoOrdering(), ORDERING_YAML_CONTENT_TYPE); err != nil {
+		return fmt.Errorf("Unable to upload %s%s: %s", album.BucketPrefix, ORDERING_YAML_NAME, err.Error())
+	}
+	fmt.Fprintf(out, "Uploaded %s%s\n", album.BucketPrefix, ORDERING_YAML_NAME)
+	return nil
+}
+
+func runSeedDemo(args []string, out io.Writer) error {
+	if len(args) != 1 || args[0] == "" {
+		return fmt.Errorf("Usage: 50mm %s <bucket>", SEED_DEMO_COMMAND)
+	}
+	answers, err := getDemoAnswers(args[0])
+	if err != nil {
+		return err
+	}
+
+	// an existing config is somebody's site, so it's never replaced
+	configDir := getConfigDir()
+	configPath := filepath.Join(configDir, answers.Domain+".ini")
+	if _, err := os.Stat(configPath); err == nil {
+		return fmt.Errorf("%s already exists, remove it to seed the demo again", configPath)
+	}
+
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		return err
+	}
+	stagedPath := configPath + CONFIG_STAGED_SUFFIX
+	if err := ioutil.WriteFile(stagedPath, answers.getConfig(), 0600); err != nil {
+		return err
+	}
+	defer os.Remove(stagedPath)
+
+	site, err := LoadSiteFromFile(stagedPath)
+	if err != nil {
+		return fmt.Errorf("The demo config isn't valid: %s", err.Error())
+	}
+	if err := site.checkBucketReachable(); err != nil {
+		return err
+	}
+	if err := uploadDemoAlbum(site.Albums[0], out); err != nil {
+		return err
+	}
+
+	if err := os.Rename(stagedPath, configPath); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\nWrote %s. Start 50mm and the demo is at %s\n", configPath, site.Albums[0].GetCanonicalUrl().String())
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/go-ini/ini"
+)
+
+// New configs are written next to the site's config file first, and only take its place once they've been
+// loaded and checked. The config they replace is kept, so it can be rolled back to. Neither ends in .ini, so
+// they aren't loaded as sites of their own on restarts.
+const CONFIG_STAGED_SUFFIX = ".staged"
+const CONFIG_PREVIOUS_SUFFIX = ".previous"
+
+// Settings that name files (or sockets) on the server. Whoever logs in to the admin could otherwise read any
+// file 50mm can through them, or create and append to one with AuthAuditLog, so only the config file on the
+// server can change them. Deployed configs can leave them out, or give them a value the config already has.
+var CONFIG_FILE_SETTINGS = []string{"AuthFile", "AuthAuditLog", "TemplateDir", "ErrorTemplate", "JWTPublicKeyPath",
+	"AWSCloudfrontKeyPath", "ClamAVAddress"}
+
+// one deploy at a time, so two admins deploying at once can't both pass the hash check
+var configDeployMutex sync.Mutex
+
+type AdminConfigPageContext struct {
+	*BasePageContext
+
+	Config      string
+	CurrentHash string
+	HasPrevious bool
+	Message     string
+}
+
+func HashConfig(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// whether every album's prefix can be listed with the site's keys, which a site needs to show anything
+func (s *Site) checkBucketReachable() error {
+	svc, err := s.GetS3Service()
+	if err != nil {
+		return err
+	}
+
+	for _, a := range s.Albums {
+		if _, err := svc.ListObjects(&s3.ListObjectsInput{
+			Bucket:  aws.String(s.BucketName),
+			Prefix:  aws.String(a.BucketPrefix),
+			MaxKeys: aws.Int64(1),
+		}); err != nil {
+			return fmt.Errorf("Unable to list album %s in bucket %s: %s", a.Path, s.BucketName, err.Error())
+		}
+	}
+	return nil
+}
+
+// Checks the new config only gives the settings in CONFIG_FILE_SETTINGS the values the current one does, before
+// it's loaded: loading it would already read (or create) the files. Albums that are new in it can use the values
+// of any of the sections of the current config.
+func checkConfigFileSettings(current []byte, data []byte) error {
+	currentCfg, err := ini.Load(current)
+	if err != nil {
+		return err
+	}
+	cfg, err := ini.Load(data)
+	if err != nil {
+		return err
+	}
+
+	for _, section := range cfg.Sections() {
+		currentSection, err := currentCfg.GetSection(section.Name())
+		isNew := err != nil
+		for _, key := range CONFIG_FILE_SETTINGS {
+			if !section.HasKey(key) {
+				continue
+			}
+			value := section.Key(key).String()
+			if !isNew {
+				if currentSection.Key(key).String() != value {
+					return fmt.Errorf("%s names a file on the server, it can only be changed in the config file there", key)
+				}
+				continue
+			}
+
+			known := false
+			for _, v := range currentCfg.Sections() {
+				known = known || (v.HasKey(key) && v.Key(key).String() == value)
+			}
+			if !known {
+				return fmt.Errorf("%s names a file on the server, new albums can only use one the config already has", key)
+			}
+		}
+	}
+	return nil
+}
+
+// loads and checks the staged config as it would be on a restart, giving the site it makes
+func (s *Site) loadStagedConfig(stagedPath string) (*Site, error) {
+	staged, err := LoadSiteFromFile(stagedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// the admin of one site can't take over another's domain, or lock themselves out of rolling back
+	if staged.Domain != s.Domain {
+		return nil, fmt.Errorf("The new config is for %s, it can only change the config of %s", staged.Domain, s.Domain)
+	}
+	if !staged.HasAdmin() {
+		return nil, errors.New("The new config has no AdminUser and AdminPass, it couldn't be rolled back from the admin")
+	}
+	if err := staged.checkBucketReachable(); err != nil {
+		return nil, err
+	}
+	return staged, nil
+}
+
+// Puts data in place of the site's config file, and serves the site it makes, if it loads and can reach the
+// bucket. expectedHash is the hash of the config it was made from, so changes made in the meantime (by another
+// admin, or by hand) aren't lost.
+func (s *Site) DeployConfig(data []byte, expectedHash string) (*Site, error) {
+	if s.configPath == "" {
+		return nil, errors.New("This site wasn't loaded from a config file")
+	}
+
+	configDeployMutex.Lock()
+	defer configDeployMutex.Unlock()
+
+	current, err := ioutil.ReadFile(s.configPath)
+	if err != nil {
+		return nil, err
+	}
+	if HashConfig(current) != expectedHash {
+		return nil, errors.New("The config was changed by somebody else in the meantime, please start over.")
+	}
+
+	if err := checkConfigFileSettings(current, data); err != nil {
+		return nil, err
+	}
+
+	stagedPath := s.configPath + CONFIG_STAGED_SUFFIX
+	if err := ioutil.WriteFile(stagedPath, data, 0600); err != nil {
+		return nil, err
+	}
+	defer os.Remove(stagedPath)
+
+	staged, err := s.loadStagedConfig(stagedPath)
+	if err != nil {
+		closeUnusedAuthAuditLoggers()
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(s.configPath+CONFIG_PREVIOUS_SUFFIX, current, 0600); err != nil {
+		return nil, err
+	}
+	// a rename is atomic, a restart halfway through finds the old config or the new one, never part of either
+	if err := os.Rename(stagedPath, s.configPath); err != nil {
+		return nil, err
+	}
+	staged.configPath = s.configPath
+
+	app.ReplaceSite(staged)
+	fmt.Printf("\nDeployed a new config for %s from %s", s.Domain, s.configPath)
+	return staged, nil
+}
+
+// swaps the config and the previous one, so a rollback can be rolled back as well
+func (s *Site) RollbackConfig() (*Site, error) {
+	previous, err := ioutil.ReadFile(s.configPath + CONFIG_PREVIOUS_SUFFIX)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("There is no previous config to roll back to.")
+		}
+		return nil, err
+	}
+
+	current, err := ioutil.ReadFile(s.configPath)
+	if err != nil {
+		return nil, err
+	}
+	return s.DeployConfig(previous, HashConfig(current))
+}
+
+func (s *Site) hasPreviousConfig() bool {
+	_, err := os.Stat(s.configPath + CONFIG_PREVIOUS_SUFFIX)
+	return err == nil
+}
+
+// the config pages are about the whole site, rather than one of its albums
+func isAdminSitePage(page string) bool {
+	return page == "config" || page == "config/deploy" || page == "config/rollback" || page == "publish"
+}
+
+func handleAdminSitePage(site *Site, page string, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case page == "config" && r.Method == http.MethodGet:
+		handleAdminConfig(site, w, r)
+	case page == "config/deploy" && r.Method == http.MethodPost:
+		handleAdminConfigDeploy(site, w, r)
+	case page == "config/rollback" && r.Method == http.MethodPost:
+		handleAdminConfigRollback(site, w, r)
+	case page == "publish" && r.Method == http.MethodPost:
+		handleAdminPublish(site, w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found\n"))
+	}
+}
+
+func handleAdminConfig(site *Site, w http.ResponseWriter, r *http.Request) {
+	current, err := ioutil.ReadFile(site.configPath)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var message string
+	switch r.FormValue("done") {
+	case "deploy":
+		message = "The new config has been deployed."
+	case "rollback":
+		message = "The previous config has been deployed again."
+	}
+
+	ctx := &AdminConfigPageContext{
+		getAdminBasePageContext(site, ADMIN_PATH+"config", "Config"),
+		string(current),
+		HashConfig(current),
+		site.hasPreviousConfig(),
+		message,
+	}
+	site.executeTemplate(w, "admin_config.html", ctx)
+}
+
+func writeDeployedConfig(deployed *Site, done string, w http.ResponseWriter, r *http.Request) {
+	if getBearerToken(r) != "" {
+		current, _ := ioutil.ReadFile(deployed.configPath)
+		writeAdminJSON(w, map[string]interface{}{"domain": deployed.Domain, "hash": HashConfig(current)})
+		return
+	}
+	http.Redirect(w, r, deployed.GetUrlPath(ADMIN_PATH+"config?done="+url.QueryEscape(done)), http.StatusSeeOther)
+}
+
+// A config that doesn't load, or can't reach the bucket, is refused and nothing changes
+func handleAdminConfigDeploy(site *Site, w http.ResponseWriter, r *http.Request) {
+	deployed, err := site.DeployConfig([]byte(r.PostFormValue("config")), r.PostFormValue("hash"))
+	if err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+	writeDeployedConfig(deployed, "deploy", w, r)
+}
+
+func handleAdminConfigRollback(site *Site, w http.ResponseWriter, r *http.Request) {
+	deployed, err := site.RollbackConfig()
+	if err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+	writeDeployedConfig(deployed, "rollback", w, r)
+}
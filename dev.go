@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+)
+
+// `50mm -dev` is for working on templates and themes: templates, locales and themes are read from disk again for
+// every page, so an edit shows up on the next reload without restarting 50mm, and nothing is cached. Pages come
+// without ETags, and browsers revalidate the files of /static/ and /themes/ every time they're used. It's slower,
+// sites shouldn't be run with it.
+const DEV_FLAG = "dev"
+
+// revalidated on every use with -dev, so changes to stylesheets and scripts show up as well
+func withDevCaching(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if DEBUG {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Albums with Embed on have a compact gallery at <album path>embed, a strip of the album's first photos without
+// the site's header and footer, for blogs and other sites to show in an iframe. The embedding page picks the
+// height of the photos (?height=), how many there are (?count=) and whether they link to their pages on this
+// site (?links=0 to leave the links out). Embeds are shown to anybody, so albums with a login can't have one.
+const ALBUM_EMBED_SLUG = "embed"
+
+const EMBED_DEFAULT_HEIGHT = 200
+const EMBED_MIN_HEIGHT = 50
+const EMBED_MAX_HEIGHT = 1000
+
+const EMBED_DEFAULT_COUNT = 12
+
+type EmbedPageContext struct {
+	*BasePageContext
+
+	AlbumTitle string
+	AlbumUrl   string // the photos' pages are at AlbumUrl followed by their slug, empty when the embed has no links
+
+	Photos     []Renderable
+	Height     int
+	MorePhotos int // how many photos of the album aren't in the embed
+}
+
+func (a *Album) validateEmbed() error {
+	if a.Embed && !a.isEmbeddable() {
+		return errors.New("Embed shows the album on other sites to anybody, an album with a login or AllowedCIDRs (its own or the site's) can't have one")
+	}
+	return nil
+}
+
+// the embed's options from its query, out of range values are brought back in to range
+func getEmbedOptions(r *http.Request) (int, int, bool) {
+	height, count := EMBED_DEFAULT_HEIGHT, EMBED_DEFAULT_COUNT
+	if v, err := strconv.Atoi(r.FormValue("height")); err == nil {
+		height = v
+	}
+	if height < EMBED_MIN_HEIGHT {
+		height = EMBED_MIN_HEIGHT
+	}
+	if height > EMBED_MAX_HEIGHT {
+		height = EMBED_MAX_HEIGHT
+	}
+	if v, err := strconv.Atoi(r.FormValue("count")); err == nil && v > 0 {
+		count = v
+	}
+	return height, count, r.FormValue("links") != "0"
+}
+
+func handleAlbumEmbed(album *Album, w http.ResponseWriter, r *http.Request) {
+	albumOrdering, err := album.GetOrderedPhotos()
+	if err != nil {
+		album.writeLoadError(err, w, r)
+		return
+	}
+	album.setCloudfrontCookies(w)
+
+	height, count, links := getEmbedOptions(r)
+	photos := albumOrdering.Ordering
+	if len(photos) > count {
+		photos = photos[:count]
+	}
+
+	ctx := &EmbedPageContext{
+		&BasePageContext{
+			album.site.GetCanonicalUrl().String(),
+			album.GetCanonicalUrl().String() + ALBUM_EMBED_SLUG,
+			album.MetaTitle,
+			album.site.SiteTitle,
+			album.GetLocale(w, r),
+			album.GetTheme(),
+			album.site.GetColorScheme(),
+		},
+		album.AlbumTitle,
+		"",
+		photos,
+		height,
+		len(albumOrdering.Ordering) - len(photos),
+	}
+	if links {
+		ctx.AlbumUrl = album.GetCanonicalUrl().String()
+	}
+	allowFraming(w)
+	album.site.executeTemplate(w, "embed.html", ctx)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Sites with ErrorPages on show visitors a page with the site's header and styling for the 403s, 404s, 410s and
+// 500s of their pages, from templates/error.html (or the site's ErrorTemplate or TemplateDir), instead of a
+// line of plain text. Albums that can't be loaded while the bucket can't be reached get a 503 saying so, and to
+// try again in a minute. The admin and the API keep their plain errors, and 500s only go to the log, not to
+// the page.
+const ERROR_TEMPLATE = "error.html"
+
+// how long visitors are asked to wait when the bucket can't be reached
+const ERROR_UNREACHABLE_RETRY_AFTER = "60"
+
+type ErrorPageContext struct {
+	*BasePageContext
+
+	Status  int
+	Title   string
+	Message string
+	Detail  string // what went wrong, for the 4xx errors
+
+	AlbumTitle string // empty unless the error is about an album
+	AlbumUrl   string
+}
+
+func (s *Site) validateErrorPages() error {
+	if s.ErrorTemplate == "" {
+		return nil
+	}
+	if !s.ErrorPages {
+		return errors.New("ErrorTemplate is only used with ErrorPages on")
+	}
+	if _, err := os.Stat(s.getTemplatePath(s.GetTheme(), s.ErrorTemplate)); err != nil {
+		return fmt.Errorf("ErrorTemplate %s isn't in templates/ or the TemplateDir: %s", s.ErrorTemplate, err.Error())
+	}
+	return nil
+}
+
+func (s *Site) getErrorTemplate() string {
+	if s.ErrorTemplate != "" {
+		return s.ErrorTemplate
+	}
+	return ERROR_TEMPLATE
+}
+
+// the strings of the page for the status, by their ids in the locales
+func getErrorStringIds(status int) (string, string) {
+	switch status {
+	case http.StatusForbidden:
+		return "error_403_title", "error_403"
+	case http.StatusNotFound:
+		return "error_404_title", "error_404"
+	case http.StatusGone:
+		return "error_410_title", "error_410"
+	case http.StatusServiceUnavailable:
+		return "error_503_title", "error_503"
+	default:
+		return "error_500_title", "error_500"
+	}
+}
+
+// Writes the error, as the site's error page or as detail in plain text for sites without ErrorPages. album is
+// nil for errors that aren't about one.
+func (s *Site) writeErrorPage(album *Album, status int, detail string, w http.ResponseWriter, r *http.Request) {
+	if !s.ErrorPages {
+		w.WriteHeader(status)
+		w.Write([]byte(detail))
+		return
+	}
+
+	var locale *Locale
+	var theme *Theme
+	if album != nil {
+		locale, theme = album.GetLocale(w, r), album.GetTheme()
+	} else {
+		locale, theme = s.GetLocale(w, r), s.GetTheme()
+	}
+	titleId, messageId := getErrorStringIds(status)
+	ctx := &ErrorPageContext{
+		&BasePageContext{
+			s.GetCanonicalUrl().String(),
+			s.GetCanonicalUrl().String(),
+			locale.T(titleId) + " | " + s.MetaTitle,
+			s.SiteTitle,
+			locale,
+			theme,
+			s.GetColorScheme(),
+		},
+		status,
+		locale.T(titleId),
+		locale.T(messageId),
+		"",
+		"",
+		"",
+	}
+	if status < 500 {
+		ctx.Detail = detail
+	} else {
+		log.Printf("%s%s: %d %s", s.Domain, r.URL.Path, status, detail)
+	}
+	if album != nil {
+		ctx.AlbumTitle = album.AlbumTitle
+		ctx.AlbumUrl = album.GetCanonicalUrl().String()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Del("ETag") // set for the page that couldn't be rendered
+	w.WriteHeader(status)
+	s.executeTemplate(w, s.getErrorTemplate(), ctx)
+}
+
+// for albums whose photos couldn't be loaded, a 503 while the bucket can't be reached, a 500 otherwise
+func (a *Album) writeLoadError(err error, w http.ResponseWriter, r *http.Request) {
+	if a.site.IsS3Degraded() {
+		w.Header().Set("Retry-After", ERROR_UNREACHABLE_RETRY_AFTER)
+		a.site.writeErrorPage(a, http.StatusServiceUnavailable, err.Error(), w, r)
+		return
+	}
+	a.site.writeErrorPage(a, http.StatusInternalServerError, err.Error(), w, r)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Album pages get an ETag worked out from what they're made of (the photos, their details and ordering, the
+// site's config and the template) without rendering them, so browsers that already have the page are answered
+// with a 304 and no body. Pages are always revalidated, a refresh that changes the album changes the ETag.
+var templateVersions sync.Map // by template file, only kept when templates are parsed once (see DEBUG)
+
+// a hash of the template's file (see getTemplatePath), so changing a template changes the ETags of the pages it
+// renders
+func getTemplateVersion(templatePath string) string {
+	if v, ok := templateVersions.Load(templatePath); ok && !DEBUG {
+		return v.(string)
+	}
+
+	data, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	version := hex.EncodeToString(sum[:])
+	templateVersions.Store(templatePath, version)
+	return version
+}
+
+// the details that go in to the ETag, signed URLs are different every time they're asked for so they only count
+// for whether they're there
+func getPhotoDetailsFingerprint(details *PhotoDetails) string {
+	if details == nil {
+		return ""
+	}
+	d := *details
+	if d.AnimationUrl != "" {
+		d.AnimationUrl = "animated"
+	}
+	if d.MotionUrl != "" {
+		d.MotionUrl = "motion"
+	}
+	data, _ := json.Marshal(d)
+	return string(data)
+}
+
+// The ETag of a page of the album, as opened with accessQuery in the language of locale. Photo URLs that expire
+// (see UsesSignedUrls) are signed anew on every render, so for those the ETag changes every half of their
+// lifetime as well, before the URLs of a page browsers kept stop working.
+func (a *Album) GetPageETag(accessQuery string, page int, locale *Locale) (string, error) {
+	orderingKeys, err := a.getVisibleOrderedKeys()
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%s\n%d\n%s\n", getTemplateVersion(a.site.getTemplatePath(a.GetTheme(), "album.html")), a.site.configHash, accessQuery, page,
+		locale.getVersion())
+	writeKey := func(key string) {
+		fmt.Fprintf(hash, "%s\n%s\n", key, getPhotoDetailsFingerprint(orderingKeys.photoDetails[strings.TrimLeft(key, "/")]))
+	}
+	writeKey(orderingKeys.Cover)
+	for _, v := range orderingKeys.Thumbnails {
+		writeKey(v)
+	}
+	for _, v := range orderingKeys.Ordering {
+		writeKey(v)
+	}
+	if a.site.UsesSignedUrls() {
+		fmt.Fprintf(hash, "%d\n", time.Now().UnixNano()/int64(a.GetImageUrlExpiry()/2))
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)) + `"`, nil
+}
+
+// whether one of the ETags of an If-None-Match header is etag, weak ones included as they're only compared for GETs
+func matchesETag(ifNoneMatch string, etag string) bool {
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends the ETag of the page, and answers with a 304 when the browser has it already, in which case the page
+// isn't to be written. Pages behind a login are kept out of shared caches.
+func writeNotModified(w http.ResponseWriter, r *http.Request, etag string, private bool) bool {
+	if DEBUG {
+		// with -dev pages change with their templates and themes, which the ETag doesn't all cover
+		w.Header().Set("Cache-Control", "no-store")
+		return false
+	}
+	if private {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("ETag", etag)
+
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !matchesETag(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
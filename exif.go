@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the EXIF block sits at the very start of a JPEG, the rest of the file is never needed
+const EXIF_READ_BYTES = 64 * 1024
+
+const XMP_SEGMENT_PREFIX = "http://ns.adobe.com/xap/1.0/\x00"
+
+const EXIF_TAG_MAKE = 0x010F
+const EXIF_TAG_MODEL = 0x0110
+const EXIF_TAG_ORIENTATION = 0x0112
+const EXIF_TAG_GPS_IFD = 0x8825
+const EXIF_TAG_EXIF_IFD = 0x8769
+const EXIF_TAG_DATE_TIME_ORIGINAL = 0x9003
+const EXIF_TAG_EXPOSURE_TIME = 0x829A
+const EXIF_TAG_F_NUMBER = 0x829D
+const EXIF_TAG_ISO = 0x8827
+const EXIF_TAG_FOCAL_LENGTH = 0x920A
+
+// longer camera names than this are cut short, they're only shown
+const EXIF_MAX_STRING_LENGTH = 64
+
+// EXIF dates have no time zone, they're in whatever time the camera was set to
+const EXIF_DATE_TIME_LAYOUT = "2006:01:02 15:04:05"
+
+const GPS_TAG_LATITUDE_REF = 0x0001
+const GPS_TAG_LATITUDE = 0x0002
+const GPS_TAG_LONGITUDE_REF = 0x0003
+const GPS_TAG_LONGITUDE = 0x0004
+
+// ExifData holds the few metadata values of a JPEG 50mm cares about, read once per photo and cached by its
+// album. Most come from EXIF, the projection from XMP and the dimensions from the JPEG frame header.
+type ExifData struct {
+	// 1 to 8 as defined by the EXIF spec, 0 when the photo has no orientation tag
+	Orientation int
+
+	// in decimal degrees, only meaningful when HasLocation is set
+	HasLocation bool
+	Latitude    float64
+	Longitude   float64
+
+	// when the photo was taken, in the camera's time (read as UTC), zero when unknown
+	DateTime time.Time
+
+	// the GPano projection type photo spheres are tagged with, like "equirectangular", empty for plain photos
+	Projection string
+
+	// in pixels, 0 when the frame header wasn't in the bytes we read
+	Width  int
+	Height int
+
+	// the camera and its settings, shown on photo pages of albums with ShowExif on. Empty or 0 when unknown.
+	Make         string
+	Model        string
+	ExposureTime float64 // in seconds
+	FNumber      float64
+	ISO          int
+	FocalLength  float64 // in millimetres
+}
+
+// Parses the EXIF data of a JPEG from (at least) its first EXIF_READ_BYTES bytes. A JPEG without EXIF data
+// gives an empty ExifData, anything that isn't a JPEG gives an error. XMP and the frame header are picked up
+// on the way.
+func ParseExif(data []byte) (*ExifData, error) {
+	exif := &ExifData{}
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("Not a JPEG file")
+	}
+
+	// walk the segments up to the frame header, the metadata segments all come before it
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil, errors.New("Malformed JPEG segment")
+		}
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if marker == 0xDA || length < 2 {
+			// start of the image data, there are no more metadata segments after this
+			return exif, nil
+		}
+
+		segmentEnd := i + 2 + length
+		if segmentEnd > len(data) {
+			segmentEnd = len(data)
+		}
+		segment := data[i+4 : segmentEnd]
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")):
+			if err := parseExifTiff(segment[6:], exif); err != nil {
+				return exif, err
+			}
+		case marker == 0xE1 && bytes.HasPrefix(segment, []byte(XMP_SEGMENT_PREFIX)):
+			exif.Projection = parseXmpProjection(segment[len(XMP_SEGMENT_PREFIX):])
+		case marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC:
+			// start of frame: precision, then height and width
+			if len(segment) >= 5 {
+				exif.Height = int(binary.BigEndian.Uint16(segment[1:3]))
+				exif.Width = int(binary.BigEndian.Uint16(segment[3:5]))
+			}
+			return exif, nil
+		}
+		i = i + 2 + length
+	}
+	return exif, nil
+}
+
+// reads the tags we need from IFD0 of the TIFF structure inside the EXIF segment
+func parseExifTiff(tiff []byte, exif *ExifData) error {
+	if len(tiff) < 8 {
+		return errors.New("Truncated EXIF data")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return errors.New("Unknown EXIF byte order")
+	}
+
+	var gpsOffset, exifOffset int
+	err := walkExifIfd(tiff, order, int(order.Uint32(tiff[4:8])), func(tag uint16, count int, value []byte) {
+		switch tag {
+		case EXIF_TAG_MAKE:
+			exif.Make = readExifString(tiff, order, count, value)
+		case EXIF_TAG_MODEL:
+			exif.Model = readExifString(tiff, order, count, value)
+		case EXIF_TAG_ORIENTATION:
+			exif.Orientation = int(order.Uint16(value[:2]))
+		case EXIF_TAG_GPS_IFD:
+			gpsOffset = int(order.Uint32(value[:4]))
+		case EXIF_TAG_EXIF_IFD:
+			exifOffset = int(order.Uint32(value[:4]))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if exifOffset != 0 {
+		err = walkExifIfd(tiff, order, exifOffset, func(tag uint16, count int, value []byte) {
+			switch tag {
+			case EXIF_TAG_DATE_TIME_ORIGINAL:
+				exif.DateTime = readExifDateTime(tiff, order, value)
+			case EXIF_TAG_EXPOSURE_TIME:
+				if rationals := readExifRationals(tiff, order, value, 1); len(rationals) == 1 {
+					exif.ExposureTime = rationals[0]
+				}
+			case EXIF_TAG_F_NUMBER:
+				if rationals := readExifRationals(tiff, order, value, 1); len(rationals) == 1 {
+					exif.FNumber = rationals[0]
+				}
+			case EXIF_TAG_ISO:
+				exif.ISO = int(order.Uint16(value[:2]))
+			case EXIF_TAG_FOCAL_LENGTH:
+				if rationals := readExifRationals(tiff, order, value, 1); len(rationals) == 1 {
+					exif.FocalLength = rationals[0]
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if gpsOffset == 0 {
+		return nil
+	}
+
+	var latitudeRef, longitudeRef byte
+	var latitude, longitude []float64
+	err = walkExifIfd(tiff, order, gpsOffset, func(tag uint16, count int, value []byte) {
+		switch tag {
+		case GPS_TAG_LATITUDE_REF:
+			latitudeRef = value[0]
+		case GPS_TAG_LONGITUDE_REF:
+			longitudeRef = value[0]
+		case GPS_TAG_LATITUDE:
+			latitude = readExifRationals(tiff, order, value, 3)
+		case GPS_TAG_LONGITUDE:
+			longitude = readExifRationals(tiff, order, value, 3)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// degrees, minutes and seconds
+	if len(latitude) == 3 && len(longitude) == 3 {
+		exif.HasLocation = true
+		exif.Latitude = latitude[0] + latitude[1]/60 + latitude[2]/3600
+		exif.Longitude = longitude[0] + longitude[1]/60 + longitude[2]/3600
+		if latitudeRef == 'S' {
+			exif.Latitude = -exif.Latitude
+		}
+		if longitudeRef == 'W' {
+			exif.Longitude = -exif.Longitude
+		}
+	}
+	return nil
+}
+
+// calls fn with the tag, the number of values and the 4 byte value field (an offset for values that don't fit)
+// of every entry
+func walkExifIfd(tiff []byte, order binary.ByteOrder, offset int, fn func(tag uint16, count int, value []byte)) error {
+	if offset < 0 || offset+2 > len(tiff) {
+		return errors.New("Truncated EXIF data")
+	}
+
+	entries := int(order.Uint16(tiff[offset : offset+2]))
+	for n := 0; n < entries; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return errors.New("Truncated EXIF data")
+		}
+		fn(order.Uint16(tiff[entry:entry+2]), int(order.Uint32(tiff[entry+4:entry+8])), tiff[entry+8:entry+12])
+	}
+	return nil
+}
+
+// rationals never fit in the value field, so it holds the offset they're stored at
+func readExifRationals(tiff []byte, order binary.ByteOrder, value []byte, count int) []float64 {
+	offset := int(order.Uint32(value[:4]))
+	if offset < 0 || offset+count*8 > len(tiff) {
+		return nil
+	}
+
+	var rationals []float64
+	for i := 0; i < count; i++ {
+		numerator := order.Uint32(tiff[offset+i*8 : offset+i*8+4])
+		denominator := order.Uint32(tiff[offset+i*8+4 : offset+i*8+8])
+		if denominator == 0 {
+			return nil
+		}
+		rationals = append(rationals, float64(numerator)/float64(denominator))
+	}
+	return rationals
+}
+
+// the date is a 20 byte string (with its terminating NUL), too long for the value field so it holds an offset
+func readExifDateTime(tiff []byte, order binary.ByteOrder, value []byte) time.Time {
+	offset := int(order.Uint32(value[:4]))
+	if offset < 0 || offset+19 > len(tiff) {
+		return time.Time{}
+	}
+
+	dateTime, err := time.Parse(EXIF_DATE_TIME_LAYOUT, string(tiff[offset:offset+19]))
+	if err != nil {
+		return time.Time{}
+	}
+	return dateTime
+}
+
+// ASCII values of up to 4 bytes (their NUL included) are in the value field, longer ones are at the offset it holds
+func readExifString(tiff []byte, order binary.ByteOrder, count int, value []byte) string {
+	data := value
+	if count > 4 {
+		offset := int(order.Uint32(value[:4]))
+		if count > EXIF_MAX_STRING_LENGTH {
+			count = EXIF_MAX_STRING_LENGTH
+		}
+		if offset < 0 || offset+count > len(tiff) {
+			return ""
+		}
+		data = tiff[offset : offset+count]
+	} else if count >= 0 {
+		data = value[:count]
+	}
+
+	if end := bytes.IndexByte(data, 0); end >= 0 {
+		data = data[:end]
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// XMP is XML, but all we're after is one attribute (or element), which every camera and app that makes photo
+// spheres writes the same way
+func parseXmpProjection(xmp []byte) string {
+	for _, prefix := range []string{`GPano:ProjectionType="`, `<GPano:ProjectionType>`} {
+		i := bytes.Index(xmp, []byte(prefix))
+		if i < 0 {
+			continue
+		}
+
+		value := xmp[i+len(prefix):]
+		if end := bytes.IndexAny(value, `"<`); end >= 0 {
+			return string(bytes.TrimSpace(value[:end]))
+		}
+	}
+	return ""
+}
+
+// photo spheres are tagged as such, but plenty of stitching software doesn't, so a 2:1 photo is taken to be one
+// too. Panoramas that don't go all the way round are wider than that.
+func (e *ExifData) IsPanorama() bool {
+	if e.Projection == "equirectangular" {
+		return true
+	}
+	return e.Height > 0 && e.Width == 2*e.Height
+}
+
+// how far the photo has to be turned clockwise to show it upright. Mirrored orientations (2, 4, 5 and 7)
+// come out of cameras so rarely they're treated like their unmirrored counterparts.
+func (e *ExifData) RotationDegrees() int {
+	switch e.Orientation {
+	case 3, 4:
+		return 180
+	case 5, 6:
+		return 90
+	case 7, 8:
+		return 270
+	default:
+		return 0
+	}
+}
+
+// the make and model of the camera, cameras tend to repeat their make in the model ("Canon" and "Canon EOS R6")
+func (e *ExifData) GetCamera() string {
+	if e.Make == "" || strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(strings.Fields(e.Make)[0])) {
+		return e.Model
+	}
+	return strings.TrimSpace(e.Make + " " + e.Model)
+}
+
+// the camera's settings the way photographers write them, like "35mm f/1.8 1/250s ISO 400", empty when unknown
+func (e *ExifData) GetSettings() string {
+	var settings []string
+	if e.FocalLength > 0 {
+		settings = append(settings, fmt.Sprintf("%gmm", e.FocalLength))
+	}
+	if e.FNumber > 0 {
+		settings = append(settings, fmt.Sprintf("f/%g", e.FNumber))
+	}
+	if e.ExposureTime > 0 && e.ExposureTime < 1 {
+		settings = append(settings, fmt.Sprintf("1/%.0fs", 1/e.ExposureTime))
+	} else if e.ExposureTime >= 1 {
+		settings = append(settings, fmt.Sprintf("%gs", e.ExposureTime))
+	}
+	if e.ISO > 0 {
+		settings = append(settings, fmt.Sprintf("ISO %d", e.ISO))
+	}
+	return strings.Join(settings, " ")
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upload links let guests (of a wedding, say) add photos to an album until the link expires, without a
+// password and without the admin, e.g. /guest-upload?album=/wedding/&token=1700000000.abc...
+const GUEST_UPLOAD_PATH = "/guest-upload"
+
+const DEFAULT_GUEST_UPLOAD_DAYS = 3
+const DEFAULT_GUEST_UPLOAD_MAX_MB = 50
+
+// files per form, the whole form has to fit in GuestUploadMaxMB for each of them
+const GUEST_UPLOAD_MAX_FILES = 20
+
+type GuestUploadPageContext struct {
+	*BasePageContext
+
+	Album    *Album
+	Token    string
+	Expires  time.Time
+	MaxFiles int
+	MaxMB    int
+	Uploaded []string
+	Rejected []UploadRejection
+}
+
+func (a *Album) HasGuestUploads() bool {
+	return a.HasShareLinks() && !a.Locked
+}
+
+// Signed like share tokens, over something share tokens never are, so a share link can't be turned in to an
+// upload link (or the other way around). Changing ShareLinkSecret takes back both.
+func (a *Album) NewGuestUploadToken(expiry time.Time) string {
+	expires := strconv.FormatInt(expiry.Unix(), 10)
+	return expires + "." + a.signGuestUploadToken(expires)
+}
+
+func (a *Album) signGuestUploadToken(expires string) string {
+	mac := hmac.New(sha256.New, []byte(a.site.ShareLinkSecret))
+	mac.Write([]byte("upload\n" + a.Path + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// gives the expiry of a token that lets guests upload to this album at now
+func (a *Album) VerifyGuestUploadToken(token string, now time.Time) (time.Time, bool) {
+	if !a.HasGuestUploads() {
+		return time.Time{}, false
+	}
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(a.signGuestUploadToken(parts[0])), []byte(parts[1])) {
+		return time.Time{}, false
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	expiry := time.Unix(expires, 0)
+	return expiry, now.Before(expiry)
+}
+
+func (a *Album) GetGuestUploadUrl(expiry time.Time) string {
+	u := a.site.GetUrlForPath(GUEST_UPLOAD_PATH)
+	u.RawQuery = "album=" + url.QueryEscape(a.Path) + "&" + SHARE_TOKEN_PARAM + "=" + a.NewGuestUploadToken(expiry)
+	return u.String()
+}
+
+// Guests and the API never replace a photo, a name that's taken gets a number, like IMG_0001-2.jpg. uploaded are
+// the names stored earlier in the same upload, which aren't in the key cache yet.
+func (a *Album) getFreeUploadName(name string, uploaded []string) string {
+	keys, _ := a.KeyCache.Load().([]string)
+	taken := make(map[string]bool)
+	for _, v := range keys {
+		taken[strings.ToLower(v)] = true
+	}
+	for _, v := range uploaded {
+		taken[strings.ToLower(a.BucketPrefix+v)] = true
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	free := name
+	for i := 2; taken[strings.ToLower(a.BucketPrefix+free)]; i++ {
+		free = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	return free
+}
+
+// Checks the file is what its name says, a photo or video rather than a page or a script renamed to .jpg.
+// Formats browsers don't know (like HEIC) sniff as application/octet-stream, which is let through on their name.
+func checkUploadType(file io.ReadSeeker) error {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	contentType := http.DetectContentType(head[:n])
+	if !strings.HasPrefix(contentType, "image/") && !strings.HasPrefix(contentType, "video/") &&
+		contentType != "application/octet-stream" {
+		return errors.New("This isn't a photo or a video")
+	}
+	return nil
+}
+
+// Stores a file that comes from outside the admin, a guest's or one sent to the API, once it's checked to be a
+// photo or a video, under a free name (see getFreeUploadName). Files that can't seek, like the parts of a
+// multipart body, are spooled to disk first. Gives the name it was stored under and why it wasn't, empty when it
+// was, with an error only when the bucket couldn't take it.
+func uploadExternalFile(album *Album, name string, file io.Reader, uploaded []string) (string, string, error) {
+	if !album.IsUploadableName(name) {
+		// the rest of a multipart part is skipped by NextPart
+		return name, "This isn't a photo this album can show", nil
+	}
+
+	body, ok := file.(io.ReadSeeker)
+	if !ok {
+		spooled, err := ioutil.TempFile("", "50mm-upload-")
+		if err != nil {
+			return name, "", err
+		}
+		defer os.Remove(spooled.Name())
+		defer spooled.Close()
+
+		size, err := io.Copy(spooled, file)
+		if err != nil {
+			return name, "Unable to read the file, the upload may be too big", nil
+		}
+		if size == 0 {
+			return name, "The file is empty", nil
+		}
+		if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+			return name, "", err
+		}
+		body = spooled
+	}
+	if err := checkUploadType(body); err != nil {
+		return name, err.Error(), nil
+	}
+
+	name = album.getFreeUploadName(name, uploaded)
+	skipped, err := album.UploadObject(name, body)
+	return name, skipped, err
+}
+
+// why the guest's file wasn't uploaded, empty when it was
+func uploadGuestFile(album *Album, name string, header *multipart.FileHeader, uploaded []string) (string, string) {
+	if header.Size > int64(album.site.GuestUploadMaxMB)*1024*1024 {
+		return name, fmt.Sprintf("Photos can be at most %dMB", album.site.GuestUploadMaxMB)
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return name, err.Error()
+	}
+	defer file.Close()
+
+	name, skipped, err := uploadExternalFile(album, name, file, uploaded)
+	if err != nil {
+		fmt.Printf("\nUnable to upload guest photo %s to album %s. Error: %s", name, album.Path, err.Error())
+		return name, "The photo couldn't be stored, try again later"
+	}
+	return name, skipped
+}
+
+func handleGuestUpload(site *Site, w http.ResponseWriter, r *http.Request) {
+	album, err := site.GetAlbumForPath(r.URL.Query().Get("album"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !album.requireAllowedNetwork(w, r) {
+		return
+	}
+
+	token := r.URL.Query().Get(SHARE_TOKEN_PARAM)
+	expiry, ok := album.VerifyGuestUploadToken(token, time.Now())
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("This upload link has expired, or isn't valid\n"))
+		return
+	}
+
+	ctx := &GuestUploadPageContext{
+		getAdminBasePageContext(site, GUEST_UPLOAD_PATH, "Add photos to "+album.AlbumTitle),
+		album,
+		token,
+		expiry,
+		GUEST_UPLOAD_MAX_FILES,
+		site.GuestUploadMaxMB,
+		nil,
+		nil,
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !isSameOriginRequest(r) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Cross-origin requests are not allowed\n"))
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, int64(site.GuestUploadMaxMB)*1024*1024*GUEST_UPLOAD_MAX_FILES)
+		if err := r.ParseMultipartForm(ADMIN_UPLOAD_MEMORY); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Unable to read the upload, it may be too big\n"))
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		files := r.MultipartForm.File["photos"]
+		if len(files) > GUEST_UPLOAD_MAX_FILES {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Upload at most %d photos at once\n", GUEST_UPLOAD_MAX_FILES)))
+			return
+		}
+		for _, header := range files {
+			name := path.Base(strings.Replace(header.Filename, "\\", "/", -1))
+			if name, reason := uploadGuestFile(album, name, header, ctx.Uploaded); reason != "" {
+				ctx.Rejected = append(ctx.Rejected, UploadRejection{name, reason})
+			} else {
+				ctx.Uploaded = append(ctx.Uploaded, name)
+			}
+		}
+
+		if len(ctx.Uploaded) > 0 {
+			fmt.Printf("\nGuests uploaded %d photos to album %s", len(ctx.Uploaded), album.Path)
+			album.RefreshKeyCache()
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	site.executeTemplate(w, "guest_upload.html", ctx)
+}
+
+func (s *Site) validateGuestUploads() error {
+	if s.GuestUploadMaxMB <= 0 {
+		return errors.New("GuestUploadMaxMB must be at least 1")
+	}
+	return nil
+}
+
+func handleAdminShareUpload(album *Album, w http.ResponseWriter, r *http.Request) {
+	if !album.HasGuestUploads() {
+		writeAdminError(w, http.StatusBadRequest, errors.New("Set ShareLinkSecret, and unlock the album, to create upload links"))
+		return
+	}
+
+	days, err := strconv.Atoi(r.PostFormValue("days"))
+	if err != nil || days < 1 || days > MAX_SHARE_LINK_DAYS {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Upload links last between 1 and %d days", MAX_SHARE_LINK_DAYS))
+		return
+	}
+
+	expiry := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+	if getBearerToken(r) != "" {
+		writeAdminJSON(w, map[string]interface{}{"url": album.GetGuestUploadUrl(expiry), "expires": expiry})
+		return
+	}
+
+	ctx := &AdminSharePageContext{
+		getAdminBasePageContext(album.site, ADMIN_PATH+"share", "Share "+album.AlbumTitle),
+		album,
+		DEFAULT_SHARE_LINK_DAYS,
+		"",
+		time.Time{},
+		"",
+		days,
+		album.GetGuestUploadUrl(expiry),
+		expiry,
+	}
+	album.site.executeTemplate(w, "admin_share.html", ctx)
+}
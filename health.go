@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// /healthz only says the process is up, for liveness probes that shouldn't restart 50mm while S3 is away.
+// /readyz (see readyzHandler) says whether it can serve anything, and with ?detail=1 gives the state of the
+// site the request is for as JSON, for the site's admins only.
+const READYZ_DETAIL_PARAM = "detail"
+
+type ReadyzDetail struct {
+	Domain    string              `json:"domain"`
+	Readiness string              `json:"readiness"`
+	S3        ReadyzS3Detail      `json:"s3"`
+	Albums    []ReadyzAlbumDetail `json:"albums"`
+}
+
+type ReadyzS3Detail struct {
+	LastSuccess *time.Time `json:"last_success"` // nil until S3 has been talked to
+	LastFailure *time.Time `json:"last_failure"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+type ReadyzAlbumDetail struct {
+	Path            string     `json:"path"`
+	Cached          bool       `json:"cached"`
+	Keys            int        `json:"keys"`
+	KeysUpdated     *time.Time `json:"keys_updated"`
+	OrderingUpdated *time.Time `json:"ordering_updated"`
+	Stale           bool       `json:"stale"` // due for a refresh
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (s *Site) GetReadyzDetail() ReadyzDetail {
+	health := s.GetS3Health()
+	detail := ReadyzDetail{
+		Domain:    s.Domain,
+		Readiness: s.GetReadiness(),
+		S3: ReadyzS3Detail{
+			LastSuccess: timeOrNil(health.LastSuccess),
+			LastFailure: timeOrNil(health.LastFailure),
+		},
+		Albums: []ReadyzAlbumDetail{},
+	}
+	if health.LastError != nil {
+		detail.S3.LastError = health.LastError.Error()
+	}
+	for _, a := range s.Albums {
+		keys, _ := a.KeyCache.Load().([]string)
+		detail.Albums = append(detail.Albums, ReadyzAlbumDetail{
+			Path:            a.Path,
+			Cached:          a.HasCachedKeys(),
+			Keys:            len(keys),
+			KeysUpdated:     timeOrNil(a.LastKeyCacheUpdate),
+			OrderingUpdated: timeOrNil(a.LastAlbumOrderingConfigCacheUpdate),
+			Stale:           a.NeedsKeyCacheUpdate() || a.NeedsOrderingCacheUpdate(),
+		})
+	}
+	return detail
+}
+
+func handleReadyzDetail(w http.ResponseWriter, r *http.Request) {
+	site, err := app.SiteForDomain(r.Host)
+	if err != nil || !site.HasAdmin() {
+		writeApiError(w, http.StatusNotFound, errors.New("Detail is only given to the admins of a site with an admin"))
+		return
+	}
+	if !requireAdminAccess(site, w, r, JWT_SCOPE_ADMIN, "") {
+		return
+	}
+
+	detail := site.GetReadyzDetail()
+	if detail.Readiness == "unavailable" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeAdminJSON(w, detail)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AuthFile is checked for changes at most this often, so logins added or removed with htpasswd take effect
+// within seconds without a restart
+const HTPASSWD_RELOAD_INTERVAL = 5 * time.Second
+
+const HTPASSWD_APR1_PREFIX = "$apr1$"
+const HTPASSWD_MD5_CRYPT_PREFIX = "$1$"
+const HTPASSWD_SHA_PREFIX = "{SHA}"
+
+var HTPASSWD_BCRYPT_PREFIXES = []string{"$2a$", "$2b$", "$2y$"}
+
+const MD5_CRYPT_ALPHABET = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// The logins of an htpasswd file, as written by Apache's htpasswd with -B (bcrypt), -m (md5-crypt, the
+// default) or -s (SHA-1). Plain text and crypt() entries aren't supported. A TOTP secret can be added to the
+// end of a line, as user:hash:secret.
+type HtpasswdFile struct {
+	path string
+
+	mutex       sync.Mutex
+	hashes      map[string]string
+	totpSecrets map[string][]byte
+	modTime     time.Time
+	lastCheck   time.Time
+}
+
+func LoadHtpasswdFile(path string) (*HtpasswdFile, error) {
+	f := &HtpasswdFile{path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if f.hashes, f.totpSecrets, err = readHtpasswdFile(path); err != nil {
+		return nil, err
+	}
+	f.modTime = info.ModTime()
+	f.lastCheck = time.Now()
+	return f, nil
+}
+
+func readHtpasswdFile(path string) (map[string]string, map[string][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hashes := make(map[string]string)
+	totpSecrets := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// none of the hashes have colons in them
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, nil, fmt.Errorf("Line %d of %s isn't written as user:hash", n, path)
+		}
+		if !isSupportedHtpasswdHash(parts[1]) {
+			return nil, nil, fmt.Errorf("Line %d of %s has a hash 50mm can't check, use htpasswd -B (bcrypt) or -m (md5)", n, path)
+		}
+		hashes[parts[0]] = parts[1]
+
+		if len(parts) == 3 {
+			key, err := parseTOTPSecret(parts[2])
+			if err != nil {
+				return nil, nil, fmt.Errorf("Line %d of %s: %s", n, path, err.Error())
+			}
+			totpSecrets[parts[0]] = key
+		}
+	}
+	return hashes, totpSecrets, scanner.Err()
+}
+
+func isSupportedHtpasswdHash(hash string) bool {
+	for _, prefix := range HTPASSWD_BCRYPT_PREFIXES {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return strings.HasPrefix(hash, HTPASSWD_APR1_PREFIX) || strings.HasPrefix(hash, HTPASSWD_MD5_CRYPT_PREFIX) ||
+		strings.HasPrefix(hash, HTPASSWD_SHA_PREFIX)
+}
+
+// picks up changes to the file. A file that can't be read (or is halfway through being written) leaves the
+// logins we have alone, rather than locking everybody out.
+func (f *HtpasswdFile) reloadIfChanged() {
+	if time.Since(f.lastCheck) < HTPASSWD_RELOAD_INTERVAL {
+		return
+	}
+	f.lastCheck = time.Now()
+
+	info, err := os.Stat(f.path)
+	if err != nil || info.ModTime().Equal(f.modTime) {
+		return
+	}
+
+	hashes, totpSecrets, err := readHtpasswdFile(f.path)
+	if err != nil {
+		fmt.Printf("\nUnable to reload %s, keeping the logins it had. Error: %s", f.path, err.Error())
+		return
+	}
+	f.hashes = hashes
+	f.totpSecrets = totpSecrets
+	f.modTime = info.ModTime()
+}
+
+func (f *HtpasswdFile) CheckCredentials(user string, pass string) bool {
+	f.mutex.Lock()
+	f.reloadIfChanged()
+	hash, ok := f.hashes[user]
+	f.mutex.Unlock()
+
+	return ok && checkHtpasswdHash(hash, pass)
+}
+
+// the user's hash, empty for users that aren't in the file
+func (f *HtpasswdFile) GetHash(user string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.reloadIfChanged()
+	return f.hashes[user]
+}
+
+// the user's TOTP secret, nil for users without one
+func (f *HtpasswdFile) GetTOTPSecret(user string) []byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.reloadIfChanged()
+	return f.totpSecrets[user]
+}
+
+func checkHtpasswdHash(hash string, pass string) bool {
+	switch {
+	case strings.HasPrefix(hash, HTPASSWD_APR1_PREFIX):
+		return checkMd5Crypt(hash, pass, HTPASSWD_APR1_PREFIX)
+	case strings.HasPrefix(hash, HTPASSWD_MD5_CRYPT_PREFIX):
+		return checkMd5Crypt(hash, pass, HTPASSWD_MD5_CRYPT_PREFIX)
+	case strings.HasPrefix(hash, HTPASSWD_SHA_PREFIX):
+		sum := sha1.Sum([]byte(pass))
+		expected := HTPASSWD_SHA_PREFIX + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	}
+}
+
+func checkMd5Crypt(hash string, pass string, magic string) bool {
+	salt := strings.TrimPrefix(hash, magic)
+	if i := strings.Index(salt, "$"); i >= 0 {
+		salt = salt[:i]
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(md5Crypt(pass, salt, magic))) == 1
+}
+
+// the MD5 based crypt() of FreeBSD, which htpasswd uses with its own $apr1$ magic. The odd steps are the
+// algorithm's, they have to be followed exactly to get the same hash.
+func md5Crypt(pass string, salt string, magic string) string {
+	password := []byte(pass)
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alternate := md5.New()
+	alternate.Write(password)
+	alternate.Write([]byte(salt))
+	alternate.Write(password)
+	final := alternate.Sum(nil)
+
+	digest := md5.New()
+	digest.Write(password)
+	digest.Write([]byte(magic))
+	digest.Write([]byte(salt))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			digest.Write(final)
+		} else {
+			digest.Write(final[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			digest.Write([]byte{0})
+		} else {
+			digest.Write(password[:1])
+		}
+	}
+	final = digest.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(password)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(password)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(password)
+		}
+		final = round.Sum(nil)
+	}
+
+	encoded := make([]byte, 0, 22)
+	encode := func(value uint, chars int) {
+		for ; chars > 0; chars-- {
+			encoded = append(encoded, MD5_CRYPT_ALPHABET[value&0x3f])
+			value >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[group[0]])<<16|uint(final[group[1]])<<8|uint(final[group[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+
+	return magic + salt + "$" + string(encoded)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The words of the visitors' pages come from the bundles in locales/, one YAML file of strings by id for every
+// language (locales/de.yaml for German), which templates look up with {{.T "id"}}. Sites (and albums) pick their
+// language with Language, or `auto` to go by the languages the visitor's browser asks for. Strings a bundle
+// doesn't have are taken from the English one, so a new string never shows up as its id. The admin is English.
+const LOCALES_DIR = "locales"
+const DEFAULT_LANGUAGE = "en"
+const LANGUAGE_AUTO = "auto"
+
+// ids of strings with a singular and a plural, for TN, end in these
+const LOCALE_PLURAL_ONE_SUFFIX = "_one"
+const LOCALE_PLURAL_OTHER_SUFFIX = "_other"
+
+type Locale struct {
+	Language string
+
+	strings  map[string]string
+	fallback *Locale // English, nil for English itself
+	version  string  // a hash of the bundle, for the ETags of pages in the language
+}
+
+var locales map[string]*Locale
+var localesMutex sync.Mutex
+
+// reads every bundle in LOCALES_DIR, by their language
+func loadLocales() (map[string]*Locale, error) {
+	paths, err := filepath.Glob(filepath.Join(LOCALES_DIR, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := make(map[string]*Locale)
+	for _, v := range paths {
+		data, err := ioutil.ReadFile(v)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		locale := &Locale{Language: strings.TrimSuffix(filepath.Base(v), ".yaml"), version: hex.EncodeToString(sum[:])}
+		if err := yaml.Unmarshal(data, &locale.strings); err != nil {
+			return nil, fmt.Errorf("Unable to read %s: %s", v, err.Error())
+		}
+		loaded[locale.Language] = locale
+	}
+
+	english, ok := loaded[DEFAULT_LANGUAGE]
+	if !ok {
+		return nil, fmt.Errorf("There's no %s/%s.yaml, the strings other languages don't have are taken from it", LOCALES_DIR, DEFAULT_LANGUAGE)
+	}
+	for _, v := range loaded {
+		if v != english {
+			v.fallback = english
+		}
+	}
+	return loaded, nil
+}
+
+// the bundles by language, read once unless templates are read for every page as well (see DEBUG). Without any
+// bundles every string is its id.
+func getLocales() map[string]*Locale {
+	localesMutex.Lock()
+	defer localesMutex.Unlock()
+
+	if locales == nil || DEBUG {
+		loaded, err := loadLocales()
+		if err != nil {
+			fmt.Printf("\nUnable to load the locales. Error: %s", err.Error())
+			if locales == nil {
+				locales = make(map[string]*Locale)
+			}
+			return locales
+		}
+		locales = loaded
+	}
+	return locales
+}
+
+func getLocale(language string) *Locale {
+	if locale, ok := getLocales()[language]; ok {
+		return locale
+	}
+	return &Locale{Language: DEFAULT_LANGUAGE}
+}
+
+func validateLanguage(language string) error {
+	if language == "" || language == LANGUAGE_AUTO {
+		return nil
+	}
+	if _, ok := getLocales()[language]; !ok {
+		var available []string
+		for k := range getLocales() {
+			available = append(available, k)
+		}
+		sort.Strings(available)
+		return fmt.Errorf("Language %s has no bundle in %s/, use one of %s or %s", language, LOCALES_DIR,
+			strings.Join(available, ", "), LANGUAGE_AUTO)
+	}
+	return nil
+}
+
+// the versions of the bundle and of English, which it falls back to
+func (l *Locale) getVersion() string {
+	if l.fallback != nil {
+		return l.version + l.fallback.version
+	}
+	return l.version
+}
+
+// The string with the id, formatted with args like fmt.Sprintf when there are any. Ids no bundle has are given
+// as they are, so they stand out.
+func (l *Locale) T(id string, args ...interface{}) string {
+	for locale := l; locale != nil; locale = locale.fallback {
+		if s, ok := locale.strings[id]; ok {
+			if len(args) > 0 {
+				return fmt.Sprintf(s, args...)
+			}
+			return s
+		}
+	}
+	return id
+}
+
+// the id of the singular (id_one) or plural (id_other) of a string, for n of something
+func getPluralId(id string, n int) string {
+	if n == 1 {
+		return id + LOCALE_PLURAL_ONE_SUFFIX
+	}
+	return id + LOCALE_PLURAL_OTHER_SUFFIX
+}
+
+// T for strings with a singular and a plural, n is the first argument
+func (l *Locale) TN(id string, n int, args ...interface{}) string {
+	return l.T(getPluralId(id, n), append([]interface{}{n}, args...)...)
+}
+
+// T for strings with markup in them, like links. Bundles are trusted like templates, args are escaped.
+func (l *Locale) THTML(id string, args ...interface{}) template.HTML {
+	for i, v := range args {
+		if s, ok := v.(string); ok {
+			args[i] = html.EscapeString(s)
+		}
+	}
+	return template.HTML(l.T(id, args...))
+}
+
+// THTML for strings with a singular and a plural, like TN
+func (l *Locale) TNHTML(id string, n int, args ...interface{}) template.HTML {
+	return l.THTML(getPluralId(id, n), append([]interface{}{n}, args...)...)
+}
+
+// a date the way the language writes them, with the month names and date_format of the bundle
+func (l *Locale) Date(t time.Time) string {
+	months := strings.Fields(l.T("months"))
+	month := t.Month().String()
+	if len(months) == 12 {
+		month = months[t.Month()-1]
+	}
+	return l.T("date_format", t.Day(), month, t.Year())
+}
+
+// The languages the browser asks for, most wanted first. Languages are lower case, and languages with a region
+// (de-CH) are followed by the language itself, for the bundles that are only for the language.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		language string
+		q        float64
+	}
+	var languages []weighted
+	for _, v := range strings.Split(header, ",") {
+		parts := strings.Split(strings.TrimSpace(v), ";")
+		language := strings.ToLower(strings.TrimSpace(parts[0]))
+		if language == "" || language == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range parts[1:] {
+			if value := strings.TrimPrefix(strings.TrimSpace(param), "q="); value != strings.TrimSpace(param) {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			languages = append(languages, weighted{language, q})
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].q > languages[j].q
+	})
+
+	var ordered []string
+	for _, v := range languages {
+		ordered = append(ordered, v.language)
+		if i := strings.Index(v.language, "-"); i > 0 {
+			ordered = append(ordered, v.language[:i])
+		}
+	}
+	return ordered
+}
+
+// The locale of a page for the language of the site or album. Pages in the visitor's language say so to caches.
+// r can be nil for pages rendered for nobody in particular, like the static mirror, they're in English with `auto`.
+func getRequestLocale(language string, w http.ResponseWriter, r *http.Request) *Locale {
+	if language == "" {
+		language = DEFAULT_LANGUAGE
+	}
+	if language != LANGUAGE_AUTO {
+		return getLocale(language)
+	}
+
+	if w != nil {
+		w.Header().Add("Vary", "Accept-Language")
+	}
+	if r != nil {
+		available := getLocales()
+		for _, v := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+			if locale, ok := available[v]; ok {
+				return locale
+			}
+		}
+	}
+	return getLocale(DEFAULT_LANGUAGE)
+}
+
+func (s *Site) GetLocale(w http.ResponseWriter, r *http.Request) *Locale {
+	return getRequestLocale(s.Language, w, r)
+}
+
+// the album's Language, or the site's
+func (a *Album) GetLocale(w http.ResponseWriter, r *http.Request) *Locale {
+	if a.Language != "" {
+		return getRequestLocale(a.Language, w, r)
+	}
+	return a.site.GetLocale(w, r)
+}
+
+// pages without a locale, like the admin's, are in English
+func (c *BasePageContext) getLocale() *Locale {
+	if c.Locale == nil {
+		return getLocale(DEFAULT_LANGUAGE)
+	}
+	return c.Locale
+}
+
+func (c *BasePageContext) Lang() string {
+	return c.getLocale().Language
+}
+
+func (c *BasePageContext) T(id string, args ...interface{}) string {
+	return c.getLocale().T(id, args...)
+}
+
+func (c *BasePageContext) TN(id string, n int, args ...interface{}) string {
+	return c.getLocale().TN(id, n, args...)
+}
+
+func (c *BasePageContext) THTML(id string, args ...interface{}) template.HTML {
+	return c.getLocale().THTML(id, args...)
+}
+
+func (c *BasePageContext) TNHTML(id string, n int, args ...interface{}) template.HTML {
+	return c.getLocale().TNHTML(id, n, args...)
+}
+
+func (c *BasePageContext) Date(t time.Time) string {
+	return c.getLocale().Date(t)
+}
@@ -0,0 +1,352 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Builds with the integration tag (go build -tags integration) can run `50mm integration-test` from the
+// directory with templates/, which runs the whole Site and Album stack against a real S3 API: MinIO, started in
+// docker for the run and thrown away after. Point FIFTYMM_MINIO_URL at a MinIO that's already running (one from
+// docker-compose in CI, say) to use that instead, MINIO_ROOT_USER and MINIO_ROOT_PASSWORD are its keys. Every run
+// gets a bucket of its own.
+const MINIO_IMAGE = "minio/minio"
+const MINIO_URL_ENV_VAR = "FIFTYMM_MINIO_URL"
+const MINIO_DEFAULT_KEY = "minioadmin"
+const MINIO_START_TIMEOUT = time.Minute
+
+// more than one page of ListObjects, which gives 1000 objects at a time
+const INTEGRATION_LISTING_PHOTOS = 1005
+
+const INTEGRATION_DOMAIN = "integration.test"
+
+var integrationConfig = `[DEFAULT]
+Domain = %s
+BucketRegion = us-east-1
+BucketName = %s
+AWSKeyId = %s
+AWSKey = %s
+S3Host = %s
+S3ForcePathStyle = 1
+SiteTitle = Integration
+MetaTitle = Integration
+HasAlbumIndex = 1
+
+[Listing]
+Path = /listing/
+BucketPrefix = listing/
+AlbumTitle = Listing
+
+[Ordered]
+Path = /ordered/
+BucketPrefix = ordered/
+AlbumTitle = Ordered
+
+[Private]
+Path = /private/
+BucketPrefix = private/
+AlbumTitle = Private
+AuthUser = alice
+AuthPass = hunter2
+InIndex = 0
+`
+
+type integrationTest struct {
+	Name string
+	Run  func(site *Site) error
+}
+
+var integrationTests = []integrationTest{
+	{"listing albums bigger than a page", testIntegrationListing},
+	{"preprocessing ordering.yaml", testIntegrationOrdering},
+	{"negative caching of ordering.yaml", testIntegrationNegativeCaching},
+	{"auth", testIntegrationAuth},
+}
+
+func init() {
+	runIntegrationTests = runIntegration
+}
+
+func getMinioKeys() (string, string) {
+	user, pass := os.Getenv("MINIO_ROOT_USER"), os.Getenv("MINIO_ROOT_PASSWORD")
+	if user == "" {
+		user = MINIO_DEFAULT_KEY
+	}
+	if pass == "" {
+		pass = MINIO_DEFAULT_KEY
+	}
+	return user, pass
+}
+
+// a free port on localhost for the container to listen on
+func getFreePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Starts MinIO in docker and waits for it to be ready. Gives its URL, and what stops (and removes) it.
+func startMinio(user string, pass string, out io.Writer) (string, func(), error) {
+	port, err := getFreePort()
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := exec.Command("docker", "run", "-d", "--rm", "-p", fmt.Sprintf("127.0.0.1:%d:9000", port),
+		"-e", "MINIO_ROOT_USER="+user, "-e", "MINIO_ROOT_PASSWORD="+pass, MINIO_IMAGE, "server", "/data").Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to start MinIO in docker: %s", err.Error())
+	}
+	container := strings.TrimSpace(string(id))
+	stop := func() {
+		exec.Command("docker", "stop", container).Run()
+	}
+
+	minioUrl := fmt.Sprintf("http://127.0.0.1:%d", port)
+	fmt.Fprintf(out, "Started MinIO at %s\n", minioUrl)
+	if err := waitForMinio(minioUrl); err != nil {
+		stop()
+		return "", nil, err
+	}
+	return minioUrl, stop, nil
+}
+
+func waitForMinio(minioUrl string) error {
+	client := &http.Client{Timeout: 2 * time.Second}
+	for start := time.Now(); time.Since(start) < MINIO_START_TIMEOUT; time.Sleep(time.Second) {
+		resp, err := client.Get(minioUrl + "/minio/health/ready")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("MinIO at %s wasn't ready within %s", minioUrl, MINIO_START_TIMEOUT)
+}
+
+// loads the site the way the server would, from a config file, and serves it from the app
+func loadIntegrationSite(minioUrl string, user string, pass string) (*Site, error) {
+	dir, err := ioutil.TempDir("", "50mm-integration-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	bucket := fmt.Sprintf("50mm-integration-%d", time.Now().UnixNano())
+	configPath := filepath.Join(dir, INTEGRATION_DOMAIN+".ini")
+	config := fmt.Sprintf(integrationConfig, INTEGRATION_DOMAIN, bucket, user, pass, minioUrl)
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		return nil, err
+	}
+	site, err := LoadSiteFromFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	svc, err := site.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := svc.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		return nil, fmt.Errorf("Unable to create bucket %s: %s", bucket, err.Error())
+	}
+
+	app = &App{sites: map[string]*Site{site.Domain: site}}
+	templates = template.Must(template.ParseGlob("templates/*.html"))
+	return site, nil
+}
+
+func runIntegration(args []string, out io.Writer) error {
+	user, pass := getMinioKeys()
+	minioUrl := os.Getenv(MINIO_URL_ENV_VAR)
+	if minioUrl == "" {
+		var stop func()
+		var err error
+		if minioUrl, stop, err = startMinio(user, pass, out); err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	site, err := loadIntegrationSite(minioUrl, user, pass)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, v := range integrationTests {
+		if err := v.Run(site); err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL %s: %s\n", v.Name, err.Error())
+		} else {
+			fmt.Fprintf(out, "ok   %s\n", v.Name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d integration tests failed", failed, len(integrationTests))
+	}
+	fmt.Fprintf(out, "All %d integration tests passed\n", len(integrationTests))
+	return nil
+}
+
+func getIntegrationAlbum(site *Site, path string) *Album {
+	album, err := site.GetAlbumForPath(path)
+	if err != nil {
+		panic(err)
+	}
+	return album
+}
+
+func putIntegrationPhotos(album *Album, names ...string) error {
+	for _, v := range names {
+		if err := album.PutObjectInBucket(v, []byte("photo "+v), "image/jpeg"); err != nil {
+			return fmt.Errorf("Unable to upload %s: %s", v, err.Error())
+		}
+	}
+	return nil
+}
+
+func testIntegrationListing(site *Site) error {
+	album := getIntegrationAlbum(site, "/listing/")
+	var names []string
+	for i := 1; i <= INTEGRATION_LISTING_PHOTOS; i++ {
+		names = append(names, fmt.Sprintf("photo-%04d.jpg", i))
+	}
+	if err := putIntegrationPhotos(album, names...); err != nil {
+		return err
+	}
+
+	album.RefreshKeyCache()
+	keys, _ := album.KeyCache.Load().([]string)
+	if len(keys) != INTEGRATION_LISTING_PHOTOS {
+		return fmt.Errorf("The album has %d keys rather than %d", len(keys), INTEGRATION_LISTING_PHOTOS)
+	}
+	orderingKeys, err := album.GetOrderedKeys(AlbumOrderingConfig{})
+	if err != nil {
+		return err
+	}
+	if last := orderingKeys.Ordering[len(orderingKeys.Ordering)-1]; last != album.BucketPrefix+names[len(names)-1] {
+		return fmt.Errorf("The last photo is %s rather than %s", last, names[len(names)-1])
+	}
+	return nil
+}
+
+func testIntegrationOrdering(site *Site) error {
+	album := getIntegrationAlbum(site, "/ordered/")
+	if err := putIntegrationPhotos(album, "a.jpg", "b.jpg", "c.jpg", "skip-1.jpg"); err != nil {
+		return err
+	}
+	ordering := "cover: c.jpg\nthumbnails:\n  - a.jpg\nordering:\n  - key: b.jpg\n    title: Bee\n  - a.jpg\nexclude:\n  - skip-*.jpg\n"
+	if err := album.PutObjectInBucket(ORDERING_YAML_NAME, []byte(ordering), ORDERING_YAML_CONTENT_TYPE); err != nil {
+		return err
+	}
+	album.RefreshKeyCache()
+	album.RefreshOrderingCache()
+
+	config, err := album.GetAlbumOrderingConfig()
+	if err != nil {
+		return err
+	}
+	if config.Cover != "ordered/c.jpg" {
+		return fmt.Errorf("The cover is %q rather than ordered/c.jpg", config.Cover)
+	}
+	orderingKeys, err := album.GetOrderedKeys(config)
+	if err != nil {
+		return err
+	}
+	if got := strings.Join(orderingKeys.Ordering, " "); got != "ordered/b.jpg ordered/a.jpg ordered/c.jpg" {
+		return fmt.Errorf("The ordering is %s", got)
+	}
+	// the rest of the thumbnails are filled in from the ordering
+	if len(orderingKeys.Thumbnails) == 0 || orderingKeys.Thumbnails[0] != "ordered/a.jpg" {
+		return fmt.Errorf("The thumbnails are %s", strings.Join(orderingKeys.Thumbnails, " "))
+	}
+	if photo, ok := album.GetPhotoForSlug("b.jpg"); !ok || photo.Details().Title != "Bee" {
+		return errors.New("b.jpg doesn't have its title")
+	}
+	return nil
+}
+
+// missing and malformed ordering files are cached like good ones, until the cache is refreshed
+func testIntegrationNegativeCaching(site *Site) error {
+	album := getIntegrationAlbum(site, "/listing/")
+	album.RefreshOrderingCache()
+	if config, ok := album.OrderingCache.Load().(AlbumOrderingConfig); !ok || !config.negativeCacheThis {
+		return errors.New("The missing ordering.yaml wasn't cached")
+	}
+
+	if err := album.PutObjectInBucket(ORDERING_YAML_NAME, []byte("cover: photo-0002.jpg\n"), ORDERING_YAML_CONTENT_TYPE); err != nil {
+		return err
+	}
+	if config, err := album.GetAlbumOrderingConfig(); err != nil || config.Cover != "" {
+		return errors.New("The new ordering.yaml was read before the cache was refreshed")
+	}
+	album.RefreshOrderingCache()
+	if config, err := album.GetAlbumOrderingConfig(); err != nil || config.Cover != "listing/photo-0002.jpg" {
+		return errors.New("The new ordering.yaml wasn't read when the cache was refreshed")
+	}
+
+	if err := album.PutObjectInBucket(ORDERING_YAML_NAME, []byte("cover: [not yaml\n"), ORDERING_YAML_CONTENT_TYPE); err != nil {
+		return err
+	}
+	album.RefreshOrderingCache()
+	if config, ok := album.OrderingCache.Load().(AlbumOrderingConfig); !ok || !config.negativeCacheThis {
+		return errors.New("The malformed ordering.yaml wasn't cached")
+	}
+	return nil
+}
+
+func testIntegrationAuth(site *Site) error {
+	if err := putIntegrationPhotos(getIntegrationAlbum(site, "/private/"), "secret.jpg"); err != nil {
+		return err
+	}
+
+	get := func(path string, user string, pass string) int {
+		r := httptest.NewRequest("GET", "http://"+INTEGRATION_DOMAIN+path, nil)
+		if user != "" {
+			r.SetBasicAuth(user, pass)
+		}
+		w := httptest.NewRecorder()
+		siteHandler(w, r)
+		return w.Code
+	}
+	checks := []struct {
+		path   string
+		user   string
+		pass   string
+		status int
+	}{
+		{"/ordered/", "", "", http.StatusOK},
+		{"/private/", "", "", http.StatusUnauthorized},
+		{"/private/", "alice", "wrong", http.StatusUnauthorized},
+		{"/private/", "alice", "hunter2", http.StatusOK},
+		{"/private/secret.jpg", "", "", http.StatusUnauthorized},
+		{"/private/secret.jpg", "alice", "hunter2", http.StatusOK},
+	}
+	for _, v := range checks {
+		if status := get(v.path, v.user, v.pass); status != v.status {
+			return fmt.Errorf("%s as %q answered %d rather than %d", v.path, v.user, status, v.status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// what bearer tokens can be allowed to do, either everywhere or, with the album's path after a colon (like
+// read:/baku/), in one album only
+const JWT_SCOPE_READ = "read"
+const JWT_SCOPE_UPLOAD = "upload"
+const JWT_SCOPE_REFRESH = "refresh"
+const JWT_SCOPE_EDIT = "edit"
+const JWT_SCOPE_ADMIN = "admin"
+
+// HS256 secrets shorter than the hash are easy to brute force from a single token
+const JWT_SECRET_MIN_LENGTH = 32
+
+// Sites and albums implement this, requests with a bearer token get checked against its scopes rather than
+// asked for a password, see checkAndRequireAuth
+type BearerTokenChecker interface {
+	CheckBearerToken(w http.ResponseWriter, r *http.Request, scope string) bool
+}
+
+// the claims of a bearer token we act on, tokens are stateless so whatever they say goes until they expire
+type BearerToken struct {
+	Subject string
+	Scopes  []string
+	Expires time.Time
+}
+
+// checks the signature of the JWT in token with verify, and gives its claims
+func parseJwt(token string, verify func(alg string, kid string, signed []byte, signature []byte) error) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Malformed token signature")
+	}
+	if err := verify(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeJwtPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("Malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("Malformed token")
+	}
+	return nil
+}
+
+func verifyJwtRS256(key *rsa.PublicKey, signed []byte, signature []byte) error {
+	hash := sha256.Sum256(signed)
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return errors.New("Invalid token signature")
+	}
+	return nil
+}
+
+func verifyJwtHS256(secret string, signed []byte, signature []byte) error {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return errors.New("Invalid token signature")
+	}
+	return nil
+}
+
+// both PKIX ("PUBLIC KEY") and PKCS #1 ("RSA PUBLIC KEY") PEM files, as written by openssl
+func GetPublicKeyFromFile(path string) (*rsa.PublicKey, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return nil, errors.New("Public Key: No Block found in keyfile")
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, errors.New("Public Key: Unsupported key type, should be an RSA public key")
+	default:
+		return nil, errors.New("Public Key: Unsupported key type, should be an RSA public key in a pem file")
+	}
+}
+
+func (s *Site) HasBearerTokens() bool {
+	return s.JWTSecret != "" || s.JWTPublicKeyPath != ""
+}
+
+// Tokens are signed either with JWTSecret (HS256) or with the private key that goes with JWTPublicKeyPath
+// (RS256), and only the algorithm of the one that's configured is accepted
+func (s *Site) VerifyBearerToken(token string, now time.Time) (*BearerToken, error) {
+	claims, err := parseJwt(token, func(alg string, kid string, signed []byte, signature []byte) error {
+		switch {
+		case alg == "HS256" && s.JWTSecret != "":
+			return verifyJwtHS256(s.JWTSecret, signed, signature)
+		case alg == "RS256" && s.jwtPublicKey != nil:
+			return verifyJwtRS256(s.jwtPublicKey, signed, signature)
+		default:
+			return fmt.Errorf("Unsupported token algorithm %s", alg)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("Tokens need an expiry")
+	}
+	bearer := &BearerToken{Expires: time.Unix(int64(exp), 0)}
+	if now.After(bearer.Expires) {
+		return nil, errors.New("Token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("Token isn't valid yet")
+	}
+	if s.JWTIssuer != "" {
+		if iss, _ := claims["iss"].(string); iss != s.JWTIssuer {
+			return nil, fmt.Errorf("Token issued by %s rather than %s", iss, s.JWTIssuer)
+		}
+	}
+
+	bearer.Subject, _ = claims["sub"].(string)
+	// scope is a space separated string in OAuth, scopes a list is just as common
+	if scope, ok := claims["scope"].(string); ok {
+		bearer.Scopes = strings.Fields(scope)
+	}
+	if scopes, ok := claims["scopes"].([]interface{}); ok {
+		for _, v := range scopes {
+			if scope, ok := v.(string); ok {
+				bearer.Scopes = append(bearer.Scopes, scope)
+			}
+		}
+	}
+	return bearer, nil
+}
+
+// albumPath is empty for things that aren't about an album, those need the scope without a path
+// editing was part of admin before it had a scope of its own, so admin tokens still can
+func (t *BearerToken) HasScope(scope string, albumPath string) bool {
+	if scope == JWT_SCOPE_EDIT && t.HasScope(JWT_SCOPE_ADMIN, albumPath) {
+		return true
+	}
+	for _, v := range t.Scopes {
+		if v == scope || (albumPath != "" && v == scope+":"+albumPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// the token of an Authorization: Bearer header, empty without one
+func getBearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// Answers requests whose bearer token is invalid, or doesn't have scope, the way RFC 6750 says to
+func (s *Site) requireBearerScope(w http.ResponseWriter, r *http.Request, scope string, albumPath string) bool {
+	bearer, err := s.VerifyBearerToken(getBearerToken(r), time.Now())
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, err.Error()))
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized\n"))
+		return false
+	}
+
+	if !bearer.HasScope(scope, albumPath) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("This token can't do that\n"))
+		return false
+	}
+	return true
+}
+
+func (a *Album) CheckBearerToken(w http.ResponseWriter, r *http.Request, scope string) bool {
+	return a.site.requireBearerScope(w, r, scope, a.Path)
+}
+
+func (s *Site) CheckBearerToken(w http.ResponseWriter, r *http.Request, scope string) bool {
+	return s.requireBearerScope(w, r, scope, "")
+}
+
+func (s *Site) validateBearerTokens() error {
+	if s.JWTSecret != "" && len(s.JWTSecret) < JWT_SECRET_MIN_LENGTH {
+		return fmt.Errorf("JWTSecret must be at least %d characters long", JWT_SECRET_MIN_LENGTH)
+	}
+	if s.JWTPublicKeyPath != "" {
+		if _, err := GetPublicKeyFromFile(s.JWTPublicKeyPath); err != nil {
+			return err
+		}
+	}
+	if s.JWTIssuer != "" && !s.HasBearerTokens() {
+		return errors.New("JWTIssuer needs JWTSecret or JWTPublicKeyPath to check tokens with")
+	}
+	return nil
+}
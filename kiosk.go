@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Albums with Kiosk on get a slideshow at <album path>/kiosk/ for screens left running at events: every photo in
+// turn, full screen, picking up new ones from the album's events stream (see live.go) without reloading. To keep
+// the photo and its caption from burning in to the screen, the layout moves a little every few minutes.
+const ALBUM_KIOSK_SLUG = "kiosk"
+
+const KIOSK_PHOTO_WIDTH = 2048
+const DEFAULT_KIOSK_INTERVAL = 8 * time.Second
+const MIN_KIOSK_INTERVAL = 2 * time.Second
+const KIOSK_LAYOUT_SHIFT_INTERVAL = 5 * time.Minute
+
+// the list of photos is fetched again this often at most, so the kiosk never runs out of working photo URLs
+const KIOSK_MAX_RELOAD_INTERVAL = 10 * time.Minute
+
+type KioskPageContext struct {
+	*BasePageContext
+
+	AlbumTitle string
+	Photos     []KioskPhoto
+
+	IntervalMs    int64
+	LayoutShiftMs int64
+	ReloadMs      int64
+
+	LiveUpdatesUrl string
+
+	NoIndex bool
+}
+
+type KioskPhoto struct {
+	Slug    string
+	Url     string
+	Title   string
+	Caption string
+}
+
+func (a *Album) validateKiosk() error {
+	if a.KioskInterval != 0 && !a.Kiosk {
+		return errors.New("KioskInterval is for the slideshow, which needs Kiosk on")
+	}
+	if a.KioskInterval != 0 && a.KioskInterval < MIN_KIOSK_INTERVAL {
+		return errors.New("KioskInterval must be at least 2s")
+	}
+	return nil
+}
+
+func (a *Album) getKioskInterval() time.Duration {
+	if a.KioskInterval > 0 {
+		return a.KioskInterval
+	}
+	return DEFAULT_KIOSK_INTERVAL
+}
+
+// half of how long the photo URLs work, so they're replaced well before they stop
+func (a *Album) getKioskReloadInterval() time.Duration {
+	if expiry := a.GetImageUrlExpiry() / 2; expiry < KIOSK_MAX_RELOAD_INTERVAL {
+		return expiry
+	}
+	return KIOSK_MAX_RELOAD_INTERVAL
+}
+
+func handleAlbumKiosk(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+	album.setCloudfrontCookies(w)
+
+	albumOrdering, err := album.GetOrderedPhotos()
+	if err != nil {
+		album.writeLoadError(err, w, r)
+		return
+	}
+
+	ctx := &KioskPageContext{
+		&BasePageContext{
+			album.site.GetCanonicalUrl().String(),
+			album.GetCanonicalUrl().String() + ALBUM_KIOSK_SLUG + "/",
+			album.MetaTitle,
+			album.site.SiteTitle,
+			album.GetLocale(w, r),
+			album.GetTheme(),
+			album.site.GetColorScheme(),
+		},
+		album.AlbumTitle,
+		nil,
+		album.getKioskInterval().Milliseconds(),
+		KIOSK_LAYOUT_SHIFT_INTERVAL.Milliseconds(),
+		album.getKioskReloadInterval().Milliseconds(),
+		album.GetCanonicalUrl().String() + ALBUM_EVENTS_SLUG + album.getAccessQuery(r),
+		album.NoIndex,
+	}
+	for _, v := range albumOrdering.Ordering {
+		ctx.Photos = append(ctx.Photos, KioskPhoto{
+			v.Slug(),
+			v.GetPhotoForWidth(KIOSK_PHOTO_WIDTH),
+			v.Details().Title,
+			v.Details().Caption,
+		})
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	album.site.executeTemplate(w, "kiosk.html", ctx)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Albums with LiveUpdates (or Kiosk) on have a server-sent events stream at <album path>/events, which tells the
+// album pages open in browsers when the album's photos (or their titles and captions) change, so event galleries
+// fill up while photos are uploaded. Changes are found when the album is reloaded from the bucket, which uploads
+// through 50mm do right away, others within the hour.
+const ALBUM_EVENTS_SLUG = "events"
+
+// proxies close connections that are quiet for too long, a comment every so often keeps them open
+const LIVE_UPDATES_HEARTBEAT = 30 * time.Second
+
+// how long browsers wait before connecting again, after 50mm restarts for instance
+const LIVE_UPDATES_RETRY = 10 * time.Second
+
+// every open album page holds a connection, so there's a limit to how many an album keeps open
+const LIVE_UPDATES_MAX_CLIENTS = 1000
+
+const LIVE_UPDATES_EVENT = "photos"
+
+// the kiosk picks up new photos the same way the album page does
+func (a *Album) HasLiveUpdates() bool {
+	return a.LiveUpdates || a.Kiosk
+}
+
+// changes whenever the album page would, as far as photos go
+func (a *Album) getLiveFingerprint() (string, error) {
+	albumOrdering, err := a.GetOrderedPhotos()
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	for _, v := range albumOrdering.Ordering {
+		fmt.Fprintf(hash, "%s\n%s\n%s\n", v.Slug(), v.Details().Title, v.Details().Caption)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// tells every open album page the album changed, if it did since the last time
+func (a *Album) notifyLiveUpdate() {
+	fingerprint, err := a.getLiveFingerprint()
+	if err != nil {
+		return
+	}
+
+	a.liveClientsMutex.Lock()
+	defer a.liveClientsMutex.Unlock()
+	previous := a.liveFingerprint
+	a.liveFingerprint = fingerprint
+	if previous == "" || previous == fingerprint {
+		return
+	}
+	for c := range a.liveClients {
+		// a page that hasn't taken the last one yet is told anyway
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (a *Album) addLiveClient() (chan struct{}, bool) {
+	a.liveClientsMutex.Lock()
+	defer a.liveClientsMutex.Unlock()
+	if len(a.liveClients) >= LIVE_UPDATES_MAX_CLIENTS {
+		return nil, false
+	}
+	if a.liveClients == nil {
+		a.liveClients = make(map[chan struct{}]bool)
+	}
+	c := make(chan struct{}, 1)
+	a.liveClients[c] = true
+	return c, true
+}
+
+func (a *Album) removeLiveClient(c chan struct{}) {
+	a.liveClientsMutex.Lock()
+	delete(a.liveClients, c)
+	a.liveClientsMutex.Unlock()
+}
+
+func handleAlbumEvents(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Live updates aren't supported here\n"))
+		return
+	}
+
+	c, ok := album.addLiveClient()
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Too many open album pages, reload to see new photos\n"))
+		return
+	}
+	defer album.removeLiveClient(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", LIVE_UPDATES_RETRY.Milliseconds())
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(LIVE_UPDATES_HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-c:
+			fmt.Fprintf(w, "event: %s\ndata: %d\n\n", LIVE_UPDATES_EVENT, time.Now().Unix())
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const DEFAULT_AUTH_MAX_FAILURES = 10
+const DEFAULT_AUTH_FAILURE_WINDOW = 15 * time.Minute
+const DEFAULT_AUTH_LOCKOUT = 15 * time.Minute
+
+// addresses that stopped failing are forgotten, at most this often, so the map doesn't grow forever
+const AUTH_LIMITER_PRUNE_INTERVAL = time.Minute
+
+// Providers that count failed logins per address, and lock an address out for a while once it fails too
+// often. Those logins are never checked while it's locked out, not even the right ones.
+type AuthLimited interface {
+	GetAuthLimiter() *AuthLimiter
+}
+
+// One per site, so failures count the same for every album and the admin
+type AuthLimiter struct {
+	site        *Site
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+
+	mutex     sync.Mutex
+	clients   map[string]*authFailures
+	lastPrune time.Time
+}
+
+type authFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// nil (which limits nothing) when the site has AuthMaxFailures = 0
+func NewAuthLimiter(s *Site) *AuthLimiter {
+	if s.AuthMaxFailures == 0 {
+		return nil
+	}
+	return &AuthLimiter{
+		site:        s,
+		maxFailures: s.AuthMaxFailures,
+		window:      s.AuthFailureWindow,
+		lockout:     s.AuthLockout,
+		clients:     make(map[string]*authFailures),
+	}
+}
+
+func (l *AuthLimiter) getClient(r *http.Request) string {
+	if ip := l.site.GetClientIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// how much longer the request's address is locked out for, 0 when it isn't
+func (l *AuthLimiter) GetLockout(r *http.Request) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if failures, ok := l.clients[l.getClient(r)]; ok {
+		if remaining := time.Until(failures.lockedUntil); remaining > 0 {
+			return remaining
+		}
+	}
+	return 0
+}
+
+func (l *AuthLimiter) RecordFailure(r *http.Request) {
+	if l == nil {
+		return
+	}
+
+	client := l.getClient(r)
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.prune(now)
+
+	failures, ok := l.clients[client]
+	if !ok || now.Sub(failures.first) > l.window {
+		failures = &authFailures{first: now}
+		l.clients[client] = failures
+	}
+	failures.count++
+	if failures.count >= l.maxFailures {
+		failures.lockedUntil = now.Add(l.lockout)
+		fmt.Printf("\nLocked out %s on %s for %s after %d failed logins", client, l.site.Domain, l.lockout, failures.count)
+		// the next round starts over once the lockout is up
+		failures.count = 0
+		failures.first = failures.lockedUntil
+	}
+}
+
+// a login that works wipes the slate clean, so somebody who mistyped their password isn't closer to a lockout
+func (l *AuthLimiter) RecordSuccess(r *http.Request) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.clients, l.getClient(r))
+}
+
+// expects the mutex to be held
+func (l *AuthLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < AUTH_LIMITER_PRUNE_INTERVAL {
+		return
+	}
+	l.lastPrune = now
+
+	for client, failures := range l.clients {
+		if now.After(failures.lockedUntil) && now.Sub(failures.first) > l.window {
+			delete(l.clients, client)
+		}
+	}
+}
+
+func (s *Site) GetAuthLimiter() *AuthLimiter {
+	return s.authLimiter
+}
+
+func (a *Album) GetAuthLimiter() *AuthLimiter {
+	return a.site.authLimiter
+}
+
+// the admin's login, which counts towards the site's lockouts like any other
+type AdminCredentials struct {
+	StaticCredentials
+	site  *Site
+	scope string //what the page needs, logins of the site with a role that allows it get in too
+}
+
+func (c *AdminCredentials) CheckCredentials(user string, pass string) bool {
+	if c.StaticCredentials.CheckCredentials(user, pass) {
+		return true
+	}
+	return c.site.roleAllows(user, c.scope) && c.site.CheckCredentials(user, pass)
+}
+
+func (c *AdminCredentials) GetAuthLimiter() *AuthLimiter {
+	return c.site.authLimiter
+}
+
+func (s *Site) validateAuthLimiter() error {
+	if s.AuthMaxFailures < 0 {
+		return errors.New("AuthMaxFailures can't be negative, use 0 to turn lockouts off")
+	}
+	if s.AuthMaxFailures > 0 && (s.AuthFailureWindow <= 0 || s.AuthLockout <= 0) {
+		return errors.New("AuthFailureWindow and AuthLockout must be longer than 0 with AuthMaxFailures on")
+	}
+	return nil
+}
+
+func writeLockedOut(w http.ResponseWriter, remaining time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(remaining.Seconds())+1))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("Too many failed logins, try again later\n"))
+}
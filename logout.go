@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// /logout ends every login to the site, its albums and the admin in this browser, <album>/logout the album's
+// (along with the site's, for albums that use its login). Photo slugs always have an extension, so they can't
+// clash with the album's.
+const LOGOUT_PATH = "/logout"
+const ALBUM_LOGOUT_SLUG = "logout"
+
+type LoggedOutPageContext struct {
+	*BasePageContext
+
+	BackUrl string
+}
+
+// whether the site has anything to log out of
+func (s *Site) HasLogins() bool {
+	if s.HasAuth() || s.HasAdmin() || s.ShareLinkSecret != "" {
+		return true
+	}
+	for _, a := range s.Albums {
+		if a.HasOwnAuth() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Site) clearCookie(w http.ResponseWriter, name string) {
+	s.setCookie(w, name, "", time.Unix(0, 0))
+}
+
+// only the cookies the browser sent are cleared, rather than one for every album of the site
+func isLoginCookie(name string) bool {
+	return strings.HasPrefix(name, LOGIN_SESSION_COOKIE) || strings.HasPrefix(name, SHARE_COOKIE_PREFIX) ||
+		name == OIDC_SESSION_COOKIE
+}
+
+// Browsers keep sending a basic auth login until a request with it is refused, so requests that come with one
+// get a 401. It asks for the login again, cancelling shows the page.
+func writeLoggedOut(site *Site, backUrl string, locale *Locale, w http.ResponseWriter, r *http.Request) {
+	ctx := &LoggedOutPageContext{
+		getAdminBasePageContext(site, r.URL.Path, locale.T("logged_out_title")),
+		backUrl,
+	}
+	ctx.Locale = locale
+	ctx.Theme = site.GetTheme()
+	ctx.ColorScheme = site.GetColorScheme()
+
+	w.Header().Set("Cache-Control", "no-store")
+	if _, _, ok := r.BasicAuth(); ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="You need a username/password to access this page"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	site.executeTemplate(w, "logged_out.html", ctx)
+}
+
+func handleLogout(site *Site, w http.ResponseWriter, r *http.Request) {
+	for _, v := range r.Cookies() {
+		if isLoginCookie(v.Name) {
+			site.clearCookie(w, v.Name)
+		}
+	}
+	for _, a := range site.Albums {
+		a.clearCloudfrontCookies(w)
+	}
+	writeLoggedOut(site, site.GetCanonicalUrl().String(), site.GetLocale(w, r), w, r)
+}
+
+// the OIDC session is the site's, so logging out of an album with OIDC logins logs out of the site as well
+func handleAlbumLogout(album *Album, w http.ResponseWriter, r *http.Request) {
+	names := []string{getLoginSessionCookieName(album.getLoginRealm()), album.getShareCookieName()}
+	if album.UsesOIDC() {
+		names = append(names, OIDC_SESSION_COOKIE)
+	}
+	for _, v := range names {
+		if _, err := r.Cookie(v); err == nil {
+			album.site.clearCookie(w, v)
+		}
+	}
+	album.clearCloudfrontCookies(w)
+	writeLoggedOut(album.site, album.GetCanonicalUrl().String(), album.GetLocale(w, r), w, r)
+}
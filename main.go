@@ -2,22 +2,104 @@ package main
 
 import (
 	"crypto/subtle"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
-const DEBUG = true
+// templates, locales and themes are read again for every page, set by -dev (see dev.go)
+var DEBUG = false
+
+// the map of an album is served next to its photos, photo slugs always have an extension so they can't clash
+const ALBUM_MAP_SLUG = "map"
 
 var app *App
 var templates *template.Template
 
+// `50mm integration-test` runs the integration tests, in builds with the integration tag (see integration.go)
+const INTEGRATION_TEST_COMMAND = "integration-test"
+
+var runIntegrationTests func(args []string, out io.Writer) error
+
 type AuthCredentialsProvider interface {
-	GetAuthUser() string
-	GetAuthPass() string
+	CheckCredentials(user string, pass string) bool
+}
+
+type StaticCredentials struct {
+	User string
+	Pass string
+}
+
+func (c *StaticCredentials) CheckCredentials(user string, pass string) bool {
+	return checkCredentials(user, pass, c.User, c.Pass)
+}
+
+// the password is compared in constant time, so response times don't give away how much of it was right
+func checkCredentials(user string, pass string, expectedUser string, expectedPass string) bool {
+	return expectedUser != "" && user == expectedUser && subtle.ConstantTimeCompare([]byte(pass), []byte(expectedPass)) == 1
+}
+
+// AuthPassHash is written as <scheme>:<hash>, so other schemes can be added later
+const PASS_HASH_BCRYPT_PREFIX = "bcrypt:"
+
+// bcrypt takes as long to compare any password, so this is constant time as well
+func checkHashedCredentials(user string, pass string, expectedUser string, passHash string) bool {
+	hash := strings.TrimPrefix(passHash, PASS_HASH_BCRYPT_PREFIX)
+	return expectedUser != "" && hash != passHash && user == expectedUser &&
+		bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+func validatePassHash(user string, pass string, passHash string) error {
+	if passHash == "" {
+		return nil
+	}
+	if user == "" {
+		return errors.New("AuthPassHash needs the AuthUser it's the password of")
+	}
+	if pass != "" {
+		return errors.New("AuthPass and AuthPassHash can't both be set, use one or the other")
+	}
+
+	hash := strings.TrimPrefix(passHash, PASS_HASH_BCRYPT_PREFIX)
+	if _, err := bcrypt.Cost([]byte(hash)); hash == passHash || err != nil {
+		return errors.New("AuthPassHash must be a bcrypt hash, written like bcrypt:$2a$10$..., make one with htpasswd -nB user")
+	}
+	return nil
+}
+
+// checks against AuthUsers style lists of user:pass pairs, which have been validated to all have a colon
+func checkCredentialsList(user string, pass string, list []string) bool {
+	for _, v := range list {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) == 2 && checkCredentials(user, pass, parts[0], parts[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthUsers lists need a user name and a password in every entry, and every user name only once
+func validateAuthUsers(list []string) error {
+	seen := make(map[string]bool)
+	for _, v := range list {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("AuthUsers entry '%s' must be written as user:password", parts[0])
+		}
+		if seen[parts[0]] {
+			return fmt.Errorf("AuthUsers lists user '%s' more than once", parts[0])
+		}
+		seen[parts[0]] = true
+	}
+	return nil
 }
 
 type BasePageContext struct {
@@ -26,12 +108,23 @@ type BasePageContext struct {
 
 	MetaTitle string
 	SiteTitle string
+
+	Locale *Locale // the language of the page, nil for English (see i18n.go)
+	Theme  *Theme  // nil for the classic look (see theme.go)
+
+	ColorScheme string // auto, light or dark, empty for the admin's pages (see colorscheme.go)
 }
 
 type IndexPageContext struct {
 	*BasePageContext
 
 	Albums []*Album
+
+	ChangelogUrl string // empty unless the site has a changelog
+	SearchUrl    string // empty unless the site has Search on
+
+	Description string // for link previews, like OgImageUrl (the cover of the first album)
+	OgImageUrl  string
 }
 
 type ImagePageContext struct {
@@ -40,6 +133,23 @@ type ImagePageContext struct {
 	Photo      Renderable
 	Slug       string
 	AlbumTitle string
+
+	DownloadUrl string // empty unless the album allows downloading originals
+
+	AccessQuery string // the access key the page was opened with, for its links
+
+	NoIndex bool // asks search engines to leave the page out, set by the album's NoIndex
+
+	OgImageUrl string // the photo at the size link previews show it
+
+	OEmbedUrl string // empty unless the site has OEmbed on, and the album can be embedded
+
+	TagsUrl string // empty unless the site has TagPages on, the photo's tags link to it followed by the tag
+
+	PrevUrl string // empty for the first photo of the album
+	NextUrl string // empty for the last photo
+
+	Exif *ExifData // nil unless the album has ShowExif on and the photo's EXIF data has been read
 }
 
 type AlbumPageContext struct {
@@ -51,12 +161,62 @@ type AlbumPageContext struct {
 	NumImagesToLoadAtStart int
 
 	OgPhoto Renderable // OpenGraph image meta tag
+
+	MapUrl string // empty unless the album has a map
+
+	ZipDownloadUrl    string // empty unless the album can be downloaded as a zip
+	WebZipDownloadUrl string // the same for the web sized photos
+
+	LogoutUrl string // empty unless the album needs a login
+
+	LiveUpdatesUrl string // empty unless the album has LiveUpdates on
+
+	AccessQuery string // the access key the page was opened with, for its links
+
+	NoIndex bool
+
+	Description string // for link previews, like OgImageUrl (the cover)
+	OgImageUrl  string
+	ShareTitle  string
+	ShareText   string
+
+	OEmbedUrl string // empty unless the site has OEmbed on, and the album can be embedded
+
+	Page        int // 0 when every photo is on the page
+	NumPages    int
+	PrevPageUrl string // empty on the first page
+	NextPageUrl string // empty on the last page
+}
+
+type AlbumMapPageContext struct {
+	*BasePageContext
+
+	AlbumTitle string
+
+	Points []MapPoint
+
+	AccessQuery string // the access key the page was opened with, for its links
+
+	NoIndex bool
+}
+
+// a geotagged photo as plotted by the map page's script
+type MapPoint struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lng"`
+	Url       string  `json:"url"`
+	Thumbnail string  `json:"thumbnail"`
+	Title     string  `json:"title"`
 }
 
 func executeTemplateHelper(w io.Writer, templateName string, ctx interface{}) {
 	var err error
 	if DEBUG {
-		tmpl := template.Must(template.ParseFiles(fmt.Sprintf("templates/%s", templateName)))
+		tmpl, parseErr := template.ParseFiles(fmt.Sprintf("templates/%s", templateName))
+		if parseErr != nil {
+			writeTemplateParseError(w, fmt.Sprintf("templates/%s", templateName), parseErr)
+			return
+		}
 		err = tmpl.Execute(w, ctx)
 	} else {
 		err = templates.ExecuteTemplate(w, templateName, ctx)
@@ -70,32 +230,87 @@ func handleImagePage(slug string, album *Album, w http.ResponseWriter, r *http.R
 	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
 		return
 	}
-	imgUrl := album.site.GetPhotoForKey(album.BucketPrefix + slug)
+	album.setCloudfrontCookies(w)
+	album.RecordView()
+
+	imgUrl, ok := album.GetPhotoForSlug(slug)
+	if !ok {
+		imgUrl = album.GetPhotoForKey(album.BucketPrefix + slug)
+	}
+	renderImagePage(slug, imgUrl, album, album.getAccessQuery(r), album.GetLocale(w, r), w)
+}
 
+func renderImagePage(slug string, imgUrl Renderable, album *Album, accessQuery string, locale *Locale, w io.Writer) {
 	ctx := &ImagePageContext{
 		&BasePageContext{
 			album.site.GetCanonicalUrl().String(),
 			album.GetCanonicalUrl().String(),
 			album.MetaTitle,
 			album.site.SiteTitle,
+			locale,
+			album.GetTheme(),
+			album.site.GetColorScheme(),
 		},
 		imgUrl,
 		slug,
 		album.AlbumTitle,
+		album.GetOriginalDownloadUrl(slug),
+		accessQuery,
+		album.NoIndex,
+		getOgImageUrl(imgUrl),
+		album.getOEmbedUrl(album.GetCanonicalUrl().String() + slug),
+		"",
+		"",
+		"",
+		nil,
 	}
-	executeTemplateHelper(w, "photo.html", ctx)
+	if album.site.TagPages {
+		ctx.TagsUrl = album.site.GetTagUrl("")
+	}
+	prev, next := album.GetNeighbourSlugs(slug)
+	if prev != "" {
+		ctx.PrevUrl = album.GetCanonicalUrl().String() + prev + accessQuery
+	}
+	if next != "" {
+		ctx.NextUrl = album.GetCanonicalUrl().String() + next + accessQuery
+	}
+	if album.ShowExif && imgUrl != nil {
+		ctx.Exif = imgUrl.Details().Exif
+	}
+	album.site.executeTemplate(w, "photo.html", ctx)
 }
 
 func handleAlbumPage(album *Album, w http.ResponseWriter, r *http.Request) {
 	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
 		return
 	}
+	page, ok := getRequestedPage(r)
+	if !ok || page > album.GetNumPages() {
+		album.site.writeErrorPage(album, http.StatusNotFound, "The album doesn't have that page\n", w, r)
+		return
+	}
+	album.setCloudfrontCookies(w)
+	album.RecordView()
 
-	if albumOrdering, err := album.GetOrderedPhotos(); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+	locale := album.GetLocale(w, r)
+	// the page is rendered when its ETag can't be worked out, so the error is reported
+	if etag, err := album.GetPageETag(album.getAccessQuery(r), page, locale); err == nil && writeNotModified(w, r, etag, album.HasAuth()) {
 		return
+	}
+
+	if err := renderAlbumPage(album, album.getAccessQuery(r), page, locale, w); err != nil {
+		album.writeLoadError(err, w, r)
+	}
+}
+
+// renders a page of the album's photos, page 0 for all of them on one page. Nothing is written when there's
+// an error, so it can still be reported
+func renderAlbumPage(album *Album, accessQuery string, page int, locale *Locale, w io.Writer) error {
+	if albumOrdering, err := album.GetOrderedPhotos(); err != nil {
+		return err
 	} else {
+		numPhotos := len(albumOrdering.Ordering)
+		albumOrdering, numPages := album.PaginatePhotos(albumOrdering, page)
 		imageUrls := albumOrdering.Ordering
 		ctx := &AlbumPageContext{
 			&BasePageContext{
@@ -103,36 +318,155 @@ func handleAlbumPage(album *Album, w http.ResponseWriter, r *http.Request) {
 				album.GetCanonicalUrl().String(),
 				album.MetaTitle,
 				album.site.SiteTitle,
+				locale,
+				album.GetTheme(),
+				album.site.GetColorScheme(),
 			},
 			album.AlbumTitle,
 			imageUrls,
 			10,
 			nil,
+			"",
+			"",
+			"",
+			"",
+			"",
+			accessQuery,
+			album.NoIndex,
+			album.GetMetaDescription(numPhotos),
+			"",
+			album.GetShareTitle(),
+			album.GetShareText(),
+			album.getOEmbedUrl(album.GetCanonicalUrl().String()),
+			page,
+			numPages,
+			"",
+			"",
+		}
+		if page > 1 {
+			ctx.PrevPageUrl = album.GetPageUrl(page-1, accessQuery)
+		}
+		if page > 0 && page < numPages {
+			ctx.NextPageUrl = album.GetPageUrl(page+1, accessQuery)
+		}
+		// visitors let in by an access key have no login to log out of
+		if album.HasAuth() && accessQuery == "" {
+			ctx.LogoutUrl = album.GetCanonicalUrl().String() + ALBUM_LOGOUT_SLUG
+		}
+		if album.ShowMap {
+			ctx.MapUrl = album.GetCanonicalUrl().String() + ALBUM_MAP_SLUG + accessQuery
+		}
+		if album.LiveUpdates {
+			ctx.LiveUpdatesUrl = album.GetCanonicalUrl().String() + ALBUM_EVENTS_SLUG + accessQuery
+		}
+		if album.AllowZipDownload {
+			ctx.ZipDownloadUrl = album.GetCanonicalUrl().String() + ALBUM_ZIP_SLUG + accessQuery
+		}
+		if album.AllowWebZipDownload {
+			ctx.WebZipDownloadUrl = album.GetCanonicalUrl().String() + ALBUM_WEB_ZIP_SLUG + accessQuery
 		}
 		if coverPhoto, err := album.GetCoverPhoto(); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
+			return err
 		} else {
 			ctx.OgPhoto = coverPhoto
+			ctx.OgImageUrl = getOgImageUrl(coverPhoto)
 		}
-		executeTemplateHelper(w, "album.html", ctx)
+		album.site.executeTemplate(w, "album.html", ctx)
+	}
+	return nil
+}
+
+func handleAlbumMapPage(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+	album.setCloudfrontCookies(w)
+
+	if err := renderAlbumMapPage(album, album.getAccessQuery(r), album.GetLocale(w, r), w); err != nil {
+		album.writeLoadError(err, w, r)
 	}
 }
 
+func renderAlbumMapPage(album *Album, accessQuery string, locale *Locale, w io.Writer) error {
+	if albumOrdering, err := album.GetOrderedPhotos(); err != nil {
+		return err
+	} else {
+		var points []MapPoint
+		for _, v := range albumOrdering.Ordering {
+			exif := v.Details().Exif
+			if exif == nil || !exif.HasLocation {
+				continue
+			}
+
+			points = append(points, MapPoint{
+				exif.Latitude,
+				exif.Longitude,
+				album.GetCanonicalUrl().String() + v.Slug() + accessQuery,
+				v.GetThumbnailForWidthAndHeight(150, 100),
+				v.Details().Title,
+			})
+		}
+
+		ctx := &AlbumMapPageContext{
+			&BasePageContext{
+				album.site.GetCanonicalUrl().String(),
+				album.GetCanonicalUrl().String() + ALBUM_MAP_SLUG,
+				album.MetaTitle,
+				album.site.SiteTitle,
+				locale,
+				album.GetTheme(),
+				album.site.GetColorScheme(),
+			},
+			album.AlbumTitle,
+			points,
+			accessQuery,
+			album.NoIndex,
+		}
+		album.site.executeTemplate(w, "map.html", ctx)
+	}
+	return nil
+}
+
 func handleAlbumsIndex(site *Site, w http.ResponseWriter, r *http.Request) {
+	// albums in the index don't have logins of their own, so visitors let in to the index can see their covers
+	for _, v := range site.GetAlbumsForIndex() {
+		v.setCloudfrontCookies(w)
+	}
+	renderAlbumsIndex(site, site.GetLocale(w, r), w)
+}
+
+func renderAlbumsIndex(site *Site, locale *Locale, w io.Writer) {
 	ctx := &IndexPageContext{
 		&BasePageContext{
 			site.GetCanonicalUrl().String(),
 			site.GetCanonicalUrl().String(),
 			site.MetaTitle,
 			site.SiteTitle,
+			locale,
+			site.GetTheme(),
+			site.GetColorScheme(),
 		},
 
 		site.GetAlbumsForIndex(),
+		"",
+		"",
+		"",
+		"",
+	}
+	ctx.Description = site.GetMetaDescription(len(ctx.Albums))
+	if len(ctx.Albums) > 0 {
+		ctx.OgImageUrl = getOgImageUrl(ctx.Albums[0].GetIndexCoverPhotoForTemplate())
+	}
+	if site.HasChangelog {
+		u := site.GetUrlForPath(CHANGELOG_PATH)
+		ctx.ChangelogUrl = u.String()
+	}
+	if site.Search {
+		u := site.GetUrlForPath(SEARCH_PATH)
+		ctx.SearchUrl = u.String()
 	}
 
-	executeTemplateHelper(w, "index.html", ctx)
+	site.executeTemplate(w, "index.html", ctx)
 }
 
 func siteHandler(w http.ResponseWriter, r *http.Request) {
@@ -144,6 +478,116 @@ func siteHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	} else {
+		var ok bool
+		if r, ok = site.stripBasePath(w, r); !ok {
+			return
+		}
+		path = r.URL.Path
+		site.setSecurityHeaders(w)
+
+		// the site's own /static/ and /themes/, the ones at the root are for the sites without a BasePath
+		if site.BasePath != "" && strings.HasPrefix(path, STATIC_PATH) {
+			staticHandler.ServeHTTP(w, r)
+			return
+		}
+		if site.BasePath != "" && strings.HasPrefix(path, THEMES_PATH) {
+			themeHandler.ServeHTTP(w, r)
+			return
+		}
+
+		// crawlers outside of the site's networks get told to stay away, rather than a 403
+		if site.RobotsTxt && path == ROBOTS_TXT_PATH {
+			handleRobotsTxt(site, w, r)
+			return
+		}
+
+		if !site.requireAllowedNetwork(w, r, site.allowedNets) {
+			return
+		}
+
+		if site.RobotsTxt && path == SITEMAP_PATH {
+			handleSitemap(site, w, r)
+			return
+		}
+
+		if site.HasAdmin() && strings.HasPrefix(path, ADMIN_PATH) {
+			handleAdmin(site, w, r)
+			return
+		}
+
+		if site.HasAdmin() && strings.HasPrefix(path, API_PATH) {
+			if site.handleCORS(w, r) {
+				return
+			}
+			handleApi(site, w, r)
+			return
+		}
+
+		if site.ProxyPhotos && strings.HasPrefix(path, PHOTO_PROXY_PATH) {
+			if site.handleCORS(w, r) {
+				return
+			}
+			handlePhotoProxy(site, w, r)
+			return
+		}
+
+		if site.UsesSignedUrls() && path == SIGNED_URL_PATH {
+			handleSignedUrl(site, w, r)
+			return
+		}
+
+		if site.ShareLinkSecret != "" && path == GUEST_UPLOAD_PATH {
+			handleGuestUpload(site, w, r)
+			return
+		}
+
+		if site.OIDCIssuer != "" && path == OIDC_LOGIN_PATH {
+			handleOIDCLogin(site, w, r)
+			return
+		}
+		if site.OIDCIssuer != "" && path == OIDC_CALLBACK_PATH {
+			handleOIDCCallback(site, w, r)
+			return
+		}
+
+		if site.HasLogins() && path == LOGOUT_PATH {
+			handleLogout(site, w, r)
+			return
+		}
+
+		if site.PublicStats && path == STATS_PATH {
+			handleStats(site, w, r)
+			return
+		}
+
+		if site.OEmbed && path == OEMBED_PATH {
+			handleOEmbed(site, w, r)
+			return
+		}
+
+		if site.Search && path == SEARCH_PATH {
+			handleSearch(site, w, r)
+			return
+		}
+
+		if site.TagPages && strings.HasPrefix(path, TAGS_PATH) {
+			handleTagPage(site, w, r)
+			return
+		}
+		if site.TagPages && path == strings.TrimRight(TAGS_PATH, "/") {
+			http.Redirect(w, r, site.GetUrlPath(TAGS_PATH), http.StatusMovedPermanently)
+			return
+		}
+
+		if site.HasChangelog && path == CHANGELOG_PATH {
+			handleChangelog(site, w, r)
+			return
+		}
+		if site.HasChangelog && path == strings.TrimRight(CHANGELOG_PATH, "/") {
+			http.Redirect(w, r, site.GetUrlPath(CHANGELOG_PATH), http.StatusMovedPermanently)
+			return
+		}
+
 		if site.HasAlbumIndex && path == "/" {
 			if site.HasAuth() && !checkAndRequireAuth(w, r, site) {
 				return
@@ -153,17 +597,73 @@ func siteHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		album, err := site.GetAlbumForPath(path)
+		album, err := site.GetPublishedAlbumForPath(path)
 		if err != nil {
 			// path isn't an album; see if it's an album + image
 			i := strings.LastIndex(path, "/") + 1
 			albumPath := path[:i]
 			slug := path[i:]
 
-			album, err = site.GetAlbumForPath(albumPath)
+			// the kiosk is a folder of the album, so it's the folder that isn't an album
+			if slug == "" && strings.HasSuffix(albumPath, "/"+ALBUM_KIOSK_SLUG+"/") {
+				albumPath = strings.TrimSuffix(albumPath, ALBUM_KIOSK_SLUG+"/")
+				slug = ALBUM_KIOSK_SLUG + "/"
+			}
+
+			album, err = site.GetPublishedAlbumForPath(albumPath)
+			if err != nil && slug != "" && strings.HasSuffix(albumPath, "/"+ALBUM_PHOTO_SLUG+"/") {
+				if photoAlbum, err := site.GetPublishedAlbumForPath(strings.TrimSuffix(albumPath, ALBUM_PHOTO_SLUG+"/")); err == nil {
+					if photoAlbum.requireAllowedNetwork(w, r) {
+						handlePhotoPermalink(photoAlbum, slug, w, r)
+					}
+					return
+				}
+			}
 			if err != nil {
-				w.WriteHeader(http.StatusNotFound)
-				w.Write([]byte(err.Error()))
+				site.writeErrorPage(nil, http.StatusNotFound, err.Error(), w, r)
+				return
+			}
+
+			if !album.requireAllowedNetwork(w, r) {
+				return
+			}
+			album.setRobotsHeader(w)
+
+			if album.HasAuth() && slug == ALBUM_LOGOUT_SLUG {
+				handleAlbumLogout(album, w, r)
+				return
+			}
+
+			if album.ShowMap && slug == ALBUM_MAP_SLUG {
+				handleAlbumMapPage(album, w, r)
+				return
+			}
+
+			if album.Kiosk && slug == ALBUM_KIOSK_SLUG+"/" {
+				handleAlbumKiosk(album, w, r)
+				return
+			}
+			if album.Kiosk && slug == ALBUM_KIOSK_SLUG {
+				http.Redirect(w, r, site.GetUrlPath(path+"/"), http.StatusMovedPermanently)
+				return
+			}
+
+			if album.Embed && slug == ALBUM_EMBED_SLUG {
+				handleAlbumEmbed(album, w, r)
+				return
+			}
+
+			if album.HasLiveUpdates() && slug == ALBUM_EVENTS_SLUG {
+				handleAlbumEvents(album, w, r)
+				return
+			}
+
+			if album.AllowZipDownload && slug == ALBUM_ZIP_SLUG {
+				handleAlbumZipDownload(album, false, w, r)
+				return
+			}
+			if album.AllowWebZipDownload && slug == ALBUM_WEB_ZIP_SLUG {
+				handleAlbumZipDownload(album, true, w, r)
 				return
 			}
 
@@ -172,35 +672,168 @@ func siteHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			// a photo that was taken down stays gone, rather than leading to the album like a mistyped URL
+			if album.IsTakenDown(slug) {
+				site.writeErrorPage(album, http.StatusGone, "This photo has been removed\n", w, r)
+				return
+			}
+
 			// Couldn't find the image in this album...just redirect to album
-			http.Redirect(w, r, albumPath, http.StatusMovedPermanently)
+			http.Redirect(w, r, site.GetUrlPath(albumPath), http.StatusMovedPermanently)
 			return
 		}
 		// Redirect to canonical album page (with trailing slash) if necessary
 		if path[len(path)-1] != '/' {
-			http.Redirect(w, r, path+"/", http.StatusMovedPermanently)
+			http.Redirect(w, r, site.GetUrlPath(path+"/"), http.StatusMovedPermanently)
 			return
 		}
+		if !album.requireAllowedNetwork(w, r) {
+			return
+		}
+		album.setRobotsHeader(w)
 		handleAlbumPage(album, w, r)
 	}
 }
 
+// Reports whether this instance can serve anything. A site whose bucket is unreachable but which still has
+// cached albums is degraded, not down, so we only fail the probe when no site is able to serve anything. It
+// answers on every site's domain without a login, so it doesn't say which sites there are or what S3 said, that
+// is for the site's admins with ?detail=1.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get(READYZ_DETAIL_PARAM) != "" {
+		handleReadyzDetail(w, r)
+		return
+	}
+
+	status := http.StatusServiceUnavailable
+	for _, s := range app.Sites() {
+		if s.GetReadiness() != "unavailable" {
+			status = http.StatusOK
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if status == http.StatusOK {
+		w.Write([]byte("ok\n"))
+	} else {
+		w.Write([]byte("unavailable\n"))
+	}
+}
+
 func checkAndRequireAuth(w http.ResponseWriter, r *http.Request, provider AuthCredentialsProvider) bool {
-	if u, p, ok := r.BasicAuth(); !ok || u != provider.GetAuthUser() || subtle.ConstantTimeCompare([]byte(p), []byte(provider.GetAuthPass())) != 1 {
+	if checker, ok := provider.(ShareTokenChecker); ok {
+		shared := checker.CheckShareToken(w, r)
+		// the cookie it leaves behind isn't a login of its own
+		if r.URL.Query().Get(SHARE_TOKEN_PARAM) != "" {
+			if shared {
+				auditLogin(provider, r, "share", "", AUTH_AUDIT_SUCCESS)
+			} else {
+				auditLogin(provider, r, "share", "", AUTH_AUDIT_FAILURE)
+			}
+		}
+		if shared {
+			return true
+		}
+	}
+
+	if checker, ok := provider.(AccessKeyChecker); ok && r.URL.Query().Get(ACCESS_KEY_PARAM) != "" {
+		if checker.CheckAccessKey(r) {
+			auditLogin(provider, r, "key", "", AUTH_AUDIT_SUCCESS)
+			return true
+		}
+		auditLogin(provider, r, "key", "", AUTH_AUDIT_FAILURE)
+	}
+
+	if checker, ok := provider.(BearerTokenChecker); ok && getBearerToken(r) != "" {
+		allowed := checker.CheckBearerToken(w, r, JWT_SCOPE_READ)
+		if allowed {
+			auditLogin(provider, r, "bearer", getBearerSubject(provider, r), AUTH_AUDIT_SUCCESS)
+		} else {
+			auditLogin(provider, r, "bearer", getBearerSubject(provider, r), AUTH_AUDIT_FAILURE)
+		}
+		return allowed
+	}
+
+	if authorizer, ok := provider.(OIDCAuthorizer); ok && authorizer.UsesOIDC() {
+		return authorizer.CheckOIDCSession(w, r)
+	}
+
+	sessions, _ := provider.(LoginSessionProvider)
+	if sessions != nil && GetLoginSessionUser(sessions, r) != "" {
+		return true
+	}
+
+	var limiter *AuthLimiter
+	if limited, ok := provider.(AuthLimited); ok {
+		limiter = limited.GetAuthLimiter()
+	}
+	if remaining := limiter.GetLockout(r); remaining > 0 {
+		if u, _, ok := r.BasicAuth(); ok {
+			auditLogin(provider, r, "basic", u, AUTH_AUDIT_LOCKED_OUT)
+		}
+		writeLockedOut(w, remaining)
+		return false
+	}
+
+	u, p, ok := r.BasicAuth()
+	if !ok || !provider.CheckCredentials(u, p) {
+		// browsers ask without a login first, only logins that were actually tried count
+		if ok {
+			limiter.RecordFailure(r)
+			auditLogin(provider, r, "basic", u, AUTH_AUDIT_FAILURE)
+		}
 		w.Header().Set("WWW-Authenticate", `Basic realm="You need a username/password to access this page"`)
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Unauthorized\n"))
 		return false
 	}
+	limiter.RecordSuccess(r)
+	auditLogin(provider, r, "basic", u, AUTH_AUDIT_SUCCESS)
+	if sessions != nil {
+		StartLoginSession(sessions, w, u)
+	}
 	return true
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == SETUP_COMMAND {
+		if err := runSetupWizard(os.Stdin, os.Stdout); err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == SEED_DEMO_COMMAND {
+		if err := runSeedDemo(os.Args[2:], os.Stdout); err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == INTEGRATION_TEST_COMMAND && runIntegrationTests != nil {
+		if err := runIntegrationTests(os.Args[2:], os.Stdout); err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	flag.BoolVar(&DEBUG, DEV_FLAG, false, "read templates, locales and themes again for every page, and don't cache pages")
+	flag.Parse()
+	if DEBUG {
+		fmt.Printf("Development mode: templates are read for every page, and pages aren't cached\n")
+	}
+
 	app = NewApp()
-	templates = template.Must(template.ParseFiles("templates/album.html"))
+	app.StartRefresher()
+	templates = template.Must(template.ParseGlob("templates/*.html"))
 
 	http.HandleFunc("/", siteHandler)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.Handle(STATIC_PATH, staticHandler)
+	http.Handle(THEMES_PATH, themeHandler)
 
 	fmt.Printf("Starting server at port %s\n", app.port)
 	if err := http.ListenAndServe(fmt.Sprintf(":%s", app.port), nil); err != nil {
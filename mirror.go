@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Hybrid mode: sites with a StaticMirrorBucket also write their public pages to it every time an album's caches
+// are refreshed, so a bucket set up for static website hosting keeps serving a copy of the site that's up to
+// date should the server go down. Pages are written as <StaticMirrorPrefix><path>, with index.html for the index
+// and album pages, and pages that are already up to date in the bucket aren't written again.
+const STATIC_MIRROR_INDEX = "index.html"
+const STATIC_MIRROR_ASSETS = "static/"
+const STATIC_MIRROR_CACHE_CONTROL = "public, max-age=300"
+const STATIC_MIRROR_HTML_TYPE = "text/html; charset=utf-8"
+
+func (s *Site) HasStaticMirror() bool {
+	return s.StaticMirrorBucket != ""
+}
+
+// only pages anybody can see are mirrored, the bucket has no logins or networks to keep the others behind
+func (s *Site) isStaticMirrorPublic() bool {
+	return !s.HasAuth() && len(s.AllowedCIDRs) == 0
+}
+
+func (a *Album) isStaticMirrorPublic() bool {
+	return a.site.isStaticMirrorPublic() && !a.HasOwnAuth() && len(a.AllowedCIDRs) == 0
+}
+
+func (s *Site) getStaticMirrorKey(p string) string {
+	return s.StaticMirrorPrefix + strings.TrimPrefix(p, "/")
+}
+
+func (s *Site) validateStaticMirror() error {
+	if !s.HasStaticMirror() {
+		if s.StaticMirrorPrefix != "" {
+			return errors.New("StaticMirrorPrefix needs the StaticMirrorBucket it's a prefix of")
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(s.StaticMirrorPrefix, "/") || (s.StaticMirrorPrefix != "" && !strings.HasSuffix(s.StaticMirrorPrefix, "/")) {
+		return errors.New("StaticMirrorPrefix must be written like mirror/, without a leading slash and with a trailing one")
+	}
+	if !s.isStaticMirrorPublic() {
+		return errors.New("StaticMirrorBucket only gets public pages, and this site needs a login (or is limited to AllowedCIDRs)")
+	}
+
+	// the pages would be written over the photos, or be taken for photos
+	if s.StaticMirrorBucket == s.BucketName {
+		if s.StaticMirrorPrefix == "" {
+			return errors.New("StaticMirrorPrefix is required when StaticMirrorBucket is the site's BucketName")
+		}
+		for _, a := range s.Albums {
+			if strings.HasPrefix(a.BucketPrefix, s.StaticMirrorPrefix) || strings.HasPrefix(s.StaticMirrorPrefix, a.BucketPrefix) {
+				return fmt.Errorf("StaticMirrorPrefix %s can't overlap the BucketPrefix of album %s", s.StaticMirrorPrefix, a.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// ETags of the objects right under prefix by key, which are their MD5s as they're always written in one part
+func (s *Site) getStaticMirrorEtags(svc *s3.S3, prefix string) (map[string]string, error) {
+	etags := make(map[string]string)
+	err := svc.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket:    aws.String(s.StaticMirrorBucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			etags[*obj.Key] = strings.Trim(aws.StringValue(obj.ETag), `"`)
+		}
+		return true
+	})
+	return etags, err
+}
+
+// Writes the pages right under prefix, and deletes the ones that are gone (taken down photos, say). Pages of
+// albums under another album's path are further down, so they're left alone.
+func (s *Site) writeStaticMirrorPages(svc *s3.S3, prefix string, pages map[string][]byte, deleteStale bool) error {
+	etags, err := s.getStaticMirrorEtags(svc, prefix)
+	if err != nil {
+		return fmt.Errorf("Unable to list %s in StaticMirrorBucket: %s", prefix, err.Error())
+	}
+
+	for key, data := range pages {
+		sum := md5.Sum(data)
+		if etags[key] == hex.EncodeToString(sum[:]) {
+			continue
+		}
+
+		contentType := STATIC_MIRROR_HTML_TYPE
+		if strings.HasPrefix(key, s.getStaticMirrorKey(STATIC_MIRROR_ASSETS)) ||
+			strings.HasPrefix(key, s.getStaticMirrorKey(strings.TrimPrefix(THEMES_PATH, "/"))) {
+			contentType = mime.TypeByExtension(path.Ext(key))
+		}
+		if _, err := svc.PutObject(&s3.PutObjectInput{
+			Bucket:       aws.String(s.StaticMirrorBucket),
+			Key:          aws.String(key),
+			Body:         bytes.NewReader(data),
+			ContentType:  aws.String(contentType),
+			CacheControl: aws.String(STATIC_MIRROR_CACHE_CONTROL),
+		}); err != nil {
+			return fmt.Errorf("Unable to write %s to StaticMirrorBucket: %s", key, err.Error())
+		}
+	}
+
+	if !deleteStale {
+		return nil
+	}
+	for key := range etags {
+		if _, ok := pages[key]; ok {
+			continue
+		}
+		if _, err := svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(s.StaticMirrorBucket),
+			Key:    aws.String(key),
+		}); err != nil {
+			return fmt.Errorf("Unable to delete %s from StaticMirrorBucket: %s", key, err.Error())
+		}
+	}
+	return nil
+}
+
+// the index and the stylesheets and scripts the pages use, written along with every album as any album can
+// change the index. Albums writing it at the same time write the same thing, so that's left to happen.
+func (s *Site) updateStaticMirrorIndex(svc *s3.S3) error {
+	if s.HasAlbumIndex {
+		var buf bytes.Buffer
+		renderAlbumsIndex(s, s.GetLocale(nil, nil), &buf)
+		pages := map[string][]byte{s.getStaticMirrorKey(STATIC_MIRROR_INDEX): buf.Bytes()}
+		if err := s.writeStaticMirrorPages(svc, s.StaticMirrorPrefix, pages, false); err != nil {
+			return err
+		}
+	}
+
+	assets, err := s.readStaticMirrorAssets(STATIC_MIRROR_ASSETS, STATIC_MIRROR_ASSETS)
+	if err != nil {
+		return err
+	}
+	if err := s.writeStaticMirrorPages(svc, s.getStaticMirrorKey(STATIC_MIRROR_ASSETS), assets, true); err != nil {
+		return err
+	}
+
+	// the files of the themes are at /themes/<theme>/ (see theme.go)
+	for _, theme := range s.getUsedThemes() {
+		if theme == nil {
+			continue
+		}
+		prefix := strings.TrimPrefix(THEMES_PATH, "/") + theme.Name + "/"
+		assets, err := s.readStaticMirrorAssets(path.Join(THEMES_DIR, theme.Name, "static")+"/", prefix)
+		if err != nil {
+			return err
+		}
+		if err := s.writeStaticMirrorPages(svc, s.getStaticMirrorKey(prefix), assets, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the files right in dir, by their keys under prefix
+func (s *Site) readStaticMirrorAssets(dir string, prefix string) (map[string][]byte, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) && dir != STATIC_MIRROR_ASSETS {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %s", dir, err.Error())
+	}
+	assets := make(map[string][]byte)
+	for _, v := range files {
+		if v.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(dir + v.Name())
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read %s: %s", dir+v.Name(), err.Error())
+		}
+		assets[s.getStaticMirrorKey(prefix+v.Name())] = data
+	}
+	return assets, nil
+}
+
+func (a *Album) getStaticMirrorPages() (map[string][]byte, error) {
+	albumOrdering, err := a.GetOrderedPhotos()
+	if err != nil {
+		return nil, err
+	}
+
+	// the mirror is the same for every visitor, albums in the visitor's language are in English there
+	locale := a.GetLocale(nil, nil)
+	pages := make(map[string][]byte)
+	var buf bytes.Buffer
+	if err := renderAlbumPage(a, "", 0, locale, &buf); err != nil {
+		return nil, err
+	}
+	pages[a.site.getStaticMirrorKey(a.Path+STATIC_MIRROR_INDEX)] = buf.Bytes()
+
+	if a.ShowMap {
+		var buf bytes.Buffer
+		if err := renderAlbumMapPage(a, "", locale, &buf); err != nil {
+			return nil, err
+		}
+		pages[a.site.getStaticMirrorKey(a.Path+ALBUM_MAP_SLUG)] = buf.Bytes()
+	}
+
+	for _, v := range albumOrdering.Ordering {
+		slug := strings.TrimLeft(v.Slug(), "/")
+		var buf bytes.Buffer
+		renderImagePage(slug, v, a, "", locale, &buf)
+		pages[a.site.getStaticMirrorKey(a.Path+slug)] = buf.Bytes()
+	}
+	return pages, nil
+}
+
+func (a *Album) writeStaticMirror() error {
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return err
+	}
+
+	if err := a.site.updateStaticMirrorIndex(svc); err != nil {
+		return err
+	}
+	if !a.isStaticMirrorPublic() || !a.IsPublished() {
+		return nil
+	}
+
+	// an album that can't be shown right now keeps the pages it had, rather than losing them all
+	pages, err := a.getStaticMirrorPages()
+	if err != nil {
+		return err
+	}
+	return a.site.writeStaticMirrorPages(svc, a.site.getStaticMirrorKey(a.Path), pages, true)
+}
+
+// Brings the album's pages in the bucket up to date, in the background after every refresh. Refreshes while
+// it's running (after a takedown, say) have it run once more when it's done, rather than wait for the next one.
+func (a *Album) updateStaticMirror() {
+	atomic.StoreInt32(&a.staticMirrorPending, 1)
+	for atomic.CompareAndSwapInt32(&a.staticMirrorUpdating, 0, 1) {
+		for atomic.CompareAndSwapInt32(&a.staticMirrorPending, 1, 0) {
+			if err := a.writeStaticMirror(); err != nil {
+				fmt.Printf("\nUnable to mirror album %s to StaticMirrorBucket. Error: %s", a.Path, err.Error())
+			}
+		}
+		atomic.StoreInt32(&a.staticMirrorUpdating, 0)
+
+		// a call between the last write and the line above left it pending, and found it still updating
+		if atomic.LoadInt32(&a.staticMirrorPending) == 0 {
+			return
+		}
+	}
+}
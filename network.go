@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// CIDRs like 10.0.0.0/8, or single addresses which are taken to be a /32 (or /128)
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' isn't a valid network, write it like 192.168.1.0/24 or 2001:db8::/32", v)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, v := range nets {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The address of whoever made the request. Behind a proxy that's in X-Forwarded-For, but only proxies in
+// TrustedProxies get to say so: the header is read from the right, every proxy we trust appends the address
+// it got the request from, and the first address that isn't one of ours is the visitor's.
+func (s *Site) GetClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(s.trustedProxies, ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(s.trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// Refuses requests from outside the networks in nets, before anybody gets to try a password
+func (s *Site) requireAllowedNetwork(w http.ResponseWriter, r *http.Request, nets []*net.IPNet) bool {
+	if len(nets) == 0 {
+		return true
+	}
+
+	if ip := s.GetClientIP(r); ip == nil || !containsIP(nets, ip) {
+		s.writeErrorPage(nil, http.StatusForbidden, "This page can't be reached from your network\n", w, r)
+		return false
+	}
+	return true
+}
+
+// the site's AllowedCIDRs are checked for every request already, an album's own come on top of those
+func (a *Album) requireAllowedNetwork(w http.ResponseWriter, r *http.Request) bool {
+	return a.site.requireAllowedNetwork(w, r, a.allowedNets)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Sites with OEmbed set answer oEmbed (https://oembed.com) requests for their album and photo pages here, so
+// platforms like WordPress and Mastodon turn links to them in to embedded galleries. Album and photo pages link
+// to it, which is how those platforms find it.
+const OEMBED_PATH = "/oembed"
+
+// the size of the embed when the platform doesn't limit it, photos are cropped to fit
+const OEMBED_DEFAULT_WIDTH = 600
+const OEMBED_DEFAULT_HEIGHT = 400
+
+// the photos of an album that are embedded along with its cover
+const OEMBED_ALBUM_THUMBNAILS = 4
+
+type OEmbedResponse struct {
+	Type            string `json:"type"`
+	Version         string `json:"version"`
+	Title           string `json:"title"`
+	ProviderName    string `json:"provider_name"`
+	ProviderUrl     string `json:"provider_url"`
+	Html            string `json:"html"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	ThumbnailUrl    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+func (s *Site) validateOEmbed() error {
+	if !s.OEmbed {
+		return nil
+	}
+	for _, a := range s.Albums {
+		if strings.HasPrefix(a.Path, OEMBED_PATH+"/") {
+			return fmt.Errorf("Album %s can't be served under %s, that's where oEmbed requests are answered", a.Path, OEMBED_PATH)
+		}
+	}
+	return nil
+}
+
+// embeds are shown on other sites to anybody, so only albums anybody can see can be embedded
+func (a *Album) isEmbeddable() bool {
+	return !a.HasAuth() && len(a.AllowedCIDRs) == 0 && len(a.site.AllowedCIDRs) == 0
+}
+
+// what discovery links on the album's pages point at, empty when the album can't be embedded
+func (a *Album) getOEmbedUrl(pageUrl string) string {
+	if !a.site.OEmbed || !a.isEmbeddable() {
+		return ""
+	}
+	u := a.site.GetUrlForPath(OEMBED_PATH)
+	u.RawQuery = url.Values{"url": {pageUrl}, "format": {"json"}}.Encode()
+	return u.String()
+}
+
+// the embed's size, within maxwidth and maxheight when the platform asks for that
+func getOEmbedSize(r *http.Request) (int, int) {
+	width, height := OEMBED_DEFAULT_WIDTH, OEMBED_DEFAULT_HEIGHT
+	if maxWidth, err := strconv.Atoi(r.FormValue("maxwidth")); err == nil && maxWidth > 0 && maxWidth < width {
+		width, height = maxWidth, maxWidth*OEMBED_DEFAULT_HEIGHT/OEMBED_DEFAULT_WIDTH
+	}
+	if maxHeight, err := strconv.Atoi(r.FormValue("maxheight")); err == nil && maxHeight > 0 && maxHeight < height {
+		width, height = maxHeight*OEMBED_DEFAULT_WIDTH/OEMBED_DEFAULT_HEIGHT, maxHeight
+	}
+	return width, height
+}
+
+func getOEmbedImageHtml(photo Renderable, width int, height int) string {
+	return fmt.Sprintf(`<img src="%s" width="%d" height="%d" alt="%s" style="object-fit: cover; display: block;">`,
+		html.EscapeString(photo.GetThumbnailForWidthAndHeight(width, height)), width, height,
+		html.EscapeString(photo.Details().GetAltText()))
+}
+
+func handleOEmbed(site *Site, w http.ResponseWriter, r *http.Request) {
+	if format := r.FormValue("format"); format != "" && format != "json" {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("Only the json format is supported\n"))
+		return
+	}
+
+	u, err := url.Parse(r.FormValue("url"))
+	if err != nil || u.Host != site.Domain {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not a page of this site\n"))
+		return
+	}
+
+	// like siteHandler, the path is an album or a photo of one
+	var slug string
+	album, err := site.GetPublishedAlbumForPath(u.Path)
+	if err != nil {
+		i := strings.LastIndex(u.Path, "/") + 1
+		slug = u.Path[i:]
+		album, err = site.GetPublishedAlbumForPath(u.Path[:i])
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !album.isEmbeddable() {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("This album needs a login, it can't be embedded\n"))
+		return
+	}
+
+	response, err := album.getOEmbed(slug, r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// the platforms fetch it from their own servers, but some fetch it from the browser
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(response)
+}
+
+// The album's cover with its first thumbnails under it, or a single photo, linking to the page. The HTML works
+// without any script or stylesheet of this site.
+func (a *Album) getOEmbed(slug string, r *http.Request) (*OEmbedResponse, error) {
+	albumOrdering, err := a.GetOrderedPhotos()
+	if err != nil {
+		return nil, err
+	}
+	width, height := getOEmbedSize(r)
+	response := &OEmbedResponse{
+		Type:         "rich",
+		Version:      "1.0",
+		ProviderName: a.site.SiteTitle,
+		ProviderUrl:  a.site.GetCanonicalUrl().String(),
+		Width:        width,
+	}
+
+	pageUrl := a.GetCanonicalUrl().String()
+	var photo Renderable
+	if slug != "" {
+		var ok bool
+		if photo, ok = a.GetPhotoForSlug(slug); !ok {
+			return nil, errors.New("Not a photo of this album")
+		}
+		pageUrl += slug
+		response.Title = a.AlbumTitle
+		if title := photo.Details().Title; title != "" {
+			response.Title = title + " - " + a.AlbumTitle
+		}
+	} else {
+		if len(albumOrdering.Ordering) == 0 {
+			return nil, errors.New("This album doesn't have any photos yet")
+		}
+		photo = albumOrdering.Cover
+		response.Title = a.AlbumTitle
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<a href="%s" title="%s" style="display: block; width: %dpx;">`, html.EscapeString(pageUrl),
+		html.EscapeString(response.Title), width)
+	b.WriteString(getOEmbedImageHtml(photo, width, height))
+	response.Height = height
+
+	if slug == "" && len(albumOrdering.Thumbnails) > 0 {
+		thumbnails := albumOrdering.Thumbnails
+		if len(thumbnails) > OEMBED_ALBUM_THUMBNAILS {
+			thumbnails = thumbnails[:OEMBED_ALBUM_THUMBNAILS]
+		}
+		size := width / OEMBED_ALBUM_THUMBNAILS
+		b.WriteString(`<span style="display: flex;">`)
+		for _, v := range thumbnails {
+			b.WriteString(getOEmbedImageHtml(v, size, size))
+		}
+		b.WriteString(`</span>`)
+		response.Height += size
+	}
+	b.WriteString(`</a>`)
+	response.Html = b.String()
+
+	response.ThumbnailUrl = photo.GetThumbnailForWidthAndHeight(width, height)
+	response.ThumbnailWidth, response.ThumbnailHeight = width, height
+	return response, nil
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the login and callback live here on sites with an OIDCIssuer, the callback is the redirect URI to register
+// with the identity provider
+const OIDC_PATH = "/oidc/"
+const OIDC_LOGIN_PATH = OIDC_PATH + "login"
+const OIDC_CALLBACK_PATH = OIDC_PATH + "callback"
+
+const OIDC_SESSION_COOKIE = "50mm_session"
+const OIDC_STATE_COOKIE = "50mm_oidc_state"
+
+// how long a visitor stays logged in, independent of how long the identity provider's ID token is valid
+const OIDC_SESSION_LENGTH = 12 * time.Hour
+
+// time to get through the identity provider's login page
+const OIDC_STATE_LENGTH = 15 * time.Minute
+
+const OIDC_TIMEOUT = 10 * time.Second
+
+// a kid we don't know makes us fetch the provider's keys again (keys get rotated), but no more often than this
+const OIDC_JWKS_REFRESH_INTERVAL = time.Minute
+
+const DEFAULT_OIDC_GROUPS_CLAIM = "groups"
+
+var DEFAULT_OIDC_SCOPES = []string{"openid", "email", "profile"}
+
+// Sites and albums implement this, the ones set up for OIDC send visitors to the identity provider instead of
+// asking for a username and password, see checkAndRequireAuth
+type OIDCAuthorizer interface {
+	UsesOIDC() bool
+	CheckOIDCSession(w http.ResponseWriter, r *http.Request) bool
+}
+
+// who a visitor logged in as, kept in a cookie signed with the site's SessionSecret (or its OIDCClientSecret)
+type OIDCSession struct {
+	Email   string    `json:"email"`
+	Groups  []string  `json:"groups,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// what we need of the identity provider's discovery document and keys, fetched the first time a visitor logs in
+type OIDCProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+
+	keys          map[string]*rsa.PublicKey
+	lastKeysFetch time.Time
+	mutex         sync.Mutex
+}
+
+type oidcJwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+type oidcTokenResponse struct {
+	IdToken string `json:"id_token"`
+}
+
+var oidcClient = &http.Client{Timeout: OIDC_TIMEOUT}
+
+// An album with OIDCEmailDomains or OIDCGroups of its own uses those, otherwise it uses the site's, unless it has
+// basic auth logins of its own
+func (a *Album) UsesOIDC() bool {
+	if len(a.OIDCEmailDomains) > 0 || len(a.OIDCGroups) > 0 {
+		return true
+	}
+	return !a.HasOwnAuth() && a.site.UsesOIDC()
+}
+
+func (a *Album) CheckOIDCSession(w http.ResponseWriter, r *http.Request) bool {
+	if len(a.OIDCEmailDomains) > 0 || len(a.OIDCGroups) > 0 {
+		return a.site.requireOIDCSession(w, r, a.OIDCEmailDomains, a.OIDCGroups)
+	}
+	return a.site.CheckOIDCSession(w, r)
+}
+
+func (s *Site) UsesOIDC() bool {
+	return s.OIDCIssuer != "" && (len(s.OIDCEmailDomains) > 0 || len(s.OIDCGroups) > 0)
+}
+
+func (s *Site) CheckOIDCSession(w http.ResponseWriter, r *http.Request) bool {
+	return s.requireOIDCSession(w, r, s.OIDCEmailDomains, s.OIDCGroups)
+}
+
+// domains are matched against the part of the email address after the @, "@example.com" works as well
+func canonicalizeEmailDomains(domains []string) []string {
+	var canonical []string
+	for _, v := range domains {
+		domain := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(v), "@"))
+		if domain != "" {
+			canonical = append(canonical, domain)
+		}
+	}
+	return canonical
+}
+
+func (s *Site) validateOIDC() error {
+	if s.OIDCIssuer == "" {
+		if len(s.OIDCEmailDomains) > 0 || len(s.OIDCGroups) > 0 {
+			return errors.New("OIDCEmailDomains and OIDCGroups need an OIDCIssuer to log in with")
+		}
+		for _, a := range s.Albums {
+			if len(a.OIDCEmailDomains) > 0 || len(a.OIDCGroups) > 0 {
+				return fmt.Errorf("Album %s has OIDCEmailDomains or OIDCGroups, which need the site to have an OIDCIssuer", a.Path)
+			}
+		}
+		return nil
+	}
+
+	if u, err := url.Parse(s.OIDCIssuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("OIDCIssuer must be the URL of the identity provider, not %s", s.OIDCIssuer)
+	}
+	if s.OIDCClientId == "" || s.OIDCClientSecret == "" {
+		return errors.New("OIDCIssuer needs the OIDCClientId and OIDCClientSecret of the client registered with it")
+	}
+	if !stringInSlice("openid", s.OIDCScopes) {
+		return errors.New("OIDCScopes must include openid")
+	}
+	if s.UsesOIDC() && ((s.AuthUser != "" && (s.AuthPass != "" || s.AuthPassHash != "")) || len(s.AuthUsers) > 0 || s.AuthFile != "") {
+		return errors.New("Site can ask for OIDC logins or for a username and password, not both")
+	}
+
+	for _, a := range s.Albums {
+		if (len(a.OIDCEmailDomains) > 0 || len(a.OIDCGroups) > 0) &&
+			((a.AuthUser != "" && (a.AuthPass != "" || a.AuthPassHash != "")) || len(a.AuthUsers) > 0 || a.AuthFile != "") {
+			return fmt.Errorf("Album %s can ask for OIDC logins or for a username and password, not both", a.Path)
+		}
+	}
+	return nil
+}
+
+// Lets visitors through who are logged in with an email address in one of emailDomains or who are in one of
+// groups. Visitors who aren't logged in are sent to log in, and brought back here after.
+func (s *Site) requireOIDCSession(w http.ResponseWriter, r *http.Request, emailDomains []string, groups []string) bool {
+	session := s.GetOIDCSession(r)
+	if session == nil {
+		u := s.GetUrlPath(OIDC_LOGIN_PATH) + "?next=" + url.QueryEscape(r.URL.RequestURI())
+		http.Redirect(w, r, u, http.StatusFound)
+		return false
+	}
+
+	if !session.IsAllowed(emailDomains, groups) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("%s isn't allowed to see this page\n", session.Email)))
+		return false
+	}
+	return true
+}
+
+func (o *OIDCSession) IsAllowed(emailDomains []string, groups []string) bool {
+	if i := strings.LastIndex(o.Email, "@"); i >= 0 && stringInSlice(strings.ToLower(o.Email[i+1:]), emailDomains) {
+		return true
+	}
+	for _, v := range o.Groups {
+		if stringInSlice(v, groups) {
+			return true
+		}
+	}
+	return false
+}
+
+// the visitor's session, nil when they haven't logged in (or the session has run out)
+func (s *Site) GetOIDCSession(r *http.Request) *OIDCSession {
+	if s.OIDCIssuer == "" {
+		return nil
+	}
+	cookie, err := r.Cookie(OIDC_SESSION_COOKIE)
+	if err != nil {
+		return nil
+	}
+
+	var session OIDCSession
+	if !s.readSignedCookie(cookie.Value, &session) || time.Now().After(session.Expires) {
+		return nil
+	}
+	return &session
+}
+
+// cookies we set hold JSON and a signature over it, so visitors can read their own cookies but can't change them
+func (s *Site) signCookie(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + s.signCookiePayload(payload), nil
+}
+
+func (s *Site) signCookiePayload(payload string) string {
+	mac := hmac.New(sha256.New, []byte(s.getCookieSecret()))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Site) readSignedCookie(value string, v interface{}) bool {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(s.signCookiePayload(parts[0])), []byte(parts[1])) {
+		return false
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	return err == nil && json.Unmarshal(data, v) == nil
+}
+
+func (s *Site) setCookie(w http.ResponseWriter, name string, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     s.GetUrlPath("/"),
+		Expires:  expires,
+		Secure:   s.CanonicalSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *Site) getOIDCRedirectUri() string {
+	return s.GetUrlForPath(OIDC_CALLBACK_PATH).String()
+}
+
+func (s *Site) getOIDCProvider() (*OIDCProvider, error) {
+	s.oidcProviderMutex.Lock()
+	defer s.oidcProviderMutex.Unlock()
+
+	if s.oidcProvider != nil {
+		return s.oidcProvider, nil
+	}
+
+	provider := &OIDCProvider{}
+	if err := getOIDCJson(strings.TrimRight(s.OIDCIssuer, "/")+"/.well-known/openid-configuration", provider); err != nil {
+		return nil, fmt.Errorf("Unable to read the discovery document of %s: %s", s.OIDCIssuer, err.Error())
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JwksUri == "" {
+		return nil, fmt.Errorf("The discovery document of %s is missing its endpoints", s.OIDCIssuer)
+	}
+
+	s.oidcProvider = provider
+	return provider, nil
+}
+
+func getOIDCJson(u string, v interface{}) error {
+	resp, err := oidcClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *OIDCProvider) getKey(kid string) (*rsa.PublicKey, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.lastKeysFetch) < OIDC_JWKS_REFRESH_INTERVAL {
+		return nil, fmt.Errorf("Unknown signing key %s", kid)
+	}
+	p.lastKeysFetch = time.Now()
+
+	var jwks oidcJwks
+	if err := getOIDCJson(p.JwksUri, &jwks); err != nil {
+		return nil, fmt.Errorf("Unable to read the signing keys: %s", err.Error())
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, v := range jwks.Keys {
+		if v.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(v.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(v.E)
+		if err != nil {
+			continue
+		}
+		keys[v.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.keys = keys
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unknown signing key %s", kid)
+}
+
+// Checks the signature and claims of an ID token and gives the session it logs in to. Only RS256 is supported,
+// which is what every identity provider signs with unless told otherwise.
+func (s *Site) verifyIdToken(provider *OIDCProvider, token string, nonce string, now time.Time) (*OIDCSession, error) {
+	claims, err := parseJwt(token, func(alg string, kid string, signed []byte, signature []byte) error {
+		if alg != "RS256" {
+			return fmt.Errorf("Unsupported ID token algorithm %s", alg)
+		}
+		key, err := provider.getKey(kid)
+		if err != nil {
+			return err
+		}
+		return verifyJwtRS256(key, signed, signature)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != strings.TrimRight(s.OIDCIssuer, "/") {
+		return nil, fmt.Errorf("ID token issued by %s rather than %s", iss, s.OIDCIssuer)
+	}
+	if !jwtAudienceContains(claims["aud"], s.OIDCClientId) {
+		return nil, errors.New("ID token issued to another client")
+	}
+	if exp, _ := claims["exp"].(float64); now.After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("ID token has expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("ID token is for another login")
+	}
+
+	email, _ := claims["email"].(string)
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		email = ""
+	}
+
+	session := &OIDCSession{Email: strings.ToLower(email), Expires: now.Add(OIDC_SESSION_LENGTH)}
+	if groups, ok := claims[s.OIDCGroupsClaim].([]interface{}); ok {
+		for _, v := range groups {
+			if group, ok := v.(string); ok {
+				session.Groups = append(session.Groups, group)
+			}
+		}
+	}
+	return session, nil
+}
+
+// aud is either the client id or a list that has it
+func jwtAudienceContains(aud interface{}, clientId string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientId
+	case []interface{}:
+		for _, v := range aud {
+			if v == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// what the login started with, to check the callback against
+type oidcLoginState struct {
+	State   string    `json:"state"`
+	Nonce   string    `json:"nonce"`
+	Next    string    `json:"next"`
+	Expires time.Time `json:"expires"`
+}
+
+// only paths on this site, so the login can't be used to send visitors elsewhere
+func isLocalPath(next string) bool {
+	return strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\")
+}
+
+func handleOIDCLogin(site *Site, w http.ResponseWriter, r *http.Request) {
+	provider, err := site.getOIDCProvider()
+	if err != nil {
+		fmt.Printf("\n%s", err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("Unable to reach the login provider, please try again later\n"))
+		return
+	}
+
+	next := r.URL.Query().Get("next")
+	if !isLocalPath(next) {
+		next = "/"
+	}
+
+	u, err := site.startOIDCLogin(provider, next, w)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// remembers the login in a cookie and gives the identity provider's URL to send the visitor to
+func (s *Site) startOIDCLogin(provider *OIDCProvider, next string, w http.ResponseWriter) (string, error) {
+	state, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	loginState := oidcLoginState{state, nonce, next, time.Now().Add(OIDC_STATE_LENGTH)}
+	cookie, err := s.signCookie(loginState)
+	if err != nil {
+		return "", err
+	}
+	s.setCookie(w, OIDC_STATE_COOKIE, cookie, loginState.Expires)
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {s.OIDCClientId},
+		"redirect_uri":  {s.getOIDCRedirectUri()},
+		"scope":         {strings.Join(s.OIDCScopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+func handleOIDCCallback(site *Site, w http.ResponseWriter, r *http.Request) {
+	var loginState oidcLoginState
+	cookie, err := r.Cookie(OIDC_STATE_COOKIE)
+	if err != nil || !site.readSignedCookie(cookie.Value, &loginState) || time.Now().After(loginState.Expires) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("This login has expired, please try again\n"))
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("state") != loginState.State {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("This login doesn't match the one we started, please try again\n"))
+		return
+	}
+	if e := query.Get("error"); e != "" {
+		site.auditLogin(r, loginState.Next, "", "oidc", "", AUTH_AUDIT_FAILURE)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("The login provider refused the login: %s\n", e)))
+		return
+	}
+
+	session, err := site.exchangeOIDCCode(query.Get("code"), loginState.Nonce)
+	if err != nil {
+		fmt.Printf("\nUnable to complete the login on %s. Error: %s", site.Domain, err.Error())
+		site.auditLogin(r, loginState.Next, "", "oidc", "", AUTH_AUDIT_FAILURE)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Unable to complete the login, please try again\n"))
+		return
+	}
+
+	value, err := site.signCookie(session)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	site.auditLogin(r, loginState.Next, "", "oidc", session.Email, AUTH_AUDIT_SUCCESS)
+	site.setCookie(w, OIDC_SESSION_COOKIE, value, session.Expires)
+	site.setCookie(w, OIDC_STATE_COOKIE, "", time.Unix(0, 0))
+	http.Redirect(w, r, site.GetUrlPath(loginState.Next), http.StatusFound)
+}
+
+func (s *Site) exchangeOIDCCode(code string, nonce string) (*OIDCSession, error) {
+	if code == "" {
+		return nil, errors.New("No code in the callback")
+	}
+	provider, err := s.getOIDCProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {s.getOIDCRedirectUri()},
+	}
+	req, err := http.NewRequest("POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(s.OIDCClientId), url.QueryEscape(s.OIDCClientSecret))
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Token endpoint answered with status %d", resp.StatusCode)
+	}
+
+	var token oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	return s.verifyIdToken(provider, token.IdToken, nonce, time.Now())
+}
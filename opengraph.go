@@ -0,0 +1,40 @@
+package main
+
+import "fmt"
+
+// Index and album pages (photo pages too) describe themselves with OpenGraph and Twitter card tags, so links to
+// them shared in chat apps and on social networks show a preview: the title, a description and the cover.
+// Previews are shown up to 1200 pixels wide (Facebook's recommended size), so that's the width the image is
+// asked for.
+const OG_IMAGE_WIDTH = 1200
+
+// the site's MetaDescription, or how many albums are in the index
+func (s *Site) GetMetaDescription(numAlbums int) string {
+	if s.MetaDescription != "" {
+		return s.MetaDescription
+	}
+	return fmt.Sprintf("%d %s", numAlbums, pluralize(numAlbums, "album"))
+}
+
+// the album's MetaDescription, or how many photos it has, and where
+func (a *Album) GetMetaDescription(numPhotos int) string {
+	if a.MetaDescription != "" {
+		return a.MetaDescription
+	}
+	return fmt.Sprintf("%d %s in %s", numPhotos, pluralize(numPhotos, "photo"), a.site.SiteTitle)
+}
+
+func pluralize(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
+
+// empty for albums without photos, which get a preview without an image
+func getOgImageUrl(photo Renderable) string {
+	if photo == nil {
+		return ""
+	}
+	return photo.GetPhotoForWidth(OG_IMAGE_WIDTH)
+}
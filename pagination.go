@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Albums with a PageSize (their own or the site's) show that many photos per page, the rest are on ?page=2
+// and on, so albums of hundreds of photos don't make pages that take ages to load. Photo pages, the map, the
+// zips and the static mirror (which can't tell ?page=2 from the first page) still have the whole album.
+const PAGE_PARAM = "page"
+
+// the album's PageSize, or the site's, 0 for every photo on one page
+func (a *Album) GetPageSize() int {
+	if a.PageSize > 0 {
+		return a.PageSize
+	}
+	return a.site.PageSize
+}
+
+func getNumPages(numPhotos int, pageSize int) int {
+	if pageSize == 0 || numPhotos <= pageSize {
+		return 1
+	}
+	return (numPhotos + pageSize - 1) / pageSize
+}
+
+// how many pages the album's photos take, an album without photos still has its first page
+func (a *Album) GetNumPages() int {
+	orderingKeys, err := a.getVisibleOrderedKeys()
+	if err != nil {
+		return 1
+	}
+	return getNumPages(len(orderingKeys.Ordering), a.GetPageSize())
+}
+
+// Narrows the ordering of GetOrderedPhotos down to the photos of the page, 1 being the first. Page 0 keeps
+// every photo (on a single page), pages past the last have none. Gives the number of pages as well.
+func (a *Album) PaginatePhotos(albumOrdering AlbumOrdering, page int) (AlbumOrdering, int) {
+	size := a.GetPageSize()
+	if page == 0 || size == 0 {
+		return albumOrdering, 1
+	}
+	numPages := getNumPages(len(albumOrdering.Ordering), size)
+
+	start, end := (page-1)*size, page*size
+	if start > len(albumOrdering.Ordering) {
+		start = len(albumOrdering.Ordering)
+	}
+	if end > len(albumOrdering.Ordering) {
+		end = len(albumOrdering.Ordering)
+	}
+	albumOrdering.Ordering = albumOrdering.Ordering[start:end]
+	return albumOrdering, numPages
+}
+
+// the page asked for, 1 without one, and whether it's a page number at all
+func getRequestedPage(r *http.Request) (int, bool) {
+	value := r.URL.Query().Get(PAGE_PARAM)
+	if value == "" {
+		return 1, true
+	}
+	page, err := strconv.Atoi(value)
+	return page, err == nil && page >= 1
+}
+
+// the URL of a page of the album, keeping the access key the page was opened with
+func (a *Album) GetPageUrl(page int, accessQuery string) string {
+	u := a.GetCanonicalUrl().String() + accessQuery
+	if page <= 1 {
+		return u
+	}
+	separator := "?"
+	if accessQuery != "" {
+		separator = "&"
+	}
+	return u + separator + PAGE_PARAM + "=" + strconv.Itoa(page)
+}
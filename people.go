@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Whether a person tagged in the album's photos (with `people:` on a photo in ordering.yaml) agreed to be
+// shown publicly. Going by the top level `people:` section of ordering.yaml, e.g.
+//
+//	people:
+//	  Alice:
+//	    public: true
+//
+// People that aren't listed there never agreed, so photos of them are only shown behind a login.
+type PersonConsent struct {
+	Public bool `yaml:"public"`
+}
+
+func (c AlbumOrderingConfig) IsPublicPerson(name string) bool {
+	consent, ok := c.People[name]
+	return ok && consent.Public
+}
+
+// whether anybody in the photo didn't agree to be shown publicly
+func (a *Album) hasPrivatePeople(key string, photoDetails map[string]*PhotoDetails, config AlbumOrderingConfig) bool {
+	details, ok := photoDetails[strings.TrimLeft(key, "/")]
+	if !ok {
+		return false
+	}
+	for _, v := range details.People {
+		if !config.IsPublicPerson(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Leaves out whatever is public about people who didn't agree to it. Albums without a login are public, so
+// their photos and names are left out altogether. Albums with one keep them, except for the cover and
+// thumbnails, which show up on the site index and in link previews.
+func (a *Album) applyPeopleConsent(orderingKeys *AlbumOrderingKeys, config AlbumOrderingConfig) {
+	if len(config.Entries) == 0 {
+		return
+	}
+
+	for k, details := range orderingKeys.photoDetails {
+		details.hasPrivatePeople = a.hasPrivatePeople(k, orderingKeys.photoDetails, config)
+	}
+	private := func(key string) bool {
+		details, ok := orderingKeys.photoDetails[strings.TrimLeft(key, "/")]
+		return ok && details.hasPrivatePeople
+	}
+	public := func(keys []string) []string {
+		var kept []string
+		for _, v := range keys {
+			if !private(v) {
+				kept = append(kept, v)
+			}
+		}
+		return kept
+	}
+
+	if !a.HasAuth() {
+		orderingKeys.Ordering = public(orderingKeys.Ordering)
+		for _, details := range orderingKeys.photoDetails {
+			var names []string
+			for _, v := range details.People {
+				if config.IsPublicPerson(v) {
+					names = append(names, v)
+				}
+			}
+			details.People = names
+		}
+	}
+
+	orderingKeys.Thumbnails = public(orderingKeys.Thumbnails)
+	if orderingKeys.Cover != "" && private(orderingKeys.Cover) {
+		orderingKeys.Cover = ""
+		if candidates := public(orderingKeys.Ordering); len(candidates) > 0 {
+			orderingKeys.Cover = candidates[0]
+		}
+	}
+}
+
+// GetOrderedKeys for visitors, the admin sees everybody (and, with StagedPublishing, what isn't published yet)
+func (a *Album) getVisibleOrderedKeys() (AlbumOrderingKeys, error) {
+	if a.site.StagedPublishing {
+		orderingKeys, err := a.getPublishedOrderedKeys()
+		if err == nil {
+			a.applyCoverFallback(&orderingKeys)
+		}
+		return orderingKeys, err
+	}
+
+	//note that this may be all empties if there's an err in retrieval/parsing.
+	albumOrderingConfig, err := a.GetAlbumOrderingConfig()
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() != 404 {
+		//regular 404's add too much noise, we shouldn't say anything. Other errors should be displayed.
+		fmt.Printf("\nUnable to pick up album ordering for album %s from S3, Error: %s", a.Path, err.Error())
+	}
+
+	orderingKeys, err := a.GetOrderedKeys(albumOrderingConfig)
+	if err != nil {
+		return orderingKeys, err
+	}
+	a.applyPeopleConsent(&orderingKeys, albumOrderingConfig)
+	a.applyCoverFallback(&orderingKeys)
+	return orderingKeys, nil
+}
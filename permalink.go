@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Every photo of an album has a page of its own at <album path><photo>, e.g. /baku/PA036278.jpg, which is what
+// gets linked and shared. It steps through the album's ordering with previous and next links (and the arrow
+// keys). Links written as <album path>photo/<photo> are sent on to it, photo slugs always have an extension so
+// they can't clash.
+const ALBUM_PHOTO_SLUG = "photo"
+
+// the slugs of the photos before and after slug in the album's ordering, empty at either end and for photos
+// that aren't in it
+func (a *Album) GetNeighbourSlugs(slug string) (string, string) {
+	orderingKeys, err := a.getVisibleOrderedKeys()
+	if err != nil {
+		return "", ""
+	}
+
+	slug = strings.TrimLeft(slug, "/")
+	for i, v := range orderingKeys.Ordering {
+		if getSlugForKey(v) != slug {
+			continue
+		}
+
+		var prev, next string
+		if i > 0 {
+			prev = getSlugForKey(orderingKeys.Ordering[i-1])
+		}
+		if i < len(orderingKeys.Ordering)-1 {
+			next = getSlugForKey(orderingKeys.Ordering[i+1])
+		}
+		return prev, next
+	}
+	return "", ""
+}
+
+// the slug a photo's Renderable would have
+func getSlugForKey(key string) string {
+	parts := strings.Split(key, "/")
+	return parts[len(parts)-1]
+}
+
+// the page of the photo, at <album path>photo/<slug>, keeping the access key (or share token) it was opened with
+func handlePhotoPermalink(album *Album, slug string, w http.ResponseWriter, r *http.Request) {
+	target := album.site.GetUrlPath(album.Path + slug)
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
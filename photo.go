@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/md5"
 	"crypto/rsa"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
+	"path"
 	"strings"
 	"time"
 
@@ -16,13 +20,143 @@ import (
 	"github.com/globocom/gothumbor"
 )
 
+// the formats we know how to offer next to the original, best first, as browsers pick the first
+// <source> they support.
+var MODERN_FORMATS = []string{"avif", "webp"}
+
+var FORMAT_MIME_TYPES = map[string]string{
+	"avif": "image/avif",
+	"webp": "image/webp",
+}
+
+// PhotoDetails is everything we know about a photo besides how to build its URLs. Every Renderable
+// embeds one; the album fills it in from the bucket listing.
+type PhotoDetails struct {
+	// other encodings of the same photo uploaded next to it (photo.webp next to photo.jpg), keyed by format
+	Siblings map[string]string
+
+	// set when the photo's album is watermarked, nil otherwise
+	Watermark *Watermark
+
+	// set by the album's StripExif, for resizing services that keep metadata unless they're told not to
+	StripExif bool
+
+	// how long the photo's URLs work, set by the album's ImageUrlLifetime. 0 for as long as usual.
+	UrlLifetime time.Duration
+
+	Title   string
+	Caption string
+	Alt     string // describes the photo for screen readers and search engines
+
+	// the people tagged in the photo, in albums without a login only the ones that agreed to be shown publicly
+	People           []string
+	hasPrivatePeople bool
+
+	// from ordering.yaml, normalized by normalizeTag
+	Tags []string
+
+	// read from the photo's EXIF data when the site has FixOrientation or DetectPanoramas or the album ShowMap,
+	// ShowExif or CollapseBursts on, nil when unknown
+	Exif *ExifData
+
+	// shown while the photo loads when the site has PlaceholderColors on, empty until it's known
+	DominantColor string
+
+	// set by the site's PageBudgetKB, 0 leaves the quality to the resizing service and the width to the template
+	Quality  int
+	MaxWidth int
+
+	// set for animated GIFs, APNGs and WebPs when the site has AnimatedImages on. With AnimatedImages = poster
+	// the photo's own URLs give a still of the first frame and AnimationUrl the untouched original.
+	IsAnimated   bool
+	AnimationUrl string
+
+	// the video of a Live Photo or motion photo uploaded next to it (IMG_1234.mov next to IMG_1234.jpg), played
+	// straight from the bucket. Empty for plain photos.
+	MotionUrl string
+
+	// with CollapseBursts on, the first photo of a burst knows how many photos the burst has and the others
+	// the slug of the first one
+	BurstSize   int
+	BurstLeader string
+}
+
+// caps w at MaxWidth, so photos stepped down for the page budget are never asked for any bigger
+func (d *PhotoDetails) budgetWidth(w int) int {
+	if d.MaxWidth > 0 && w > d.MaxWidth {
+		return d.MaxWidth
+	}
+	return w
+}
+
+// the photo's UrlLifetime, or usual when it has none
+func (d *PhotoDetails) getUrlLifetime(usual time.Duration) time.Duration {
+	if d.UrlLifetime > 0 {
+		return d.UrlLifetime
+	}
+	return usual
+}
+
+// GetOrientation gives the EXIF orientation of the photo, 0 when it isn't known
+func (d *PhotoDetails) GetOrientation() int {
+	if d.Exif == nil {
+		return 0
+	}
+	return d.Exif.Orientation
+}
+
+// how far the resizing service has to turn the photo clockwise, 0 when it's upright or the orientation is unknown
+func (d *PhotoDetails) GetRotationDegrees() int {
+	if d.Exif == nil {
+		return 0
+	}
+	return d.Exif.RotationDegrees()
+}
+
+// IsPanorama tells templates to show the photo in a 360° viewer, only ever set with DetectPanoramas on
+func (d *PhotoDetails) IsPanorama() bool {
+	return d.Exif != nil && d.Exif.IsPanorama()
+}
+
+// GetAltText falls back to the title or caption when there's no alt text of its own, as those still
+// describe the photo better than nothing.
+func (d *PhotoDetails) GetAltText() string {
+	switch {
+	case d.Alt != "":
+		return d.Alt
+	case d.Title != "":
+		return d.Title
+	default:
+		return d.Caption
+	}
+}
+
+// Watermark is applied by the resizing service on every derivative it serves, the originals in the bucket
+// are never touched.
+type Watermark struct {
+	Text     string
+	ImageKey string
+	Opacity  int // 0 (invisible) to 100 (opaque)
+}
+
+// an alternative encoding of a photo, templates render these as <source>s inside a <picture>
+type PhotoSource struct {
+	Type string `json:"type"`
+	Url  string `json:"url"`
+}
+
 type RescaledPhoto struct {
+	*PhotoDetails
 	Key     string
 	BaseUrl *url.URL
+
+	// formats the resizing service should convert to when there's no sibling upload for them
+	Formats []string
 }
 
 type ImgixRescaledPhoto struct {
 	*RescaledPhoto
+	Secret string //the source's secure URL token, URLs aren't signed without one
 }
 
 // for use with thumbor as a basic setup, URL signing mandatory.
@@ -41,7 +175,16 @@ type ThumborCloudfront struct {
 	AWSCloudfrontPrivateKey *rsa.PrivateKey //required for URL signing
 }
 
+// for originals served by a cloudfront distribution in front of a private bucket, which only lets through
+// signed URLs, or browsers with the signed cookies an album page hands out (see cloudfront.go)
+type CloudfrontPhoto struct {
+	*RescaledPhoto
+	AWSCloudfrontKeyPairId  string
+	AWSCloudfrontPrivateKey *rsa.PrivateKey //nil with signed cookies, the URLs are left unsigned
+}
+
 type S3Photo struct {
+	*PhotoDetails
 	Key        string
 	BucketName string
 	awsSession *session.Session
@@ -54,17 +197,85 @@ type ImageProxy struct {
 
 type Renderable interface {
 	Slug() string
+	Details() *PhotoDetails
 	GetPhotoForWidth(int) string
+	GetSourcesForWidth(int) []PhotoSource
 	GetThumbnailForWidthAndHeight(int, int) string
 }
 
+func (d *PhotoDetails) Details() *PhotoDetails {
+	return d
+}
+
+// Builds the alternative sources for a photo. A sibling that was uploaded to the bucket always wins, otherwise
+// we fall back to having the resizing service convert the original, for the formats it's been configured to.
+// urlForKey gets an empty format when asked for a sibling, as the sibling already is in that format.
+func (d *PhotoDetails) GetSources(key string, convertFormats []string, urlForKey func(key string, format string) string) []PhotoSource {
+	var sources []PhotoSource
+	for _, format := range MODERN_FORMATS {
+		var url string
+		if siblingKey, ok := d.Siblings[format]; ok {
+			url = urlForKey(siblingKey, "")
+		} else if stringInSlice(format, convertFormats) {
+			url = urlForKey(key, format)
+		}
+
+		if url != "" {
+			sources = append(sources, PhotoSource{FORMAT_MIME_TYPES[format], url})
+		}
+	}
+	return sources
+}
+
+// how long signed URLs stay valid, clients that need them longer can get fresh ones (see SIGNED_URL_PATH)
+const S3_URL_EXPIRY = 24 * time.Hour
+const S3_MAX_URL_EXPIRY = 7 * 24 * time.Hour
+const CLOUDFRONT_URL_EXPIRY = 1 * time.Hour
+
+func validateImageUrlLifetime(lifetime time.Duration) error {
+	if lifetime < 0 {
+		return errors.New("ImageUrlLifetime can't be negative, use 0 for the usual lifetime")
+	}
+	if lifetime > 0 && lifetime < time.Minute {
+		return errors.New("ImageUrlLifetime must be at least 1m, pages are still loading their photos before that")
+	}
+	if lifetime > S3_MAX_URL_EXPIRY {
+		return errors.New("ImageUrlLifetime can be at most 7 days, S3 doesn't sign URLs for longer")
+	}
+	return nil
+}
+
+// the video halves of Live Photos, iPhones export them as .mov and Android phones as .mp4
+var MOTION_EXTENSIONS = []string{"mov", "mp4"}
+
+func isMotionKey(key string) bool {
+	return stringInSlice(strings.ToLower(strings.TrimPrefix(path.Ext(key), ".")), MOTION_EXTENSIONS)
+}
+
+// what iPhones upload, which browsers can't display
+var HEIC_EXTENSIONS = []string{"heic", "heif"}
+
+func isHeicKey(key string) bool {
+	return stringInSlice(strings.ToLower(strings.TrimPrefix(path.Ext(key), ".")), HEIC_EXTENSIONS)
+}
+
 func (p *RescaledPhoto) Slug() string {
 	parts := strings.Split(p.Key, "/")
 	return parts[len(parts)-1]
 }
 
 func (p *ImgixRescaledPhoto) GetPhotoForWidth(w int) string {
-	keyPathUrl, err := url.Parse(p.Key)
+	return p.getUrlForKeyAndWidth(p.Key, w, "")
+}
+
+func (p *ImgixRescaledPhoto) GetSourcesForWidth(w int) []PhotoSource {
+	return p.GetSources(p.Key, p.Formats, func(key string, format string) string {
+		return p.getUrlForKeyAndWidth(key, w, format)
+	})
+}
+
+func (p *ImgixRescaledPhoto) getUrlForKeyAndWidth(key string, w int, format string) string {
+	keyPathUrl, err := url.Parse(key)
 	if err != nil {
 		log.Print(err)
 		return ""
@@ -72,10 +283,19 @@ func (p *ImgixRescaledPhoto) GetPhotoForWidth(w int) string {
 
 	fullUrl := p.BaseUrl.ResolveReference(keyPathUrl)
 	queryValues := fullUrl.Query()
-	queryValues.Add("w", fmt.Sprint(w))
-	fullUrl.RawQuery = queryValues.Encode()
+	queryValues.Add("w", fmt.Sprint(p.budgetWidth(w)))
+	if format != "" {
+		queryValues.Add("fm", format)
+	} else if isHeicKey(key) {
+		queryValues.Add("fm", "jpg")
+	}
+	if p.Quality > 0 {
+		queryValues.Add("q", fmt.Sprint(p.Quality))
+	}
+	p.addPosterFrame(queryValues)
+	p.addWatermark(queryValues)
 
-	return fullUrl.String()
+	return p.signUrl(fullUrl, queryValues)
 }
 
 func (p *ImgixRescaledPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
@@ -91,15 +311,83 @@ func (p *ImgixRescaledPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
 	queryValues.Add("max-h", fmt.Sprint(h))
 	queryValues.Add("fit", "crop")
 	queryValues.Add("crop", "faces")
+	if isHeicKey(p.Key) {
+		queryValues.Add("fm", "jpg")
+	}
+	p.addPosterFrame(queryValues)
+	p.addWatermark(queryValues)
+
+	return p.signUrl(fullUrl, queryValues)
+}
+
+// With a Secret the URL is signed, and with an UrlLifetime it stops working a while later. The expiry is rounded
+// up to the next multiple of the lifetime so the URLs (and imgix's cache of them) stay the same for a while,
+// so they work for between one and two lifetimes. See https://docs.imgix.com/setup/securing-images
+func (p *ImgixRescaledPhoto) signUrl(fullUrl *url.URL, queryValues url.Values) string {
+	if p.Secret == "" {
+		fullUrl.RawQuery = queryValues.Encode()
+		return fullUrl.String()
+	}
 
-	fullUrl.RawQuery = queryValues.Encode()
+	if lifetime := p.UrlLifetime; lifetime > 0 {
+		seconds := int64(lifetime / time.Second)
+		expires := (time.Now().Add(lifetime).Unix()/seconds + 1) * seconds
+		queryValues.Set("expires", fmt.Sprint(expires))
+	}
+
+	query := queryValues.Encode()
+	signed := p.Secret + fullUrl.EscapedPath()
+	if query != "" {
+		signed += "?" + query
+	}
+	sum := md5.Sum([]byte(signed))
 
+	// the signature goes last, after the query it signs
+	fullUrl.RawQuery = strings.TrimLeft(query+"&s="+hex.EncodeToString(sum[:]), "&")
 	return fullUrl.String()
 }
 
+// animations shown as posters get their first frame, see https://docs.imgix.com/apis/rendering/animation/frame
+func (p *ImgixRescaledPhoto) addPosterFrame(queryValues url.Values) {
+	if p.AnimationUrl != "" {
+		queryValues.Add("frame", "1")
+	}
+}
+
+// see https://docs.imgix.com/apis/rendering/watermark and https://docs.imgix.com/apis/rendering/text
+func (p *ImgixRescaledPhoto) addWatermark(queryValues url.Values) {
+	if p.Watermark == nil {
+		return
+	}
+
+	if p.Watermark.ImageKey != "" {
+		queryValues.Add("mark", "/"+strings.TrimLeft(p.Watermark.ImageKey, "/"))
+		queryValues.Add("mark-align", "bottom,right")
+		queryValues.Add("mark-alpha", fmt.Sprint(p.Watermark.Opacity))
+	}
+
+	if p.Watermark.Text != "" {
+		queryValues.Add("txt", p.Watermark.Text)
+		queryValues.Add("txt-align", "bottom,right")
+		queryValues.Add("txt-pad", "20")
+		// imgix takes the opacity as the alpha channel of an ARGB colour
+		queryValues.Add("txt-color", fmt.Sprintf("%02xffffff", p.Watermark.Opacity*255/100))
+	}
+}
+
 func (p *ThumborRaw) GetPhotoForWidth(w int) string {
-	thumborOptions := gothumbor.ThumborOptions{Width: w, Smart: true}
-	thumborPath, err := gothumbor.GetCryptedThumborPath(p.Secret, p.Key, thumborOptions)
+	return p.getUrlForKeyAndWidth(p.Key, w, "")
+}
+
+func (p *ThumborRaw) GetSourcesForWidth(w int) []PhotoSource {
+	return p.GetSources(p.Key, p.Formats, func(key string, format string) string {
+		return p.getUrlForKeyAndWidth(key, w, format)
+	})
+}
+
+func (p *ThumborRaw) getUrlForKeyAndWidth(key string, w int, format string) string {
+	thumborOptions := p.thumborOptions(key, w, 0, format)
+	thumborPath, err := gothumbor.GetCryptedThumborPath(p.Secret, key, thumborOptions)
 	if err != nil {
 		log.Print(err)
 		return ""
@@ -112,7 +400,7 @@ func (p *ThumborRaw) GetPhotoForWidth(w int) string {
 }
 
 func (p *ThumborRaw) GetThumbnailForWidthAndHeight(w, h int) string {
-	thumborOptions := gothumbor.ThumborOptions{Width: w, Height: h, Smart: true}
+	thumborOptions := p.thumborOptions(p.Key, w, h, "")
 	thumborPath, err := gothumbor.GetCryptedThumborPath(p.Secret, p.Key, thumborOptions)
 	if err != nil {
 		log.Print(err)
@@ -134,9 +422,13 @@ func (p *ThumborCloudfront) SignCloudfrontURL(path string) string {
 	}
 	fullUrl := p.BaseUrl.ResolveReference(parsedPath)
 
-	// now sign for cloudfront
-	signer := sign.NewURLSigner(p.AWSCloudfrontKeyPairId, p.AWSCloudfrontPrivateKey)
-	signedURL, err := signer.Sign(fullUrl.String(), time.Now().Add(1*time.Hour))
+	return signCloudfrontUrl(p.AWSCloudfrontKeyPairId, p.AWSCloudfrontPrivateKey, fullUrl.String(),
+		p.getUrlLifetime(CLOUDFRONT_URL_EXPIRY))
+}
+
+func signCloudfrontUrl(keyPairId string, privateKey *rsa.PrivateKey, rawUrl string, lifetime time.Duration) string {
+	signer := sign.NewURLSigner(keyPairId, privateKey)
+	signedURL, err := signer.Sign(rawUrl, time.Now().Add(lifetime))
 	if err != nil {
 		log.Printf("Failed to sign url, err: %s\n", err.Error())
 		return ""
@@ -145,9 +437,19 @@ func (p *ThumborCloudfront) SignCloudfrontURL(path string) string {
 }
 
 func (p *ThumborCloudfront) GetPhotoForWidth(w int) string {
+	return p.getUrlForKeyAndWidth(p.Key, w, "")
+}
+
+func (p *ThumborCloudfront) GetSourcesForWidth(w int) []PhotoSource {
+	return p.GetSources(p.Key, p.Formats, func(key string, format string) string {
+		return p.getUrlForKeyAndWidth(key, w, format)
+	})
+}
+
+func (p *ThumborCloudfront) getUrlForKeyAndWidth(key string, w int, format string) string {
 	// get thumbor path without signing
-	thumborOptions := gothumbor.ThumborOptions{Width: w, Smart: true}
-	thumborPath, err := gothumbor.GetThumborPath(p.Key, thumborOptions)
+	thumborOptions := p.thumborOptions(key, w, 0, format)
+	thumborPath, err := gothumbor.GetThumborPath(key, thumborOptions)
 	if err != nil {
 		log.Print(err)
 		return ""
@@ -157,7 +459,7 @@ func (p *ThumborCloudfront) GetPhotoForWidth(w int) string {
 }
 
 func (p *ThumborCloudfront) GetThumbnailForWidthAndHeight(w, h int) string {
-	thumborOptions := gothumbor.ThumborOptions{Width: w, Height: h, Smart: true}
+	thumborOptions := p.thumborOptions(p.Key, w, h, "")
 	thumborPath, err := gothumbor.GetThumborPath(p.Key, thumborOptions)
 	if err != nil {
 		log.Print(err)
@@ -167,18 +469,58 @@ func (p *ThumborCloudfront) GetThumbnailForWidthAndHeight(w, h int) string {
 	return p.SignCloudfrontURL(thumborPath)
 }
 
+func (p *CloudfrontPhoto) GetPhotoForWidth(w int) string {
+	return p.getUrlForKey(p.Key)
+}
+
+// cloudfront only serves what's in the bucket, so uploaded siblings are the only other formats there are
+func (p *CloudfrontPhoto) GetSourcesForWidth(w int) []PhotoSource {
+	return p.GetSources(p.Key, nil, func(key string, format string) string {
+		return p.getUrlForKey(key)
+	})
+}
+
+func (p *CloudfrontPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
+	return p.getUrlForKey(p.Key)
+}
+
+func (p *CloudfrontPhoto) getUrlForKey(key string) string {
+	fullUrl := p.BaseUrl.ResolveReference(&url.URL{Path: key})
+	if p.AWSCloudfrontPrivateKey == nil {
+		return fullUrl.String()
+	}
+	return signCloudfrontUrl(p.AWSCloudfrontKeyPairId, p.AWSCloudfrontPrivateKey, fullUrl.String(),
+		p.getUrlLifetime(CLOUDFRONT_URL_EXPIRY))
+}
+
 func (p *S3Photo) Slug() string {
 	parts := strings.Split(p.Key, "/")
 	return parts[len(parts)-1]
 }
 
 func (p *S3Photo) GetPhotoForWidth(w int) string {
+	return p.getSignedUrlForKey(p.Key)
+}
+
+// there's no resizing service to convert for us, so all we can offer are sibling uploads
+func (p *S3Photo) GetSourcesForWidth(w int) []PhotoSource {
+	return p.GetSources(p.Key, nil, func(key string, format string) string {
+		return p.getSignedUrlForKey(key)
+	})
+}
+
+func (p *S3Photo) getSignedUrlForKey(key string) string {
+	if p.awsSession == nil {
+		// the site couldn't create an AWS session, it's already been logged there
+		return ""
+	}
+
 	req, _ := s3.New(p.awsSession).GetObjectRequest(&s3.GetObjectInput{
 		Bucket: aws.String(p.BucketName),
-		Key:    aws.String(p.Key),
+		Key:    aws.String(key),
 	})
 
-	signedUrl, err := req.Presign(24 * time.Hour)
+	signedUrl, err := req.Presign(p.getUrlLifetime(S3_URL_EXPIRY))
 	if err != nil {
 		log.Printf("Unable to sign URL for S3Photo. Error: %s\n", err.Error())
 		return ""
@@ -197,19 +539,18 @@ func (p *ImageProxy) Slug() string {
 }
 
 func (p *ImageProxy) GetPhotoForWidth(w int) string {
-	req, _ := s3.New(p.awsSession).GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(p.BucketName),
-		Key:    aws.String(p.Key),
+	return p.getUrlForKeyAndWidth(p.Key, w)
+}
+
+func (p *ImageProxy) GetSourcesForWidth(w int) []PhotoSource {
+	return p.GetSources(p.Key, nil, func(key string, format string) string {
+		return p.getUrlForKeyAndWidth(key, w)
 	})
+}
 
-	signedUrl, err := req.Presign(24 * time.Hour)
-	if err != nil {
-		log.Printf("Unable to sign URL for S3Photo. Error: %s\n", err.Error())
-		return ""
-	}
-	queryUrl, err := url.Parse(signedUrl)
-	if err != nil {
-		log.Printf("Unable to sign URL %s for S3Photo. Error: %s\n", queryUrl.String(), err.Error())
+func (p *ImageProxy) getUrlForKeyAndWidth(key string, w int) string {
+	signedUrl := p.getSignedUrlForKey(key)
+	if signedUrl == "" {
 		return ""
 	}
 
@@ -224,6 +565,7 @@ func (p *ImageProxy) GetThumbnailForWidthAndHeight(w, h int) string {
 Used when we can't get the photo required, and have to return something, for example in methods used by templates
 */
 type ErrorPhoto struct {
+	*PhotoDetails
 }
 
 func (p *ErrorPhoto) Slug() string {
@@ -234,6 +576,65 @@ func (p *ErrorPhoto) GetPhotoForWidth(w int) string {
 	return ""
 }
 
+func (p *ErrorPhoto) GetSourcesForWidth(w int) []PhotoSource {
+	return nil
+}
+
 func (p *ErrorPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
 	return ""
 }
+
+// thumbor converts through its format filter (an empty format leaves the format alone, except for HEIC
+// which has to become JPEG), and watermarks
+// through its watermark filter, which takes transparency rather than opacity. Thumbor can't render text.
+func (p *RescaledPhoto) thumborFilters(key string, format string) []string {
+	if format == "" && isHeicKey(key) {
+		format = "jpeg"
+	}
+
+	var filters []string
+	if format != "" {
+		filters = append(filters, fmt.Sprintf("format(%s)", format))
+	}
+	if p.Quality > 0 {
+		filters = append(filters, fmt.Sprintf("quality(%d)", p.Quality))
+	}
+	// thumbors set up to keep animations (with gifsicle) would animate the poster too
+	if p.AnimationUrl != "" {
+		filters = append(filters, "still()")
+	}
+	// thumbor ignores EXIF orientation unless it's configured otherwise, and its rotate filter turns counterclockwise
+	if degrees := p.GetRotationDegrees(); degrees != 0 {
+		filters = append(filters, fmt.Sprintf("rotate(%d)", 360-degrees))
+	}
+	// thumbors set up to keep EXIF data would pass the orientation on with the photo it no longer applies to, and
+	// browsers that go by it turn the photo a second time
+	if p.StripExif || p.GetOrientation() > 1 {
+		filters = append(filters, "strip_exif()")
+	}
+	if p.Watermark != nil && p.Watermark.ImageKey != "" {
+		filters = append(filters, fmt.Sprintf("watermark(%s,-10,-10,%d)", p.Watermark.ImageKey, 100-p.Watermark.Opacity))
+	}
+	return filters
+}
+
+// thumbor resizes before it applies the rotate filter, so photos turned on their side have to be resized
+// along the other axis to end up at the requested size.
+func (p *RescaledPhoto) thumborOptions(key string, w, h int, format string) gothumbor.ThumborOptions {
+	if h == 0 {
+		w = p.budgetWidth(w)
+	}
+	if p.GetRotationDegrees()%180 != 0 {
+		w, h = h, w
+	}
+	return gothumbor.ThumborOptions{Width: w, Height: h, Smart: true, Filters: p.thumborFilters(key, format)}
+}
+
+func stringInSlice(needle string, haystack []string) bool {
+	for _, v := range haystack {
+		if v == needle {
+			return true
+		}
+	}
+	return false
+}
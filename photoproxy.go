@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sites with ProxyPhotos on hand out photo URLs on the site itself, /photo/<album path><photo>?w=800, and 50mm
+// streams the photos from the bucket (or the resizing service) to the browser. The bucket can be private, the
+// album's login applies to its photos as much as to its pages, and nothing in the pages gives away where the
+// photos are kept. The URLs don't change from one page view to the next, so browsers can cache them, and the
+// smaller photos (thumbnails, mostly) are kept in memory for a while so they're only fetched once.
+const PHOTO_PROXY_PATH = "/photo/"
+
+// what the photo's URL asks for: a width (and height, for thumbnails) and format, or one of the variants
+const PHOTO_PROXY_WIDTH_PARAM = "w"
+const PHOTO_PROXY_HEIGHT_PARAM = "h"
+const PHOTO_PROXY_FORMAT_PARAM = "f"
+const PHOTO_PROXY_VARIANT_PARAM = "v"
+
+const PHOTO_PROXY_VARIANT_ANIMATION = "animation"
+const PHOTO_PROXY_VARIANT_MOTION = "motion"
+const PHOTO_PROXY_VARIANT_DOWNLOAD = "download"
+
+const PHOTO_PROXY_MAX_WIDTH = 8192
+
+// how long browsers keep the photos, the URL of a photo that's replaced in the bucket stays the same
+const PHOTO_PROXY_MAX_AGE = 24 * time.Hour
+
+// photos up to PHOTO_PROXY_CACHE_MAX_ENTRY are kept in memory for PHOTO_PROXY_CACHE_TTL, up to the site's
+// ProxyPhotosCacheMB altogether
+const PHOTO_PROXY_CACHE_TTL = time.Hour
+const PHOTO_PROXY_CACHE_MAX_ENTRY = 1024 * 1024
+const DEFAULT_PHOTO_PROXY_CACHE_MB = 64
+
+const PHOTO_PROXY_TIMEOUT = 30 * time.Second
+
+// what's passed on from the browser to the bucket, so Range requests and revalidations work as they would there
+var PHOTO_PROXY_REQUEST_HEADERS = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"}
+
+// and back. Content-Length and Content-Range go through http.ServeContent for photos served from memory.
+var PHOTO_PROXY_RESPONSE_HEADERS = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag",
+	"Last-Modified", "Content-Disposition"}
+var PHOTO_PROXY_CACHED_HEADERS = []string{"Content-Type", "ETag", "Last-Modified", "Content-Disposition"}
+
+// only the wait for the response is limited, originals and zips can take as long as they take to stream
+var photoProxyClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	ResponseHeaderTimeout: PHOTO_PROXY_TIMEOUT,
+}}
+
+// a photo whose URLs are on the site, the Renderable it wraps has the URLs they're fetched from
+type ProxiedPhoto struct {
+	Renderable
+	url string // /photo/<album path><slug> on the site, without the query
+}
+
+type PhotoProxyCache struct {
+	entries map[string]*list.Element
+	order   *list.List // of *PhotoProxyCacheEntry, most recently used first
+	size    int
+	mutex   sync.Mutex
+}
+
+type PhotoProxyCacheEntry struct {
+	key      string
+	header   http.Header
+	body     []byte
+	modified time.Time
+	stored   time.Time
+}
+
+func (s *Site) validateProxyPhotos() error {
+	if s.ProxyPhotosCacheMB < 0 {
+		return errors.New("ProxyPhotosCacheMB can't be negative, use 0 for the default")
+	}
+	if !s.ProxyPhotos {
+		return nil
+	}
+	if s.CloudfrontSignedCookies {
+		return errors.New("ProxyPhotos fetches the photos with signed URLs, it can't be used with CloudfrontSignedCookies")
+	}
+	if s.StaticMirrorBucket != "" {
+		return errors.New("ProxyPhotos can't be used with a StaticMirrorBucket, the mirror's pages would show photos from this server")
+	}
+	if s.ImageUrlLifetime > 0 {
+		return errors.New("Photos from ProxyPhotos are only for visitors of their album anyway, their URLs don't need an ImageUrlLifetime")
+	}
+	for _, a := range s.Albums {
+		if strings.HasPrefix(a.Path, PHOTO_PROXY_PATH) {
+			return fmt.Errorf("Album %s can't be served under %s, that's where ProxyPhotos serves the photos", a.Path, PHOTO_PROXY_PATH)
+		}
+		if a.ImageUrlLifetime > 0 {
+			return fmt.Errorf("Album %s: photos from ProxyPhotos are only for visitors of their album anyway, their URLs don't need an ImageUrlLifetime", a.Path)
+		}
+		if len(a.AccessKeys) > 0 {
+			return fmt.Errorf("Album %s: links with AccessKeys can't get the album's photos through ProxyPhotos, the photos' URLs don't carry the key", a.Path)
+		}
+	}
+	return nil
+}
+
+// the photo with URLs on the site, if the site has ProxyPhotos on
+func (a *Album) proxyPhoto(photo Renderable) Renderable {
+	if !a.site.ProxyPhotos {
+		return photo
+	}
+	return &ProxiedPhoto{photo, a.getPhotoProxyUrl(photo.Slug())}
+}
+
+func (a *Album) getPhotoProxyUrl(slug string) string {
+	return a.site.GetUrlForPath(PHOTO_PROXY_PATH + strings.TrimLeft(a.Path, "/") + strings.TrimLeft(slug, "/")).String()
+}
+
+// The photo as it's fetched, for 50mm's own requests for it (analysing, prewarming, purging and the like),
+// which shouldn't go through the proxy.
+func getUpstreamPhoto(photo Renderable) Renderable {
+	if proxied, ok := photo.(*ProxiedPhoto); ok {
+		return proxied.Renderable
+	}
+	return photo
+}
+
+func (p *ProxiedPhoto) getUrl(params url.Values) string {
+	return p.url + "?" + params.Encode()
+}
+
+func (p *ProxiedPhoto) GetPhotoForWidth(w int) string {
+	return p.getUrl(url.Values{PHOTO_PROXY_WIDTH_PARAM: {strconv.Itoa(w)}})
+}
+
+func (p *ProxiedPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
+	return p.getUrl(url.Values{PHOTO_PROXY_WIDTH_PARAM: {strconv.Itoa(w)}, PHOTO_PROXY_HEIGHT_PARAM: {strconv.Itoa(h)}})
+}
+
+func (p *ProxiedPhoto) GetSourcesForWidth(w int) []PhotoSource {
+	var sources []PhotoSource
+	for _, v := range p.Renderable.GetSourcesForWidth(w) {
+		for format, mimeType := range FORMAT_MIME_TYPES {
+			if mimeType == v.Type {
+				sources = append(sources, PhotoSource{v.Type, p.getUrl(url.Values{
+					PHOTO_PROXY_WIDTH_PARAM:  {strconv.Itoa(w)},
+					PHOTO_PROXY_FORMAT_PARAM: {format},
+				})})
+			}
+		}
+	}
+	return sources
+}
+
+// the details are shared with the photo the proxy fetches, so the ones with URLs in them are copied
+func (p *ProxiedPhoto) Details() *PhotoDetails {
+	details := *p.Renderable.Details()
+	if details.AnimationUrl != "" {
+		details.AnimationUrl = p.getUrl(url.Values{PHOTO_PROXY_VARIANT_PARAM: {PHOTO_PROXY_VARIANT_ANIMATION}})
+	}
+	if details.MotionUrl != "" {
+		details.MotionUrl = p.getUrl(url.Values{PHOTO_PROXY_VARIANT_PARAM: {PHOTO_PROXY_VARIANT_MOTION}})
+	}
+	return &details
+}
+
+// the URL the photo's proxy URL with query is fetched from, false for queries it doesn't have one for
+func (a *Album) getPhotoProxyUpstreamUrl(photo *ProxiedPhoto, query url.Values) (string, bool) {
+	upstream := photo.Renderable
+	switch query.Get(PHOTO_PROXY_VARIANT_PARAM) {
+	case PHOTO_PROXY_VARIANT_ANIMATION:
+		return upstream.Details().AnimationUrl, upstream.Details().AnimationUrl != ""
+	case PHOTO_PROXY_VARIANT_MOTION:
+		return upstream.Details().MotionUrl, upstream.Details().MotionUrl != ""
+	case PHOTO_PROXY_VARIANT_DOWNLOAD:
+		if !a.AllowOriginalDownload {
+			return "", false
+		}
+		return a.getSignedOriginalDownloadUrl(upstream.Slug()), true
+	case "":
+		break
+	default:
+		return "", false
+	}
+
+	w, err := strconv.Atoi(query.Get(PHOTO_PROXY_WIDTH_PARAM))
+	if err != nil || w < 0 || w > PHOTO_PROXY_MAX_WIDTH {
+		return "", false
+	}
+	h := 0
+	if v := query.Get(PHOTO_PROXY_HEIGHT_PARAM); v != "" {
+		if h, err = strconv.Atoi(v); err != nil || h < 0 || h > PHOTO_PROXY_MAX_WIDTH {
+			return "", false
+		}
+	}
+
+	if format := query.Get(PHOTO_PROXY_FORMAT_PARAM); format != "" {
+		for _, v := range upstream.GetSourcesForWidth(w) {
+			if v.Type == FORMAT_MIME_TYPES[format] {
+				return v.Url, true
+			}
+		}
+		return "", false
+	}
+	if h > 0 {
+		return upstream.GetThumbnailForWidthAndHeight(w, h), true
+	}
+	return upstream.GetPhotoForWidth(w), true
+}
+
+// Admins looking at an album's photos in the admin are let in without the album's login
+func isAdminSession(site *Site, r *http.Request) bool {
+	if !site.HasAdmin() {
+		return false
+	}
+	provider, ok := site.GetAdminCredentials().(LoginSessionProvider)
+	return ok && GetLoginSessionUser(provider, r) != ""
+}
+
+func handlePhotoProxy(site *Site, w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, PHOTO_PROXY_PATH)
+	i := strings.LastIndex(path, "/") + 1
+	album, err := site.GetPublishedAlbumForPath("/" + path[:i])
+	if err != nil {
+		site.writeErrorPage(nil, http.StatusNotFound, err.Error(), w, r)
+		return
+	}
+	if !album.requireAllowedNetwork(w, r) {
+		return
+	}
+	if album.HasAuth() && !isAdminSession(site, r) && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	photo, ok := album.GetPhotoForSlug(path[i:])
+	proxied, isProxied := photo.(*ProxiedPhoto)
+	if !ok || !isProxied {
+		site.writeErrorPage(album, http.StatusNotFound, "No such photo\n", w, r)
+		return
+	}
+	query := r.URL.Query()
+	// without a size or variant it's a link to the photo, like <album path>photo/<photo> (see permalink.go)
+	if query.Get(PHOTO_PROXY_WIDTH_PARAM) == "" && query.Get(PHOTO_PROXY_VARIANT_PARAM) == "" {
+		handlePhotoPermalink(album, path[i:], w, r)
+		return
+	}
+	upstream, ok := album.getPhotoProxyUpstreamUrl(proxied, query)
+	if !ok || upstream == "" {
+		site.writeErrorPage(album, http.StatusNotFound, "No such photo\n", w, r)
+		return
+	}
+
+	// the same photo whatever else is in the query, like the share token of the page it's on
+	cacheKey := r.URL.Path + "?" + url.Values{
+		PHOTO_PROXY_WIDTH_PARAM:   {query.Get(PHOTO_PROXY_WIDTH_PARAM)},
+		PHOTO_PROXY_HEIGHT_PARAM:  {query.Get(PHOTO_PROXY_HEIGHT_PARAM)},
+		PHOTO_PROXY_FORMAT_PARAM:  {query.Get(PHOTO_PROXY_FORMAT_PARAM)},
+		PHOTO_PROXY_VARIANT_PARAM: {query.Get(PHOTO_PROXY_VARIANT_PARAM)},
+	}.Encode()
+	site.serveUpstream(cacheKey, upstream, album.HasAuth(), w, r)
+}
+
+// Streams what's at the upstream URL to the browser, from memory when it's been fetched lately. cacheKey is
+// empty for responses that aren't to be kept by anybody, private for ones that only the visitor's browser may keep.
+func (s *Site) serveUpstream(cacheKey string, upstream string, private bool, w http.ResponseWriter, r *http.Request) {
+	cacheControl := fmt.Sprintf("max-age=%d", int(PHOTO_PROXY_MAX_AGE.Seconds()))
+	if cacheKey == "" {
+		cacheControl = "no-cache"
+	}
+	if private {
+		w.Header().Set("Cache-Control", "private, "+cacheControl)
+	} else {
+		w.Header().Set("Cache-Control", "public, "+cacheControl)
+	}
+
+	if entry, ok := s.photoProxyCache.Get(cacheKey); ok {
+		for k, v := range entry.header {
+			w.Header()[k] = v
+		}
+		http.ServeContent(w, r, "", entry.modified, bytes.NewReader(entry.body))
+		return
+	}
+
+	// signed URLs are only good for GETs, HEADs are answered without the body
+	req, err := http.NewRequest(http.MethodGet, upstream, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	req = req.WithContext(r.Context())
+	for _, v := range PHOTO_PROXY_REQUEST_HEADERS {
+		if value := r.Header.Get(v); value != "" {
+			req.Header.Set(v, value)
+		}
+	}
+
+	resp, err := photoProxyClient.Do(req)
+	if err != nil {
+		log.Printf("Unable to fetch %s%s. Error: %s\n", s.Domain, r.URL.Path, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("Unable to fetch the photo\n"))
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified, http.StatusPreconditionFailed,
+		http.StatusRequestedRangeNotSatisfiable:
+		break
+	case http.StatusNotFound:
+		s.writeErrorPage(nil, http.StatusNotFound, "No such photo\n", w, r)
+		return
+	default:
+		log.Printf("Unable to fetch %s%s. Status: %d\n", s.Domain, r.URL.Path, resp.StatusCode)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("Unable to fetch the photo\n"))
+		return
+	}
+
+	for _, v := range PHOTO_PROXY_RESPONSE_HEADERS {
+		if value := resp.Header.Get(v); value != "" {
+			w.Header().Set(v, value)
+		}
+	}
+
+	if cacheKey != "" && resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 &&
+		resp.ContentLength <= PHOTO_PROXY_CACHE_MAX_ENTRY {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("Unable to fetch the photo\n"))
+			return
+		}
+		entry := &PhotoProxyCacheEntry{cacheKey, make(http.Header), body, time.Time{}, time.Now()}
+		for _, v := range PHOTO_PROXY_CACHED_HEADERS {
+			if value := resp.Header.Get(v); value != "" {
+				entry.header.Set(v, value)
+			}
+		}
+		if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			entry.modified = modified
+		}
+		s.photoProxyCache.Put(entry, s.getProxyPhotosCacheSize())
+
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(body)
+		}
+		return
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	if r.Method != http.MethodHead {
+		io.Copy(w, resp.Body)
+	}
+}
+
+func (s *Site) getProxyPhotosCacheSize() int {
+	if s.ProxyPhotosCacheMB > 0 {
+		return s.ProxyPhotosCacheMB * 1024 * 1024
+	}
+	return DEFAULT_PHOTO_PROXY_CACHE_MB * 1024 * 1024
+}
+
+// the entry for key, unless it's been kept for longer than PHOTO_PROXY_CACHE_TTL
+func (c *PhotoProxyCache) Get(key string) (*PhotoProxyCacheEntry, bool) {
+	if key == "" {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*PhotoProxyCacheEntry)
+	if time.Since(entry.stored) > PHOTO_PROXY_CACHE_TTL {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry, true
+}
+
+// keeps the entry, dropping the ones that were used the longest time ago until everything fits in maxSize
+func (c *PhotoProxyCache) Put(entry *PhotoProxyCacheEntry, maxSize int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.order = list.New()
+	}
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.size += len(entry.body)
+	for c.size > maxSize && c.order.Len() > 0 {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *PhotoProxyCache) remove(element *list.Element) {
+	entry := element.Value.(*PhotoProxyCacheEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.body)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Albums with StripExif on never hand out a photo with its metadata, GPS coordinates especially. The resizing
+// service leaves it out of what it renders (thumbor through its strip_exif filter), the JPEGs 50mm zips itself
+// lose it on the way through (see stripJpegMetadata) and nothing is served straight from the bucket: not the
+// originals, nor animations or the videos of Live Photos, which can't be cleaned.
+func (a *Album) validateStripExif() error {
+	if !a.StripExif {
+		return nil
+	}
+	switch a.site.ResizingService {
+	case "imgix", "thumbor", "thumbor+cloudfront", "imageproxy":
+	default:
+		return errors.New("StripExif needs a resizing service that renders the photos (imgix, thumbor, thumbor+cloudfront or imageproxy), photos from the bucket are served as they were uploaded")
+	}
+	if a.AllowOriginalDownload {
+		return errors.New("StripExif can't be used with AllowOriginalDownload, the originals are downloaded straight from the bucket")
+	}
+	if a.ShowMap {
+		return errors.New("StripExif can't be used with ShowMap, the map shows where the photos were taken")
+	}
+	return nil
+}
+
+// only JPEGs are cleaned in original zips, anything else is zipped the way the resizing service renders it
+func canStripMetadata(key string) bool {
+	lower := strings.ToLower(key)
+	return strings.HasSuffix(lower, ".jpg") || strings.HasSuffix(lower, ".jpeg")
+}
+
+// Copies a JPEG from r to w without its EXIF, XMP and IPTC segments. The orientation is all that's kept of the
+// EXIF data, so photos taken on their side still show up the right way. The image data (and the colour profile)
+// is copied as it is.
+func stripJpegMetadata(r io.Reader, w io.Writer) error {
+	in := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(in, soi[:]); err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return errors.New("Not a JPEG file")
+	}
+	if _, err := w.Write(soi[:]); err != nil {
+		return err
+	}
+
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(in, header[:2]); err != nil {
+			return errors.New("Truncated JPEG file")
+		}
+		if header[0] != 0xFF {
+			return errors.New("Malformed JPEG segment")
+		}
+		marker := header[1]
+		if marker == 0xDA {
+			// start of the image data, there are no more metadata segments after this
+			if _, err := w.Write(header[:2]); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, in)
+			return err
+		}
+
+		if _, err := io.ReadFull(in, header[2:]); err != nil {
+			return errors.New("Truncated JPEG file")
+		}
+		length := int(binary.BigEndian.Uint16(header[2:4]))
+		if length < 2 {
+			return errors.New("Malformed JPEG segment")
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(in, segment); err != nil {
+			return errors.New("Truncated JPEG file")
+		}
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")):
+			exif := &ExifData{}
+			parseExifTiff(segment[6:], exif)
+			if exif.Orientation > 1 {
+				if _, err := w.Write(getOrientationOnlyExif(exif.Orientation)); err != nil {
+					return err
+				}
+			}
+		case marker == 0xE1 || marker == 0xED:
+			// XMP (or other APP1 data) and IPTC, which hold the same things EXIF does
+		default:
+			if _, err := w.Write(header[:]); err != nil {
+				return err
+			}
+			if _, err := w.Write(segment); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// an APP1 segment with an EXIF IFD0 of just the orientation tag
+func getOrientationOnlyExif(orientation int) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(&tiff, binary.BigEndian, uint32(8))
+	binary.Write(&tiff, binary.BigEndian, uint16(1))
+	binary.Write(&tiff, binary.BigEndian, uint16(EXIF_TAG_ORIENTATION))
+	binary.Write(&tiff, binary.BigEndian, uint16(3)) // SHORT
+	binary.Write(&tiff, binary.BigEndian, uint32(1))
+	binary.Write(&tiff, binary.BigEndian, uint16(orientation))
+	binary.Write(&tiff, binary.BigEndian, uint16(0))
+	binary.Write(&tiff, binary.BigEndian, uint32(0)) // no next IFD
+
+	var segment bytes.Buffer
+	segment.Write([]byte{0xFF, 0xE1})
+	binary.Write(&segment, binary.BigEndian, uint16(2+6+tiff.Len()))
+	segment.WriteString("Exif\x00\x00")
+	segment.Write(tiff.Bytes())
+	return segment.Bytes()
+}
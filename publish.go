@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// With StagedPublishing on, visitors see the site as it was when the admin last pressed publish: the photos in
+// every album, their ordering (captions included), which albums are in the index and the changelog, the zips
+// and the static mirror. Photos uploaded and orderings edited since only show up in the admin until the next
+// publish, which flips every album at once so nobody gets half an upload. Photos deleted from the bucket (taken
+// down, say) are gone right away, they can't be shown anyway. Albums that were never published are not found.
+//
+// What was published is kept in the bucket, so restarts and the other servers of the site see the same thing.
+const PUBLISHED_STATE_FOLDER = PREBUILT_ZIP_FOLDER + "published/"
+
+// how long visitors see nothing new before the published state is read again, after it couldn't be
+const PUBLISHED_STATE_RETRY = time.Minute
+
+type PublishedSite struct {
+	Published time.Time                 `json:"published"`
+	By        string                    `json:"by,omitempty"`
+	Albums    map[string]PublishedAlbum `json:"albums"` //by album path
+}
+
+type PublishedAlbum struct {
+	Keys     []string            `json:"keys"`
+	Ordering AlbumOrderingConfig `json:"ordering"`
+}
+
+func (s *Site) validateStagedPublishing() error {
+	if s.StagedPublishing && !s.HasAdmin() {
+		return errors.New("StagedPublishing needs the admin (AdminUser and AdminPass), that's where albums are published")
+	}
+	return nil
+}
+
+// one state per site, sites can share a bucket
+func (s *Site) getPublishedStateKey() string {
+	return PUBLISHED_STATE_FOLDER + s.Domain + ".json"
+}
+
+func (s *Site) readPublishedState() (*PublishedSite, error) {
+	svc, err := s.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+	object, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(s.getPublishedStateKey()),
+	})
+	if isNotFoundError(err) {
+		return &PublishedSite{Albums: make(map[string]PublishedAlbum)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+	data, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var published PublishedSite
+	if err := json.Unmarshal(data, &published); err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %s", s.getPublishedStateKey(), err.Error())
+	}
+	if published.Albums == nil {
+		published.Albums = make(map[string]PublishedAlbum)
+	}
+	return &published, nil
+}
+
+// Read from the bucket on first use. Until it can be, visitors see nothing at all rather than what was
+// never published.
+func (s *Site) getPublishedState() *PublishedSite {
+	if published, ok := s.publishedState.Load().(*PublishedSite); ok {
+		return published
+	}
+
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+	if published, ok := s.publishedState.Load().(*PublishedSite); ok {
+		return published
+	}
+	if time.Since(s.publishedStateAttempt) < PUBLISHED_STATE_RETRY {
+		return nil
+	}
+	s.publishedStateAttempt = time.Now()
+
+	published, err := s.readPublishedState()
+	if err != nil {
+		fmt.Printf("\nUnable to read what was published on site %s. Error: %s", s.Domain, err.Error())
+		return nil
+	}
+	s.publishedState.Store(published)
+	return published
+}
+
+func (a *Album) getPublishedAlbum() (PublishedAlbum, bool) {
+	published := a.site.getPublishedState()
+	if published == nil {
+		return PublishedAlbum{}, false
+	}
+	album, ok := published.Albums[a.Path]
+	return album, ok
+}
+
+// always true for sites without StagedPublishing
+func (a *Album) IsPublished() bool {
+	if !a.site.StagedPublishing {
+		return true
+	}
+	_, ok := a.getPublishedAlbum()
+	return ok
+}
+
+// GetAlbumForPath for visitors, who don't get to find albums that haven't been published
+func (s *Site) GetPublishedAlbumForPath(path string) (*Album, error) {
+	album, err := s.GetAlbumForPath(path)
+	if err == nil && !album.IsPublished() {
+		return nil, fmt.Errorf("Could not find album in site %s for path '%s'", s.Domain, album.Path)
+	}
+	return album, err
+}
+
+// whether the admin has photos or ordering changes visitors don't see yet
+func (a *Album) HasUnpublishedChanges() bool {
+	published, ok := a.getPublishedAlbum()
+	if !ok {
+		return true
+	}
+	keys, _ := a.KeyCache.Load().([]string)
+	ordering, _ := a.OrderingCache.Load().(AlbumOrderingConfig)
+	ordering.negativeCacheThis = false
+	return !reflect.DeepEqual(keys, published.Keys) || !reflect.DeepEqual(ordering, published.Ordering)
+}
+
+// the album's ordering as it was published, without the photos that have been deleted from the bucket since
+func (a *Album) getPublishedOrderedKeys() (AlbumOrderingKeys, error) {
+	published, ok := a.getPublishedAlbum()
+	if !ok {
+		return AlbumOrderingKeys{}, fmt.Errorf("Album %s hasn't been published yet", a.Path)
+	}
+
+	keys := published.Keys
+	if current, ok := a.KeyCache.Load().([]string); ok {
+		inBucket := make(map[string]bool)
+		for _, v := range current {
+			inBucket[v] = true
+		}
+		keys = nil
+		for _, v := range published.Keys {
+			if inBucket[v] {
+				keys = append(keys, v)
+			}
+		}
+	}
+
+	orderingKeys, err := a.mergeOrderedKeys(published.Ordering, keys)
+	if err != nil {
+		return orderingKeys, err
+	}
+	a.applyPeopleConsent(&orderingKeys, published.Ordering)
+	return orderingKeys, nil
+}
+
+// Reloads every album from the bucket and makes what's in there now what visitors see, all albums at once.
+// The state is written to the bucket before it's switched to, so a failed write changes nothing.
+func (s *Site) Publish(by string) (*PublishedSite, error) {
+	for _, a := range s.Albums {
+		a.KeyCacheUpdateMutex.Lock()
+		_, err := a.updateKeyCache()
+		a.KeyCacheUpdateMutex.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to reload the photos of album %s: %s", a.Path, err.Error())
+		}
+		a.AlbumAlbumOrderingConfigUpdateMutex.Lock()
+		a.updateOrderingCache()
+		a.AlbumAlbumOrderingConfigUpdateMutex.Unlock()
+	}
+
+	published := &PublishedSite{Published: time.Now().UTC(), By: by, Albums: make(map[string]PublishedAlbum)}
+	for _, a := range s.Albums {
+		keys, _ := a.KeyCache.Load().([]string)
+		ordering, _ := a.OrderingCache.Load().(AlbumOrderingConfig)
+		ordering.negativeCacheThis = false //like it's read back from the bucket
+		published.Albums[a.Path] = PublishedAlbum{keys, ordering}
+	}
+	data, err := json.Marshal(published)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := s.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+
+	s.publishMutex.Lock()
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.BucketName),
+		Key:         aws.String(s.getPublishedStateKey()),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err == nil {
+		s.publishedState.Store(published)
+	}
+	s.publishMutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to write %s: %s", s.getPublishedStateKey(), err.Error())
+	}
+	fmt.Printf("\nPublished site %s for %s", s.Domain, by)
+
+	for _, a := range s.Albums {
+		if a.site.HasStaticMirror() {
+			go a.updateStaticMirror()
+		}
+		if a.HasLiveUpdates() {
+			a.notifyLiveUpdate()
+		}
+		if a.PrebuildZips {
+			go a.updatePrebuiltZips()
+		}
+		if s.PrewarmImages > 0 {
+			go a.PrewarmCDN()
+		}
+		if len(s.Webhooks) > 0 {
+			go a.notifyWebhooks()
+		}
+	}
+	return published, nil
+}
+
+func handleAdminPublish(site *Site, w http.ResponseWriter, r *http.Request) {
+	if !site.StagedPublishing {
+		writeAdminError(w, http.StatusNotFound, errors.New("This site doesn't use StagedPublishing, everything is published as soon as it's in the bucket"))
+		return
+	}
+
+	published, err := site.Publish(getAdminName(site, r))
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if getBearerToken(r) != "" {
+		writeAdminJSON(w, map[string]interface{}{"published": published.Published, "albums": len(published.Albums)})
+		return
+	}
+	http.Redirect(w, r, site.GetUrlPath(ADMIN_PATH+"?published="+url.QueryEscape(published.Published.Format(time.RFC3339))), http.StatusSeeOther)
+}
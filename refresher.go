@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const REFRESH_CHECK_INTERVAL = 1 * time.Minute
+
+// Keeps the album caches warm in the background so visitors hardly ever have to wait on S3. Albums are
+// processed most viewed first, so the popular galleries are the freshest even when S3 is slow to respond.
+func (a *App) StartRefresher() {
+	go func() {
+		for {
+			a.RefreshAlbums()
+			time.Sleep(REFRESH_CHECK_INTERVAL)
+		}
+	}()
+}
+
+func (a *App) RefreshAlbums() {
+	for _, album := range a.GetAlbumsByPopularity() {
+		album.RefreshCachesIfNeeded()
+	}
+}
+
+// albums with the same number of views keep the order they have in the config files
+func (a *App) GetAlbumsByPopularity() []*Album {
+	var albums []*Album
+	for _, s := range a.Sites() {
+		albums = append(albums, s.Albums...)
+	}
+
+	sort.SliceStable(albums, func(i, j int) bool {
+		return albums[i].GetViews() > albums[j].GetViews()
+	})
+	return albums
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The S3 Object Lock status of an object. Objects under retention (until RetainUntil) or a legal hold can't be
+// deleted or replaced, 50mm doesn't try to. HEAD only returns these with s3:GetObjectRetention and
+// s3:GetObjectLegalHold, without those every object looks like it isn't held.
+type ObjectRetention struct {
+	Key         string     `json:"key"`
+	Mode        string     `json:"mode,omitempty"` // GOVERNANCE or COMPLIANCE, empty without retention
+	RetainUntil *time.Time `json:"retainUntil,omitempty"`
+	LegalHold   bool       `json:"legalHold"`
+}
+
+func (o ObjectRetention) IsRetained() bool {
+	return o.Mode != "" && o.RetainUntil != nil && o.RetainUntil.After(time.Now())
+}
+
+func (o ObjectRetention) IsHeld() bool {
+	return o.LegalHold || o.IsRetained()
+}
+
+type AdminRetentionPageContext struct {
+	*BasePageContext
+
+	Album      *Album
+	BucketLock string
+	Objects    []ObjectRetention
+}
+
+// the Object Lock status of key, or nil when there's no such object
+func getObjectRetention(svc *s3.S3, bucket string, key string) (*ObjectRetention, error) {
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if isNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectRetention{
+		Key:         key,
+		Mode:        aws.StringValue(head.ObjectLockMode),
+		RetainUntil: head.ObjectLockRetainUntilDate,
+		LegalHold:   aws.StringValue(head.ObjectLockLegalHoldStatus) == s3.ObjectLockLegalHoldStatusOn,
+	}, nil
+}
+
+// errors when name (relative to the album's prefix) is an object that's held, so writing it would replace it
+func (a *Album) checkNotHeld(svc *s3.S3, name string) error {
+	retention, err := getObjectRetention(svc, a.site.BucketName, a.BucketPrefix+name)
+	if err != nil {
+		return fmt.Errorf("Unable to check the retention of %s: %s", name, err.Error())
+	}
+	switch {
+	case retention == nil:
+		return nil
+	case retention.LegalHold:
+		return fmt.Errorf("%s is under a legal hold, it can't be replaced", name)
+	case retention.IsRetained():
+		return fmt.Errorf("%s is retained until %s, it can't be replaced before then", name, retention.RetainUntil.Format("2 January 2006"))
+	default:
+		return nil
+	}
+}
+
+// how the bucket locks new objects by default, like "COMPLIANCE for 7 years", "on" without a default
+// retention, or empty for buckets without Object Lock
+func (s *Site) GetBucketObjectLock() (string, error) {
+	svc, err := s.GetS3Service()
+	if err != nil {
+		return "", err
+	}
+
+	output, err := svc.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(s.BucketName),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ObjectLockConfigurationNotFoundError" {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	config := output.ObjectLockConfiguration
+	if config == nil || aws.StringValue(config.ObjectLockEnabled) != s3.ObjectLockEnabledEnabled {
+		return "", nil
+	}
+	if config.Rule == nil || config.Rule.DefaultRetention == nil {
+		return "on", nil
+	}
+
+	retention := config.Rule.DefaultRetention
+	if years := aws.Int64Value(retention.Years); years > 0 {
+		return fmt.Sprintf("%s for %d years", aws.StringValue(retention.Mode), years), nil
+	}
+	return fmt.Sprintf("%s for %d days", aws.StringValue(retention.Mode), aws.Int64Value(retention.Days)), nil
+}
+
+// the Object Lock status of every object in the album's prefix, one HEAD each
+func (a *Album) GetRetentionReport() ([]ObjectRetention, error) {
+	objects, err := a.GetAllObjects()
+	if err != nil {
+		return nil, err
+	}
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+
+	report := []ObjectRetention{}
+	for _, v := range objects {
+		retention, err := getObjectRetention(svc, a.site.BucketName, aws.StringValue(v.Key))
+		if err != nil {
+			return nil, err
+		}
+		if retention != nil {
+			retention.Key = path.Base(retention.Key)
+			report = append(report, *retention)
+		}
+	}
+	return report, nil
+}
+
+func handleAdminRetention(album *Album, w http.ResponseWriter, r *http.Request) {
+	bucketLock, err := album.site.GetBucketObjectLock()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, fmt.Errorf("Unable to read the bucket's Object Lock configuration: %s", err.Error()))
+		return
+	}
+	report, err := album.GetRetentionReport()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if getBearerToken(r) != "" {
+		writeAdminJSON(w, map[string]interface{}{"album": album.Path, "bucketLock": bucketLock, "objects": report})
+		return
+	}
+
+	ctx := &AdminRetentionPageContext{
+		getAdminBasePageContext(album.site, ADMIN_PATH+"retention", "Retention of "+album.AlbumTitle),
+		album,
+		bucketLock,
+		report,
+	}
+	album.site.executeTemplate(w, "admin_retention.html", ctx)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Albums with NoIndex set are public but not searchable: every response for them asks search engines to leave
+// it out, with an X-Robots-Tag header (their pages have a robots meta tag as well), and they're left out of the
+// changelog. Anybody with the link still gets in, use a login to keep people out.
+const NOINDEX_ROBOTS_TAG = "noindex"
+
+// Sites with RobotsTxt on serve their own robots.txt, keeping crawlers out of the albums behind a login and the
+// unlisted ones, and a sitemap of the albums in the index. robots.txt is public: it does name the albums it
+// keeps crawlers out of.
+const ROBOTS_TXT_PATH = "/robots.txt"
+const SITEMAP_PATH = "/sitemap.xml"
+
+const SITEMAP_NAMESPACE = "http://www.sitemaps.org/schemas/sitemap/0.9"
+const SITEMAP_DATE_LAYOUT = "2006-01-02"
+
+type Sitemap struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Urls    []SitemapUrl `xml:"url"`
+}
+
+type SitemapUrl struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+func (a *Album) setRobotsHeader(w http.ResponseWriter) {
+	if a.NoIndex {
+		w.Header().Set("X-Robots-Tag", NOINDEX_ROBOTS_TAG)
+	}
+}
+
+// Albums that crawlers can't or shouldn't get to. NoIndex albums aren't in here, crawlers have to see their
+// pages to see they're not to be indexed. Albums that haven't been published yet aren't either, as they 404.
+func (a *Album) IsDisallowedForRobots() bool {
+	return a.IsPublished() && (a.HasOwnAuth() || !a.InIndex || len(a.allowedNets) > 0)
+}
+
+func (s *Site) getRobotsTxt() string {
+	lines := []string{"User-agent: *"}
+	if s.HasAuth() || len(s.allowedNets) > 0 {
+		// nothing a crawler can get to
+		lines = append(lines, "Disallow: "+s.GetUrlPath("/"))
+		return strings.Join(lines, "\n") + "\n"
+	}
+
+	if s.HasAdmin() {
+		lines = append(lines, "Disallow: "+s.GetUrlPath(ADMIN_PATH), "Disallow: "+s.GetUrlPath(API_PATH))
+	}
+	if s.Search {
+		lines = append(lines, "Disallow: "+s.GetUrlPath(SEARCH_PATH))
+	}
+	for _, a := range s.Albums {
+		if a.IsDisallowedForRobots() {
+			lines = append(lines, "Disallow: "+s.GetUrlPath(a.Path))
+		}
+	}
+	if len(lines) == 1 {
+		// an empty Disallow lets crawlers in everywhere, without it the record isn't valid
+		lines = append(lines, "Disallow:")
+	}
+
+	lines = append(lines, "", "Sitemap: "+s.GetUrlForPath(SITEMAP_PATH).String())
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (s *Site) GetSitemap() Sitemap {
+	sitemap := Sitemap{Xmlns: SITEMAP_NAMESPACE}
+	if s.HasAlbumIndex {
+		u := s.GetUrlForPath("/")
+		sitemap.Urls = append(sitemap.Urls, SitemapUrl{Loc: u.String()})
+	}
+	if s.HasChangelog {
+		u := s.GetUrlForPath(CHANGELOG_PATH)
+		sitemap.Urls = append(sitemap.Urls, SitemapUrl{Loc: u.String()})
+	}
+	for _, a := range s.GetAlbumsForIndex() {
+		if a.NoIndex || a.IsDisallowedForRobots() {
+			continue
+		}
+		entry := SitemapUrl{Loc: a.GetCanonicalUrl().String()}
+		if _, newest := a.getShareStats(); !newest.IsZero() {
+			entry.LastMod = newest.Format(SITEMAP_DATE_LAYOUT)
+		}
+		sitemap.Urls = append(sitemap.Urls, entry)
+	}
+	return sitemap
+}
+
+func handleRobotsTxt(site *Site, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(site.getRobotsTxt()))
+}
+
+func handleSitemap(site *Site, w http.ResponseWriter, r *http.Request) {
+	if site.HasAuth() || len(site.allowedNets) > 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("The site has no sitemap\n"))
+		return
+	}
+
+	data, err := xml.MarshalIndent(site.GetSitemap(), "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Unable to build the sitemap: %s\n", err.Error())))
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Logins to the site (AuthUser, AuthUsers, AuthFile) only view albums, unless UserRoles gives them more: editors
+// reload albums, upload and edit the ordering, captions and culls of albums in the admin, admins can do anything
+// there the AdminUser can. A role is the bearer token scopes it comes with, so the admin checks both the same way
+// (see getAdminPageScope).
+const ROLE_VIEWER = "viewer"
+const ROLE_EDITOR = "editor"
+const ROLE_ADMIN = "admin"
+
+var ROLE_SCOPES = map[string][]string{
+	ROLE_VIEWER: {},
+	ROLE_EDITOR: {JWT_SCOPE_UPLOAD, JWT_SCOPE_REFRESH, JWT_SCOPE_EDIT},
+	ROLE_ADMIN:  {JWT_SCOPE_UPLOAD, JWT_SCOPE_REFRESH, JWT_SCOPE_EDIT, JWT_SCOPE_ADMIN},
+}
+
+// UserRoles lists are written as user:role
+func parseUserRoles(list []string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, v := range list {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("UserRoles entry '%s' must be written as user:role", parts[0])
+		}
+		if _, ok := ROLE_SCOPES[parts[1]]; !ok {
+			return nil, fmt.Errorf("UserRoles entry for '%s' must be %s, %s or %s", parts[0], ROLE_VIEWER, ROLE_EDITOR, ROLE_ADMIN)
+		}
+		if _, ok := roles[parts[0]]; ok {
+			return nil, fmt.Errorf("UserRoles lists user '%s' more than once", parts[0])
+		}
+		roles[parts[0]] = parts[1]
+	}
+	return roles, nil
+}
+
+func (s *Site) validateUserRoles() error {
+	roles, err := parseUserRoles(s.UserRoles)
+	if err != nil {
+		return err
+	}
+	if len(roles) > 0 && !s.HasAdmin() {
+		return errors.New("UserRoles are for the admin, which needs AdminUser and AdminPass")
+	}
+	if _, ok := roles[s.AdminUser]; ok && s.AdminUser != "" {
+		return fmt.Errorf("UserRoles can't list the AdminUser '%s', who can do anything already", s.AdminUser)
+	}
+	return nil
+}
+
+// whether the site's login user can use admin pages that need scope
+func (s *Site) roleAllows(user string, scope string) bool {
+	role, ok := s.userRoles[user]
+	if !ok {
+		return false
+	}
+	for _, v := range ROLE_SCOPES[role] {
+		if v == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Every request a site sends to its bucket (retries included, they're billed too) is counted by day, in UTC.
+// The counts are logged when the day is over, and with an S3DailyRequestLimit set a warning is logged once
+// the day's requests pass S3_REQUEST_WARN_PERCENT of it, and again when they pass it, so a crawler or a
+// refresh gone wrong shows up in the logs before it shows up on the bill. Nothing is ever refused. Photo URLs
+// pre-signed for visitors' browsers go straight to the bucket, and aren't counted.
+const S3_REQUEST_WARN_PERCENT = 80
+
+const S3_REQUEST_DAY_LAYOUT = "2006-01-02"
+
+type S3RequestCount struct {
+	Day         string
+	Total       int
+	ByOperation map[string]int
+
+	warned   bool // past S3_REQUEST_WARN_PERCENT of the limit
+	exceeded bool // past the limit itself
+}
+
+func (s *Site) validateS3RequestLimit() error {
+	if s.S3DailyRequestLimit < 0 {
+		return errors.New("S3DailyRequestLimit can't be negative, use 0 for no limit")
+	}
+	return nil
+}
+
+func (s *Site) recordS3Request(operation string, now time.Time) {
+	day := now.UTC().Format(S3_REQUEST_DAY_LAYOUT)
+
+	s.s3RequestsMutex.Lock()
+	defer s.s3RequestsMutex.Unlock()
+	if s.s3Requests.Day != day {
+		if s.s3Requests.Day != "" {
+			fmt.Printf("\nS3 requests of site %s on %s: %s", s.Domain, s.s3Requests.Day, s.s3Requests.String())
+		}
+		s.s3Requests = S3RequestCount{Day: day, ByOperation: make(map[string]int)}
+	}
+	s.s3Requests.Total++
+	s.s3Requests.ByOperation[operation]++
+
+	limit := s.S3DailyRequestLimit
+	if limit == 0 {
+		return
+	}
+	if !s.s3Requests.warned && s.s3Requests.Total*100 >= limit*S3_REQUEST_WARN_PERCENT {
+		s.s3Requests.warned = true
+		fmt.Printf("\nSite %s has made %d S3 requests today, %d%% of its S3DailyRequestLimit of %d: %s",
+			s.Domain, s.s3Requests.Total, S3_REQUEST_WARN_PERCENT, limit, s.s3Requests.String())
+	}
+	if !s.s3Requests.exceeded && s.s3Requests.Total > limit {
+		s.s3Requests.exceeded = true
+		fmt.Printf("\nSite %s has made more S3 requests today than its S3DailyRequestLimit of %d: %s",
+			s.Domain, limit, s.s3Requests.String())
+	}
+}
+
+// like "1234 (ListObjects 1000, GetObject 234)", the busiest operations first
+func (c S3RequestCount) String() string {
+	var operations []string
+	for k := range c.ByOperation {
+		operations = append(operations, k)
+	}
+	sort.Slice(operations, func(i, j int) bool {
+		if c.ByOperation[operations[i]] != c.ByOperation[operations[j]] {
+			return c.ByOperation[operations[i]] > c.ByOperation[operations[j]]
+		}
+		return operations[i] < operations[j]
+	})
+
+	var parts []string
+	for _, v := range operations {
+		parts = append(parts, fmt.Sprintf("%s %d", v, c.ByOperation[v]))
+	}
+	return fmt.Sprintf("%d (%s)", c.Total, strings.Join(parts, ", "))
+}
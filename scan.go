@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const UPLOAD_SCANNER_CLAMAV = "clamav"
+const UPLOAD_SCANNER_HTTP = "http"
+
+// big files take a while to scan, but a scanner that doesn't answer at all shouldn't hold up the upload forever
+const UPLOAD_SCAN_TIMEOUT = 2 * time.Minute
+
+// clamd reads the stream in chunks that each start with their length
+const CLAMAV_CHUNK_SIZE = 64 * 1024
+
+// Checks uploads before they're written to the bucket, so nothing a scanner objects to is ever visible in an
+// album. Scan gives what was found in the file, empty when it's clean. Uploads are refused when the scanner
+// can't be reached, rather than let through unscanned.
+type UploadScanner interface {
+	Scan(name string, body io.Reader) (string, error)
+}
+
+// nil when the site doesn't scan its uploads
+func (s *Site) GetUploadScanner() UploadScanner {
+	switch s.UploadScanner {
+	case UPLOAD_SCANNER_CLAMAV:
+		return &ClamAVScanner{s.ClamAVAddress}
+	case UPLOAD_SCANNER_HTTP:
+		return &HttpScanner{s.UploadScanUrl, &http.Client{Timeout: UPLOAD_SCAN_TIMEOUT}}
+	default:
+		return nil
+	}
+}
+
+func (s *Site) validateUploadScanner() error {
+	switch s.UploadScanner {
+	case "":
+		return nil
+	case UPLOAD_SCANNER_CLAMAV:
+		if s.ClamAVAddress == "" {
+			return errors.New("UploadScanner = clamav needs the ClamAVAddress clamd listens on, like 127.0.0.1:3310 or /var/run/clamav/clamd.ctl")
+		}
+	case UPLOAD_SCANNER_HTTP:
+		if u, err := url.Parse(s.UploadScanUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("UploadScanner = http needs the UploadScanUrl to send uploads to")
+		}
+	default:
+		return fmt.Errorf("UploadScanner must be %s or %s, not %s", UPLOAD_SCANNER_CLAMAV, UPLOAD_SCANNER_HTTP, s.UploadScanner)
+	}
+	return nil
+}
+
+// talks to clamd over TCP, or over its unix socket when Address is a path
+type ClamAVScanner struct {
+	Address string
+}
+
+func (c *ClamAVScanner) Scan(name string, body io.Reader) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(c.Address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, c.Address, UPLOAD_SCAN_TIMEOUT)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(UPLOAD_SCAN_TIMEOUT))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+
+	chunk := make([]byte, CLAMAV_CHUNK_SIZE)
+	length := make([]byte, 4)
+	for {
+		n, err := body.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(length, uint32(n))
+			if _, err := conn.Write(append(length, chunk[:n]...)); err != nil {
+				return "", err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	// a zero length chunk ends the stream
+	binary.BigEndian.PutUint32(length, 0)
+	if _, err := conn.Write(length); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return parseClamAVReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// replies look like "stream: OK", "stream: Eicar-Signature FOUND" or "INSTREAM size limit exceeded. ERROR"
+func parseClamAVReply(reply string) (string, error) {
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd answered %q", reply)
+	}
+}
+
+// POSTs the upload to Url (with its name in the name parameter), which answers 200 for a clean file and 422,
+// with what it found as the body, for files that aren't
+type HttpScanner struct {
+	Url    string
+	client *http.Client
+}
+
+func (h *HttpScanner) Scan(name string, body io.Reader) (string, error) {
+	u, err := url.Parse(h.Url)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("name", name)
+	u.RawQuery = query.Encode()
+
+	resp, err := h.client.Post(u.String(), "application/octet-stream", body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return "", nil
+	case http.StatusUnprocessableEntity:
+		found, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if found = bytes.TrimSpace(found); len(found) == 0 {
+			return "rejected by the scanner", nil
+		}
+		return string(found), nil
+	default:
+		return "", fmt.Errorf("Scanner answered with status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Sites with Search on have a page that finds albums by their title and tags, and photos by their name, title,
+// caption, alt text, tags, the people tagged in them and (when the EXIF data has been read) the day they were taken.
+// Every word of the search has to match. Only albums the visitor can already find are searched: the ones in
+// the index, and the ones behind a login they're logged in to. Unlisted albums stay unlisted.
+const SEARCH_PATH = "/search"
+const SEARCH_PARAM = "q"
+
+const SEARCH_MAX_QUERY_LENGTH = 100
+const SEARCH_MAX_PHOTOS = 60
+
+// how long an album's index is used before it's built again, even when its caches haven't been refreshed,
+// so EXIF data read in the background gets picked up
+const SEARCH_INDEX_INTERVAL = 5 * time.Minute
+
+type SearchPageContext struct {
+	*BasePageContext
+
+	Query  string
+	Albums []*Album
+	Photos []SearchResult
+
+	TooManyPhotos bool // there were more than SEARCH_MAX_PHOTOS, only the first ones are shown
+}
+
+type SearchResult struct {
+	Album *Album
+	Photo Renderable
+	Url   string
+}
+
+// what's searched of an album and its photos by tag, built from its caches
+type albumSearchIndex struct {
+	Built           time.Time
+	KeysUpdated     time.Time // the LastKeyCacheUpdate and LastAlbumOrderingConfigCacheUpdate it was built from
+	OrderingUpdated time.Time
+	Title           string
+	Photos          []Renderable
+	PhotoTexts      []string //lower case, by photo
+	Tags            map[string][]Renderable
+}
+
+func (s *Site) validateSearch() error {
+	if !s.Search {
+		return nil
+	}
+	for _, a := range s.Albums {
+		if a.Path == SEARCH_PATH+"/" {
+			return fmt.Errorf("Album %s can't be served at %s, that's where the search is", a.Path, SEARCH_PATH)
+		}
+	}
+	return nil
+}
+
+// everything a photo can be found by, lower case
+func getPhotoSearchText(photo Renderable) string {
+	details := photo.Details()
+	name := path.Base(photo.Slug())
+	words := []string{name, strings.TrimSuffix(name, path.Ext(name)), details.Title, details.Caption, details.Alt}
+	words = append(words, details.People...)
+	words = append(words, details.Tags...)
+	if exif := details.Exif; exif != nil && !exif.DateTime.IsZero() {
+		words = append(words, exif.DateTime.Format("2 January 2006"))
+	}
+	return strings.ToLower(strings.Join(words, " "))
+}
+
+func (a *Album) getSearchIndex() *albumSearchIndex {
+	index, _ := a.searchIndex.Load().(*albumSearchIndex)
+	if index != nil && index.KeysUpdated.Equal(a.LastKeyCacheUpdate) &&
+		index.OrderingUpdated.Equal(a.LastAlbumOrderingConfigCacheUpdate) && time.Since(index.Built) < SEARCH_INDEX_INTERVAL {
+		return index
+	}
+
+	index = &albumSearchIndex{
+		Built:           time.Now(),
+		KeysUpdated:     a.LastKeyCacheUpdate,
+		OrderingUpdated: a.LastAlbumOrderingConfigCacheUpdate,
+		Title:           strings.ToLower(strings.Join(append([]string{a.AlbumTitle}, a.GetTags()...), " ")),
+		Tags:            make(map[string][]Renderable),
+	}
+	// an album that can't be listed right now can still be found by its title
+	if albumOrdering, err := a.GetOrderedPhotos(); err == nil {
+		index.Photos = albumOrdering.Ordering
+		for _, v := range albumOrdering.Ordering {
+			index.PhotoTexts = append(index.PhotoTexts, getPhotoSearchText(v))
+			for _, tag := range v.Details().Tags {
+				index.Tags[tag] = append(index.Tags[tag], v)
+			}
+		}
+	}
+	a.searchIndex.Store(index)
+	return index
+}
+
+func containsAllWords(text string, words []string) bool {
+	for _, v := range words {
+		if !strings.Contains(text, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// The albums the visitor could find without the search: the ones in the index, and the ones behind a login
+// they're logged in to (and whose network they're on). Nothing here asks for a password.
+func (s *Site) getSearchableAlbums(r *http.Request) []*Album {
+	var albums []*Album
+	for _, a := range s.Albums {
+		if !a.IsPublished() {
+			continue
+		}
+		if len(a.allowedNets) > 0 {
+			if ip := s.GetClientIP(r); ip == nil || !containsIP(a.allowedNets, ip) {
+				continue
+			}
+		}
+		if a.HasOwnAuth() {
+			if GetLoginSessionUser(a, r) == "" {
+				continue
+			}
+		} else if !a.InIndex || !a.HasIndexMinPhotos() {
+			continue
+		}
+		albums = append(albums, a)
+	}
+	return albums
+}
+
+func (s *Site) SearchAlbums(r *http.Request, query string) ([]*Album, []SearchResult, bool) {
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return nil, nil, false
+	}
+
+	var albums []*Album
+	var photos []SearchResult
+	tooMany := false
+	for _, a := range s.getSearchableAlbums(r) {
+		index := a.getSearchIndex()
+		if containsAllWords(index.Title, words) {
+			albums = append(albums, a)
+		}
+		for i, v := range index.PhotoTexts {
+			if !containsAllWords(v, words) {
+				continue
+			}
+			if len(photos) == SEARCH_MAX_PHOTOS {
+				tooMany = true
+				break
+			}
+			photos = append(photos, SearchResult{a, index.Photos[i], a.GetCanonicalUrl().String() + index.Photos[i].Slug()})
+		}
+	}
+	return albums, photos, tooMany
+}
+
+func handleSearch(site *Site, w http.ResponseWriter, r *http.Request) {
+	if site.HasAuth() && !checkAndRequireAuth(w, r, site) {
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get(SEARCH_PARAM))
+	if utf8.RuneCountInString(query) > SEARCH_MAX_QUERY_LENGTH {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Search for at most %d characters\n", SEARCH_MAX_QUERY_LENGTH)))
+		return
+	}
+
+	u := site.GetUrlForPath(SEARCH_PATH)
+	locale := site.GetLocale(w, r)
+	ctx := &SearchPageContext{
+		&BasePageContext{
+			site.GetCanonicalUrl().String(),
+			u.String(),
+			locale.T("search") + " | " + site.MetaTitle,
+			site.SiteTitle,
+			locale,
+			site.GetTheme(),
+			site.GetColorScheme(),
+		},
+		query,
+		nil,
+		nil,
+		false,
+	}
+	ctx.Albums, ctx.Photos, ctx.TooManyPhotos = site.SearchAlbums(r, query)
+	site.executeTemplate(w, "search.html", ctx)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Every response of a site comes with its security headers, so there's no need for a proxy in front just to add
+// them. Sites get X-Frame-Options, Referrer-Policy and X-Content-Type-Options by default, and HSTS as well when
+// they're CanonicalSecure. There's no Content-Security-Policy unless the site has one, the pages have inline
+// scripts and load their photos from wherever the bucket or the resizing service is. Any of the headers can be
+// turned off with `off`. Embeds (see embed.go) are shown in iframes on other sites, so their pages can always
+// be framed.
+const SECURITY_HEADER_OFF = "off"
+
+const DEFAULT_X_FRAME_OPTIONS = "SAMEORIGIN"
+const DEFAULT_REFERRER_POLICY = "strict-origin-when-cross-origin"
+const DEFAULT_STRICT_TRANSPORT_SECURITY = "max-age=31536000"
+
+var X_FRAME_OPTIONS = []string{"DENY", "SAMEORIGIN"}
+var REFERRER_POLICIES = []string{"no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin",
+	"same-origin", "strict-origin", "strict-origin-when-cross-origin", "unsafe-url"}
+
+func (s *Site) validateSecurityHeaders() error {
+	s.XFrameOptions = strings.ToUpper(s.XFrameOptions)
+	if s.XFrameOptions != "" && s.XFrameOptions != strings.ToUpper(SECURITY_HEADER_OFF) &&
+		!stringInSlice(s.XFrameOptions, X_FRAME_OPTIONS) {
+		return fmt.Errorf("XFrameOptions should be one of %s or %s", strings.Join(X_FRAME_OPTIONS, ", "), SECURITY_HEADER_OFF)
+	}
+	if s.ReferrerPolicy != "" && s.ReferrerPolicy != SECURITY_HEADER_OFF {
+		for _, v := range strings.Split(s.ReferrerPolicy, ",") {
+			if !stringInSlice(strings.TrimSpace(v), REFERRER_POLICIES) {
+				return fmt.Errorf("ReferrerPolicy %s isn't a policy browsers know, use one of %s or %s", v,
+					strings.Join(REFERRER_POLICIES, ", "), SECURITY_HEADER_OFF)
+			}
+		}
+	}
+	if s.StrictTransportSecurity != "" && s.StrictTransportSecurity != SECURITY_HEADER_OFF && !s.CanonicalSecure {
+		return errors.New("StrictTransportSecurity is only sent over https, and the site isn't CanonicalSecure")
+	}
+	return nil
+}
+
+// the header's value, with the default for empty ones and nothing for the ones that are off
+func getSecurityHeader(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	if strings.EqualFold(value, SECURITY_HEADER_OFF) {
+		return ""
+	}
+	return value
+}
+
+func (s *Site) setSecurityHeaders(w http.ResponseWriter) {
+	headers := map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         getSecurityHeader(s.XFrameOptions, DEFAULT_X_FRAME_OPTIONS),
+		"Referrer-Policy":         getSecurityHeader(s.ReferrerPolicy, DEFAULT_REFERRER_POLICY),
+		"Content-Security-Policy": getSecurityHeader(s.ContentSecurityPolicy, ""),
+	}
+	if s.CanonicalSecure {
+		headers["Strict-Transport-Security"] = getSecurityHeader(s.StrictTransportSecurity, DEFAULT_STRICT_TRANSPORT_SECURITY)
+	}
+	for k, v := range headers {
+		if v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+}
+
+// For pages other sites show in iframes: there's no X-Frame-Options, and the frame-ancestors of the site's
+// Content-Security-Policy are left out.
+func allowFraming(w http.ResponseWriter) {
+	w.Header().Del("X-Frame-Options")
+	csp := w.Header().Get("Content-Security-Policy")
+	if csp == "" {
+		return
+	}
+
+	var directives []string
+	for _, v := range strings.Split(csp, ";") {
+		if fields := strings.Fields(v); len(fields) > 0 && !strings.EqualFold(fields[0], "frame-ancestors") {
+			directives = append(directives, strings.TrimSpace(v))
+		}
+	}
+	if len(directives) == 0 {
+		w.Header().Del("Content-Security-Policy")
+		return
+	}
+	w.Header().Set("Content-Security-Policy", strings.Join(directives, "; "))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// After a login with basic auth works, the visitor gets a cookie that's accepted instead, so the password isn't
+// checked (with bcrypt, for hashed ones) on every page. Every realm, the site, albums with logins of their own
+// and the admin, gets a cookie of its own under this name.
+const LOGIN_SESSION_COOKIE = "50mm_login"
+
+const DEFAULT_AUTH_SESSION_LIFETIME = 12 * time.Hour
+
+// Providers whose basic auth logins can be kept in a session cookie. The login's secret is whatever its
+// password is checked against, sessions carry an HMAC of it so they end as soon as the password is changed or
+// the login removed. It's empty for logins the provider doesn't have.
+type LoginSessionProvider interface {
+	getLoginSite() *Site
+	getLoginRealm() string
+	getLoginSecret(user string) string
+}
+
+type LoginSession struct {
+	User        string    `json:"user"`
+	Realm       string    `json:"realm"`
+	Fingerprint string    `json:"fingerprint"`
+	Expires     time.Time `json:"expires"`
+}
+
+// SessionSecret if there's one, for sites with OIDC logins their OIDCClientSecret, which signed the cookies
+// before SessionSecret existed. Without either it's random, made on config read, so sessions end on restarts.
+func (s *Site) getCookieSecret() string {
+	if s.SessionSecret != "" {
+		return s.SessionSecret
+	}
+	if s.OIDCClientSecret != "" {
+		return s.OIDCClientSecret
+	}
+	return s.sessionSecret
+}
+
+func (s *Site) UsesLoginSessions() bool {
+	return s.AuthSessionLifetime > 0 && s.getCookieSecret() != ""
+}
+
+func (s *Site) validateLoginSessions() error {
+	if s.SessionSecret != "" && len(s.SessionSecret) < 32 {
+		return errors.New("SessionSecret must be at least 32 characters long")
+	}
+	if s.AuthSessionLifetime < 0 {
+		return errors.New("AuthSessionLifetime can't be negative, use 0 to ask for the password on every request")
+	}
+	return nil
+}
+
+func getLoginSessionCookieName(realm string) string {
+	if realm == "" {
+		return LOGIN_SESSION_COOKIE
+	}
+	sum := sha256.Sum256([]byte(realm))
+	return LOGIN_SESSION_COOKIE + "_" + hex.EncodeToString(sum[:4])
+}
+
+func getLoginFingerprint(provider LoginSessionProvider, user string) string {
+	secret := provider.getLoginSecret(user)
+	if secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(provider.getLoginSite().getCookieSecret()))
+	mac.Write([]byte(provider.getLoginRealm() + "\x00" + user + "\x00" + secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// the user of the request's session, empty without a session that's still good
+func GetLoginSessionUser(provider LoginSessionProvider, r *http.Request) string {
+	site := provider.getLoginSite()
+	if !site.UsesLoginSessions() {
+		return ""
+	}
+	cookie, err := r.Cookie(getLoginSessionCookieName(provider.getLoginRealm()))
+	if err != nil {
+		return ""
+	}
+
+	var session LoginSession
+	if !site.readSignedCookie(cookie.Value, &session) || time.Now().After(session.Expires) ||
+		session.Realm != provider.getLoginRealm() {
+		return ""
+	}
+	fingerprint := getLoginFingerprint(provider, session.User)
+	if fingerprint == "" || !hmac.Equal([]byte(fingerprint), []byte(session.Fingerprint)) {
+		return ""
+	}
+	return session.User
+}
+
+func StartLoginSession(provider LoginSessionProvider, w http.ResponseWriter, user string) {
+	site := provider.getLoginSite()
+	if !site.UsesLoginSessions() {
+		return
+	}
+
+	session := &LoginSession{
+		User:        user,
+		Realm:       provider.getLoginRealm(),
+		Fingerprint: getLoginFingerprint(provider, user),
+		Expires:     time.Now().Add(site.AuthSessionLifetime),
+	}
+	value, err := site.signCookie(session)
+	if err != nil {
+		return
+	}
+	site.setCookie(w, getLoginSessionCookieName(session.Realm), value, session.Expires)
+}
+
+// the password (or hash) to check against for every login of the user, across AuthUser, AuthUsers and AuthFile
+func getLoginSecret(user string, authUser string, authPass string, authPassHash string, authUsers []string, authFile *HtpasswdFile) string {
+	var secrets []string
+	if authUser != "" && user == authUser {
+		secrets = append(secrets, authPass+authPassHash)
+	}
+	for _, v := range authUsers {
+		if parts := strings.SplitN(v, ":", 2); len(parts) == 2 && parts[0] == user {
+			secrets = append(secrets, parts[1])
+		}
+	}
+	if authFile != nil {
+		if hash := authFile.GetHash(user); hash != "" {
+			secrets = append(secrets, hash)
+		}
+	}
+	return strings.Join(secrets, "\x00")
+}
+
+// giving a login a TOTP secret (or a new one) ends its sessions too
+func withTOTPSecret(secret string, key []byte) string {
+	if secret == "" || key == nil {
+		return secret
+	}
+	return secret + "\x00" + hex.EncodeToString(key)
+}
+
+func (s *Site) getLoginSite() *Site {
+	return s
+}
+
+func (s *Site) getLoginRealm() string {
+	return ""
+}
+
+func (s *Site) getLoginSecret(user string) string {
+	return withTOTPSecret(getLoginSecret(user, s.AuthUser, s.AuthPass, s.AuthPassHash, s.AuthUsers, s.authFile), s.getTOTPSecret(user))
+}
+
+func (a *Album) getLoginSite() *Site {
+	return a.site
+}
+
+// albums without logins of their own use the site's, and its sessions
+func (a *Album) getLoginRealm() string {
+	if a.HasOwnAuth() {
+		return a.Path
+	}
+	return a.site.getLoginRealm()
+}
+
+func (a *Album) getLoginSecret(user string) string {
+	if a.HasOwnAuth() {
+		return withTOTPSecret(getLoginSecret(user, a.AuthUser, a.AuthPass, a.AuthPassHash, a.AuthUsers, a.authFile), a.getTOTPSecret(user))
+	}
+	return a.site.getLoginSecret(user)
+}
+
+func (c *AdminCredentials) getLoginSite() *Site {
+	return c.site
+}
+
+func (c *AdminCredentials) getLoginRealm() string {
+	return ADMIN_PATH
+}
+
+// a session of a login whose role doesn't allow the page isn't accepted on it, nor one whose role was taken away
+func (c *AdminCredentials) getLoginSecret(user string) string {
+	if c.User != "" && user == c.User {
+		return c.Pass
+	}
+	if c.site.roleAllows(user, c.scope) {
+		return c.site.getLoginSecret(user)
+	}
+	return ""
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// `50mm init` asks for what a first site needs, checks the bucket can be read with it and writes the site's
+// config to the config dir, the rest of the options are left to the README.
+const SETUP_COMMAND = "init"
+
+const DEFAULT_SETUP_REGION = "us-east-1"
+
+// the starter ordering.yaml of albums without photos yet
+const SETUP_EMPTY_ORDERING = `# the photos of the album, in the order they're shown, see the README's "Customize album ordering"
+# cover: photo.jpg
+# ordering:
+#   - photo.jpg
+`
+
+var setupSlugRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+
+type setupWizard struct {
+	in  *bufio.Scanner
+	out io.Writer
+}
+
+// the answer, or def when there's none. Stdin running out is an answer of its own, so the wizard can't loop.
+func (w *setupWizard) ask(question string, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", question)
+	}
+
+	if !w.in.Scan() {
+		if err := w.in.Err(); err != nil {
+			return "", err
+		}
+		return "", errors.New("Setup was cancelled")
+	}
+	if answer := strings.TrimSpace(w.in.Text()); answer != "" {
+		return answer, nil
+	}
+	return def, nil
+}
+
+func (w *setupWizard) askRequired(question string, def string) (string, error) {
+	for {
+		answer, err := w.ask(question, def)
+		if err != nil || answer != "" {
+			return answer, err
+		}
+		fmt.Fprintln(w.out, "This one is required.")
+	}
+}
+
+func (w *setupWizard) confirm(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	answer, err := w.ask(question+" ("+hint+")", "")
+	if err != nil || answer == "" {
+		return def, err
+	}
+	return strings.HasPrefix(strings.ToLower(answer), "y"), nil
+}
+
+// values with comment characters in them are quoted, so they aren't cut short when the config is read
+func setupIniValue(value string) string {
+	if strings.ContainsAny(value, "#;") {
+		return "`" + value + "`"
+	}
+	return value
+}
+
+func getSetupSlug(title string) string {
+	return strings.Trim(setupSlugRegexp.ReplaceAllString(strings.ToLower(title), "-"), "-")
+}
+
+type setupAnswers struct {
+	Domain          string
+	CanonicalSecure bool
+	BucketName      string
+	BucketRegion    string
+	S3Host          string
+	AWSKeyId        string
+	AWSKey          string
+	SiteTitle       string
+
+	AlbumTitle   string
+	AlbumPath    string
+	BucketPrefix string
+	AuthUser     string
+	AuthPass     string
+}
+
+func (w *setupWizard) askAnswers() (*setupAnswers, error) {
+	a := &setupAnswers{}
+	var err error
+	ask := func(v *string, question string, def string, required bool) {
+		if err != nil {
+			return
+		}
+		if required {
+			*v, err = w.askRequired(question, def)
+		} else {
+			*v, err = w.ask(question, def)
+		}
+	}
+
+	ask(&a.Domain, "Domain the site is served on (like photos.example.com)", "", true)
+	if err == nil {
+		a.CanonicalSecure, err = w.confirm("Is it served over https", true)
+	}
+	ask(&a.BucketName, "Bucket", "", true)
+	ask(&a.BucketRegion, "Bucket region", DEFAULT_SETUP_REGION, true)
+	ask(&a.S3Host, "S3 endpoint, for S3 compatible stores (leave empty for Amazon S3)", "", false)
+	ask(&a.AWSKeyId, "AWS access key id", "", true)
+	ask(&a.AWSKey, "AWS secret access key", "", true)
+	ask(&a.SiteTitle, "Site title", a.Domain, true)
+
+	ask(&a.AlbumTitle, "Title of the first album", "", true)
+	slug := getSetupSlug(a.AlbumTitle)
+	ask(&a.AlbumPath, "Album path on the site", "/"+slug+"/", true)
+	ask(&a.BucketPrefix, "Folder of the album's photos in the bucket", slug+"/", false)
+	ask(&a.AuthUser, "Username for the album (leave empty for a public album)", "", false)
+	if a.AuthUser != "" {
+		ask(&a.AuthPass, "Password for the album", "", true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(a.AlbumPath, "/") {
+		a.AlbumPath = "/" + a.AlbumPath
+	}
+	if !strings.HasSuffix(a.AlbumPath, "/") {
+		a.AlbumPath += "/"
+	}
+	if a.BucketPrefix != "" && !strings.HasSuffix(a.BucketPrefix, "/") {
+		a.BucketPrefix += "/"
+	}
+	return a, nil
+}
+
+// laid out like the README's sample config
+func (a *setupAnswers) getConfig() []byte {
+	var b strings.Builder
+	line := func(key string, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%s = %s\n", key, setupIniValue(value))
+		}
+	}
+	secure := "0"
+	if a.CanonicalSecure {
+		secure = "1"
+	}
+	index := "1"
+	if a.AlbumPath == "/" {
+		index = "0"
+	}
+
+	b.WriteString("[DEFAULT]\n")
+	line("Domain", a.Domain)
+	line("CanonicalSecure", secure)
+	line("BucketRegion", a.BucketRegion)
+	line("BucketName", a.BucketName)
+	line("S3Host", a.S3Host)
+	if a.S3Host != "" {
+		line("S3ForcePathStyle", "1")
+	}
+	line("AWSKeyId", a.AWSKeyId)
+	line("AWSKey", a.AWSKey)
+	line("SiteTitle", a.SiteTitle)
+	line("MetaTitle", a.SiteTitle)
+	line("HasAlbumIndex", index)
+
+	fmt.Fprintf(&b, "\n[%s]\n", strings.NewReplacer("[", "", "]", "").Replace(a.AlbumTitle))
+	line("Path", a.AlbumPath)
+	line("BucketPrefix", a.BucketPrefix)
+	line("MetaTitle", a.AlbumTitle+" | "+a.SiteTitle)
+	line("AlbumTitle", a.AlbumTitle)
+	line("AuthUser", a.AuthUser)
+	line("AuthPass", a.AuthPass)
+	return []byte(b.String())
+}
+
+// An ordering.yaml with the album's photos in the order they're shown in now, for the owner to rearrange.
+// Albums that already have one keep it.
+func uploadStarterOrdering(album *Album) (string, error) {
+	if _, err := album.GetObjectFromBucket(ORDERING_YAML_NAME); err == nil {
+		return "The album already has an ordering.yaml, it was left as it is.", nil
+	} else if !isNotFoundError(err) {
+		return "", err
+	}
+
+	orderingKeys, err := album.GetOrderedKeys(AlbumOrderingConfig{})
+	if err != nil {
+		return "", err
+	}
+
+	data := []byte(SETUP_EMPTY_ORDERING)
+	if len(orderingKeys.Ordering) > 0 {
+		config := AlbumOrderingConfig{Cover: orderingKeys.Cover, Ordering: orderingKeys.Ordering}
+		if data, err = album.MarshalAlbumOrderingConfig(config); err != nil {
+			return "", err
+		}
+	}
+	if err := album.WriteOrderingYAML(data, HashOrderingYAML(nil)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Uploaded %s%s with %d photos.", album.BucketPrefix, ORDERING_YAML_NAME, len(orderingKeys.Ordering)), nil
+}
+
+func runSetupWizard(in io.Reader, out io.Writer) error {
+	w := &setupWizard{bufio.NewScanner(in), out}
+	configDir := getConfigDir()
+	fmt.Fprintf(out, "This sets up a site with one album, its config is written to %s (set %s to change that).\n\n",
+		configDir, CONFIG_DIR_ENV_VAR)
+
+	answers, err := w.askAnswers()
+	if err != nil {
+		return err
+	}
+
+	configPath := filepath.Join(configDir, answers.Domain+".ini")
+	if _, err := os.Stat(configPath); err == nil {
+		if replace, err := w.confirm(configPath+" already exists, replace it", false); err != nil || !replace {
+			return errors.New("Setup was cancelled, the existing config was left as it is")
+		}
+	}
+
+	// the config is checked the way it's loaded on startup before it's written where it would be loaded from
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		return err
+	}
+	stagedPath := configPath + CONFIG_STAGED_SUFFIX
+	if err := ioutil.WriteFile(stagedPath, answers.getConfig(), 0600); err != nil {
+		return err
+	}
+	defer os.Remove(stagedPath)
+
+	site, err := LoadSiteFromFile(stagedPath)
+	if err != nil {
+		return fmt.Errorf("The config isn't valid: %s", err.Error())
+	}
+
+	fmt.Fprintf(out, "\nChecking the bucket can be read with these keys...\n")
+	if err := site.checkBucketReachable(); err != nil {
+		fmt.Fprintf(out, "%s\n", err.Error())
+		if keep, err := w.confirm("Write the config anyway", false); err != nil || !keep {
+			return errors.New("Setup was cancelled, nothing was written")
+		}
+	} else {
+		fmt.Fprintf(out, "The bucket can be read.\n")
+		if upload, err := w.confirm("Upload a starter ordering.yaml to the album", false); err != nil {
+			return err
+		} else if upload {
+			message, err := uploadStarterOrdering(site.Albums[0])
+			if err != nil {
+				fmt.Fprintf(out, "Unable to upload ordering.yaml: %s\n", err.Error())
+			} else {
+				fmt.Fprintf(out, "%s\n", message)
+			}
+		}
+	}
+
+	if err := os.Rename(stagedPath, configPath); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\nWrote %s. Start 50mm and the album is at %s\n", configPath, site.Albums[0].GetCanonicalUrl().String())
+	return nil
+}
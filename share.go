@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// share links carry their token in this query parameter, after the first visit it's kept in a cookie so the
+// token doesn't have to follow the visitor around the album
+const SHARE_TOKEN_PARAM = "token"
+const SHARE_COOKIE_PREFIX = "50mm_share_"
+
+const DEFAULT_SHARE_LINK_DAYS = 14
+const MAX_SHARE_LINK_DAYS = 365
+
+// Albums implement this so visitors with a share link get past basic auth, see checkAndRequireAuth
+type ShareTokenChecker interface {
+	CheckShareToken(w http.ResponseWriter, r *http.Request) bool
+}
+
+func (a *Album) HasShareLinks() bool {
+	return a.site.ShareLinkSecret != ""
+}
+
+// A token is the expiry as a unix timestamp and a signature over it and the album's path, so a token can't be
+// moved to another album or have its expiry pushed back. Nothing is stored, changing ShareLinkSecret revokes
+// every link ever handed out.
+func (a *Album) NewShareToken(expiry time.Time) string {
+	expires := strconv.FormatInt(expiry.Unix(), 10)
+	return expires + "." + a.signShareToken(expires)
+}
+
+func (a *Album) signShareToken(expires string) string {
+	mac := hmac.New(sha256.New, []byte(a.site.ShareLinkSecret))
+	mac.Write([]byte(a.Path + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// gives the expiry of a token that's valid for this album at now
+func (a *Album) VerifyShareToken(token string, now time.Time) (time.Time, bool) {
+	if !a.HasShareLinks() {
+		return time.Time{}, false
+	}
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return time.Time{}, false
+	}
+	if !hmac.Equal([]byte(a.signShareToken(parts[0])), []byte(parts[1])) {
+		return time.Time{}, false
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	expiry := time.Unix(expires, 0)
+	return expiry, now.Before(expiry)
+}
+
+// one cookie per album, for the whole site rather than the album's path so endpoints outside of it (like
+// SIGNED_URL_PATH) see it too
+func (a *Album) getShareCookieName() string {
+	hash := fnv.New32a()
+	hash.Write([]byte(a.Path))
+	return fmt.Sprintf("%s%x", SHARE_COOKIE_PREFIX, hash.Sum32())
+}
+
+func (a *Album) GetShareUrl(expiry time.Time) string {
+	u := a.GetCanonicalUrl()
+	u.RawQuery = SHARE_TOKEN_PARAM + "=" + a.NewShareToken(expiry)
+	return u.String()
+}
+
+// Lets the request through when it has a valid token for the album, either in the URL or in the cookie a
+// previous visit with the URL left behind.
+func (a *Album) CheckShareToken(w http.ResponseWriter, r *http.Request) bool {
+	if !a.HasShareLinks() {
+		return false
+	}
+
+	if token := r.URL.Query().Get(SHARE_TOKEN_PARAM); token != "" {
+		expiry, ok := a.VerifyShareToken(token, time.Now())
+		if !ok {
+			return false
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     a.getShareCookieName(),
+			Value:    token,
+			Path:     a.site.GetUrlPath("/"),
+			Expires:  expiry,
+			Secure:   a.site.CanonicalSecure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return true
+	}
+
+	if cookie, err := r.Cookie(a.getShareCookieName()); err == nil {
+		_, ok := a.VerifyShareToken(cookie.Value, time.Now())
+		return ok
+	}
+	return false
+}
+
+type AdminSharePageContext struct {
+	*BasePageContext
+
+	Album *Album
+	Days  int
+
+	ShareUrl     string
+	Expires      time.Time
+	ShareMessage string // the album's share title and text with the link, ready to paste
+
+	UploadDays    int
+	UploadUrl     string
+	UploadExpires time.Time
+}
+
+func handleAdminShare(album *Album, w http.ResponseWriter, r *http.Request) {
+	ctx := &AdminSharePageContext{
+		getAdminBasePageContext(album.site, ADMIN_PATH+"share", "Share "+album.AlbumTitle),
+		album,
+		DEFAULT_SHARE_LINK_DAYS,
+		"",
+		time.Time{},
+		"",
+		DEFAULT_GUEST_UPLOAD_DAYS,
+		"",
+		time.Time{},
+	}
+	album.site.executeTemplate(w, "admin_share.html", ctx)
+}
+
+func handleAdminShareCreate(album *Album, w http.ResponseWriter, r *http.Request) {
+	if !album.HasShareLinks() {
+		writeAdminError(w, http.StatusBadRequest, errors.New("Set ShareLinkSecret to create share links"))
+		return
+	}
+
+	days, err := strconv.Atoi(r.PostFormValue("days"))
+	if err != nil || days < 1 || days > MAX_SHARE_LINK_DAYS {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Share links last between 1 and %d days", MAX_SHARE_LINK_DAYS))
+		return
+	}
+
+	expiry := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+	shareUrl := album.GetShareUrl(expiry)
+	ctx := &AdminSharePageContext{
+		getAdminBasePageContext(album.site, ADMIN_PATH+"share", "Share "+album.AlbumTitle),
+		album,
+		days,
+		shareUrl,
+		expiry,
+		album.GetShareMessage(shareUrl),
+		DEFAULT_GUEST_UPLOAD_DAYS,
+		"",
+		time.Time{},
+	}
+	album.site.executeTemplate(w, "admin_share.html", ctx)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ShareTitle and ShareText are what an album says about itself wherever it's shared: link previews (its OpenGraph
+// and Twitter card tags) and the message offered with share links in the admin. They can use placeholders, filled
+// in with what visitors see of the album at the time:
+//
+//	{title}  the album's AlbumTitle
+//	{count}  how many photos it has
+//	{date}   when the newest of them was uploaded, like 2 January 2006
+//	{site}   the site's SiteTitle
+var SHARE_TEXT_PLACEHOLDERS = []string{"{title}", "{count}", "{date}", "{site}"}
+
+const SHARE_TEXT_DATE_LAYOUT = "2 January 2006"
+
+var shareTextPlaceholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// placeholders that are misspelt would end up in the previews as they are
+func validateShareTemplate(option string, template string) error {
+	for _, v := range shareTextPlaceholderPattern.FindAllString(template, -1) {
+		known := false
+		for _, placeholder := range SHARE_TEXT_PLACEHOLDERS {
+			known = known || v == placeholder
+		}
+		if !known {
+			return fmt.Errorf("%s can't use %s, it can use %s", option, v, strings.Join(SHARE_TEXT_PLACEHOLDERS, ", "))
+		}
+	}
+	return nil
+}
+
+func (s *Site) validateShareTemplates() error {
+	if err := validateShareTemplate("ShareTitle", s.ShareTitle); err != nil {
+		return err
+	}
+	return validateShareTemplate("ShareText", s.ShareText)
+}
+
+func (a *Album) validateShareTemplates() error {
+	if err := validateShareTemplate("ShareTitle", a.ShareTitle); err != nil {
+		return err
+	}
+	return validateShareTemplate("ShareText", a.ShareText)
+}
+
+// the number of photos visitors see, and when the newest of them was uploaded (zero when that isn't known)
+func (a *Album) getShareStats() (int, time.Time) {
+	orderingKeys, err := a.getVisibleOrderedKeys()
+	if err != nil {
+		return 0, time.Time{}
+	}
+	dates, _ := a.KeyDatesCache.Load().(map[string]time.Time)
+	var newest time.Time
+	for _, v := range orderingKeys.Ordering {
+		if date, ok := dates[v]; ok && date.After(newest) {
+			newest = date
+		}
+	}
+	return len(orderingKeys.Ordering), newest
+}
+
+func (a *Album) expandShareTemplate(template string) string {
+	count, newest := a.getShareStats()
+	var date string
+	if !newest.IsZero() {
+		date = newest.Format(SHARE_TEXT_DATE_LAYOUT)
+	}
+	return strings.NewReplacer(
+		"{title}", a.AlbumTitle,
+		"{count}", strconv.Itoa(count),
+		"{date}", date,
+		"{site}", a.site.SiteTitle,
+	).Replace(template)
+}
+
+// the album's ShareTitle, or the site's, or its MetaTitle without either
+func (a *Album) GetShareTitle() string {
+	template := a.ShareTitle
+	if template == "" {
+		template = a.site.ShareTitle
+	}
+	if template == "" {
+		return a.MetaTitle
+	}
+	return a.expandShareTemplate(template)
+}
+
+// the album's ShareText, or the site's, or its MetaDescription (or how many photos it has) without either
+func (a *Album) GetShareText() string {
+	template := a.ShareText
+	if template == "" {
+		template = a.site.ShareText
+	}
+	if template == "" {
+		count, _ := a.getShareStats()
+		return a.GetMetaDescription(count)
+	}
+	return a.expandShareTemplate(template)
+}
+
+// what the admin offers to paste along with a share link
+func (a *Album) GetShareMessage(shareUrl string) string {
+	return strings.Join([]string{a.GetShareTitle(), a.GetShareText(), shareUrl}, "\n")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Clients that keep showing photos for longer than their signed URLs last (photo frames, single page apps)
+// get fresh URLs here, e.g. /signed-url?album=/baku/&photo=PA036278.jpg&width=800. Adding a height asks for
+// a thumbnail instead.
+const SIGNED_URL_PATH = "/signed-url"
+
+const DEFAULT_SIGNED_URL_WIDTH = 800
+
+type SignedUrlResponse struct {
+	Url     string        `json:"url"`
+	Sources []PhotoSource `json:"sources,omitempty"`
+	Expires time.Time     `json:"expires"`
+}
+
+func writeSignedUrlError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// Pages on other sites, which would hand out fresh URLs to keep hotlinked photos working. Requests without an
+// Origin or Referer (apps and photo frames, mostly) aren't from a page, so they're let through.
+func isForeignRequest(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return false
+	}
+
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
+}
+
+func handleSignedUrl(site *Site, w http.ResponseWriter, r *http.Request) {
+	album, err := site.GetAlbumForPath(r.FormValue("album"))
+	if err != nil {
+		writeSignedUrlError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	// the same network and credentials as the album itself, a fresh URL is as good as the photo
+	if !album.requireAllowedNetwork(w, r) {
+		return
+	}
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+	if album.getImageUrlLifetime() > 0 && isForeignRequest(r) {
+		writeSignedUrlError(w, http.StatusForbidden, "Photos of this album can't be embedded on other sites")
+		return
+	}
+
+	width, height := DEFAULT_SIGNED_URL_WIDTH, 0
+	if v := r.FormValue("width"); v != "" {
+		if width, err = strconv.Atoi(v); err != nil || width <= 0 {
+			writeSignedUrlError(w, http.StatusBadRequest, "Width must be a positive number")
+			return
+		}
+	}
+	if v := r.FormValue("height"); v != "" {
+		if height, err = strconv.Atoi(v); err != nil || height <= 0 {
+			writeSignedUrlError(w, http.StatusBadRequest, "Height must be a positive number")
+			return
+		}
+	}
+
+	// only photos that are actually shown in the album, so excluded photos stay hidden
+	photo, ok := album.GetPhotoForSlug(r.FormValue("photo"))
+	if !ok {
+		writeSignedUrlError(w, http.StatusNotFound, "No such photo in this album")
+		return
+	}
+
+	response := SignedUrlResponse{Expires: time.Now().Add(album.GetImageUrlExpiry()).UTC()}
+	if height > 0 {
+		response.Url = photo.GetThumbnailForWidthAndHeight(width, height)
+	} else {
+		response.Url = photo.GetPhotoForWidth(width)
+		response.Sources = photo.GetSourcesForWidth(width)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
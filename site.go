@@ -3,7 +3,14 @@ package main
 import (
 	"errors"
 	"fmt"
+	"html/template"
+	"net"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"crypto/rsa"
 	"crypto/x509"
@@ -11,23 +18,114 @@ import (
 	"io/ioutil"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/go-ini/ini"
 )
 
+const DEFAULT_S3_MAX_CONNECTIONS = 16
+const DEFAULT_S3_TIMEOUT = 30 * time.Second
+
+var DEFAULT_RENDERABLE_EXTENSIONS = []string{"jpg", "jpeg", "png", "gif", "webp"}
+
 type Site struct {
 	Domain          string
 	CanonicalSecure bool
+	BasePath        string //the site is served under it, like /photos, see basepath.go
+
+	AuthUser     string
+	AuthPass     string
+	AuthPassHash string
+	AuthUsers    []string
+	AuthFile     string
+	authFile     *HtpasswdFile //loaded on config read from AuthFile
+
+	AuthTOTPSecrets []string
+	authTOTPSecrets map[string][]byte //parsed on config read from AuthTOTPSecrets
+
+	AuthMaxFailures   int
+	AuthFailureWindow time.Duration
+	AuthLockout       time.Duration
+	authLimiter       *AuthLimiter //made on config read
+
+	AuthAuditLog    string           //a file, or stdout
+	authAuditLogger *AuthAuditLogger //opened on config read
+
+	SessionSecret       string
+	sessionSecret       string //random, made on config read for sites without a SessionSecret
+	AuthSessionLifetime time.Duration
+
+	AdminUser string
+	AdminPass string
+
+	UserRoles []string          //user:role pairs, for logins of the site that can use the admin
+	userRoles map[string]string //parsed on config read from UserRoles
+
+	ShareLinkSecret  string
+	GuestUploadMaxMB int
+
+	JWTSecret        string
+	JWTPublicKeyPath string
+	JWTIssuer        string
+	jwtPublicKey     *rsa.PublicKey //loaded on config read from JWTPublicKeyPath
+
+	UploadScanner string
+	ClamAVAddress string
+	UploadScanUrl string
+
+	Webhooks      []string //told about photos added to and removed from albums, see webhook.go
+	WebhookSecret string
+
+	OIDCIssuer        string
+	OIDCClientId      string
+	OIDCClientSecret  string
+	OIDCScopes        []string
+	OIDCGroupsClaim   string
+	OIDCEmailDomains  []string
+	OIDCGroups        []string
+	oidcProvider      *OIDCProvider //fetched from OIDCIssuer the first time somebody logs in
+	oidcProviderMutex sync.Mutex
+
+	AllowedCIDRs   []string
+	allowedNets    []*net.IPNet //parsed on config read from AllowedCIDRs
+	TrustedProxies []string
+	trustedProxies []*net.IPNet //parsed on config read from TrustedProxies
+
+	S3Host           string
+	S3ForcePathStyle bool
+	BucketRegion     string
+	BucketName       string
+
+	StaticMirrorBucket string //public pages are written to it on every refresh
+	StaticMirrorPrefix string
+
+	S3MaxConnections int
+	S3Timeout        time.Duration
+	S3MaxRetries     int
 
-	AuthUser string
-	AuthPass string
+	S3DailyRequestLimit int //a warning is logged past it, see s3budget.go
 
-	S3Host       string
-	S3ForcePathStyle  bool
-	BucketRegion string
-	BucketName   string
+	PersistCaches bool //keep what's worked out about the photos in the bucket too, see cache.go
+
+	StagedPublishing bool //visitors see what was last published from the admin, see publish.go
+
+	ImageUrlLifetime time.Duration //how long photo URLs work, for albums without an ImageUrlLifetime of their own
+
+	ProxyPhotos        bool //photos are streamed through 50mm rather than linked to, see photoproxy.go
+	ProxyPhotosCacheMB int  //of the smaller photos kept in memory, 0 for the default
+
+	CORSOrigins     []string //pages on them can use the API and the photos of ProxyPhotos, see cors.go
+	CORSMethods     []string
+	CORSHeaders     []string
+	CORSCredentials bool //requests from CORSOrigins come with the visitor's cookies or login
+
+	ContentSecurityPolicy   string //headers of every response, empty for the defaults, see security.go
+	StrictTransportSecurity string
+	ReferrerPolicy          string
+	XFrameOptions           string
 
 	UseImgix              bool //deprecated
 	ResizingService       string
@@ -35,20 +133,81 @@ type Site struct {
 	ImageProxy            string
 	BaseUrl               string
 
+	ImgixApiKey              string //purges taken down photos from imgix
+	CloudfrontDistributionId string //invalidated when a photo is taken down
+
+	ResizingServiceFormats []string
+	PrewarmImages          int
+	CheckCovers            bool //covers and thumbnails that can't be shown are swapped for others, see covercheck.go
+	IndexThumbnails        int
+	IndexMinPhotos         int //albums with fewer photos are left out of the index
+	PageSize               int //photos per album page, 0 to show every photo on one page
+	FixOrientation         bool
+	DetectPanoramas        bool
+	PlaceholderColors      bool
+	PageBudgetKB           int
+	AnimatedImages         string
+
+	RenderableExtensions []string
+
 	AWS_SECRET_KEY_ID                  string          `ini:"AWSKeyId"`
 	AWS_SECRET_KEY                     string          `ini:"AWSKey"`
 	AWS_CLOUDFRONT_PRIVATE_KEY_PATH    string          `ini:"AWSCloudfrontKeyPath"`
 	AWS_CLOUDFRONT_PRIVATE_KEY_PAIR_ID string          `ini:"AWSCloudfrontKeyPairId"`
 	CloudfrontPrivateKey               *rsa.PrivateKey //this is loaded on config read
 	//from the path provided in AWS_PRIVATE_KEY_PATH
+	CloudfrontSignedCookies bool
+	CloudfrontCookieDomain  string
 
-	SiteTitle string
-	MetaTitle string
+	SiteTitle       string
+	MetaTitle       string
+	MetaDescription string //for link previews, see opengraph.go
+	ShareTitle      string //what albums without their own say where they're shared, see sharetext.go
+	ShareText       string
 
 	HasAlbumIndex bool
+	HasChangelog  bool
+	PublicStats   bool
+	OEmbed        bool //answers oEmbed requests for album and photo pages, see oembed.go
+	Search        bool //a /search page across the albums, see search.go
+	TagPages      bool //pages at /tags/ for the tags of albums and photos, see tags.go
+	RobotsTxt     bool //serves /robots.txt and /sitemap.xml, see robots.go
 	Albums        []*Album
 
-	awsSession *session.Session
+	Language      string //of the visitors' pages, or auto for the browser's, see i18n.go
+	ErrorPages    bool   //errors as pages with the site's styling, see errorpage.go
+	ErrorTemplate string //in templates/ or the TemplateDir, for ErrorPages instead of error.html
+
+	Theme       string                        //how the pages look, see theme.go
+	ColorScheme string                        //auto, light or dark, see colorscheme.go
+	TemplateDir string                        //of templates used instead of the ones in templates/, see templatedir.go
+	templates   map[string]*template.Template //parsed on config read, by theme, for the themes and TemplateDir
+
+	configPath string //the file the site was loaded from
+	configHash string //of what was in it, for the ETags of album pages
+
+	awsSession      *session.Session
+	s3Service       *s3.S3
+	awsSessionMutex sync.Mutex
+
+	s3Health      S3Health
+	s3HealthMutex sync.Mutex
+
+	photoProxyCache PhotoProxyCache
+
+	s3Requests      S3RequestCount
+	s3RequestsMutex sync.Mutex
+
+	publishedState        atomic.Value //*PublishedSite
+	publishedStateAttempt time.Time    //when it was last read (or tried to be) from the bucket
+	publishMutex          sync.Mutex
+}
+
+// tracks whether we can currently talk to the bucket, updated after every S3 request a site makes
+type S3Health struct {
+	LastSuccess time.Time
+	LastFailure time.Time
+	LastError   error
 }
 
 func GetPrivateKeyFromFile(path string) (*rsa.PrivateKey, error) {
@@ -90,10 +249,34 @@ func LoadSiteFromFile(path string) (*Site, error) {
 		return nil, err
 	}
 
-	s := &Site{}
+	s := &Site{
+		S3MaxConnections: DEFAULT_S3_MAX_CONNECTIONS,
+		S3Timeout:        DEFAULT_S3_TIMEOUT,
+		S3MaxRetries:     aws.UseServiceDefaultRetries,
+
+		RenderableExtensions: DEFAULT_RENDERABLE_EXTENSIONS,
+		IndexThumbnails:      DEFAULT_INDEX_THUMBNAILS,
+
+		OIDCScopes:      DEFAULT_OIDC_SCOPES,
+		OIDCGroupsClaim: DEFAULT_OIDC_GROUPS_CLAIM,
+
+		AuthMaxFailures:   DEFAULT_AUTH_MAX_FAILURES,
+		AuthFailureWindow: DEFAULT_AUTH_FAILURE_WINDOW,
+		AuthLockout:       DEFAULT_AUTH_LOCKOUT,
+
+		AuthSessionLifetime: DEFAULT_AUTH_SESSION_LIFETIME,
+
+		GuestUploadMaxMB: DEFAULT_GUEST_UPLOAD_MAX_MB,
+
+		CORSMethods: DEFAULT_CORS_METHODS,
+		CORSHeaders: DEFAULT_CORS_HEADERS,
+	}
 	if err := defaultSection.MapTo(s); err != nil {
 		return nil, err
 	}
+	s.RenderableExtensions = canonicalizeExtensions(s.RenderableExtensions)
+	s.ResizingServiceFormats = canonicalizeExtensions(s.ResizingServiceFormats)
+	s.OIDCEmailDomains = canonicalizeEmailDomains(s.OIDCEmailDomains)
 
 	if s.BucketRegion == "" && s.BucketName == "" {
 		s.BucketRegion = defaultSection.Key("Region").String()
@@ -125,28 +308,46 @@ func LoadSiteFromFile(path string) (*Site, error) {
 	if err := s.IsValid(); err != nil {
 		return nil, err
 	}
-
-	sess_config := &aws.Config{
-		Region:      aws.String(s.BucketRegion),
-		Credentials: credentials.NewStaticCredentials(s.AWS_SECRET_KEY_ID, s.AWS_SECRET_KEY, ""),
+	s.configPath = path
+	if data, err := ioutil.ReadFile(path); err == nil {
+		s.configHash = HashConfig(data)
 	}
-	if s.S3Host != "" {
-		sess_config.Endpoint = aws.String(s.S3Host)
+
+	if s.AuthFile != "" {
+		if s.authFile, err = LoadHtpasswdFile(s.AuthFile); err != nil {
+			return nil, err
+		}
 	}
-	if s.S3ForcePathStyle {
-		sess_config.S3ForcePathStyle = aws.Bool(true)
+
+	if s.JWTPublicKeyPath != "" {
+		if s.jwtPublicKey, err = GetPublicKeyFromFile(s.JWTPublicKeyPath); err != nil {
+			return nil, err
+		}
 	}
 
-	if sess, err := session.NewSession(sess_config); err != nil {
-		return nil, err
-	} else {
-		s.awsSession = sess
+	// all were checked in IsValid
+	s.allowedNets, _ = parseCIDRs(s.AllowedCIDRs)
+	s.trustedProxies, _ = parseCIDRs(s.TrustedProxies)
+	s.authTOTPSecrets, _ = parseTOTPSecrets(s.AuthTOTPSecrets)
+	s.userRoles, _ = parseUserRoles(s.UserRoles)
+
+	s.authLimiter = NewAuthLimiter(s)
+
+	if s.AuthAuditLog != "" {
+		if s.authAuditLogger, err = GetAuthAuditLogger(s.AuthAuditLog); err != nil {
+			return nil, err
+		}
 	}
 
-	if err != nil {
-		return nil, err
+	if s.SessionSecret == "" {
+		if s.sessionSecret, err = randomHex(32); err != nil {
+			return nil, err
+		}
 	}
 
+	// note that we don't create the AWS session here, that happens the first time S3 is needed
+	// (see GetAWSSession) so that sites still load when the bucket is unreachable at boot.
+
 	if s.UseImgix {
 		//we've deprecated UseImgix as a config, but don't want
 		//to force users with valid configs to have their configs
@@ -156,9 +357,9 @@ func LoadSiteFromFile(path string) (*Site, error) {
 		s.ResizingService = "imgix"
 	}
 
-	// set up private key for thumbor+cloudfront, missing paths, etc
+	// set up private key for thumbor+cloudfront and cloudfront, missing paths, etc
 	// are brought to our attention during validation
-	if s.ResizingService == "thumbor+cloudfront" {
+	if s.ResizingService == "thumbor+cloudfront" || s.ResizingService == "cloudfront" {
 		s.CloudfrontPrivateKey, err = GetPrivateKeyFromFile(s.AWS_CLOUDFRONT_PRIVATE_KEY_PATH)
 
 		if err != nil {
@@ -169,6 +370,18 @@ func LoadSiteFromFile(path string) (*Site, error) {
 	return s, nil
 }
 
+// extensions can be written as "JPG", ".jpg" or "jpg" in the config, we only compare against "jpg"
+func canonicalizeExtensions(extensions []string) []string {
+	var canonical []string
+	for _, v := range extensions {
+		ext := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(v), "."))
+		if ext != "" {
+			canonical = append(canonical, ext)
+		}
+	}
+	return canonical
+}
+
 func (s *Site) IsValid() error {
 	if s.Domain == "" || s.BucketRegion == "" || s.BucketName == "" || s.AWS_SECRET_KEY_ID == "" || s.AWS_SECRET_KEY == "" {
 		return errors.New("Domain, BucketRegion, BucketName, AWSKeyId, and AWSKey are required parameters that must have valid values")
@@ -178,6 +391,118 @@ func (s *Site) IsValid() error {
 		return errors.New("Can't have a site with 0 albums")
 	}
 
+	if s.HasAdmin() {
+		for _, a := range s.Albums {
+			if strings.HasPrefix(a.Path, ADMIN_PATH) {
+				return fmt.Errorf("Album %s can't be served under %s, that's where the admin lives", a.Path, ADMIN_PATH)
+			}
+		}
+	}
+
+	if s.UsesSignedUrls() {
+		for _, a := range s.Albums {
+			if a.Path == SIGNED_URL_PATH+"/" {
+				return fmt.Errorf("Album %s can't be served at %s, that's where signed URLs are refreshed", a.Path, SIGNED_URL_PATH)
+			}
+		}
+	}
+
+	if err := s.validateCloudfrontCookies(); err != nil {
+		return err
+	}
+
+	if err := s.validateStaticMirror(); err != nil {
+		return err
+	}
+
+	if s.HasLogins() {
+		for _, a := range s.Albums {
+			if a.Path == LOGOUT_PATH+"/" {
+				return fmt.Errorf("Album %s can't be served at %s, that's where visitors log out", a.Path, LOGOUT_PATH)
+			}
+		}
+	}
+
+	if s.PublicStats && s.HasAuth() {
+		return errors.New("PublicStats would give away the numbers of a site that needs a login to anybody")
+	}
+
+	if err := s.validateShareTemplates(); err != nil {
+		return err
+	}
+
+	if err := s.validateOEmbed(); err != nil {
+		return err
+	}
+
+	if err := s.validateSearch(); err != nil {
+		return err
+	}
+
+	if err := s.validateTagPages(); err != nil {
+		return err
+	}
+
+	if err := validateLanguage(s.Language); err != nil {
+		return err
+	}
+
+	if err := s.validateBasePath(); err != nil {
+		return err
+	}
+
+	if err := validateTheme(s.Theme); err != nil {
+		return err
+	}
+
+	if err := validateColorScheme(s.ColorScheme); err != nil {
+		return err
+	}
+
+	if err := s.validateTemplateDir(); err != nil {
+		return err
+	}
+
+	if err := s.parseTemplates(); err != nil {
+		return err
+	}
+
+	if err := s.validateErrorPages(); err != nil {
+		return err
+	}
+
+	if err := s.validateProxyPhotos(); err != nil {
+		return err
+	}
+
+	if err := s.validateSecurityHeaders(); err != nil {
+		return err
+	}
+
+	if err := s.validateCORS(); err != nil {
+		return err
+	}
+
+	if err := s.validateApi(); err != nil {
+		return err
+	}
+
+	if s.HasChangelog {
+		for _, a := range s.Albums {
+			if strings.HasPrefix(a.Path, CHANGELOG_PATH) {
+				return fmt.Errorf("Album %s can't be served under %s, that's where the changelog lives", a.Path, CHANGELOG_PATH)
+			}
+		}
+	}
+
+	if s.OIDCIssuer != "" {
+		for _, a := range s.Albums {
+			if strings.HasPrefix(a.Path, OIDC_PATH) {
+				return fmt.Errorf("Album %s can't be served under %s, that's where logins happen", a.Path, OIDC_PATH)
+			}
+		}
+	}
+
 	if s.HasAlbumIndex {
 		for _, a := range s.Albums {
 			if a.Path == "/" {
@@ -186,6 +511,170 @@ func (s *Site) IsValid() error {
 		}
 	}
 
+	if len(s.RenderableExtensions) == 0 {
+		return errors.New("RenderableExtensions needs at least one extension, or skip it to use the defaults")
+	}
+
+	if s.S3MaxConnections <= 0 {
+		return errors.New("S3MaxConnections must be greater than 0")
+	}
+
+	if s.S3Timeout < 0 {
+		return errors.New("S3Timeout can't be negative, use 0 to disable the timeout")
+	}
+
+	if err := s.validateS3RequestLimit(); err != nil {
+		return err
+	}
+
+	if err := s.validateStagedPublishing(); err != nil {
+		return err
+	}
+
+	if err := validateImageUrlLifetime(s.ImageUrlLifetime); err != nil {
+		return err
+	}
+
+	if err := s.validateAuthLimiter(); err != nil {
+		return err
+	}
+
+	if err := s.validateLoginSessions(); err != nil {
+		return err
+	}
+
+	if err := s.validateGuestUploads(); err != nil {
+		return err
+	}
+
+	if _, err := parseCIDRs(s.AllowedCIDRs); err != nil {
+		return fmt.Errorf("AllowedCIDRs: %s", err.Error())
+	}
+	if _, err := parseCIDRs(s.TrustedProxies); err != nil {
+		return fmt.Errorf("TrustedProxies: %s", err.Error())
+	}
+
+	for _, format := range s.ResizingServiceFormats {
+		if !stringInSlice(format, MODERN_FORMATS) {
+			return fmt.Errorf("Unsupported ResizingServiceFormats value '%s', valid options are avif and webp", format)
+		}
+	}
+
+	resizingService := s.ResizingService
+	if s.UseImgix {
+		resizingService = "imgix"
+	}
+	for _, a := range s.Albums {
+		if a.AllowWebZipDownload && (resizingService == "" || resizingService == "cloudfront") {
+			return fmt.Errorf("Album %s has AllowWebZipDownload on, which needs a resizing service to make "+
+				"the web sized photos. Use AllowZipDownload without one", a.Path)
+		}
+		if len(a.OriginalZipUsers) > 0 && !a.HasAuth() {
+			return fmt.Errorf("Album %s has OriginalZipUsers, which needs the album (or the site) to have logins", a.Path)
+		}
+
+		if a.getImageUrlLifetime() > 0 && resizingService == "thumbor" {
+			return fmt.Errorf("Album %s has ImageUrlLifetime, thumbor's URLs can't expire. Use thumbor+cloudfront", a.Path)
+		}
+		if a.getImageUrlLifetime() > 0 && resizingService == "imgix" && s.ResizingServiceSecret == "" {
+			return fmt.Errorf("Album %s has ImageUrlLifetime, which needs the source's secure URL token as "+
+				"ResizingServiceSecret with imgix", a.Path)
+		}
+
+		if !a.HasWatermark() {
+			continue
+		}
+		if resizingService != "imgix" && resizingService != "thumbor" && resizingService != "thumbor+cloudfront" {
+			return fmt.Errorf("Album %s has a watermark, which needs a resizing service that can apply it "+
+				"(imgix, thumbor or thumbor+cloudfront)", a.Path)
+		}
+		if a.WatermarkText != "" && resizingService != "imgix" {
+			return fmt.Errorf("Album %s has a text watermark, which is only supported by imgix. "+
+				"Use WatermarkImage with thumbor", a.Path)
+		}
+	}
+
+	if s.PageBudgetKB < 0 {
+		return errors.New("PageBudgetKB can't be negative, use 0 to turn the page budget off")
+	}
+
+	if s.PageBudgetKB > 0 && s.ResizingService != "imgix" && s.ResizingService != "thumbor" &&
+		s.ResizingService != "thumbor+cloudfront" {
+		return errors.New("PageBudgetKB needs a resizing service that can lower the quality of photos (imgix, thumbor or thumbor+cloudfront)")
+	}
+
+	switch s.AnimatedImages {
+	case "", ANIMATED_IMAGES_PASSTHROUGH:
+		break
+	case ANIMATED_IMAGES_POSTER:
+		if s.ResizingService != "imgix" && s.ResizingService != "thumbor" && s.ResizingService != "thumbor+cloudfront" {
+			return errors.New("AnimatedImages = poster needs a resizing service that can make stills (imgix, thumbor or thumbor+cloudfront)")
+		}
+	default:
+		return fmt.Errorf("AnimatedImages must be %s or %s, not %s", ANIMATED_IMAGES_PASSTHROUGH, ANIMATED_IMAGES_POSTER, s.AnimatedImages)
+	}
+
+	if err := validateAuthUsers(s.AuthUsers); err != nil {
+		return err
+	}
+
+	if err := s.validateUserRoles(); err != nil {
+		return err
+	}
+
+	if err := validateTOTPSecrets(s.AuthTOTPSecrets, s.AuthSessionLifetime); err != nil {
+		return err
+	}
+
+	if err := validatePassHash(s.AuthUser, s.AuthPass, s.AuthPassHash); err != nil {
+		return err
+	}
+
+	if err := s.validateBearerTokens(); err != nil {
+		return err
+	}
+
+	if err := s.validateUploadScanner(); err != nil {
+		return err
+	}
+
+	if err := s.validateOIDC(); err != nil {
+		return err
+	}
+
+	if err := s.validateWebhooks(); err != nil {
+		return err
+	}
+
+	if s.ShareLinkSecret != "" && len(s.ShareLinkSecret) < 16 {
+		return errors.New("ShareLinkSecret must be at least 16 characters long")
+	}
+
+	if s.IndexThumbnails < 0 {
+		return errors.New("IndexThumbnails can't be negative, use 0 to show only the covers of albums in the index")
+	}
+
+	if s.IndexMinPhotos < 0 {
+		return errors.New("IndexMinPhotos can't be negative, use 0 to list every album in the index")
+	}
+
+	if s.PageSize < 0 {
+		return errors.New("PageSize can't be negative, use 0 to show every photo of an album on one page")
+	}
+
+	if s.PrewarmImages < 0 {
+		return errors.New("PrewarmImages can't be negative, use 0 to turn prewarming off")
+	}
+
+	if len(s.ResizingServiceFormats) > 0 && s.ResizingService != "imgix" && s.ResizingService != "thumbor" &&
+		s.ResizingService != "thumbor+cloudfront" && !s.UseImgix {
+		return errors.New("ResizingServiceFormats needs a resizing service that can convert images (imgix, thumbor or thumbor+cloudfront)")
+	}
+
+	if s.ImgixApiKey != "" && s.ResizingService != "imgix" && !s.UseImgix {
+		return errors.New("ImgixApiKey needs ResizingService = imgix")
+	}
+
 	if s.UseImgix && s.ResizingService != "" {
 		return errors.New("ResizingService supercedes UseImgix, please use ResizingService = imgix instead.")
 	}
@@ -197,11 +686,11 @@ func (s *Site) IsValid() error {
 		if s.ResizingServiceSecret == "" {
 			return errors.New("Thumbor resizing service requires use of a shared secret for URL signing")
 		}
-	case "thumbor+cloudfront":
+	case "thumbor+cloudfront", "cloudfront":
 		if s.AWS_CLOUDFRONT_PRIVATE_KEY_PATH == "" || s.AWS_CLOUDFRONT_PRIVATE_KEY_PAIR_ID == "" {
-			return errors.New("thumbor+cloudfront resizing service requires you to provision a private key " +
-				"and provide the path to the private key(config AWSCloudfrontKeyPath)," +
-				" along with the associated key pair id (config AWSCloudfrontKeyPairId)")
+			return fmt.Errorf("%s resizing service requires you to provision a private key "+
+				"and provide the path to the private key(config AWSCloudfrontKeyPath),"+
+				" along with the associated key pair id (config AWSCloudfrontKeyPairId)", s.ResizingService)
 		} else {
 			// we do the entire parse to ensure it's valid, however, do not assign
 			// to the config here as we don't want there to be surprises for developers
@@ -218,22 +707,71 @@ func (s *Site) IsValid() error {
 		}
 	default:
 		return fmt.Errorf("Unrecognized/Unimplemented resizing service '%s',"+
-			" valid options are imgix, thumbor, thumbor+cloudfront", s.ResizingService)
+			" valid options are imgix, thumbor, thumbor+cloudfront, cloudfront", s.ResizingService)
 	}
 
 	return nil
 }
 
 func (s *Site) HasAuth() bool {
-	return s.AuthUser != "" && s.AuthPass != ""
+	return (s.AuthUser != "" && (s.AuthPass != "" || s.AuthPassHash != "")) || len(s.AuthUsers) > 0 || s.AuthFile != "" || s.UsesOIDC()
 }
 
-func (s *Site) GetAuthUser() string {
-	return s.AuthUser
+// Photo URLs on sites without a resizing service (or behind imageproxy) are pre-signed S3 URLs, and
+// thumbor+cloudfront and cloudfront sign their URLs as well. These stop working after a while. With
+// cloudfront's signed cookies it's the cookies that do, and every page view hands out new ones. Photos
+// through ProxyPhotos have URLs on the site, which don't expire.
+func (s *Site) UsesSignedUrls() bool {
+	if s.UsesCloudfrontCookies() || s.ProxyPhotos {
+		return false
+	}
+	if s.ResizingService == "" || s.ResizingService == "imageproxy" || s.ResizingService == "thumbor+cloudfront" ||
+		s.ResizingService == "cloudfront" {
+		return true
+	}
+	// imgix URLs expire with ImageUrlLifetime
+	for _, a := range s.Albums {
+		if a.getImageUrlLifetime() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// how long the photo URLs of a site that UsesSignedUrls stay valid
+func (s *Site) GetSignedUrlExpiry() time.Duration {
+	if s.ResizingService == "thumbor+cloudfront" || s.ResizingService == "cloudfront" {
+		return CLOUDFRONT_URL_EXPIRY
+	}
+	return S3_URL_EXPIRY
+}
+
+// imgix and thumbor can read HEIC (thumbor with a HEIF capable engine) and turn it in to JPEG
+func (s *Site) TranscodesHeic() bool {
+	return s.ResizingService == "imgix" || s.ResizingService == "thumbor" || s.ResizingService == "thumbor+cloudfront"
+}
+
+func (s *Site) HasAdmin() bool {
+	return s.AdminUser != "" && s.AdminPass != ""
+}
+
+func (s *Site) GetAdminCredentials() AuthCredentialsProvider {
+	return s.GetAdminCredentialsForScope(JWT_SCOPE_ADMIN)
+}
+
+// the admin's login, along with the logins of the site whose UserRoles allow scope
+func (s *Site) GetAdminCredentialsForScope(scope string) AuthCredentialsProvider {
+	return &AdminCredentials{StaticCredentials{s.AdminUser, s.AdminPass}, s, scope}
 }
 
-func (s *Site) GetAuthPass() string {
-	return s.AuthPass
+// the code of logins with a TOTP secret is checked whether the password is right or not, so a wrong code takes
+// as long to refuse as a wrong password
+func (s *Site) CheckCredentials(user string, pass string) bool {
+	pass, codeOk := checkTOTPCode(s.getTOTPSecret(user), pass, time.Now())
+	passOk := checkCredentials(user, pass, s.AuthUser, s.AuthPass) || checkHashedCredentials(user, pass, s.AuthUser, s.AuthPassHash) ||
+		checkCredentialsList(user, pass, s.AuthUsers) ||
+		(s.authFile != nil && s.authFile.CheckCredentials(user, pass))
+	return codeOk && passOk
 }
 
 func (s *Site) GetCanonicalUrl() *url.URL {
@@ -242,17 +780,21 @@ func (s *Site) GetCanonicalUrl() *url.URL {
 		proto = "https"
 	}
 
-	return &url.URL{
+	u := &url.URL{
 		Scheme: proto,
 		Host:   domain,
 	}
+	if s.BasePath != "" {
+		u.Path = s.BasePath + "/"
+	}
+	return u
 }
 
 func (s *Site) GetAlbumsForIndex() []*Album {
 	indexAlbums := make([]*Album, 0)
 
 	for _, a := range s.Albums {
-		if a.InIndex {
+		if a.InIndex && a.IsPublished() && a.HasIndexMinPhotos() {
 			indexAlbums = append(indexAlbums, a)
 		}
 	}
@@ -260,58 +802,195 @@ func (s *Site) GetAlbumsForIndex() []*Album {
 	return indexAlbums
 }
 
+// Every site gets its own transport, so a slow or unreachable bucket can only exhaust its own
+// connection pool and never starves the other sites served by this instance.
+func (s *Site) NewS3HTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   s.S3Timeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			MaxIdleConns:          s.S3MaxConnections,
+			MaxIdleConnsPerHost:   s.S3MaxConnections,
+			MaxConnsPerHost:       s.S3MaxConnections,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   s.S3Timeout,
+			ResponseHeaderTimeout: s.S3Timeout,
+		},
+	}
+}
+
+// The session is created lazily on first use, so a site can start (and keep serving whatever it has cached)
+// without being able to reach its bucket. Failures aren't remembered, the next caller simply tries again.
+func (s *Site) GetAWSSession() (*session.Session, error) {
+	s.awsSessionMutex.Lock()
+	defer s.awsSessionMutex.Unlock()
+
+	if s.awsSession != nil {
+		return s.awsSession, nil
+	}
+
+	sess_config := &aws.Config{
+		Region:      aws.String(s.BucketRegion),
+		Credentials: credentials.NewStaticCredentials(s.AWS_SECRET_KEY_ID, s.AWS_SECRET_KEY, ""),
+		HTTPClient:  s.NewS3HTTPClient(),
+		MaxRetries:  aws.Int(s.S3MaxRetries),
+	}
+	if s.S3Host != "" {
+		sess_config.Endpoint = aws.String(s.S3Host)
+	}
+	if s.S3ForcePathStyle {
+		sess_config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	sess, err := session.NewSession(sess_config)
+	if err != nil {
+		s.RecordS3Result(err)
+		return nil, err
+	}
+
+	sess.Handlers.Complete.PushBack(func(r *request.Request) {
+		s.RecordS3Result(r.Error)
+	})
+	// Send runs for every attempt, Complete only once per call
+	sess.Handlers.Send.PushFront(func(r *request.Request) {
+		s.recordS3Request(r.Operation.Name, time.Now())
+	})
+
+	s.awsSession = sess
+	s.s3Service = s3.New(sess)
+	return sess, nil
+}
+
 func (s *Site) GetS3Service() (*s3.S3, error) {
-	return s3.New(s.awsSession), nil
+	if _, err := s.GetAWSSession(); err != nil {
+		return nil, err
+	}
+	return s.s3Service, nil
+}
+
+// Any response from S3 below a 500 (including the 404s for missing ordering files) means that the bucket
+// is reachable, only transport errors and server errors count as failures.
+func (s *Site) RecordS3Result(err error) {
+	reachable := err == nil
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() < 500 {
+		reachable = true
+	}
+
+	s.s3HealthMutex.Lock()
+	defer s.s3HealthMutex.Unlock()
+
+	if reachable {
+		s.s3Health.LastSuccess = time.Now()
+	} else {
+		s.s3Health.LastFailure = time.Now()
+		s.s3Health.LastError = err
+	}
+}
+
+func (s *Site) GetS3Health() S3Health {
+	s.s3HealthMutex.Lock()
+	defer s.s3HealthMutex.Unlock()
+	return s.s3Health
+}
+
+func (s *Site) IsS3Degraded() bool {
+	health := s.GetS3Health()
+	return health.LastFailure.After(health.LastSuccess)
+}
+
+func (s *Site) HasCachedAlbums() bool {
+	for _, a := range s.Albums {
+		if a.HasCachedKeys() {
+			return true
+		}
+	}
+	return false
+}
+
+// one of "ok", "degraded" (S3 is failing but we have cached albums to serve) or "unavailable"
+func (s *Site) GetReadiness() string {
+	if !s.IsS3Degraded() {
+		return "ok"
+	} else if s.HasCachedAlbums() {
+		return "degraded"
+	} else {
+		return "unavailable"
+	}
 }
 
 func (s *Site) GetPhotoForKey(key string) Renderable {
+	return s.GetPhotoForKeyWithDetails(key, &PhotoDetails{})
+}
+
+func (s *Site) GetPhotoForKeyWithDetails(key string, details *PhotoDetails) Renderable {
 	if s.ResizingService == "" {
-		return s.GetS3Photo(key)
+		return s.GetS3Photo(key, details)
 	} else {
-		return s.GetScaledPhoto(key)
+		return s.GetScaledPhoto(key, details)
 	}
 }
 
-func (s *Site) GetS3Photo(key string) *S3Photo {
+func (s *Site) GetS3Photo(key string, details *PhotoDetails) *S3Photo {
+	sess, err := s.GetAWSSession()
+	if err != nil {
+		fmt.Printf("Unable to create AWS session for site %s. Error: %s\n", s.Domain, err.Error())
+	}
+
 	return &S3Photo{
+		details,
 		key,
 		s.BucketName,
-		s.awsSession,
+		sess,
+	}
+}
+
+func (s *Site) newRescaledPhoto(key string, baseUrl *url.URL, details *PhotoDetails) *RescaledPhoto {
+	return &RescaledPhoto{
+		PhotoDetails: details,
+		Key:          key,
+		BaseUrl:      baseUrl,
+		Formats:      s.ResizingServiceFormats,
 	}
 }
 
-func (s *Site) GetScaledPhoto(key string) Renderable {
+func (s *Site) GetScaledPhoto(key string, details *PhotoDetails) Renderable {
 	if baseUrl, err := url.Parse(s.BaseUrl); err != nil {
 		fmt.Printf("Error trying to parse site base URL. Error: %s\n", err.Error())
 		return nil
 	} else {
 		if s.ResizingService == "imgix" {
 			return &ImgixRescaledPhoto{
-				RescaledPhoto: &RescaledPhoto{
-					key,
-					baseUrl,
-				},
+				RescaledPhoto: s.newRescaledPhoto(key, baseUrl, details),
+				Secret:        s.ResizingServiceSecret,
 			}
 		} else if s.ResizingService == "thumbor" {
 			return &ThumborRaw{
-				RescaledPhoto: &RescaledPhoto{
-					key,
-					baseUrl,
-				},
-				Secret: s.ResizingServiceSecret,
+				RescaledPhoto: s.newRescaledPhoto(key, baseUrl, details),
+				Secret:        s.ResizingServiceSecret,
 			}
 		} else if s.ResizingService == "thumbor+cloudfront" {
 			return &ThumborCloudfront{
-				RescaledPhoto: &RescaledPhoto{
-					key,
-					baseUrl,
-				},
+				RescaledPhoto:           s.newRescaledPhoto(key, baseUrl, details),
 				AWSCloudfrontKeyPairId:  s.AWS_CLOUDFRONT_PRIVATE_KEY_PAIR_ID,
 				AWSCloudfrontPrivateKey: s.CloudfrontPrivateKey,
 			}
+		} else if s.ResizingService == "cloudfront" {
+			photo := &CloudfrontPhoto{
+				RescaledPhoto:          s.newRescaledPhoto(key, baseUrl, details),
+				AWSCloudfrontKeyPairId: s.AWS_CLOUDFRONT_PRIVATE_KEY_PAIR_ID,
+			}
+			if !s.UsesCloudfrontCookies() {
+				photo.AWSCloudfrontPrivateKey = s.CloudfrontPrivateKey
+			}
+			return photo
 		} else if s.ResizingService == "imageproxy" {
 			return &ImageProxy{
-				S3Photo:    s.GetS3Photo(key),
+				S3Photo:    s.GetS3Photo(key, details),
 				ImageProxy: s.ImageProxy,
 			}
 		} else {
@@ -323,7 +1002,7 @@ func (s *Site) GetScaledPhoto(key string) Renderable {
 }
 
 func (s *Site) GetAlbumForPath(path string) (*Album, error) {
-	if path[len(path)-1] != '/' {
+	if path == "" || path[len(path)-1] != '/' {
 		path = path + "/"
 	}
 	for _, album := range s.Albums {
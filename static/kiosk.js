@@ -0,0 +1,112 @@
+// the kiosk's slideshow: shows the photos in turn, puts new ones next in line and moves the layout now and then
+(function () {
+    var kiosk = document.getElementById('kiosk');
+    var slides = kiosk.querySelectorAll('img.slide');
+    var caption = kiosk.querySelector('div.caption');
+    var empty = kiosk.querySelector('p.empty');
+    var SHIFTS = 4;
+
+    var photos = readPhotos(document);
+    var upcoming = [];
+    var current = null;
+    var front = 0;
+    var shift = 0;
+
+    function readPhotos(doc) {
+        var items = doc.querySelectorAll('#kiosk-photos li');
+        var list = [];
+        for (var i = 0; i < items.length; i++) {
+            list.push({
+                slug: items[i].getAttribute('data-slug'),
+                src: items[i].getAttribute('data-src'),
+                title: items[i].getAttribute('data-title'),
+                caption: items[i].getAttribute('data-caption')
+            });
+        }
+        return list;
+    }
+
+    function indexOf(slug) {
+        for (var i = 0; i < photos.length; i++) {
+            if (photos[i].slug === slug) {
+                return i;
+            }
+        }
+        return -1;
+    }
+
+    // new photos first, then the one after the current photo
+    function next() {
+        while (upcoming.length > 0) {
+            var i = indexOf(upcoming.shift());
+            if (i >= 0) {
+                return photos[i];
+            }
+        }
+        var at = current ? indexOf(current.slug) : -1;
+        return photos[(at + 1) % photos.length];
+    }
+
+    function show(photo) {
+        current = photo;
+        front = 1 - front;
+        var slide = slides[front];
+        slide.onload = function () {
+            slide.classList.add('current');
+            slides[1 - front].classList.remove('current');
+            caption.querySelector('p.title').textContent = photo.title;
+            caption.querySelector('p.text').textContent = photo.caption;
+            caption.classList.toggle('empty', !photo.title && !photo.caption);
+        };
+        slide.src = photo.src;
+    }
+
+    function advance() {
+        empty.hidden = photos.length > 0;
+        if (photos.length === 0) {
+            current = null;
+            slides[0].classList.remove('current');
+            slides[1].classList.remove('current');
+            caption.classList.add('empty');
+            return;
+        }
+        show(next());
+    }
+
+    // the page again, for the album's photos with fresh URLs
+    function reload() {
+        fetch(location.href, {credentials: 'same-origin', cache: 'no-store'}).then(function (response) {
+            if (!response.ok) {
+                throw new Error(response.status);
+            }
+            return response.text();
+        }).then(function (html) {
+            var previous = photos;
+            photos = readPhotos(new DOMParser().parseFromString(html, 'text/html'));
+            for (var i = 0; i < photos.length; i++) {
+                var known = false;
+                for (var j = 0; j < previous.length; j++) {
+                    known = known || previous[j].slug === photos[i].slug;
+                }
+                if (!known) {
+                    upcoming.push(photos[i].slug);
+                }
+            }
+        }).catch(function () {
+            // the photos we have keep going until the next try
+        });
+    }
+
+    advance();
+    setInterval(advance, parseInt(kiosk.getAttribute('data-interval'), 10));
+    setInterval(reload, parseInt(kiosk.getAttribute('data-reload'), 10));
+    setInterval(function () {
+        kiosk.classList.remove('shift-' + shift);
+        shift = (shift + 1) % SHIFTS;
+        kiosk.classList.add('shift-' + shift);
+    }, parseInt(kiosk.getAttribute('data-layout-shift'), 10));
+
+    if (window.EventSource) {
+        new EventSource(kiosk.getAttribute('data-events')).addEventListener('photos', reload);
+    }
+})();
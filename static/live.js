@@ -0,0 +1,22 @@
+// reloads the album page when 50mm says its photos changed, browsers keep where the page was scrolled to
+(function () {
+    if (!window.EventSource) {
+        return;
+    }
+    var events = new EventSource(document.currentScript.getAttribute('data-events'));
+    var changed = false;
+
+    function reload() {
+        if (changed && !document.hidden) {
+            events.close();
+            location.reload();
+        }
+    }
+
+    events.addEventListener('photos', function () {
+        changed = true;
+        reload();
+    });
+    // pages in a background tab catch up when they're looked at again
+    document.addEventListener('visibilitychange', reload);
+})();
@@ -0,0 +1,35 @@
+// plays the video of Live Photos on top of the still while it's hovered or touched
+(function () {
+    var pictures = document.querySelectorAll('picture.motion');
+    for (var i = 0; i < pictures.length; i++) {
+        (function (picture) {
+            var video = null;
+
+            function play() {
+                if (video) {
+                    return;
+                }
+                video = document.createElement('video');
+                video.muted = true;
+                video.playsInline = true;
+                video.src = picture.getAttribute('data-motion');
+                picture.appendChild(video);
+                video.play();
+            }
+
+            function stop() {
+                if (!video) {
+                    return;
+                }
+                video.pause();
+                picture.removeChild(video);
+                video = null;
+            }
+
+            picture.addEventListener('mouseenter', play);
+            picture.addEventListener('mouseleave', stop);
+            picture.addEventListener('touchstart', play, {passive: true});
+            picture.addEventListener('touchend', stop);
+        })(pictures[i]);
+    }
+})();
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// sites with PublicStats set give their numbers here, for badges and status pages
+const STATS_PATH = "/stats.json"
+
+// the numbers only change when the key caches are refreshed, about once an hour
+const STATS_MAX_AGE = 10 * time.Minute
+
+// Coarse on purpose: only albums in the index count, which everybody can see anyway
+type SiteStats struct {
+	Albums  int        `json:"albums"`
+	Photos  int        `json:"photos"`
+	Updated *time.Time `json:"updated,omitempty"` //when the newest photo was uploaded, as far as the caches know
+}
+
+func (s *Site) GetStats() SiteStats {
+	var stats SiteStats
+	for _, a := range s.GetAlbumsForIndex() {
+		orderingKeys, err := a.getVisibleOrderedKeys()
+		if err != nil {
+			continue
+		}
+		stats.Albums++
+		stats.Photos += len(orderingKeys.Ordering)
+
+		dates, _ := a.KeyDatesCache.Load().(map[string]time.Time)
+		for _, v := range orderingKeys.Ordering {
+			if date, ok := dates[v]; ok && (stats.Updated == nil || date.After(*stats.Updated)) {
+				updated := date.UTC()
+				stats.Updated = &updated
+			}
+		}
+	}
+	return stats
+}
+
+func handleStats(site *Site, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(STATS_MAX_AGE.Seconds())))
+	// badge services fetch these from their own domain
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(site.GetStats())
+}
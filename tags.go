@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Photos get tags in ordering.yaml (`tags: [beach, sunset]`), albums with their Tags option. With the site's
+// TagPages on, /tags/beach shows the albums and photos tagged beach across the site, and /tags/ every tag.
+// Like the search, only albums the visitor could find anyway are in them, see getSearchableAlbums.
+const TAGS_PATH = "/tags/"
+
+const TAG_MAX_PHOTOS = 200
+
+type TagPageContext struct {
+	*BasePageContext
+
+	Tag    string // empty on /tags/, which has Tags instead
+	Albums []*Album
+	Photos []SearchResult
+
+	TooManyPhotos bool // there were more than TAG_MAX_PHOTOS, only the first ones are shown
+
+	Tags []TagCount
+}
+
+type TagCount struct {
+	Tag       string
+	Url       string
+	NumAlbums int
+	NumPhotos int
+}
+
+func (s *Site) validateTagPages() error {
+	if !s.TagPages {
+		return nil
+	}
+	for _, a := range s.Albums {
+		if strings.HasPrefix(a.Path, TAGS_PATH) {
+			return fmt.Errorf("Album %s can't be served under %s, that's where the tag pages are", a.Path, TAGS_PATH)
+		}
+	}
+	return nil
+}
+
+// Tags are compared, and end up in URLs, lower case with anything but letters and digits turned in to dashes,
+// so "Old Town" and "old-town" are the same tag.
+func normalizeTag(tag string) string {
+	words := strings.FieldsFunc(strings.ToLower(tag), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	return strings.Join(words, "-")
+}
+
+// normalized, without empty tags or tags given twice
+func normalizeTags(tags []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, v := range tags {
+		tag := normalizeTag(v)
+		if tag != "" && !seen[tag] {
+			normalized = append(normalized, tag)
+			seen[tag] = true
+		}
+	}
+	return normalized
+}
+
+func (a *Album) GetTags() []string {
+	return normalizeTags(a.Tags)
+}
+
+func (s *Site) GetTagUrl(tag string) string {
+	return s.GetUrlForPath(TAGS_PATH + tag).String()
+}
+
+func (a *Album) HasTag(tag string) bool {
+	for _, v := range a.GetTags() {
+		if v == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Site) GetTaggedAlbums(r *http.Request, tag string) ([]*Album, []SearchResult, bool) {
+	var albums []*Album
+	var photos []SearchResult
+	tooMany := false
+	for _, a := range s.getSearchableAlbums(r) {
+		if a.HasTag(tag) {
+			albums = append(albums, a)
+		}
+		for _, v := range a.getSearchIndex().Tags[tag] {
+			if len(photos) == TAG_MAX_PHOTOS {
+				tooMany = true
+				break
+			}
+			photos = append(photos, SearchResult{a, v, a.GetCanonicalUrl().String() + v.Slug()})
+		}
+	}
+	return albums, photos, tooMany
+}
+
+// every tag of the albums the visitor could find, and how many albums and photos have it
+func (s *Site) GetTagCounts(r *http.Request) []TagCount {
+	counts := make(map[string]*TagCount)
+	count := func(tag string) *TagCount {
+		if _, ok := counts[tag]; !ok {
+			counts[tag] = &TagCount{Tag: tag, Url: s.GetTagUrl(tag)}
+		}
+		return counts[tag]
+	}
+	for _, a := range s.getSearchableAlbums(r) {
+		for _, v := range a.GetTags() {
+			count(v).NumAlbums++
+		}
+		for k, v := range a.getSearchIndex().Tags {
+			count(k).NumPhotos += len(v)
+		}
+	}
+
+	var tags []TagCount
+	for _, v := range counts {
+		tags = append(tags, *v)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Tag < tags[j].Tag
+	})
+	return tags
+}
+
+func handleTagPage(site *Site, w http.ResponseWriter, r *http.Request) {
+	if site.HasAuth() && !checkAndRequireAuth(w, r, site) {
+		return
+	}
+
+	tag := strings.TrimPrefix(r.URL.Path, TAGS_PATH)
+	if tag != "" && normalizeTag(tag) != tag {
+		if normalizeTag(tag) == "" {
+			site.writeErrorPage(nil, http.StatusNotFound, "No such tag\n", w, r)
+			return
+		}
+		http.Redirect(w, r, site.GetTagUrl(normalizeTag(tag)), http.StatusMovedPermanently)
+		return
+	}
+
+	locale := site.GetLocale(w, r)
+	title := locale.T("tags")
+	if tag != "" {
+		title = locale.T("tagged", tag)
+	}
+	ctx := &TagPageContext{
+		&BasePageContext{
+			site.GetCanonicalUrl().String(),
+			site.GetTagUrl(tag),
+			title + " | " + site.MetaTitle,
+			site.SiteTitle,
+			locale,
+			site.GetTheme(),
+			site.GetColorScheme(),
+		},
+		tag,
+		nil,
+		nil,
+		false,
+		nil,
+	}
+	if tag == "" {
+		ctx.Tags = site.GetTagCounts(r)
+	} else {
+		ctx.Albums, ctx.Photos, ctx.TooManyPhotos = site.GetTaggedAlbums(r, tag)
+		if len(ctx.Albums)+len(ctx.Photos) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+	site.executeTemplate(w, "tags.html", ctx)
+}
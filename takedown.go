@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// every takedown of the album, next to its prebuilt zips where the album doesn't list it
+const TAKEDOWNS_NAME = PREBUILT_ZIP_FOLDER + "takedowns.json"
+
+const IMGIX_PURGE_URL = "https://api.imgix.com/api/v1/purge"
+
+const TAKEDOWN_PURGE_TIMEOUT = 30 * time.Second
+
+// A photo that was taken down, and the tombstone of its URL, which answers 410 Gone from then on. Reason is
+// whatever the admin wrote down, like the date and sender of the request.
+type Takedown struct {
+	Photo   string    `json:"photo"`
+	Keys    []string  `json:"keys"`
+	Reason  string    `json:"reason"`
+	By      string    `json:"by"`
+	At      time.Time `json:"at"`
+	Purged  []string  `json:"purged,omitempty"`
+	Warning string    `json:"warning,omitempty"` // what didn't work, the photo is gone from the album regardless
+}
+
+type AdminTakedownPageContext struct {
+	*BasePageContext
+
+	Album     *Album
+	Photos    []string
+	Takedowns []Takedown
+	Done      *Takedown
+}
+
+// the album's takedowns as far as the last refresh knows, newest last
+func (a *Album) GetTakedowns() []Takedown {
+	takedowns, _ := a.TakedownsCache.Load().([]Takedown)
+	return takedowns
+}
+
+func (a *Album) IsTakenDown(slug string) bool {
+	for _, v := range a.GetTakedowns() {
+		if v.Photo == slug {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Album) readTakedowns() ([]Takedown, error) {
+	data, err := a.GetObjectFromBucket(TAKEDOWNS_NAME)
+	if isNotFoundError(err) {
+		return []Takedown{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var takedowns []Takedown
+	if err := json.Unmarshal(data, &takedowns); err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %s", TAKEDOWNS_NAME, err.Error())
+	}
+	return takedowns, nil
+}
+
+// a missing file is no takedowns, one that can't be read keeps the tombstones we had
+func (a *Album) updateTakedownsCache() {
+	if takedowns, err := a.readTakedowns(); err != nil {
+		fmt.Printf("\nUnable to read the takedowns of album %s. Error: %s", a.Path, err.Error())
+	} else {
+		a.TakedownsCache.Store(takedowns)
+	}
+}
+
+// the photo's key and the keys that go with it: its other formats, a HEIC original and the video of a Live Photo
+func (a *Album) getTakedownKeys(slug string) []string {
+	key := a.BucketPrefix + slug
+	name := strings.TrimSuffix(key, path.Ext(key))
+	keys, _ := a.KeyCache.Load().([]string)
+
+	var related []string
+	for _, v := range keys {
+		if strings.TrimSuffix(v, path.Ext(v)) == name {
+			related = append(related, v)
+		}
+	}
+	return related
+}
+
+// Takes a photo down everywhere at once: it (and the keys that go with it) are dropped from ordering.yaml and
+// deleted from the bucket, the prebuilt zips that hold it are deleted, the resizing service's copies are purged
+// (with an ImgixApiKey or a CloudfrontDistributionId) and its URL answers 410 Gone. Nothing is done when any of
+// the keys can't be deleted, because of a lock or a legal hold. The takedown is kept in TAKEDOWNS_NAME.
+func (a *Album) TakeDownPhoto(slug string, reason string, by string) (*Takedown, error) {
+	if err := a.checkNotLocked(); err != nil {
+		return nil, err
+	}
+	keys := a.getTakedownKeys(slug)
+	if !a.ImageExists(slug) || len(keys) == 0 {
+		return nil, fmt.Errorf("%s isn't a photo of this album", slug)
+	}
+	takedowns, err := a.readTakedowns()
+	if err != nil {
+		return nil, err
+	}
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range keys {
+		if err := a.checkNotHeld(svc, strings.TrimPrefix(v, a.BucketPrefix)); err != nil {
+			return nil, err
+		}
+	}
+
+	// the URLs to purge have to be worked out while the photo is still in the album
+	var purgeUrls []string
+	for _, v := range keys {
+		if a.IsRenderableKey(v) {
+			purgeUrls = append(purgeUrls, getUnsizedUrl(getUpstreamPhoto(a.GetPhotoForKey(v)).GetPhotoForWidth(0)))
+		}
+	}
+
+	if err := a.removeFromOrdering(keys); err != nil {
+		return nil, fmt.Errorf("Unable to remove %s from the ordering: %s", slug, err.Error())
+	}
+
+	for _, v := range keys {
+		if _, err := svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(a.site.BucketName),
+			Key:    aws.String(v),
+		}); err != nil {
+			return nil, fmt.Errorf("Unable to delete %s: %s", v, err.Error())
+		}
+	}
+
+	takedown := &Takedown{Photo: slug, Reason: reason, By: by, At: time.Now().UTC()}
+	for _, v := range keys {
+		takedown.Keys = append(takedown.Keys, strings.TrimPrefix(v, a.BucketPrefix))
+	}
+
+	var warnings []string
+	if err := a.deletePrebuiltZips(svc); err != nil {
+		warnings = append(warnings, err.Error())
+	}
+	purged, err := a.site.purgeCDN(purgeUrls)
+	takedown.Purged = purged
+	if err != nil {
+		warnings = append(warnings, err.Error())
+	}
+	takedown.Warning = strings.Join(warnings, ", ")
+
+	fmt.Printf("\nTook down %s from album %s for %s: %s", slug, a.Path, by, reason)
+	data, err := json.MarshalIndent(append(takedowns, *takedown), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := a.PutObjectInBucket(TAKEDOWNS_NAME, data, "application/json"); err != nil {
+		return nil, fmt.Errorf("%s was taken down, but the takedown couldn't be recorded: %s", slug, err.Error())
+	}
+
+	a.updateTakedownsCache()
+	a.RefreshKeyCache()
+	return takedown, nil
+}
+
+// drops the keys from every part of ordering.yaml that names photos, captions included
+func (a *Album) removeFromOrdering(keys []string) error {
+	config, current, err := getCurrentOrderingConfig(a)
+	if err != nil || current == nil {
+		return err
+	}
+
+	removed := make(map[string]bool)
+	for _, v := range keys {
+		removed[strings.TrimLeft(v, "/")] = true
+	}
+	if removed[config.Cover] {
+		config.Cover = ""
+	}
+	var thumbnails []string
+	for _, v := range config.Thumbnails {
+		if !removed[v] {
+			thumbnails = append(thumbnails, v)
+		}
+	}
+	config.Thumbnails = thumbnails
+	var ordering []string
+	for _, v := range config.Ordering {
+		if !removed[v] {
+			ordering = append(ordering, v)
+		}
+	}
+	config.Ordering = ordering
+	for k := range config.Entries {
+		if removed[k] {
+			delete(config.Entries, k)
+		}
+	}
+
+	data, err := a.MarshalAlbumOrderingConfig(config)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, current) {
+		return nil
+	}
+	return a.WriteOrderingYAML(data, HashOrderingYAML(current))
+}
+
+// the zips are built again (without the photo) at the next refresh
+func (a *Album) deletePrebuiltZips(svc *s3.S3) error {
+	if !a.PrebuildZips {
+		return nil
+	}
+
+	// a build that's running now may still have the photo in it, it's fingerprinted as before so it's
+	// simply built again at the next refresh
+	for _, web := range []bool{false, true} {
+		key := a.getPrebuiltZipKey(web)
+		if _, err := svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(a.site.BucketName),
+			Key:    aws.String(key),
+		}); err != nil {
+			return fmt.Errorf("Unable to delete the prebuilt zip %s: %s", key, err.Error())
+		}
+	}
+
+	a.prebuiltZipsMutex.Lock()
+	a.prebuiltZips = nil
+	a.prebuiltZipsMutex.Unlock()
+	return nil
+}
+
+// the URL of a photo without the resizing options in its query, which imgix purges every size of at once
+func getUnsizedUrl(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	parsed.RawQuery = ""
+	return parsed.String()
+}
+
+// Gives what was purged. Resizing services return the photo they made, and keep it cached, long after the
+// original is gone from the bucket.
+func (s *Site) purgeCDN(urls []string) ([]string, error) {
+	var purged []string
+	var failed []string
+
+	if s.ImgixApiKey != "" {
+		client := &http.Client{Timeout: TAKEDOWN_PURGE_TIMEOUT}
+		for _, v := range urls {
+			if err := purgeImgixUrl(client, s.ImgixApiKey, v); err != nil {
+				failed = append(failed, fmt.Sprintf("Unable to purge %s from imgix: %s", v, err.Error()))
+			} else {
+				purged = append(purged, v)
+			}
+		}
+	}
+
+	if s.CloudfrontDistributionId != "" {
+		if err := s.invalidateCloudfront(); err != nil {
+			failed = append(failed, fmt.Sprintf("Unable to invalidate CloudFront distribution %s: %s", s.CloudfrontDistributionId, err.Error()))
+		} else {
+			purged = append(purged, "cloudfront:"+s.CloudfrontDistributionId)
+		}
+	}
+
+	if len(failed) > 0 {
+		return purged, errors.New(strings.Join(failed, ", "))
+	}
+	return purged, nil
+}
+
+// see https://docs.imgix.com/apis/management/purges
+func purgeImgixUrl(client *http.Client, apiKey string, u string) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			"type":       "purges",
+			"attributes": map[string]string{"url": u},
+		},
+	})
+
+	req, err := http.NewRequest(http.MethodPost, IMGIX_PURGE_URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Content-Type", "application/vnd.api+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("imgix answered with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Thumbor's URLs have the resizing options in front of the key, and CloudFront can only invalidate paths that
+// end in a wildcard, so the whole distribution is invalidated.
+func (s *Site) invalidateCloudfront() error {
+	sess, err := s.GetAWSSession()
+	if err != nil {
+		return err
+	}
+
+	// the session may point at an S3 compatible host, CloudFront is always AWS's
+	svc := cloudfront.New(sess, &aws.Config{Endpoint: aws.String("")})
+	_, err = svc.CreateInvalidation(&cloudfront.CreateInvalidationInput{
+		DistributionId: aws.String(s.CloudfrontDistributionId),
+		InvalidationBatch: &cloudfront.InvalidationBatch{
+			CallerReference: aws.String(fmt.Sprintf("50mm-takedown-%d", time.Now().UnixNano())),
+			Paths: &cloudfront.Paths{
+				Quantity: aws.Int64(1),
+				Items:    []*string{aws.String("/*")},
+			},
+		},
+	})
+	return err
+}
+
+// who's taking the photo down, for the record
+func getAdminName(site *Site, r *http.Request) string {
+	if bearer := getBearerToken(r); bearer != "" {
+		if token, err := site.VerifyBearerToken(bearer, time.Now()); err == nil && token.Subject != "" {
+			return "token " + token.Subject
+		}
+		return "token"
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	if provider, ok := site.GetAdminCredentials().(LoginSessionProvider); ok {
+		if user := GetLoginSessionUser(provider, r); user != "" {
+			return user
+		}
+	}
+	return "admin"
+}
+
+func handleAdminTakedown(album *Album, w http.ResponseWriter, r *http.Request) {
+	renderAdminTakedown(album, nil, w)
+}
+
+func handleAdminTakedownSave(album *Album, w http.ResponseWriter, r *http.Request) {
+	photo := strings.TrimSpace(r.PostFormValue("photo"))
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+	if reason == "" {
+		writeAdminError(w, http.StatusBadRequest, errors.New("Write down why the photo is taken down, like who asked and when"))
+		return
+	}
+
+	takedown, err := album.TakeDownPhoto(photo, reason, getAdminName(album.site, r))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if getBearerToken(r) != "" {
+		writeAdminJSON(w, takedown)
+		return
+	}
+	renderAdminTakedown(album, takedown, w)
+}
+
+func renderAdminTakedown(album *Album, done *Takedown, w http.ResponseWriter) {
+	var photos []string
+	if ordering, err := album.GetOrderedPhotos(); err == nil {
+		for _, v := range ordering.Ordering {
+			photos = append(photos, strings.TrimLeft(v.Slug(), "/"))
+		}
+	}
+
+	takedowns, err := album.readTakedowns()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx := &AdminTakedownPageContext{
+		getAdminBasePageContext(album.site, ADMIN_PATH+"takedown", "Take down a photo of "+album.AlbumTitle),
+		album,
+		photos,
+		takedowns,
+		done,
+	}
+	album.site.executeTemplate(w, "admin_takedown.html", ctx)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Sites with a TemplateDir use the templates in it instead of the ones in templates/ with the same name, like
+// <TemplateDir>/album.html for album pages, so a site's pages can look different without a new build of 50mm.
+// Templates it doesn't have are those of the page's theme (see theme.go) or the built-in ones, so it only needs
+// the ones that are changed. They're parsed when the site's config is read, and a template that can't be parsed
+// keeps the site from loading, naming the file and the line of the mistake.
+const TEMPLATES_DIR = "templates"
+
+func (s *Site) validateTemplateDir() error {
+	if s.TemplateDir == "" {
+		return nil
+	}
+	if info, err := os.Stat(s.TemplateDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("TemplateDir %s isn't a directory", s.TemplateDir)
+	}
+	return nil
+}
+
+// Parses the templates of the themes the site uses (see theme.go), with its TemplateDir. Sites that only use the
+// built-in templates have none of their own.
+func (s *Site) parseTemplates() error {
+	s.templates = make(map[string]*template.Template)
+	for _, theme := range s.getUsedThemes() {
+		var dirs []string
+		if theme != nil && theme.templatesDir != "" {
+			dirs = append(dirs, theme.templatesDir)
+		}
+		if s.TemplateDir != "" {
+			dirs = append(dirs, s.TemplateDir)
+		}
+		if len(dirs) == 0 {
+			continue
+		}
+
+		tmpl, err := parseTemplates(dirs...)
+		if err != nil {
+			return err
+		}
+		s.templates[theme.getName()] = tmpl
+	}
+	return nil
+}
+
+// the built-in templates, with the ones in dirs instead of those with the same name, later dirs first
+func parseTemplates(dirs ...string) (*template.Template, error) {
+	tmpl, err := template.ParseGlob(filepath.Join(TEMPLATES_DIR, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.html"))
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range paths {
+			if _, err := tmpl.ParseFiles(v); err != nil {
+				return nil, fmt.Errorf("Unable to parse the template %s: %s", v, err.Error())
+			}
+		}
+	}
+	return tmpl, nil
+}
+
+// the file of the template for pages in theme, from the site's TemplateDir or the theme when they have one
+func (s *Site) getTemplatePath(theme *Theme, templateName string) string {
+	var dirs []string
+	if s.TemplateDir != "" {
+		dirs = append(dirs, s.TemplateDir)
+	}
+	if theme != nil && theme.templatesDir != "" {
+		dirs = append(dirs, theme.templatesDir)
+	}
+	for _, dir := range dirs {
+		p := filepath.Join(dir, templateName)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return filepath.Join(TEMPLATES_DIR, templateName)
+}
+
+// executeTemplateHelper for the pages of the site, with its TemplateDir and the theme of the page
+func (s *Site) executeTemplate(w io.Writer, templateName string, ctx interface{}) {
+	var theme *Theme
+	if page, ok := ctx.(interface{ getTheme() *Theme }); ok {
+		theme = page.getTheme()
+	}
+	tmpl, ok := s.templates[theme.getName()]
+	if !ok {
+		executeTemplateHelper(w, templateName, ctx)
+		return
+	}
+
+	if DEBUG {
+		path := s.getTemplatePath(theme, templateName)
+		parsed, err := template.ParseFiles(path)
+		if err != nil {
+			writeTemplateParseError(w, path, err)
+			return
+		}
+		tmpl = parsed
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, ctx); err != nil {
+		log.Println(err)
+	}
+}
+
+// With -dev a template is read for every page, so it can be broken while 50mm runs. What's wrong with it is
+// shown instead of the page, where it's worked on.
+func writeTemplateParseError(w io.Writer, path string, err error) {
+	err = fmt.Errorf("Unable to parse the template %s: %s", path, err.Error())
+	log.Println(err)
+	if rw, ok := w.(http.ResponseWriter); ok {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write([]byte(err.Error()))
+}
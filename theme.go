@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Sites (and albums) pick how their pages look with Theme. A theme is a folder in themes/, named after it, with
+// a static/ of its stylesheets, scripts and images and a templates/ of templates to use instead of the built-in
+// ones with the same name, either of which can be left out. Pages link its static/theme.css after the built-in
+// stylesheets, so a theme that's only a stylesheet just has to override what it changes, and its other files
+// are at {{.ThemeUrl "file"}} for its templates. The site's TemplateDir still comes first. Themes are found
+// when the config is read, so a new one is a folder dropped in themes/, no new build of 50mm needed.
+//
+// classic is the built-in look, with no folder of its own.
+const THEMES_DIR = "themes"
+const THEMES_PATH = "/themes/"
+const THEME_STYLESHEET = "theme.css"
+const DEFAULT_THEME = "classic"
+
+type Theme struct {
+	Name string
+
+	hasStylesheet bool
+	templatesDir  string // empty for themes without templates
+}
+
+var themes map[string]*Theme
+var themesMutex sync.Mutex
+
+// serves the static/ of every theme at /themes/<theme>/
+var themeHandler = withDevCaching(http.StripPrefix(THEMES_PATH, http.FileServer(themeAssets{})))
+
+type themeAssets struct{}
+
+// name is cleaned by http.FileServer, so it can't get out of the theme's static/
+func (themeAssets) Open(name string) (http.File, error) {
+	parts := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, os.ErrNotExist
+	}
+	return http.Dir(filepath.Join(THEMES_DIR, parts[0], "static")).Open("/" + parts[1])
+}
+
+// the folders in THEMES_DIR, by name
+func loadThemes() (map[string]*Theme, error) {
+	loaded := make(map[string]*Theme)
+	files, err := ioutil.ReadDir(THEMES_DIR)
+	if os.IsNotExist(err) {
+		return loaded, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range files {
+		if !v.IsDir() {
+			continue
+		}
+		theme := &Theme{Name: v.Name()}
+		if _, err := os.Stat(filepath.Join(THEMES_DIR, v.Name(), "static", THEME_STYLESHEET)); err == nil {
+			theme.hasStylesheet = true
+		}
+		if info, err := os.Stat(filepath.Join(THEMES_DIR, v.Name(), "templates")); err == nil && info.IsDir() {
+			theme.templatesDir = filepath.Join(THEMES_DIR, v.Name(), "templates")
+		}
+		loaded[theme.Name] = theme
+	}
+	return loaded, nil
+}
+
+// the themes, found once unless templates are read for every page as well (see DEBUG)
+func getThemes() map[string]*Theme {
+	themesMutex.Lock()
+	defer themesMutex.Unlock()
+
+	if themes == nil || DEBUG {
+		loaded, err := loadThemes()
+		if err != nil {
+			fmt.Printf("\nUnable to load the themes. Error: %s", err.Error())
+			if themes == nil {
+				themes = make(map[string]*Theme)
+			}
+			return themes
+		}
+		themes = loaded
+	}
+	return themes
+}
+
+// the theme of the name, nil for the classic look
+func getTheme(name string) *Theme {
+	return getThemes()[name]
+}
+
+func validateTheme(name string) error {
+	if name == "" || name == DEFAULT_THEME {
+		return nil
+	}
+	if getTheme(name) == nil {
+		available := []string{DEFAULT_THEME}
+		for k := range getThemes() {
+			available = append(available, k)
+		}
+		sort.Strings(available)
+		return fmt.Errorf("Theme %s has no folder in %s/, use one of %s", name, THEMES_DIR, strings.Join(available, ", "))
+	}
+	return nil
+}
+
+// "" for the classic look
+func (t *Theme) getName() string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+func (s *Site) GetTheme() *Theme {
+	return getTheme(s.Theme)
+}
+
+// the album's Theme, or the site's
+func (a *Album) GetTheme() *Theme {
+	if a.Theme != "" {
+		return getTheme(a.Theme)
+	}
+	return a.site.GetTheme()
+}
+
+// the themes the site and its albums use, with nil for the classic look
+func (s *Site) getUsedThemes() []*Theme {
+	used := []*Theme{s.GetTheme()}
+	for _, a := range s.Albums {
+		theme := a.GetTheme()
+		known := false
+		for _, v := range used {
+			known = known || v.getName() == theme.getName()
+		}
+		if !known {
+			used = append(used, theme)
+		}
+	}
+	return used
+}
+
+func (c *BasePageContext) getTheme() *Theme {
+	return c.Theme
+}
+
+// the URL of a file in the theme's static/, for the templates of themes
+func (c *BasePageContext) ThemeUrl(file string) string {
+	return c.BasePath() + THEMES_PATH + c.Theme.getName() + "/" + strings.TrimLeft(file, "/")
+}
+
+// the theme's theme.css, empty for the classic look and for themes that only have templates
+func (c *BasePageContext) ThemeStylesheet() string {
+	if c.Theme == nil || !c.Theme.hasStylesheet {
+		return ""
+	}
+	return c.ThemeUrl(THEME_STYLESHEET)
+}
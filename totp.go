@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Logins with a TOTP secret (RFC 6238, what Google Authenticator and the like make codes with) need the
+// 6 digit code of the moment after the password, in the same password field: hunter2 becomes hunter2123456.
+// Basic auth has no other field to put it in. Codes of the 30 seconds before and after are let through too,
+// for phones whose clocks are a little off.
+const TOTP_DIGITS = 6
+const TOTP_PERIOD = 30 * time.Second
+const TOTP_SKEW = 1
+
+// secrets are written in base32, the way authenticator apps show them, spaces and padding left out
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func parseTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimRight(strings.Replace(secret, " ", "", -1), "="))
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(key) < 10 {
+		return nil, errors.New("TOTP secrets must be at least 16 characters of base32, like JBSWY3DPEHPK3PXP")
+	}
+	return key, nil
+}
+
+// AuthTOTPSecrets lists are written like AuthUsers ones, as user:secret
+func parseTOTPSecrets(list []string) (map[string][]byte, error) {
+	secrets := make(map[string][]byte)
+	for _, v := range list {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("AuthTOTPSecrets entry '%s' must be written as user:secret", parts[0])
+		}
+		if _, ok := secrets[parts[0]]; ok {
+			return nil, fmt.Errorf("AuthTOTPSecrets lists user '%s' more than once", parts[0])
+		}
+		key, err := parseTOTPSecret(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("AuthTOTPSecrets entry for '%s': %s", parts[0], err.Error())
+		}
+		secrets[parts[0]] = key
+	}
+	return secrets, nil
+}
+
+// the code changes all the time, so only the first request of a login can have it, the session cookie has to
+// take over from there
+func validateTOTPSecrets(list []string, sessionLifetime time.Duration) error {
+	if _, err := parseTOTPSecrets(list); err != nil {
+		return err
+	}
+	if len(list) > 0 && sessionLifetime <= 0 {
+		return errors.New("AuthTOTPSecrets need login sessions, AuthSessionLifetime can't be 0")
+	}
+	return nil
+}
+
+func getTOTPCode(key []byte, counter uint64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, code%1000000)
+}
+
+// Splits the code off the password of a login with a TOTP secret, giving the password to check and whether the
+// code is right. Logins without a secret keep their password as it is.
+func checkTOTPCode(key []byte, pass string, now time.Time) (string, bool) {
+	if key == nil {
+		return pass, true
+	}
+	if len(pass) < TOTP_DIGITS {
+		return pass, false
+	}
+
+	password, code := pass[:len(pass)-TOTP_DIGITS], pass[len(pass)-TOTP_DIGITS:]
+	counter := now.Unix() / int64(TOTP_PERIOD/time.Second)
+	ok := false
+	for i := int64(-TOTP_SKEW); i <= TOTP_SKEW; i++ {
+		if subtle.ConstantTimeCompare([]byte(getTOTPCode(key, uint64(counter+i))), []byte(code)) == 1 {
+			ok = true
+		}
+	}
+	return password, ok
+}
+
+// the secret of the user, from AuthTOTPSecrets or else from the AuthFile, nil for users without one
+func getTOTPSecret(user string, secrets map[string][]byte, authFile *HtpasswdFile) []byte {
+	if key, ok := secrets[user]; ok {
+		return key
+	}
+	if authFile != nil {
+		return authFile.GetTOTPSecret(user)
+	}
+	return nil
+}
+
+func (s *Site) getTOTPSecret(user string) []byte {
+	return getTOTPSecret(user, s.authTOTPSecrets, s.authFile)
+}
+
+func (a *Album) getTOTPSecret(user string) []byte {
+	return getTOTPSecret(user, a.authTOTPSecrets, a.authFile)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// uploads bigger than this are spooled to disk while the form is read, rather than kept in memory
+const ADMIN_UPLOAD_MEMORY = 32 * 1024 * 1024
+
+// a whole upload form, which can hold many photos
+const ADMIN_UPLOAD_MAX_BYTES = 2 * 1024 * 1024 * 1024
+
+type AdminUploadPageContext struct {
+	*BasePageContext
+
+	Album    *Album
+	Uploaded []string
+	Rejected []UploadRejection
+}
+
+// an upload that didn't make it in to the bucket, and why
+type UploadRejection struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// photos the album shows (and the videos of Live Photos), anything else would just sit in the bucket
+func (a *Album) IsUploadableName(name string) bool {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\") {
+		return false
+	}
+	return a.IsRenderableKey(name) || isMotionKey(name)
+}
+
+// Writes an upload to the album's prefix, unless it's already in the album under any name, or the site's
+// UploadScanner (if it has one) objects to it, so nothing the scanner objects to is ever visible in the album.
+// Gives why the upload was skipped, empty when it was written.
+func (a *Album) UploadObject(name string, body io.ReadSeeker) (string, error) {
+	if err := a.checkNotLocked(); err != nil {
+		return "", err
+	}
+	if !a.IsUploadableName(name) {
+		return "", fmt.Errorf("%s isn't a photo this album can show", name)
+	}
+
+	checksums, err := checksumUpload(body)
+	if err != nil {
+		return "", err
+	}
+	duplicate, err := a.FindDuplicateObject(checksums)
+	if err != nil {
+		return "", fmt.Errorf("Unable to look for duplicates of %s: %s", name, err.Error())
+	}
+	if duplicate != "" {
+		return "Already in the album as " + path.Base(duplicate), nil
+	}
+
+	if scanner := a.site.GetUploadScanner(); scanner != nil {
+		found, err := scanner.Scan(name, body)
+		if err != nil {
+			return "", fmt.Errorf("Unable to scan %s: %s", name, err.Error())
+		}
+		if found != "" {
+			fmt.Printf("\nRefused upload %s to album %s, the scanner found %s", name, a.Path, found)
+			return "The scanner found " + found, nil
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+
+	svc, err := a.site.GetS3Service()
+	if err != nil {
+		return "", err
+	}
+	if err := a.checkNotHeld(svc, name); err != nil {
+		return "", err
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(a.site.BucketName),
+		Key:         aws.String(a.BucketPrefix + name),
+		Body:        body,
+		ContentType: aws.String(contentType),
+		Metadata: map[string]*string{
+			UPLOAD_CHECKSUM_METADATA: aws.String(checksums.Sha256),
+		},
+	}
+	if !checksums.IsMultipart() {
+		input.ContentMD5 = aws.String(checksums.Md5Base64())
+	}
+	if _, err := newUploader(svc).Upload(input); err != nil {
+		return "", err
+	}
+	return "", verifyUploadedObject(svc, a.site.BucketName, a.BucketPrefix+name, checksums)
+}
+
+// fetches the keys from the bucket right away, so uploads show up without waiting for the next refresh.
+func (a *Album) RefreshKeyCache() {
+	a.KeyCacheUpdateMutex.Lock()
+	_, err := a.updateKeyCache()
+	if err != nil {
+		fmt.Printf("\nUnable to refresh object keys for album %s. Error: %s", a.Path, err.Error())
+	}
+	a.KeyCacheUpdateMutex.Unlock()
+
+	if err == nil && a.site.HasStaticMirror() {
+		go a.updateStaticMirror()
+	}
+	if err == nil && a.HasLiveUpdates() {
+		a.notifyLiveUpdate()
+	}
+}
+
+func handleAdminUpload(album *Album, w http.ResponseWriter, r *http.Request) {
+	ctx := &AdminUploadPageContext{
+		getAdminBasePageContext(album.site, ADMIN_PATH+"upload", "Upload to "+album.AlbumTitle),
+		album,
+		nil,
+		nil,
+	}
+	album.site.executeTemplate(w, "admin_upload.html", ctx)
+}
+
+func handleAdminUploadSave(album *Album, w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, ADMIN_UPLOAD_MAX_BYTES)
+	if err := r.ParseMultipartForm(ADMIN_UPLOAD_MEMORY); err != nil {
+		writeAdminError(w, http.StatusBadRequest, errors.New("Unable to read the upload, it may be too big"))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	ctx := &AdminUploadPageContext{
+		getAdminBasePageContext(album.site, ADMIN_PATH+"upload", "Upload to "+album.AlbumTitle),
+		album,
+		nil,
+		nil,
+	}
+	for _, header := range r.MultipartForm.File["photos"] {
+		name := path.Base(strings.Replace(header.Filename, "\\", "/", -1))
+		if reason := uploadFile(album, name, header); reason != "" {
+			ctx.Rejected = append(ctx.Rejected, UploadRejection{name, reason})
+		} else {
+			ctx.Uploaded = append(ctx.Uploaded, name)
+		}
+	}
+
+	if len(ctx.Uploaded) > 0 {
+		album.RefreshKeyCache()
+	}
+	album.site.executeTemplate(w, "admin_upload.html", ctx)
+}
+
+// why the file wasn't uploaded, empty when it was
+func uploadFile(album *Album, name string, header *multipart.FileHeader) string {
+	file, err := header.Open()
+	if err != nil {
+		return err.Error()
+	}
+	defer file.Close()
+
+	skipped, err := album.UploadObject(name, file)
+	if err != nil {
+		return err.Error()
+	}
+	return skipped
+}
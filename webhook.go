@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Sites with Webhooks tell other systems (static rebuilds, notifications) about photos added to or removed from
+// their albums, as the key cache refreshes (or, with StagedPublishing, publishes) find them. Only the photos
+// visitors see count, not the ones left out by Exclude, those of people who didn't agree to be shown publicly
+// or ones that aren't published yet. Every URL gets a POST of a WebhookPayload, signed with an HMAC-SHA256 of
+// the body keyed by WebhookSecret so they can tell it came from us. The first fill after startup doesn't count
+// as a change, nor does anything that happened while 50mm wasn't running.
+const WEBHOOK_EVENT_ALBUM_CHANGED = "album.changed"
+const WEBHOOK_SIGNATURE_HEADER = "X-50mm-Signature"
+const WEBHOOK_EVENT_HEADER = "X-50mm-Event"
+
+const WEBHOOK_TIMEOUT = 10 * time.Second
+const WEBHOOK_ATTEMPTS = 3
+const WEBHOOK_RETRY_DELAY = 5 * time.Second
+
+var webhookClient = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+
+type WebhookPayload struct {
+	Event      string    `json:"event"`
+	Site       string    `json:"site"`
+	Album      string    `json:"album"`
+	Url        string    `json:"url"`
+	Title      string    `json:"title"`
+	ShareTitle string    `json:"share_title"`
+	ShareText  string    `json:"share_text"`
+	Added      []string  `json:"added"` // photos, relative to the album like in ordering.yaml
+	Removed    []string  `json:"removed"`
+	Time       time.Time `json:"time"`
+}
+
+func (s *Site) validateWebhooks() error {
+	if len(s.Webhooks) == 0 {
+		return nil
+	}
+	for _, v := range s.Webhooks {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Webhook '%s' isn't an http or https URL", v)
+		}
+	}
+	if len(s.WebhookSecret) < 16 {
+		return errors.New("Webhooks need a WebhookSecret of at least 16 characters to sign them with")
+	}
+	return nil
+}
+
+// The photos visitors see in the album, relative to it. Photos of people who didn't agree to be shown publicly
+// are left out even in albums with a login, the webhooks' systems aren't logged in. Albums that were never
+// published have none, ok is false when that can't be told.
+func (a *Album) getWebhookPhotos() (photos []string, ok bool) {
+	photos = []string{}
+	if a.site.StagedPublishing {
+		if a.site.getPublishedState() == nil {
+			return nil, false
+		}
+		if !a.IsPublished() {
+			return photos, true
+		}
+	}
+
+	orderingKeys, err := a.getVisibleOrderedKeys()
+	if err != nil {
+		return nil, false
+	}
+	for _, v := range orderingKeys.Ordering {
+		if details, ok := orderingKeys.photoDetails[strings.TrimLeft(v, "/")]; ok && details.hasPrivatePeople {
+			continue
+		}
+		if a.IsRenderableKey(v) {
+			photos = append(photos, a.RelativeOrderingKey(v))
+		}
+	}
+	return photos, true
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Tells every webhook of the site about the photos visitors see now that they didn't the last time, and the
+// other way around. Nothing is sent when only other files changed.
+func (a *Album) notifyWebhooks() {
+	photos, ok := a.getWebhookPhotos()
+	if !ok {
+		return
+	}
+	a.webhookPhotosMutex.Lock()
+	previous := a.webhookPhotos
+	a.webhookPhotos = photos
+	a.webhookPhotosMutex.Unlock()
+	if previous == nil {
+		return
+	}
+
+	payload := WebhookPayload{
+		Event:      WEBHOOK_EVENT_ALBUM_CHANGED,
+		Site:       a.site.Domain,
+		Album:      a.Path,
+		Url:        a.GetCanonicalUrl().String(),
+		Title:      a.AlbumTitle,
+		ShareTitle: a.GetShareTitle(),
+		ShareText:  a.GetShareText(),
+		Added:      append([]string{}, addedKeys(previous, photos)...),
+		Removed:    append([]string{}, addedKeys(photos, previous)...),
+		Time:       time.Now().UTC(),
+	}
+	if len(payload.Added)+len(payload.Removed) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Printf("\nUnable to build the webhook for album %s. Error: %s", a.Path, err.Error())
+		return
+	}
+	for _, v := range a.site.Webhooks {
+		go sendWebhook(v, a.site.WebhookSecret, body)
+	}
+}
+
+func sendWebhook(webhookUrl string, secret string, body []byte) {
+	var err error
+	for attempt := 1; attempt <= WEBHOOK_ATTEMPTS; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * WEBHOOK_RETRY_DELAY)
+		}
+		if err = postWebhook(webhookUrl, secret, body); err == nil {
+			return
+		}
+	}
+	fmt.Printf("\nWebhook %s failed %d times, giving up. Error: %s", redactUrl(webhookUrl), WEBHOOK_ATTEMPTS, err.Error())
+}
+
+func postWebhook(webhookUrl string, secret string, body []byte) error {
+	req, err := http.NewRequest("POST", webhookUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_EVENT_HEADER, WEBHOOK_EVENT_ALBUM_CHANGED)
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, signWebhook(secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Got %s", resp.Status)
+	}
+	return nil
+}
+
+// webhook URLs often carry a token in their path or query, the logs only get the host
+func redactUrl(webhookUrl string) string {
+	u, err := url.Parse(webhookUrl)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// albums with AllowZipDownload set serve all their photos as a zip next to them, photo slugs are never zips.
+// AllowWebZipDownload does the same with the photos at ZIP_WEB_PHOTO_WIDTH.
+const ALBUM_ZIP_SLUG = "download.zip"
+const ALBUM_WEB_ZIP_SLUG = "download-web.zip"
+
+// big enough for a screen or an email, a fraction of the originals' size
+const ZIP_WEB_PHOTO_WIDTH = 2048
+
+const ZIP_WEB_PHOTO_TIMEOUT = 60 * time.Second
+
+// the resizing service may hand back another format than the original's (HEIC becomes JPEG, for one)
+var ZIP_WEB_EXTENSIONS = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/avif": ".avif",
+}
+
+// the keys of the photos in the album's order, and their total size as far as the last bucket listing knows
+func (a *Album) getZipDownloadKeys() ([]string, map[string]*PhotoDetails, int64, error) {
+	orderingKeys, err := a.getVisibleOrderedKeys()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	sizes, _ := a.KeySizesCache.Load().(map[string]int64)
+	var total int64
+	for _, v := range orderingKeys.Ordering {
+		total += sizes[v]
+	}
+	return orderingKeys.Ordering, orderingKeys.photoDetails, total, nil
+}
+
+// the name the zip is saved as, after the album's path
+func (a *Album) GetZipDownloadFilename(web bool) string {
+	name := strings.Replace(strings.Trim(a.Path, "/"), "/", "-", -1)
+	if name == "" {
+		name = "album"
+	}
+	if web {
+		name += "-web"
+	}
+	return name + ".zip"
+}
+
+// With OriginalZipUsers set only those logins get the originals, everybody else can still get the web sized zip
+func (a *Album) CanDownloadOriginalZip(r *http.Request) bool {
+	if len(a.OriginalZipUsers) == 0 {
+		return true
+	}
+
+	if a.UsesOIDC() {
+		session := a.site.GetOIDCSession(r)
+		return session != nil && stringInSlice(session.Email, a.OriginalZipUsers)
+	}
+
+	if user := GetLoginSessionUser(a, r); user != "" {
+		return stringInSlice(user, a.OriginalZipUsers)
+	}
+	user, pass, ok := r.BasicAuth()
+	return ok && stringInSlice(user, a.OriginalZipUsers) && a.CheckCredentials(user, pass)
+}
+
+// Streams the album's photos as a zip, the originals or (with web set) the photos at ZIP_WEB_PHOTO_WIDTH. The
+// zip is built while it's sent, one photo at a time straight from the bucket or the resizing service, so memory
+// use doesn't grow with the album. Photos are stored rather than compressed, JPEGs don't get any smaller and
+// it saves the CPU.
+func handleAlbumZipDownload(album *Album, web bool, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	if !web && !album.CanDownloadOriginalZip(r) && album.UsesOIDC() {
+		album.site.writeErrorPage(album, http.StatusForbidden, "Your login can't download the originals\n", w, r)
+		return
+	}
+	if !web && !album.CanDownloadOriginalZip(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="You need a username/password to download the originals"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized\n"))
+		return
+	}
+
+	keys, photoDetails, total, err := album.getZipDownloadKeys()
+	if err != nil {
+		album.writeLoadError(err, w, r)
+		return
+	}
+
+	if !web && album.ZipDownloadMaxMB > 0 && total > int64(album.ZipDownloadMaxMB)*1024*1024 {
+		album.site.writeErrorPage(album, http.StatusForbidden, "This album is too big to download as a zip\n", w, r)
+		return
+	}
+
+	if album.PrebuildZips {
+		if u := album.GetPrebuiltZipUrl(web, keys); u != "" {
+			// sites with ProxyPhotos don't give out the bucket's URLs
+			if album.site.ProxyPhotos {
+				album.site.serveUpstream("", u, album.HasAuth(), w, r)
+			} else {
+				http.Redirect(w, r, u, http.StatusFound)
+			}
+			return
+		}
+		// not built yet (or out of date), this visitor gets a streamed zip while it's being built
+		go album.updatePrebuiltZips()
+	}
+
+	svc, err := album.site.GetS3Service()
+	if err != nil {
+		album.site.writeErrorPage(album, http.StatusInternalServerError, err.Error(), w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", album.GetZipDownloadFilename(web)))
+
+	if err := album.writeZip(svc, keys, photoDetails, web, w); err != nil {
+		// the headers are long gone, all we can do is cut the zip short so it doesn't look complete
+		fmt.Printf("\nUnable to zip album %s. Error: %s", album.Path, err.Error())
+	}
+}
+
+// Photos are named by their key relative to the album, like day-1/IMG_0001.jpg, so those with the same name in
+// different sub-prefixes don't overwrite each other when the zip is extracted. Cleaned, no name gets out of the
+// folder it's extracted to.
+func (a *Album) getZipEntryName(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+a.RelativeOrderingKey(key)), "/")
+}
+
+// writes the zip of keys to w, stopping at the first photo that can't be added
+func (a *Album) writeZip(svc *s3.S3, keys []string, photoDetails map[string]*PhotoDetails, web bool, w io.Writer) error {
+	dates, _ := a.KeyDatesCache.Load().(map[string]time.Time)
+	client := &http.Client{Timeout: ZIP_WEB_PHOTO_TIMEOUT}
+	zipWriter := zip.NewWriter(w)
+	for _, v := range keys {
+		var err error
+		// originals that can't be cleaned of their metadata are zipped at web size instead
+		if web || (a.StripExif && !canStripMetadata(v)) {
+			u := getUpstreamPhoto(a.getPhotoForKey(v, photoDetails)).GetPhotoForWidth(ZIP_WEB_PHOTO_WIDTH)
+			err = writeUrlToZip(client, u, a.getZipEntryName(v), dates[v], zipWriter)
+		} else {
+			err = writeObjectToZip(svc, a.site.BucketName, v, a.getZipEntryName(v), dates[v], a.StripExif, zipWriter)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Unable to add %s: %s", v, err.Error())
+		}
+	}
+	return zipWriter.Close()
+}
+
+func createZipFile(zipWriter *zip.Writer, name string, modified time.Time) (io.Writer, error) {
+	header := &zip.FileHeader{
+		Name:   name,
+		Method: zip.Store,
+	}
+	if !modified.IsZero() {
+		header.Modified = modified
+	}
+	return zipWriter.CreateHeader(header)
+}
+
+func writeObjectToZip(svc *s3.S3, bucket string, key string, name string, modified time.Time, stripExif bool, zipWriter *zip.Writer) error {
+	object, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	file, err := createZipFile(zipWriter, name, modified)
+	if err != nil {
+		return err
+	}
+	if stripExif {
+		return stripJpegMetadata(object.Body, file)
+	}
+	_, err = io.Copy(file, object.Body)
+	return err
+}
+
+func writeUrlToZip(client *http.Client, u string, name string, modified time.Time, zipWriter *zip.Writer) error {
+	resp, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+
+	if ext, ok := ZIP_WEB_EXTENSIONS[resp.Header.Get("Content-Type")]; ok {
+		name = strings.TrimSuffix(name, path.Ext(name)) + ext
+	}
+
+	file, err := createZipFile(zipWriter, name, modified)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, resp.Body)
+	return err
+}